@@ -16,15 +16,141 @@ limitations under the License.
 
 package v1alpha1
 
+import (
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
 const (
 	MSSQLContainerName                  = "mssql"
 	MSSQLWorkDirectoryName              = "workdir"
 	MSSQLWorkDirectoryPath              = "/work-dir"
 	MSSQLInstallContainerName           = "copy-config"
+	MSSQLCoordinatorContainerName       = "mssql-coordinator"
+	MSSQLCoordinatorPortName            = "coordinator"
+	MSSQLCoordinatorPort                = 2380
 	MSSQLDatabasePortName               = "db"
 	MSSQLDatabasePort                   = 1433
+	MSSQLMirroringPortName              = "mirroring"
+	MSSQLMirroringPort                  = 5022
+	MSSQLAdminPortName                  = "admin"
+	MSSQLAdminPort                      = 1434
 	MSSQLUser                           = "sa"
 	MSSQLDataDirectoryName              = "datadir"
 	MSSQLDataDirectoryPath              = "/var/opt/mssql"
 	MSSQLDefaultVolumeClaimTemplateName = MSSQLDataDirectoryName
+	MSSQLInitScriptsVolumeName          = "init-scripts"
+	MSSQLInitScriptsPath                = "/init-scripts"
+	MSSQLConfigVolumeName               = "config"
+	MSSQLConfigSourcePath               = "/etc/mssql-config"
+	MSSQLTLSVolumeName                  = "tls"
+	MSSQLTLSPath                        = "/etc/mssql-tls"
+	// MSSQLTLSCAKey holds the CA of the server certificate, in its secret & in the CA secret
+	MSSQLTLSCAKey = "ca.crt"
+	// MSSQLTLSHashAnnotation on the pods is the hash of the server certificate they have been started with
+	MSSQLTLSHashAnnotation = "microsoft.kubedb.com/tls-hash"
+	// MSSQLSwitchoverAnnotation on the MSSQL moves the primary role of the availability group to the pod it names.
+	// The operator removes it once the switchover is done.
+	MSSQLSwitchoverAnnotation = "microsoft.kubedb.com/switchover"
+
+	// MSSQLConfigFileName is the key of the mssql.conf in spec.configSecret & in the rendered config secret
+	MSSQLConfigFileName = "mssql.conf"
+
+	// MSSQLMaxReplicas is the maximum number of replicas of an availability group, the primary included
+	MSSQLMaxReplicas = 9
+	// MSSQLMaxSynchronousReplicas is the maximum number of SYNCHRONOUS_COMMIT replicas, the primary included
+	MSSQLMaxSynchronousReplicas = 5
+	// MSSQLDefaultBackupPriority is the backup priority SQL Server gives to the replicas
+	MSSQLDefaultBackupPriority = 50
+	// MSSQLStandardEditionMaxReplicas is the limit of the basic availability groups of the Standard edition
+	MSSQLStandardEditionMaxReplicas = 2
+	// MSSQLMinMemory is the minimum memory SQL Server requires to start
+	MSSQLMinMemory = "2Gi"
+	// MSSQLDefaultMemory is the memory limit of the database container by default. Less the default headroom, it
+	// leaves the minimum memory.memorylimitmb to SQL Server.
+	MSSQLDefaultMemory = "2560Mi"
+	// MSSQLMinMemoryLimitMB is the lowest memory.memorylimitmb SQL Server accepts
+	MSSQLMinMemoryLimitMB = 2048
+	// MSSQLDefaultMemoryHeadroomPercent of the container memory limit is kept out of memory.memorylimitmb
+	MSSQLDefaultMemoryHeadroomPercent = 20
+	// MSSQLDefaultPrimaryTimeoutSeconds is how long the primary replica has to be lost before it is failed over
+	MSSQLDefaultPrimaryTimeoutSeconds = 30
+	// MSSQLFSGroup is the group of the mssql user of the SQL Server image, which needs to own the data directory
+	MSSQLFSGroup = 10001
+)
+
+// DatabasePodSecondary is the role label of the pods of the secondary replicas of an availability group. The primary
+// is labeled dbapi.DatabasePodPrimary.
+const DatabasePodSecondary = "secondary"
+
+// The cert-manager API the server certificate is requested through
+const (
+	CertManagerGroup             = "cert-manager.io"
+	CertManagerVersion           = "v1"
+	CertManagerCertificateKind   = "Certificate"
+	CertManagerIssuerKind        = "Issuer"
+	CertManagerClusterIssuerKind = "ClusterIssuer"
+)
+
+// MSSQLCertificateAlias identifies a certificate of spec.tls.certificates.
+type MSSQLCertificateAlias string
+
+const (
+	// MSSQLServerCert is served by SQL Server to the clients
+	MSSQLServerCert MSSQLCertificateAlias = "server"
+)
+
+// DatabaseInitialized condition & its reasons. The condition is only set for the MSSQL objects with spec.init.script.
+const (
+	DatabaseInitialized            = "DatabaseInitialized"
+	InitScriptsPending             = "InitScriptsPending"
+	InitScriptsSucceeded           = "InitScriptsSucceeded"
+	InitScriptFailed               = "InitScriptFailed"
+	InitSkippedForExistingDatabase = "InitSkippedForExistingDatabase"
 )
+
+// ConfigurationValid condition & its reasons. The condition is only set for the MSSQL objects with spec.configSecret.
+const (
+	DatabaseConfigurationValid = "ConfigurationValid"
+	ConfigurationAccepted      = "ConfigurationAccepted"
+	InvalidConfiguration       = "InvalidConfiguration"
+)
+
+// PendingRestart condition & its reasons. It is set once a change of spec.configuration or of the memory limit needs
+// the pods to be restarted. The StatefulSet is updated OnDelete, so the pods have to be deleted to pick it up.
+const (
+	DatabasePendingRestart = "PendingRestart"
+	SettingsChanged        = "SettingsChanged"
+	PodsRestarted          = "PodsRestarted"
+)
+
+// SwitchingOver condition & its reasons. It is set while a switchover waits for its target to be SYNCHRONIZED, &
+// then for the primary service to select it. The reconcile is requeued meanwhile instead of waiting in the operator.
+const (
+	DatabaseSwitchingOver     = "SwitchingOver"
+	WaitingForSynchronization = "WaitingForSynchronization"
+	WaitingForPrimaryService  = "WaitingForPrimaryService"
+	SwitchoverCompleted       = "SwitchoverCompleted"
+	SwitchoverTimedOut        = "SwitchoverTimedOut"
+	SwitchoverCancelled       = "SwitchoverCancelled"
+)
+
+// MSSQLDefaultResources are used for the database container when no resources are given
+var MSSQLDefaultResources = core.ResourceRequirements{
+	Requests: core.ResourceList{
+		core.ResourceCPU:    resource.MustParse(".500"),
+		core.ResourceMemory: resource.MustParse(MSSQLDefaultMemory),
+	},
+	Limits: core.ResourceList{
+		core.ResourceMemory: resource.MustParse(MSSQLDefaultMemory),
+	},
+}
+
+// MSSQLReservedSettings of mssql.conf are managed by the operator & can't be set through spec.configSecret: section,
+// key & the fields of the MSSQL to use instead.
+var MSSQLReservedSettings = [][3]string{
+	{"network", "tcpport", "spec.port or spec.configuration.tcpPort"},
+	{"network", "tlscert", "spec.tls"},
+	{"network", "tlskey", "spec.tls"},
+	{"network", "forceencryption", "spec.sslMode"},
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MSSQLConfiguration holds the commonly used mssql-conf settings. Each one is rendered into the mssql.conf of the pods
+// and, where SQL Server supports it, into an environment variable. The typed settings take precedence over the ones
+// of spec.configSecret.
+type MSSQLConfiguration struct {
+	// MemoryLimitMB caps the memory SQL Server uses, memory.memorylimitmb. By default it is taken from the mssql.conf
+	// of spec.configSecret, or else derived from the memory limit of the database container, less
+	// memoryHeadroomPercent of it. SQL Server would otherwise size itself after the memory of the node.
+	// +kubebuilder:validation:Minimum=2048
+	// +optional
+	MemoryLimitMB *int32 `json:"memoryLimitMB,omitempty"`
+
+	// MemoryHeadroomPercent of the container memory limit is left to the memory SQL Server allocates outside
+	// of memory.memorylimitmb when the limit is derived. Defaults to 20.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=90
+	// +optional
+	MemoryHeadroomPercent *int32 `json:"memoryHeadroomPercent,omitempty"`
+
+	// Collation of the server, i.e. SQL_Latin1_General_CP1_CI_AS. It is only applied when the instance is set up,
+	// so it can't be changed afterwards.
+	// +optional
+	Collation string `json:"collation,omitempty"`
+
+	// LCID is the locale identifier of the server messages, language.lcid
+	// +optional
+	LCID *int32 `json:"lcid,omitempty"`
+
+	// TimeZone of the server, i.e. Etc/UTC
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// SQLAgentEnabled enables SQL Server Agent, sqlagent.enabled
+	// +optional
+	SQLAgentEnabled *bool `json:"sqlAgentEnabled,omitempty"`
+
+	// DefaultDataDir is the default directory of new data files, filelocation.defaultdatadir
+	// +optional
+	DefaultDataDir string `json:"defaultDataDir,omitempty"`
+
+	// DefaultLogDir is the default directory of new log files, filelocation.defaultlogdir
+	// +optional
+	DefaultLogDir string `json:"defaultLogDir,omitempty"`
+
+	// DefaultBackupDir is the default directory of backup files, filelocation.defaultbackupdir
+	// +optional
+	DefaultBackupDir string `json:"defaultBackupDir,omitempty"`
+
+	// TraceFlags are enabled globally, traceflag.traceflagN. Changes are applied to the running instances too.
+	// +optional
+	TraceFlags []int32 `json:"traceFlags,omitempty"`
+
+	// TCPPort is the port SQL Server listens on inside the pods, network.tcpport. Defaults to spec.port, the services
+	// forward spec.port to it.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	TCPPort *int32 `json:"tcpPort,omitempty"`
+
+	// NumErrorLogs is the number of error log files kept, errorlog.numerrorlogs
+	// +kubebuilder:validation:Minimum=6
+	// +kubebuilder:validation:Maximum=99
+	// +optional
+	NumErrorLogs *int32 `json:"numErrorLogs,omitempty"`
+
+	// HADREnabled enables availability groups, hadr.hadrenabled
+	// +optional
+	HADREnabled *bool `json:"hadrEnabled,omitempty"`
+
+	// ForceEncryption requires all client connections to be encrypted, network.forceencryption
+	// +optional
+	ForceEncryption *bool `json:"forceEncryption,omitempty"`
+}
+
+// MSSQLConfigurationStatus tells which changes of spec.configuration are in effect.
+type MSSQLConfigurationStatus struct {
+	// Settings are the values of spec.configuration the pods have been configured with, by field name. configSecret
+	// is the hash of the settings of spec.configSecret.
+	// +optional
+	Settings map[string]string `json:"settings,omitempty"`
+	// PendingRestart lists the settings changed while the instances were running. They take effect once all the pods
+	// have been restarted.
+	// +optional
+	PendingRestart []string `json:"pendingRestart,omitempty"`
+	// PendingSince is the time of the first change still waiting for a restart
+	// +optional
+	PendingSince *metav1.Time `json:"pendingSince,omitempty"`
+	// AppliedLive lists the settings of the last change that have been applied to the running instances
+	// without a restart
+	// +optional
+	AppliedLive []string `json:"appliedLive,omitempty"`
+}
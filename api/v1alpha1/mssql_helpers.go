@@ -18,8 +18,13 @@ package v1alpha1
 
 import (
 	"fmt"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
 	metautil "kmodules.xyz/client-go/meta"
+	ofst "kmodules.xyz/offshoot-api/api/v1"
+	"kubedb.dev/apimachinery/apis"
 	"kubedb.dev/apimachinery/apis/kubedb"
 	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
 )
@@ -56,6 +61,11 @@ func (in MSSQL) PrimaryServiceName() string {
 	return in.OffshootName()
 }
 
+// StandbyServiceName is the name of the service selecting the secondary replicas of the availability group.
+func (in MSSQL) StandbyServiceName() string {
+	return metautil.NameWithSuffix(in.PrimaryServiceName(), string(dbapi.StandbyServiceAlias))
+}
+
 func (in MSSQL) GoverningServiceName() string {
 	return metautil.NameWithSuffix(in.PrimaryServiceName(), "pods")
 }
@@ -90,6 +100,172 @@ func (in MSSQL) GetAuthSecretName() string {
 	return metautil.NameWithSuffix(in.OffshootName(), "auth")
 }
 
+// ServicePort is the database port of the services.
+func (in MSSQL) ServicePort() int32 {
+	if in.Spec.Port != nil {
+		return *in.Spec.Port
+	}
+	return MSSQLDatabasePort
+}
+
+// ServerPort is the port SQL Server listens on inside the pods.
+func (in MSSQL) ServerPort() int32 {
+	if in.Spec.Configuration != nil && in.Spec.Configuration.TCPPort != nil {
+		return *in.Spec.Configuration.TCPPort
+	}
+	return in.ServicePort()
+}
+
+// MirroringPort is the port of the database mirroring endpoint, 0 when it is not enabled.
+func (in MSSQL) MirroringPort() int32 {
+	if in.Spec.Endpoints == nil || in.Spec.Endpoints.Mirroring == nil {
+		return 0
+	}
+	if in.Spec.Endpoints.Mirroring.Port != nil {
+		return *in.Spec.Endpoints.Mirroring.Port
+	}
+	return MSSQLMirroringPort
+}
+
+// AdminServicePort is the port of the dedicated admin connection on the services, 0 when it is not enabled.
+func (in MSSQL) AdminServicePort() int32 {
+	if in.Spec.Endpoints == nil || in.Spec.Endpoints.AdminConnection == nil {
+		return 0
+	}
+	if in.Spec.Endpoints.AdminConnection.Port != nil {
+		return *in.Spec.Endpoints.AdminConnection.Port
+	}
+	return MSSQLAdminPort
+}
+
+// MemoryLimitMB is the memory.memorylimitmb of SQL Server: spec.configuration.memoryLimitMB if set, otherwise the
+// memory limit of the database container less the headroom. It is nil when the container has no memory limit.
+// The derived value never exceeds the container limit; the webhook rejects the limits leaving less than
+// MSSQLMinMemoryLimitMB after the headroom.
+func (in MSSQL) MemoryLimitMB() *int32 {
+	cfg := in.Spec.Configuration
+	if cfg != nil && cfg.MemoryLimitMB != nil {
+		return cfg.MemoryLimitMB
+	}
+	if in.Spec.PodTemplate == nil {
+		return nil
+	}
+	memory, ok := in.Spec.PodTemplate.Spec.Resources.Limits[core.ResourceMemory]
+	if !ok || memory.IsZero() {
+		return nil
+	}
+	v := int32(memory.Value() / (1024 * 1024) * (100 - in.memoryHeadroomPercent()) / 100)
+	return &v
+}
+
+// memoryHeadroomPercent is the share of the container memory limit left out of the derived memory.memorylimitmb.
+func (in MSSQL) memoryHeadroomPercent() int64 {
+	if cfg := in.Spec.Configuration; cfg != nil && cfg.MemoryHeadroomPercent != nil {
+		return int64(*cfg.MemoryHeadroomPercent)
+	}
+	return MSSQLDefaultMemoryHeadroomPercent
+}
+
+// ConfigSecretName is the name of the secret holding the mssql.conf rendered by the operator.
+// spec.configSecret is only an input of it.
+func (in MSSQL) ConfigSecretName() string {
+	return metautil.NameWithSuffix(in.OffshootName(), "config")
+}
+
+// CertificateName is the name of the cert-manager Certificate of the alias.
+func (in MSSQL) CertificateName(alias MSSQLCertificateAlias) string {
+	return metautil.NameWithSuffix(in.OffshootName(), fmt.Sprintf("%s-cert", string(alias)))
+}
+
+// GetCertSecretName is the name of the secret holding the certificate of the alias.
+// It defaults to the name of the Certificate.
+func (in MSSQL) GetCertSecretName(alias MSSQLCertificateAlias) string {
+	if in.Spec.TLS != nil {
+		if name, ok := kmapi.GetCertificateSecretName(in.Spec.TLS.Certificates, string(alias)); ok {
+			return name
+		}
+	}
+	return in.CertificateName(alias)
+}
+
+// GetCertificateStatus returns the status of the certificate of the alias, nil if it hasn't been issued yet.
+func (in MSSQL) GetCertificateStatus(alias MSSQLCertificateAlias) *MSSQLCertificateStatus {
+	for i := range in.Status.Certificates {
+		if in.Status.Certificates[i].Alias == alias {
+			return &in.Status.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// CASecretName is the name of the secret publishing the CA of the server certificate to the clients.
+func (in MSSQL) CASecretName() string {
+	return metautil.NameWithSuffix(in.OffshootName(), "ca")
+}
+
+// AvailabilityGroup returns spec.topology.availabilityGroup, nil when the replicas don't form an availability group.
+func (in MSSQL) AvailabilityGroup() *MSSQLAvailabilityGroupSpec {
+	if in.Spec.Topology == nil {
+		return nil
+	}
+	return in.Spec.Topology.AvailabilityGroup
+}
+
+// SynchronousReplicas is how many replicas use SYNCHRONOUS_COMMIT, see
+// spec.topology.availabilityGroup.synchronousReplicas, at most the number of replicas.
+func (in MSSQL) SynchronousReplicas() int32 {
+	n := int32(MSSQLMaxSynchronousReplicas)
+	if ag := in.AvailabilityGroup(); ag != nil && ag.SynchronousReplicas != nil {
+		n = *ag.SynchronousReplicas
+	}
+	if replicas := pointer.Int32(in.Spec.Replicas); replicas < n {
+		return replicas
+	}
+	return n
+}
+
+// AvailabilityReplica returns the configuration of the availability replica of the given pod, with the defaults.
+func (in MSSQL) AvailabilityReplica(podName string) MSSQLAvailabilityReplicaSpec {
+	replica := MSSQLAvailabilityReplicaSpec{Name: podName}
+	if ag := in.AvailabilityGroup(); ag != nil {
+		for _, r := range ag.Replicas {
+			if r.Name == podName {
+				replica = *r.DeepCopy()
+			}
+		}
+	}
+	if replica.BackupPriority == nil {
+		replica.BackupPriority = pointer.Int32P(MSSQLDefaultBackupPriority)
+	}
+	if replica.ReadableSecondary == "" {
+		replica.ReadableSecondary = MSSQLReadableSecondaryReadOnly
+		if in.Spec.Edition == MSSQLEditionStandard {
+			replica.ReadableSecondary = MSSQLReadableSecondaryNo
+		}
+	}
+	return replica
+}
+
+// EndpointSecretName is the name of the secret holding the certificate the mirroring endpoints authenticate
+// each other with, along with the passwords protecting it on the instances.
+func (in MSSQL) EndpointSecretName() string {
+	return metautil.NameWithSuffix(in.OffshootName(), "endpoint")
+}
+
+// PrimaryLeaseName is the name of the Lease whose holder is the pod of the primary replica of the availability group.
+func (in MSSQL) PrimaryLeaseName() string {
+	return in.OffshootName()
+}
+
+// ServiceAccountName is the service account of the pods: the one of spec.podTemplate if set, otherwise the one
+// the operator creates for the coordinator.
+func (in MSSQL) ServiceAccountName() string {
+	if in.Spec.PodTemplate != nil && in.Spec.PodTemplate.Spec.ServiceAccountName != "" {
+		return in.Spec.PodTemplate.Spec.ServiceAccountName
+	}
+	return in.OffshootName()
+}
+
 func (in MSSQL) PodControllerLabels(podControllerLabels map[string]string, extraLabels ...map[string]string) map[string]string {
 	return in.offshootLabels(metautil.OverwriteKeys(in.OffshootSelectors(), extraLabels...), podControllerLabels)
 }
@@ -97,3 +273,140 @@ func (in MSSQL) PodControllerLabels(podControllerLabels map[string]string, extra
 func (in MSSQL) PodLabels(podTemplateLabels map[string]string, extraLabels ...map[string]string) map[string]string {
 	return in.offshootLabels(metautil.OverwriteKeys(in.OffshootSelectors(), extraLabels...), podTemplateLabels)
 }
+
+// GetPhase derives the phase of the database from its current status conditions.
+// The conditions generally maintain the following chronological order:
+//
+//	ProvisioningStarted --> ReplicaReady --> AcceptingConnection --> Ready --> Provisioned
+//
+// ReplicaReady, AcceptingConnection, Ready & Paused are transitional, they may change at any time.
+func (in MSSQL) GetPhase() dbapi.DatabasePhase {
+	conditions := in.Status.Conditions
+
+	// the database is paused by some other party (i.e. backup/restore, ops request). keep the phase as it is.
+	if kmapi.IsConditionTrue(conditions, dbapi.DatabasePaused) {
+		return in.Status.Phase
+	}
+	if kmapi.IsConditionTrue(conditions, dbapi.DatabaseHalted) {
+		return dbapi.DatabasePhaseHalted
+	}
+	// the database has never been Ready yet
+	if !kmapi.IsConditionTrue(conditions, dbapi.DatabaseProvisioned) {
+		return dbapi.DatabasePhaseProvisioning
+	}
+	if !kmapi.IsConditionTrue(conditions, dbapi.DatabaseAcceptingConnection) {
+		return dbapi.DatabasePhaseNotReady
+	}
+	// the database accepts connections, but some replicas are not ready or the server reports unhealthy
+	if !kmapi.IsConditionTrue(conditions, dbapi.DatabaseReplicaReady) ||
+		!kmapi.IsConditionTrue(conditions, dbapi.DatabaseReady) {
+		return dbapi.DatabasePhaseCritical
+	}
+	return dbapi.DatabasePhaseReady
+}
+
+// SetDefaults fills in the optional fields of the spec, so that the controller can rely on them being set.
+func (in *MSSQL) SetDefaults() {
+	if in.Spec.StorageType == "" {
+		in.Spec.StorageType = dbapi.StorageTypeDurable
+	}
+	if in.Spec.Replicas == nil {
+		in.Spec.Replicas = pointer.Int32P(1)
+	}
+	if in.Spec.Edition == "" {
+		in.Spec.Edition = MSSQLEditionDeveloper
+	}
+	if in.Spec.SSLMode == "" {
+		if in.Spec.TLS != nil {
+			in.Spec.SSLMode = MSSQLSSLModeRequireSSL
+		} else {
+			in.Spec.SSLMode = MSSQLSSLModeDisabled
+		}
+	}
+	if in.Spec.TerminationPolicy == "" {
+		in.Spec.TerminationPolicy = dbapi.TerminationPolicyDelete
+	}
+	if in.Spec.AuthSecret == nil {
+		in.Spec.AuthSecret = &dbapi.SecretReference{}
+	}
+	if in.Spec.AuthSecret.Name == "" {
+		in.Spec.AuthSecret.Name = in.GetAuthSecretName()
+	}
+
+	if in.Spec.PodTemplate == nil {
+		in.Spec.PodTemplate = &ofst.PodTemplateSpec{}
+	}
+	if in.Spec.PodTemplate.Spec.SecurityContext == nil {
+		in.Spec.PodTemplate.Spec.SecurityContext = &core.PodSecurityContext{}
+	}
+	if in.Spec.PodTemplate.Spec.SecurityContext.FSGroup == nil {
+		in.Spec.PodTemplate.Spec.SecurityContext.FSGroup = pointer.Int64P(MSSQLFSGroup)
+	}
+	apis.SetDefaultResourceLimits(&in.Spec.PodTemplate.Spec.Resources, MSSQLDefaultResources)
+
+	if in.Spec.Topology == nil && *in.Spec.Replicas > 1 {
+		in.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+	}
+	in.SetAvailabilityGroupDefaults()
+	in.SetTLSDefaults()
+	in.SetHealthCheckerDefaults()
+}
+
+// SetAvailabilityGroupDefaults fills in the availability group & enables what it depends on: HADR & the mirroring
+// endpoint.
+func (in *MSSQL) SetAvailabilityGroupDefaults() {
+	ag := in.AvailabilityGroup()
+	if ag == nil {
+		return
+	}
+	if ag.Name == "" {
+		ag.Name = in.OffshootName()
+	}
+	if ag.ClusterType == "" {
+		ag.ClusterType = MSSQLClusterTypeExternal
+	}
+	if ag.Failover == nil {
+		ag.Failover = &MSSQLFailoverSpec{}
+	}
+	if ag.Failover.Automatic == nil {
+		ag.Failover.Automatic = pointer.BoolP(ag.ClusterType == MSSQLClusterTypeExternal || ag.Failover.AllowDataLoss)
+	}
+	if ag.Failover.PrimaryTimeoutSeconds == nil {
+		ag.Failover.PrimaryTimeoutSeconds = pointer.Int32P(MSSQLDefaultPrimaryTimeoutSeconds)
+	}
+	if in.Spec.Endpoints == nil {
+		in.Spec.Endpoints = &MSSQLEndpoints{}
+	}
+	if in.Spec.Endpoints.Mirroring == nil {
+		in.Spec.Endpoints.Mirroring = &MSSQLEndpoint{}
+	}
+	if in.Spec.Configuration == nil {
+		in.Spec.Configuration = &MSSQLConfiguration{}
+	}
+	if in.Spec.Configuration.HADREnabled == nil {
+		in.Spec.Configuration.HADREnabled = pointer.BoolP(true)
+	}
+}
+
+// SetTLSDefaults fills in the secret name of the server certificate.
+func (in *MSSQL) SetTLSDefaults() {
+	if in.Spec.TLS == nil {
+		return
+	}
+	in.Spec.TLS.Certificates = kmapi.SetMissingSpecForCertificate(in.Spec.TLS.Certificates, kmapi.CertificateSpec{
+		Alias:      string(MSSQLServerCert),
+		SecretName: in.CertificateName(MSSQLServerCert),
+	})
+}
+
+func (in *MSSQL) SetHealthCheckerDefaults() {
+	if in.Spec.HealthChecker.PeriodSeconds == nil {
+		in.Spec.HealthChecker.PeriodSeconds = pointer.Int32P(10)
+	}
+	if in.Spec.HealthChecker.TimeoutSeconds == nil {
+		in.Spec.HealthChecker.TimeoutSeconds = pointer.Int32P(10)
+	}
+	if in.Spec.HealthChecker.FailureThreshold == nil {
+		in.Spec.HealthChecker.FailureThreshold = pointer.Int32P(1)
+	}
+}
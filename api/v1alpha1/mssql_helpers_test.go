@@ -0,0 +1,236 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	ofst "kmodules.xyz/offshoot-api/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+)
+
+func conditions(kv ...interface{}) []kmapi.Condition {
+	var out []kmapi.Condition
+	for i := 0; i < len(kv); i += 2 {
+		status := core.ConditionFalse
+		if kv[i+1].(bool) {
+			status = core.ConditionTrue
+		}
+		out = append(out, kmapi.Condition{Type: kv[i].(string), Status: status})
+	}
+	return out
+}
+
+func TestGetPhase(t *testing.T) {
+	cases := []struct {
+		name       string
+		current    dbapi.DatabasePhase
+		conditions []kmapi.Condition
+		want       dbapi.DatabasePhase
+	}{
+		{
+			name:       "just started",
+			conditions: conditions(dbapi.DatabaseProvisioningStarted, true),
+			want:       dbapi.DatabasePhaseProvisioning,
+		},
+		{
+			name: "replicas ready, never provisioned",
+			conditions: conditions(dbapi.DatabaseProvisioningStarted, true, dbapi.DatabaseReplicaReady, true,
+				dbapi.DatabaseAcceptingConnection, true),
+			want: dbapi.DatabasePhaseProvisioning,
+		},
+		{
+			name: "ready",
+			conditions: conditions(dbapi.DatabaseProvisioned, true, dbapi.DatabaseReplicaReady, true,
+				dbapi.DatabaseAcceptingConnection, true, dbapi.DatabaseReady, true),
+			want: dbapi.DatabasePhaseReady,
+		},
+		{
+			name: "some replica down",
+			conditions: conditions(dbapi.DatabaseProvisioned, true, dbapi.DatabaseReplicaReady, false,
+				dbapi.DatabaseAcceptingConnection, true, dbapi.DatabaseReady, false),
+			want: dbapi.DatabasePhaseCritical,
+		},
+		{
+			name: "not accepting connection",
+			conditions: conditions(dbapi.DatabaseProvisioned, true, dbapi.DatabaseReplicaReady, false,
+				dbapi.DatabaseAcceptingConnection, false),
+			want: dbapi.DatabasePhaseNotReady,
+		},
+		{
+			name:       "halted",
+			conditions: conditions(dbapi.DatabaseProvisioned, true, dbapi.DatabaseHalted, true),
+			want:       dbapi.DatabasePhaseHalted,
+		},
+		{
+			name:    "paused keeps the current phase",
+			current: dbapi.DatabasePhaseReady,
+			conditions: conditions(dbapi.DatabaseProvisioned, true, dbapi.DatabasePaused, true,
+				dbapi.DatabaseAcceptingConnection, false),
+			want: dbapi.DatabasePhaseReady,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := MSSQL{Status: MSSQLStatus{Phase: c.current, Conditions: c.conditions}}
+			if got := db.GetPhase(); got != c.want {
+				t.Errorf("GetPhase() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	db := MSSQL{ObjectMeta: metav1.ObjectMeta{Name: "sample"}}
+	db.SetDefaults()
+
+	if db.Spec.StorageType != dbapi.StorageTypeDurable {
+		t.Errorf("storageType = %q, want %q", db.Spec.StorageType, dbapi.StorageTypeDurable)
+	}
+	if db.Spec.Replicas == nil || *db.Spec.Replicas != 1 {
+		t.Errorf("replicas = %v, want 1", db.Spec.Replicas)
+	}
+	if db.Spec.AuthSecret == nil || db.Spec.AuthSecret.Name != "sample-auth" {
+		t.Errorf("authSecret = %v, want sample-auth", db.Spec.AuthSecret)
+	}
+	if fsGroup := db.Spec.PodTemplate.Spec.SecurityContext.FSGroup; fsGroup == nil || *fsGroup != MSSQLFSGroup {
+		t.Errorf("fsGroup = %v, want %d", fsGroup, MSSQLFSGroup)
+	}
+	memory := db.Spec.PodTemplate.Spec.Resources.Limits[core.ResourceMemory]
+	if memory.Cmp(resource.MustParse(MSSQLMinMemory)) < 0 {
+		t.Errorf("memory limit = %s, want at least %s", memory.String(), MSSQLMinMemory)
+	}
+	if db.Spec.HealthChecker.PeriodSeconds == nil {
+		t.Error("healthChecker.periodSeconds is not defaulted")
+	}
+	if db.Spec.Topology != nil {
+		t.Errorf("topology = %v, want none for a single replica", db.Spec.Topology)
+	}
+	if errs := db.validate(); len(errs) == 0 {
+		t.Error("a defaulted object without storage must not be valid")
+	}
+}
+
+func TestSetAvailabilityGroupDefaults(t *testing.T) {
+	db := MSSQL{ObjectMeta: metav1.ObjectMeta{Name: "sample"}, Spec: MSSQLSpec{Replicas: pointer.Int32P(3)}}
+	db.SetDefaults()
+
+	ag := db.AvailabilityGroup()
+	if ag == nil {
+		t.Fatal("availability group is not defaulted for 3 replicas")
+	}
+	if ag.Name != "sample" || ag.ClusterType != MSSQLClusterTypeExternal {
+		t.Errorf("availability group = %+v, want sample with cluster type %s", ag, MSSQLClusterTypeExternal)
+	}
+	if db.MirroringPort() != MSSQLMirroringPort {
+		t.Errorf("mirroring port = %d, want %d", db.MirroringPort(), MSSQLMirroringPort)
+	}
+	if hadr := db.Spec.Configuration.HADREnabled; hadr == nil || !*hadr {
+		t.Errorf("hadrEnabled = %v, want true", hadr)
+	}
+	if f := ag.Failover; f == nil || !pointer.Bool(f.Automatic) || pointer.Int32(f.PrimaryTimeoutSeconds) != MSSQLDefaultPrimaryTimeoutSeconds {
+		t.Errorf("failover = %+v, want automatic after %ds", f, MSSQLDefaultPrimaryTimeoutSeconds)
+	}
+
+	db.Spec.Topology.AvailabilityGroup = &MSSQLAvailabilityGroupSpec{ClusterType: MSSQLClusterTypeNone}
+	db.SetDefaults()
+	if pointer.Bool(db.AvailabilityGroup().Failover.Automatic) {
+		t.Error("failover is automatic without a cluster manager")
+	}
+}
+
+func TestAvailabilityReplicas(t *testing.T) {
+	db := MSSQL{ObjectMeta: metav1.ObjectMeta{Name: "sample"}, Spec: MSSQLSpec{Replicas: pointer.Int32P(7)}}
+	db.SetDefaults()
+	if n := db.SynchronousReplicas(); n != MSSQLMaxSynchronousReplicas {
+		t.Errorf("synchronous replicas = %d, want %d", n, MSSQLMaxSynchronousReplicas)
+	}
+	db.Spec.Topology.AvailabilityGroup.SynchronousReplicas = pointer.Int32P(2)
+	if n := db.SynchronousReplicas(); n != 2 {
+		t.Errorf("synchronous replicas = %d, want 2", n)
+	}
+	db.Spec.Replicas = pointer.Int32P(1)
+	if n := db.SynchronousReplicas(); n != 1 {
+		t.Errorf("synchronous replicas of a single replica = %d, want 1", n)
+	}
+
+	db.Spec.Topology.AvailabilityGroup.Replicas = []MSSQLAvailabilityReplicaSpec{{Name: "sample-1", BackupPriority: pointer.Int32P(0)}}
+	want := MSSQLAvailabilityReplicaSpec{Name: "sample-1", BackupPriority: pointer.Int32P(0), ReadableSecondary: MSSQLReadableSecondaryReadOnly}
+	if got := db.AvailabilityReplica("sample-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("AvailabilityReplica() = %+v, want %+v", got, want)
+	}
+	db.Spec.Edition = MSSQLEditionStandard
+	want = MSSQLAvailabilityReplicaSpec{Name: "sample-0", BackupPriority: pointer.Int32P(MSSQLDefaultBackupPriority), ReadableSecondary: MSSQLReadableSecondaryNo}
+	if got := db.AvailabilityReplica("sample-0"); !reflect.DeepEqual(got, want) {
+		t.Errorf("AvailabilityReplica() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryLimitMB(t *testing.T) {
+	cases := []struct {
+		name   string
+		memory string
+		cfg    *MSSQLConfiguration
+		want   *int32
+	}{
+		{name: "no memory limit"},
+		{name: "derived", memory: "8Gi", want: pointer.Int32P(6553)},
+		{name: "custom headroom", memory: "8Gi", cfg: &MSSQLConfiguration{MemoryHeadroomPercent: pointer.Int32P(10)}, want: pointer.Int32P(7372)},
+		{name: "never above the container limit", memory: "2Gi", want: pointer.Int32P(1638)},
+		{name: "default memory", memory: MSSQLDefaultMemory, want: pointer.Int32P(MSSQLMinMemoryLimitMB)},
+		{name: "override", memory: "8Gi", cfg: &MSSQLConfiguration{MemoryLimitMB: pointer.Int32P(4096)}, want: pointer.Int32P(4096)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := MSSQL{Spec: MSSQLSpec{Configuration: c.cfg, PodTemplate: &ofst.PodTemplateSpec{}}}
+			if c.memory != "" {
+				db.Spec.PodTemplate.Spec.Resources.Limits = core.ResourceList{core.ResourceMemory: resource.MustParse(c.memory)}
+			}
+			if got := db.MemoryLimitMB(); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("MemoryLimitMB() = %v, want %v", pointer.Int32(got), pointer.Int32(c.want))
+			}
+		})
+	}
+}
+
+func TestPorts(t *testing.T) {
+	db := MSSQL{}
+	if db.ServicePort() != MSSQLDatabasePort || db.ServerPort() != MSSQLDatabasePort || db.MirroringPort() != 0 || db.AdminServicePort() != 0 {
+		t.Errorf("unexpected default ports %d/%d/%d/%d", db.ServicePort(), db.ServerPort(), db.MirroringPort(), db.AdminServicePort())
+	}
+
+	db.Spec.Port = pointer.Int32P(11433)
+	db.Spec.Endpoints = &MSSQLEndpoints{Mirroring: &MSSQLEndpoint{}, AdminConnection: &MSSQLEndpoint{}}
+	if db.ServicePort() != 11433 || db.ServerPort() != 11433 {
+		t.Errorf("spec.port: service port = %d, server port = %d", db.ServicePort(), db.ServerPort())
+	}
+	if db.MirroringPort() != MSSQLMirroringPort || db.AdminServicePort() != MSSQLAdminPort {
+		t.Errorf("endpoints: mirroring port = %d, admin port = %d", db.MirroringPort(), db.AdminServicePort())
+	}
+
+	db.Spec.Configuration = &MSSQLConfiguration{TCPPort: pointer.Int32P(1533)}
+	if db.ServicePort() != 11433 || db.ServerPort() != 1533 {
+		t.Errorf("tcpPort: service port = %d, server port = %d", db.ServicePort(), db.ServerPort())
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MSSQLTopology tells how the replicas of a MSSQL work together.
+type MSSQLTopology struct {
+	// AvailabilityGroup joins the replicas into an Always On availability group without a failover cluster.
+	// The first pod becomes the primary, the others secondaries seeded from it. It is set by default for more
+	// than one replica.
+	// +optional
+	AvailabilityGroup *MSSQLAvailabilityGroupSpec `json:"availabilityGroup,omitempty"`
+}
+
+type MSSQLAvailabilityGroupSpec struct {
+	// Name of the availability group. Defaults to the name of the MSSQL object. It can't be changed.
+	// +kubebuilder:validation:MaxLength=128
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// ClusterType of the availability group. With External the roles are changed by the operator, with None
+	// only a manual, forced failover is possible. Defaults to External. It can't be changed.
+	// +optional
+	ClusterType MSSQLClusterType `json:"clusterType,omitempty"`
+
+	// Databases are added to the availability group & seeded to the secondaries. The missing ones are created.
+	// Removing a database from the list doesn't remove it from the availability group.
+	// +optional
+	Databases []string `json:"databases,omitempty"`
+
+	// Failover tells how a secondary is promoted when the primary replica is lost
+	// +optional
+	Failover *MSSQLFailoverSpec `json:"failover,omitempty"`
+
+	// SynchronousReplicas is how many replicas, the primary included, use SYNCHRONOUS_COMMIT & are the targets of
+	// automatic failover: the pods with the lowest ordinals. The others use ASYNCHRONOUS_COMMIT & only take over
+	// with failover.allowDataLoss, they can't be switched over to. Defaults to all the replicas, at most 5.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=5
+	// +optional
+	SynchronousReplicas *int32 `json:"synchronousReplicas,omitempty"`
+
+	// RequiredSynchronizedSecondariesToCommit is how many synchronous secondaries must have hardened a transaction
+	// before it commits on the primary replica. The primary stops taking writes while fewer secondaries are
+	// SYNCHRONIZED. Defaults to 0.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	RequiredSynchronizedSecondariesToCommit *int32 `json:"requiredSynchronizedSecondariesToCommit,omitempty"`
+
+	// Replicas sets the backup priority & the connections of the secondaries, per pod. The pods that aren't
+	// listed use the defaults.
+	// +optional
+	Replicas []MSSQLAvailabilityReplicaSpec `json:"replicas,omitempty"`
+}
+
+// MSSQLAvailabilityReplicaSpec is the configuration of the availability replica of a pod.
+type MSSQLAvailabilityReplicaSpec struct {
+	// Name of the pod
+	Name string `json:"name"`
+
+	// BackupPriority of the replica, from 0 to 100, 0 excludes it from backups. Defaults to 50.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	BackupPriority *int32 `json:"backupPriority,omitempty"`
+
+	// ReadableSecondary tells which connections the replica accepts while it is a secondary. The read-only
+	// connections routed from the primary replica go to the readable secondaries. Defaults to ReadOnly, to No with
+	// the Standard edition, whose basic availability groups have no readable secondaries.
+	// +optional
+	ReadableSecondary MSSQLReadableSecondary `json:"readableSecondary,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=No;ReadOnly;All
+type MSSQLReadableSecondary string
+
+const (
+	// MSSQLReadableSecondaryNo refuses the connections to the secondary
+	MSSQLReadableSecondaryNo MSSQLReadableSecondary = "No"
+	// MSSQLReadableSecondaryReadOnly accepts the connections with ApplicationIntent=ReadOnly
+	MSSQLReadableSecondaryReadOnly MSSQLReadableSecondary = "ReadOnly"
+	// MSSQLReadableSecondaryAll accepts all connections, for reads only
+	MSSQLReadableSecondaryAll MSSQLReadableSecondary = "All"
+)
+
+type MSSQLFailoverSpec struct {
+	// Automatic promotes a secondary once the primary replica has been lost for primaryTimeoutSeconds. The
+	// synchronous secondary that is the most caught up is chosen. Defaults to true with the External cluster type.
+	// With the None cluster type, it requires allowDataLoss.
+	// +optional
+	Automatic *bool `json:"automatic,omitempty"`
+
+	// PrimaryTimeoutSeconds is how long the primary has to be unreachable, for both the health checker & the
+	// coordinator, before it is failed over. It is the duration of the primary lease too: a primary replica that
+	// couldn't renew the lease for a third of it demotes itself. Defaults to 30.
+	// +kubebuilder:validation:Minimum=5
+	// +optional
+	PrimaryTimeoutSeconds *int32 `json:"primaryTimeoutSeconds,omitempty"`
+
+	// AllowDataLoss fails over with FORCE_FAILOVER_ALLOW_DATA_LOSS when no synchronous secondary can take over
+	// without data loss, the transactions not yet sent to the new primary are lost.
+	// +optional
+	AllowDataLoss bool `json:"allowDataLoss,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=External;None
+type MSSQLClusterType string
+
+const (
+	MSSQLClusterTypeExternal MSSQLClusterType = "External"
+	MSSQLClusterTypeNone     MSSQLClusterType = "None"
+)
+
+// MSSQLAvailabilityGroupStatus is the state of the availability group, as seen by the operator.
+type MSSQLAvailabilityGroupStatus struct {
+	Name string `json:"name"`
+	// Primary is the pod of the primary replica
+	// +optional
+	Primary string `json:"primary,omitempty"`
+	// Replicas are the pods that have joined the availability group, the primary included
+	// +optional
+	Replicas []string `json:"replicas,omitempty"`
+	// Databases of the availability group
+	// +optional
+	Databases []string `json:"databases,omitempty"`
+	// PrimaryUnreachableSince is set by the health checker while the primary replica doesn't answer
+	// +optional
+	PrimaryUnreachableSince *metav1.Time `json:"primaryUnreachableSince,omitempty"`
+	// LastFailover is the last time the primary role moved to another replica
+	// +optional
+	LastFailover *MSSQLFailoverStatus `json:"lastFailover,omitempty"`
+	// PrimaryServicePause is set while a switchover holds the new connections through the primary service, until
+	// the service selects the new primary replica
+	// +optional
+	PrimaryServicePause *MSSQLServicePause `json:"primaryServicePause,omitempty"`
+}
+
+// MSSQLServicePause records new connections through a service being held.
+type MSSQLServicePause struct {
+	// Pod is the only pod the service may select meanwhile, once its coordinator labeled it
+	Pod string `json:"pod"`
+	// Since is when the connections were first held
+	Since metav1.Time `json:"since"`
+}
+
+// MSSQLFailoverStatus records a failover of the primary role.
+type MSSQLFailoverStatus struct {
+	// From is the pod of the old primary replica
+	From string `json:"from"`
+	// To is the pod of the new primary replica
+	To string `json:"to"`
+	// Reason of the failover
+	Reason string `json:"reason"`
+	// DataLossAllowed tells whether the failover was forced, possibly losing transactions
+	// +optional
+	DataLossAllowed bool `json:"dataLossAllowed,omitempty"`
+	// DetectedAt is when the old primary was first found unreachable
+	// +optional
+	DetectedAt *metav1.Time `json:"detectedAt,omitempty"`
+	// CompletedAt is when the new primary took over. For a switchover, it is when the primary service selected the
+	// new primary.
+	CompletedAt metav1.Time `json:"completedAt"`
+	// Duration between the detection & the completion, the time the database was not writable at least. For a
+	// switchover, it is the time new connections through the primary service were held.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+}
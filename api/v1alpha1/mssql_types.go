@@ -49,7 +49,7 @@ type MSSQL struct {
 }
 
 type MSSQLSpec struct {
-	// Version of MSSQL to be deployed.
+	// Version of MSSQL to be deployed. It is the name of a MSSQLVersion object.
 	Version string `json:"version"`
 
 	// Number of instances to deploy for a MSSQL database.
@@ -69,8 +69,29 @@ type MSSQLSpec struct {
 	// EphemeralStorage spec to specify the configuration of ephemeral storage type.
 	EphemeralStorage *core.EmptyDirVolumeSource `json:"ephemeralStorage,omitempty"`
 
+	// Port of the services & the default port SQL Server listens on. Defaults to 1433.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port *int32 `json:"port,omitempty"`
+
+	// Topology of the replicas
+	// +optional
+	Topology *MSSQLTopology `json:"topology,omitempty"`
+
+	// Endpoints enables the endpoints of SQL Server besides the database port
+	// +optional
+	Endpoints *MSSQLEndpoints `json:"endpoints,omitempty"`
+
 	// SSLMode for both standalone and clusters. (default, disabled.)
-	SSLMode string `json:"sslMode,omitempty"`
+	// +optional
+	SSLMode MSSQLSSLMode `json:"sslMode,omitempty"`
+
+	// TLS issues the server certificate of SQL Server through a cert-manager Issuer or ClusterIssuer.
+	// The certificate covers the services & the pods. spec.sslMode tells whether the clients must encrypt their
+	// connections, it can't be disabled with TLS. The CA of the certificate is published in the <name>-ca secret.
+	// +optional
+	TLS *kmapi.TLSConfig `json:"tls,omitempty"`
 
 	// Monitor is used monitor database instance
 	// +optional
@@ -80,18 +101,41 @@ type MSSQLSpec struct {
 	// +optional
 	AuthSecret *dbapi.SecretReference `json:"authSecret,omitempty"`
 
-	// ConfigSecret is an optional field to provide custom configuration file for database
-	// If specified, this file will be used as configuration file otherwise default configuration file will be used.
+	// ConfigSecret is an optional field to provide custom configuration file for database.
+	// The mssql.conf key of the secret is merged with the operator defaults & written to /var/opt/mssql/mssql.conf
+	// before SQL Server starts. Unknown sections & keys are dropped & reported in the ConfigurationValid condition.
+	// The settings managed by the operator, e.g. network.tcpport, are rejected: use spec.port & spec.configuration.
 	ConfigSecret *core.LocalObjectReference `json:"configSecret,omitempty"`
 
+	// Configuration holds typed mssql-conf settings
+	// +optional
+	Configuration *MSSQLConfiguration `json:"configuration,omitempty"`
+
 	// PodTemplate is an optional configuration for pods used to expose database
 	// +optional
 	PodTemplate *ofst.PodTemplateSpec `json:"podTemplate,omitempty"`
 
+	// Init is used to initialize a new database with the .sql scripts of a ConfigMap, a Secret or a PVC.
+	// The scripts are run in lexical order, once. Every pod mounts the volume, so a PVC has to be ReadOnlyMany or
+	// ReadWriteMany with more than one replica. A failing script stops the initialization until spec.init changes.
+	// +optional
+	Init *dbapi.InitSpec `json:"init,omitempty"`
+
 	// ServiceTemplates is an optional configuration for services used to expose database
 	// +optional
 	ServiceTemplates []dbapi.NamedServiceTemplateSpec `json:"serviceTemplates,omitempty"`
 
+	// Indicates that the database is halted. The StatefulSet is scaled down to zero and the services are removed,
+	// while the PVCs, the auth secret and the finalizer are kept. Unset it to bring the database back with the same data.
+	// +optional
+	Halted bool `json:"halted,omitempty"`
+
+	// TerminationPolicy controls the delete operation for database. A DoNotTerminate database that gets deleted anyway,
+	// i.e. bypassing the webhook, stays in Terminating until the policy is changed.
+	// +kubebuilder:default=Delete
+	// +optional
+	TerminationPolicy dbapi.TerminationPolicy `json:"terminationPolicy,omitempty"`
+
 	// HealthChecker defines attributes of the health checker
 	// +optional
 	// +kubebuilder:default={periodSeconds: 10, timeoutSeconds: 10, failureThreshold: 1}
@@ -108,10 +152,80 @@ const (
 	MSSQLEditionEnterprise MSSQLEdition = "Enterprise"
 )
 
+// MSSQLEndpoints are the optional endpoints of SQL Server, exposed as named ports of the pods & the services.
+type MSSQLEndpoints struct {
+	// Mirroring is the database mirroring endpoint the replicas of an availability group connect to.
+	// It is exposed through the governing service only. The port defaults to 5022.
+	// +optional
+	Mirroring *MSSQLEndpoint `json:"mirroring,omitempty"`
+
+	// AdminConnection is the dedicated admin connection (DAC). Remote admin connections are enabled on the instances.
+	// SQL Server listens for it on 1434, the port sets the port of the services. Defaults to 1434.
+	// +optional
+	AdminConnection *MSSQLEndpoint `json:"adminConnection,omitempty"`
+}
+
+type MSSQLEndpoint struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port *int32 `json:"port,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=disabled;allowSSL;requireSSL
+type MSSQLSSLMode string
+
+const (
+	MSSQLSSLModeDisabled   MSSQLSSLMode = "disabled"
+	MSSQLSSLModeAllowSSL   MSSQLSSLMode = "allowSSL"
+	MSSQLSSLModeRequireSSL MSSQLSSLMode = "requireSSL"
+)
+
 type MSSQLStatus struct {
 	// Specifies the current phase of the database
 	// +optional
-	Phase string `json:"phase,omitempty"`
+	Phase dbapi.DatabasePhase `json:"phase,omitempty"`
+	// observedGeneration is the most recent generation observed for this resource. It corresponds to the
+	// resource's generation, which is updated on mutation by the API Server.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions applied to the database, such as ProvisioningStarted, ReplicaReady, AcceptingConnection, Ready,
+	// DatabaseInitialized, PendingRestart, SwitchingOver & Paused.
+	// +optional
+	Conditions []kmapi.Condition `json:"conditions,omitempty"`
+	// InitScripts lists the init scripts that have been run successfully, in order. They are never run again.
+	// +optional
+	InitScripts []string `json:"initScripts,omitempty"`
+	// InitFailedSpecHash is the hash of spec.init an init script failed with. The init scripts are not retried
+	// until spec.init changes, i.e. points to fixed scripts.
+	// +optional
+	InitFailedSpecHash string `json:"initFailedSpecHash,omitempty"`
+	// Configuration tells which changes of spec.configuration are in effect
+	// +optional
+	Configuration *MSSQLConfigurationStatus `json:"configuration,omitempty"`
+	// Certificates reports the certificates issued for spec.tls
+	// +optional
+	Certificates []MSSQLCertificateStatus `json:"certificates,omitempty"`
+	// AvailabilityGroup reports the availability group of spec.topology.availabilityGroup
+	// +optional
+	AvailabilityGroup *MSSQLAvailabilityGroupStatus `json:"availabilityGroup,omitempty"`
+}
+
+// MSSQLCertificateStatus is the state of a certificate mounted into the pods.
+type MSSQLCertificateStatus struct {
+	Alias      MSSQLCertificateAlias `json:"alias"`
+	SecretName string                `json:"secretName"`
+	// Hash of the content of the secret. SQL Server only reads the certificate on startup, so the pods running
+	// with another one are restarted, one at a time.
+	// +optional
+	Hash string `json:"hash,omitempty"`
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+	// +optional
+	NotBefore *metav1.Time `json:"notBefore,omitempty"`
+	// NotAfter is the expiry date of the certificate
+	// +optional
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -0,0 +1,671 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	"kubedb.dev/mssql/pkg/mssqlconf"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var mssqllog = logf.Log.WithName("mssql-resource")
+
+func (in *MSSQL) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(in).
+		WithValidator(&MSSQLValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-microsoft-kubedb-com-v1alpha1-mssql,mutating=true,failurePolicy=fail,sideEffects=None,groups=microsoft.kubedb.com,resources=mssqls,verbs=create;update,versions=v1alpha1,name=mmssql.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &MSSQL{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (in *MSSQL) Default() {
+	mssqllog.Info("default", "name", in.Name)
+	in.SetDefaults()
+}
+
+//+kubebuilder:webhook:path=/validate-microsoft-kubedb-com-v1alpha1-mssql,mutating=false,failurePolicy=fail,sideEffects=None,groups=microsoft.kubedb.com,resources=mssqls,verbs=create;update;delete,versions=v1alpha1,name=vmssql.kb.io,admissionReviewVersions=v1
+
+// MSSQLValidator validates MSSQL objects. It needs a client to look up the MSSQLVersion catalog.
+// +kubebuilder:object:generate=false
+type MSSQLValidator struct {
+	Client client.Reader
+}
+
+var _ admission.CustomValidator = &MSSQLValidator{}
+
+// ValidateCreate implements admission.CustomValidator so a webhook will be registered for the type
+func (v *MSSQLValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	db, ok := obj.(*MSSQL)
+	if !ok {
+		return fmt.Errorf("expected a MSSQL but got a %T", obj)
+	}
+	mssqllog.Info("validate create", "name", db.Name)
+
+	allErrs := db.validate()
+	allErrs = append(allErrs, v.validateVersion(ctx, db, nil)...)
+	allErrs = append(allErrs, v.validateInitVolume(ctx, db, nil)...)
+	allErrs = append(allErrs, v.validateConfigSecret(ctx, db, nil)...)
+	return db.toInvalid(allErrs)
+}
+
+// ValidateUpdate implements admission.CustomValidator so a webhook will be registered for the type
+func (v *MSSQLValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	db, ok := newObj.(*MSSQL)
+	if !ok {
+		return fmt.Errorf("expected a MSSQL but got a %T", newObj)
+	}
+	oldDB, ok := oldObj.(*MSSQL)
+	if !ok {
+		return fmt.Errorf("expected a MSSQL but got a %T", oldObj)
+	}
+	mssqllog.Info("validate update", "name", db.Name)
+
+	// a MSSQL being deleted is only updated to remove the finalizer or to change the terminationPolicy,
+	// which must never be blocked by validation rules the object doesn't meet anymore
+	if db.DeletionTimestamp != nil {
+		return nil
+	}
+
+	allErrs := db.validate()
+	allErrs = append(allErrs, db.validateImmutableFields(oldDB)...)
+	allErrs = append(allErrs, v.validateVersion(ctx, db, oldDB)...)
+	allErrs = append(allErrs, v.validateInitVolume(ctx, db, oldDB)...)
+	allErrs = append(allErrs, v.validateConfigSecret(ctx, db, oldDB)...)
+	return db.toInvalid(allErrs)
+}
+
+// ValidateDelete implements admission.CustomValidator so a webhook will be registered for the type
+func (v *MSSQLValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	db, ok := obj.(*MSSQL)
+	if !ok {
+		return fmt.Errorf("expected a MSSQL but got a %T", obj)
+	}
+	mssqllog.Info("validate delete", "name", db.Name)
+
+	if db.Spec.TerminationPolicy == dbapi.TerminationPolicyDoNotTerminate {
+		return fmt.Errorf(`MSSQL %s/%s can't be deleted. Change .spec.terminationPolicy from "%s" to allow the deletion`,
+			db.Namespace, db.Name, dbapi.TerminationPolicyDoNotTerminate)
+	}
+	return nil
+}
+
+// validateVersion makes sure spec.version refers to a known MSSQLVersion. A new object may not use a deprecated
+// version, and a version change has to be allowed by the update constraints of the current version.
+func (v *MSSQLValidator) validateVersion(ctx context.Context, db, oldDB *MSSQL) field.ErrorList {
+	path := field.NewPath("spec", "version")
+	if db.Spec.Version == "" || (oldDB != nil && oldDB.Spec.Version == db.Spec.Version) {
+		return nil
+	}
+
+	var version MSSQLVersion
+	if err := v.Client.Get(ctx, client.ObjectKey{Name: db.Spec.Version}, &version); err != nil {
+		if apierrors.IsNotFound(err) {
+			return field.ErrorList{field.NotFound(path, db.Spec.Version)}
+		}
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	if version.Spec.Deprecated {
+		return field.ErrorList{field.Invalid(path, db.Spec.Version, "version is deprecated")}
+	}
+	if oldDB == nil {
+		return nil
+	}
+
+	var current MSSQLVersion
+	if err := v.Client.Get(ctx, client.ObjectKey{Name: oldDB.Spec.Version}, &current); err != nil {
+		if apierrors.IsNotFound(err) {
+			return field.ErrorList{field.Invalid(path, db.Spec.Version,
+				fmt.Sprintf("current version %s is not found, can't check the update constraints", oldDB.Spec.Version))}
+		}
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	if !current.IsUpdateAllowed(db.Spec.Version) {
+		return field.ErrorList{field.Forbidden(path,
+			fmt.Sprintf("update from version %s to %s is not allowed", oldDB.Spec.Version, db.Spec.Version))}
+	}
+	return nil
+}
+
+// validateInitVolume makes sure all the replicas can mount a PVC holding the init scripts. The StatefulSet mounts it
+// into every pod, while a ReadWriteOnce volume is only attached to a single node.
+func (v *MSSQLValidator) validateInitVolume(ctx context.Context, db, oldDB *MSSQL) field.ErrorList {
+	if db.Spec.Init == nil || db.Spec.Init.Script == nil || db.Spec.Init.Script.PersistentVolumeClaim == nil ||
+		db.Spec.Replicas == nil || *db.Spec.Replicas <= 1 {
+		return nil
+	}
+	if oldDB != nil && oldDB.Spec.Replicas != nil && *oldDB.Spec.Replicas > 1 && reflect.DeepEqual(oldDB.Spec.Init, db.Spec.Init) {
+		return nil
+	}
+
+	path := field.NewPath("spec", "init", "script", "persistentVolumeClaim", "claimName")
+	name := db.Spec.Init.Script.PersistentVolumeClaim.ClaimName
+	var pvc core.PersistentVolumeClaim
+	if err := v.Client.Get(ctx, client.ObjectKey{Namespace: db.Namespace, Name: name}, &pvc); err != nil {
+		if apierrors.IsNotFound(err) {
+			return field.ErrorList{field.NotFound(path, name)}
+		}
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	for _, mode := range pvc.Spec.AccessModes {
+		if mode == core.ReadOnlyMany || mode == core.ReadWriteMany {
+			return nil
+		}
+	}
+	return field.ErrorList{field.Invalid(path, name, fmt.Sprintf("must have the access mode %s or %s, as all the %d replicas mount it",
+		core.ReadOnlyMany, core.ReadWriteMany, *db.Spec.Replicas))}
+}
+
+// validateConfigSecret makes sure the mssql.conf of spec.configSecret leaves the reserved settings to the operator.
+// A secret that doesn't exist yet, or is changed later, is checked by the controller, which drops & reports them.
+func (v *MSSQLValidator) validateConfigSecret(ctx context.Context, db, oldDB *MSSQL) field.ErrorList {
+	if db.Spec.ConfigSecret == nil || (oldDB != nil && reflect.DeepEqual(oldDB.Spec.ConfigSecret, db.Spec.ConfigSecret)) {
+		return nil
+	}
+
+	path := field.NewPath("spec", "configSecret", "name")
+	var secret core.Secret
+	if err := v.Client.Get(ctx, client.ObjectKey{Namespace: db.Namespace, Name: db.Spec.ConfigSecret.Name}, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	cfg, _ := mssqlconf.Parse(string(secret.Data[MSSQLConfigFileName]))
+	var allErrs field.ErrorList
+	for _, setting := range MSSQLReservedSettings {
+		if _, ok := cfg.Get(setting[0], setting[1]); ok {
+			allErrs = append(allErrs, field.Invalid(path, db.Spec.ConfigSecret.Name,
+				fmt.Sprintf("%s sets %s.%s, which is managed by the operator, use %s instead", MSSQLConfigFileName, setting[0], setting[1], setting[2])))
+		}
+	}
+	return allErrs
+}
+
+func (in *MSSQL) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind(ResourceKindMSSQL).GroupKind(), in.Name, allErrs)
+}
+
+// validate checks the spec for inconsistencies the controller can't act upon.
+func (in *MSSQL) validate() field.ErrorList {
+	var allErrs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if in.Spec.Version == "" {
+		allErrs = append(allErrs, field.Required(spec.Child("version"), "version of MSSQL must be specified"))
+	}
+
+	allErrs = append(allErrs, in.validateReplicas(spec)...)
+	allErrs = append(allErrs, in.validateTopology(spec)...)
+	allErrs = append(allErrs, in.validateStorage(spec)...)
+	allErrs = append(allErrs, in.validateResources(spec)...)
+	allErrs = append(allErrs, in.validateInit(spec)...)
+	allErrs = append(allErrs, in.validateConfiguration(spec)...)
+	allErrs = append(allErrs, in.validatePorts(spec)...)
+	allErrs = append(allErrs, in.validateTLS(spec)...)
+	allErrs = append(allErrs, in.validateServiceTemplates(spec)...)
+
+	switch in.Spec.SSLMode {
+	case "", MSSQLSSLModeDisabled, MSSQLSSLModeAllowSSL, MSSQLSSLModeRequireSSL:
+	default:
+		allErrs = append(allErrs, field.NotSupported(spec.Child("sslMode"), in.Spec.SSLMode,
+			[]string{string(MSSQLSSLModeDisabled), string(MSSQLSSLModeAllowSSL), string(MSSQLSSLModeRequireSSL)}))
+	}
+
+	if target, ok := in.Annotations[MSSQLSwitchoverAnnotation]; ok {
+		annotationPath := field.NewPath("metadata", "annotations").Key(MSSQLSwitchoverAnnotation)
+		if in.AvailabilityGroup() == nil {
+			allErrs = append(allErrs, field.Forbidden(annotationPath, "a switchover requires an availability group"))
+		} else if !in.isPodName(target) {
+			allErrs = append(allErrs, field.Invalid(annotationPath, target, "must be the name of a pod of the MSSQL"))
+		} else if !in.isSynchronousReplica(target) {
+			allErrs = append(allErrs, field.Invalid(annotationPath, target,
+				"the replica uses ASYNCHRONOUS_COMMIT, it can't be switched over to"))
+		}
+	}
+
+	if in.Spec.AuthSecret != nil && in.Spec.AuthSecret.ExternallyManaged && in.Spec.AuthSecret.Name == "" {
+		allErrs = append(allErrs, field.Required(spec.Child("authSecret", "name"),
+			"name of an externally managed auth secret must be specified"))
+	}
+
+	switch in.Spec.TerminationPolicy {
+	case "", dbapi.TerminationPolicyHalt, dbapi.TerminationPolicyDelete, dbapi.TerminationPolicyWipeOut:
+	case dbapi.TerminationPolicyDoNotTerminate:
+		if in.Spec.Halted {
+			allErrs = append(allErrs, field.Invalid(spec.Child("halted"), in.Spec.Halted,
+				fmt.Sprintf(`can't halt a database with terminationPolicy "%s"`, dbapi.TerminationPolicyDoNotTerminate)))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(spec.Child("terminationPolicy"), in.Spec.TerminationPolicy,
+			[]string{
+				string(dbapi.TerminationPolicyHalt), string(dbapi.TerminationPolicyDelete),
+				string(dbapi.TerminationPolicyWipeOut), string(dbapi.TerminationPolicyDoNotTerminate),
+			}))
+	}
+
+	return allErrs
+}
+
+// validateInit checks that the init scripts come from exactly one ConfigMap, Secret or PVC.
+func (in *MSSQL) validateInit(spec *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if in.Spec.Init == nil {
+		return nil
+	}
+	initPath := spec.Child("init")
+	if in.Spec.Init.WaitForInitialRestore {
+		allErrs = append(allErrs, field.Forbidden(initPath.Child("waitForInitialRestore"), "restore is not supported for MSSQL"))
+	}
+	script := in.Spec.Init.Script
+	if script == nil {
+		return allErrs
+	}
+	scriptPath := initPath.Child("script")
+
+	sources := 0
+	for _, set := range []bool{script.ConfigMap != nil, script.Secret != nil, script.PersistentVolumeClaim != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		allErrs = append(allErrs, field.Invalid(scriptPath, "",
+			"exactly one of configMap, secret or persistentVolumeClaim must be specified"))
+	}
+	if script.ScriptPath != "" &&
+		(path.IsAbs(script.ScriptPath) || strings.HasPrefix(path.Clean(script.ScriptPath), "..")) {
+		allErrs = append(allErrs, field.Invalid(scriptPath.Child("scriptPath"), script.ScriptPath,
+			"must be a path relative to the root of the volume"))
+	}
+	return allErrs
+}
+
+// validateConfiguration checks the settings of spec.configuration the CRD schema can't.
+func (in *MSSQL) validateConfiguration(spec *field.Path) field.ErrorList {
+	if in.Spec.Configuration == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	if limit := in.Spec.Configuration.MemoryLimitMB; limit != nil && in.Spec.PodTemplate != nil {
+		memory, ok := in.Spec.PodTemplate.Spec.Resources.Limits[core.ResourceMemory]
+		if ok && int64(*limit)*1024*1024 > memory.Value() {
+			allErrs = append(allErrs, field.Invalid(spec.Child("configuration", "memoryLimitMB"), *limit,
+				fmt.Sprintf("must not exceed the memory limit of the container, %s", memory.String())))
+		}
+	}
+
+	path := spec.Child("configuration", "traceFlags")
+	seen := map[int32]bool{}
+	for i, flag := range in.Spec.Configuration.TraceFlags {
+		switch {
+		case flag <= 0:
+			allErrs = append(allErrs, field.Invalid(path.Index(i), flag, "must be a positive number"))
+		case seen[flag]:
+			allErrs = append(allErrs, field.Duplicate(path.Index(i), flag))
+		}
+		seen[flag] = true
+	}
+	return allErrs
+}
+
+// validateTLS checks that the server certificate has a cert-manager issuer & that spec.sslMode matches spec.tls.
+func (in *MSSQL) validateTLS(spec *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if cfg := in.Spec.Configuration; cfg != nil && cfg.ForceEncryption != nil &&
+		*cfg.ForceEncryption != (in.Spec.SSLMode == MSSQLSSLModeRequireSSL) {
+		allErrs = append(allErrs, field.Invalid(spec.Child("configuration", "forceEncryption"), *cfg.ForceEncryption,
+			fmt.Sprintf("must match spec.sslMode, encryption is only forced with %s", MSSQLSSLModeRequireSSL)))
+	}
+	if in.Spec.TLS == nil {
+		return allErrs
+	}
+
+	tlsPath := spec.Child("tls")
+	if in.Spec.SSLMode == MSSQLSSLModeDisabled {
+		allErrs = append(allErrs, field.Invalid(spec.Child("sslMode"), in.Spec.SSLMode,
+			fmt.Sprintf("must be %s or %s when tls is set", MSSQLSSLModeAllowSSL, MSSQLSSLModeRequireSSL)))
+	}
+	for i, cert := range in.Spec.TLS.Certificates {
+		if cert.Alias != string(MSSQLServerCert) {
+			allErrs = append(allErrs, field.NotSupported(tlsPath.Child("certificates").Index(i).Child("alias"),
+				cert.Alias, []string{string(MSSQLServerCert)}))
+		}
+	}
+
+	issuerPath := tlsPath.Child("issuerRef")
+	issuer := in.Spec.TLS.IssuerRef
+	if _, cert := kmapi.GetCertificate(in.Spec.TLS.Certificates, string(MSSQLServerCert)); cert != nil && cert.IssuerRef != nil {
+		issuer = cert.IssuerRef
+	}
+	switch {
+	case issuer == nil:
+		allErrs = append(allErrs, field.Required(issuerPath, "an Issuer or a ClusterIssuer of cert-manager must be specified"))
+	case issuer.APIGroup == nil || *issuer.APIGroup != CertManagerGroup:
+		allErrs = append(allErrs, field.NotSupported(issuerPath.Child("apiGroup"), issuer.APIGroup, []string{CertManagerGroup}))
+	case issuer.Kind != CertManagerIssuerKind && issuer.Kind != CertManagerClusterIssuerKind:
+		allErrs = append(allErrs, field.NotSupported(issuerPath.Child("kind"), issuer.Kind,
+			[]string{CertManagerIssuerKind, CertManagerClusterIssuerKind}))
+	}
+	return allErrs
+}
+
+// validatePorts checks that the endpoints don't share a port, neither in the pods nor on the services.
+func (in *MSSQL) validatePorts(spec *field.Path) field.ErrorList {
+	// the dedicated admin connection is served on a fixed port inside the pods
+	var adminContainerPort int32
+	if in.AdminServicePort() != 0 {
+		adminContainerPort = MSSQLAdminPort
+	}
+	podPorts := []int32{in.ServerPort(), in.MirroringPort(), adminContainerPort}
+	servicePorts := []int32{in.ServicePort(), in.MirroringPort(), in.AdminServicePort()}
+	names := []string{"database", "mirroring", "adminConnection"}
+
+	var allErrs field.ErrorList
+	for i := 1; i < len(names); i++ {
+		for j := 0; j < i; j++ {
+			if podPorts[i] != 0 && (podPorts[i] == podPorts[j] || servicePorts[i] == servicePorts[j]) {
+				allErrs = append(allErrs, field.Invalid(spec.Child("endpoints", names[i], "port"), servicePorts[i],
+					fmt.Sprintf("conflicts with the %s port", names[j])))
+				break
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateServiceTemplates checks that the service templates name the services of the MSSQL, the standby service
+// existing with an availability group only.
+func (in *MSSQL) validateServiceTemplates(spec *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, t := range in.Spec.ServiceTemplates {
+		path := spec.Child("serviceTemplates").Index(i).Child("alias")
+		switch t.Alias {
+		case dbapi.PrimaryServiceAlias:
+		case dbapi.StandbyServiceAlias:
+			if in.AvailabilityGroup() == nil {
+				allErrs = append(allErrs, field.Forbidden(path, "the standby service requires an availability group"))
+			}
+		default:
+			allErrs = append(allErrs, field.NotSupported(path, t.Alias,
+				[]string{string(dbapi.PrimaryServiceAlias), string(dbapi.StandbyServiceAlias)}))
+		}
+	}
+	return allErrs
+}
+
+func (in *MSSQL) validateReplicas(spec *field.Path) field.ErrorList {
+	if in.Spec.Replicas == nil {
+		return nil
+	}
+
+	path := spec.Child("replicas")
+	replicas := *in.Spec.Replicas
+	switch {
+	case replicas < 1:
+		return field.ErrorList{field.Invalid(path, replicas, "must be at least 1, use spec.halted to stop the database")}
+	case replicas > MSSQLMaxReplicas:
+		return field.ErrorList{field.Invalid(path, replicas, fmt.Sprintf("must be at most %d", MSSQLMaxReplicas))}
+	case in.Spec.Edition == MSSQLEditionExpress && replicas > 1:
+		return field.ErrorList{field.Invalid(path, replicas,
+			fmt.Sprintf("%s edition doesn't support availability groups, must be 1", MSSQLEditionExpress))}
+	case in.Spec.Edition == MSSQLEditionStandard && replicas > MSSQLStandardEditionMaxReplicas:
+		return field.ErrorList{field.Invalid(path, replicas,
+			fmt.Sprintf("%s edition supports basic availability groups only, must be at most %d",
+				MSSQLEditionStandard, MSSQLStandardEditionMaxReplicas))}
+	}
+	return nil
+}
+
+// agDatabaseName matches the database names the operator accepts for an availability group
+var agDatabaseName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_@#$-]*$`)
+
+// validateTopology checks that the edition & the settings support the availability group.
+func (in *MSSQL) validateTopology(spec *field.Path) field.ErrorList {
+	ag := in.AvailabilityGroup()
+	if ag == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	agPath := spec.Child("topology", "availabilityGroup")
+	if in.Spec.Edition == MSSQLEditionExpress {
+		allErrs = append(allErrs, field.Forbidden(agPath,
+			fmt.Sprintf("%s edition doesn't support availability groups", MSSQLEditionExpress)))
+	}
+	if cfg := in.Spec.Configuration; cfg != nil && cfg.HADREnabled != nil && !*cfg.HADREnabled {
+		allErrs = append(allErrs, field.Invalid(spec.Child("configuration", "hadrEnabled"), *cfg.HADREnabled,
+			"must be enabled for the availability group"))
+	}
+	switch ag.ClusterType {
+	case "", MSSQLClusterTypeExternal, MSSQLClusterTypeNone:
+	default:
+		allErrs = append(allErrs, field.NotSupported(agPath.Child("clusterType"), ag.ClusterType,
+			[]string{string(MSSQLClusterTypeExternal), string(MSSQLClusterTypeNone)}))
+	}
+
+	if f := ag.Failover; f != nil && f.Automatic != nil && *f.Automatic &&
+		ag.ClusterType == MSSQLClusterTypeNone && !f.AllowDataLoss {
+		allErrs = append(allErrs, field.Invalid(agPath.Child("failover", "automatic"), *f.Automatic,
+			fmt.Sprintf("the %s cluster type can only fail over with allowDataLoss", MSSQLClusterTypeNone)))
+	}
+
+	if n := ag.RequiredSynchronizedSecondariesToCommit; n != nil && *n >= in.SynchronousReplicas() {
+		allErrs = append(allErrs, field.Invalid(agPath.Child("requiredSynchronizedSecondariesToCommit"), *n,
+			fmt.Sprintf("must be lower than the number of synchronous replicas, %d", in.SynchronousReplicas())))
+	}
+	replicaPath := agPath.Child("replicas")
+	replicaSeen := map[string]bool{}
+	for i, replica := range ag.Replicas {
+		switch {
+		case !in.isOrdinalName(replica.Name):
+			allErrs = append(allErrs, field.Invalid(replicaPath.Index(i).Child("name"), replica.Name,
+				"must be the name of a pod of the MSSQL"))
+		case replicaSeen[replica.Name]:
+			allErrs = append(allErrs, field.Duplicate(replicaPath.Index(i).Child("name"), replica.Name))
+		}
+		replicaSeen[replica.Name] = true
+		if in.Spec.Edition == MSSQLEditionStandard && replica.ReadableSecondary != "" && replica.ReadableSecondary != MSSQLReadableSecondaryNo {
+			allErrs = append(allErrs, field.Forbidden(replicaPath.Index(i).Child("readableSecondary"),
+				fmt.Sprintf("%s edition doesn't support readable secondaries", MSSQLEditionStandard)))
+		}
+	}
+
+	dbPath := agPath.Child("databases")
+	if in.Spec.Edition == MSSQLEditionStandard && len(ag.Databases) > 1 {
+		allErrs = append(allErrs, field.TooMany(dbPath, len(ag.Databases), 1))
+	}
+	seen := map[string]bool{}
+	for i, name := range ag.Databases {
+		lower := strings.ToLower(name)
+		switch {
+		case len(name) > 128 || !agDatabaseName.MatchString(name):
+			allErrs = append(allErrs, field.Invalid(dbPath.Index(i), name,
+				"must start with a letter or _ & contain only letters, digits & _@#$-, at most 128 characters"))
+		case lower == "master" || lower == "model" || lower == "msdb" || lower == "tempdb":
+			allErrs = append(allErrs, field.Invalid(dbPath.Index(i), name, "system databases can't be part of an availability group"))
+		case seen[lower]:
+			allErrs = append(allErrs, field.Duplicate(dbPath.Index(i), name))
+		}
+		seen[lower] = true
+	}
+	return allErrs
+}
+
+// isPodName tells whether name is the name of one of the pods of the statefulset.
+func (in *MSSQL) isPodName(name string) bool {
+	for i := int32(0); in.Spec.Replicas != nil && i < *in.Spec.Replicas; i++ {
+		if name == fmt.Sprintf("%s-%d", in.OffshootName(), i) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSynchronousReplica tells whether the pod is one of the SYNCHRONOUS_COMMIT replicas.
+func (in *MSSQL) isSynchronousReplica(name string) bool {
+	for i := int32(0); i < in.SynchronousReplicas(); i++ {
+		if name == fmt.Sprintf("%s-%d", in.OffshootName(), i) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOrdinalName tells whether the name is the one of a pod of the MSSQL, with any number of replicas. The
+// settings of a replica can outlive a scale down.
+func (in *MSSQL) isOrdinalName(name string) bool {
+	for i := 0; i < MSSQLMaxReplicas; i++ {
+		if name == fmt.Sprintf("%s-%d", in.OffshootName(), i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (in *MSSQL) validateStorage(spec *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	switch in.Spec.StorageType {
+	case dbapi.StorageTypeEphemeral:
+		if in.Spec.Storage != nil {
+			allErrs = append(allErrs, field.Forbidden(spec.Child("storage"),
+				fmt.Sprintf("must not be set when storageType is %s", dbapi.StorageTypeEphemeral)))
+		}
+	case "", dbapi.StorageTypeDurable:
+		if in.Spec.EphemeralStorage != nil {
+			allErrs = append(allErrs, field.Forbidden(spec.Child("ephemeralStorage"),
+				fmt.Sprintf("must not be set when storageType is %s", dbapi.StorageTypeDurable)))
+		}
+		if in.Spec.Storage == nil {
+			allErrs = append(allErrs, field.Required(spec.Child("storage"),
+				fmt.Sprintf("must be set when storageType is %s", dbapi.StorageTypeDurable)))
+		} else if _, ok := in.Spec.Storage.Resources.Requests[core.ResourceStorage]; !ok {
+			allErrs = append(allErrs, field.Required(spec.Child("storage", "resources", "requests", "storage"),
+				"size of the storage must be specified"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(spec.Child("storageType"), in.Spec.StorageType,
+			[]string{string(dbapi.StorageTypeDurable), string(dbapi.StorageTypeEphemeral)}))
+	}
+	return allErrs
+}
+
+func (in *MSSQL) validateResources(spec *field.Path) field.ErrorList {
+	if in.Spec.PodTemplate == nil {
+		return nil
+	}
+
+	minMemory := resource.MustParse(MSSQLMinMemory)
+	path := spec.Child("podTemplate", "spec", "resources", "limits", "memory")
+	memory, ok := in.Spec.PodTemplate.Spec.Resources.Limits[core.ResourceMemory]
+	if !ok {
+		return nil
+	}
+	if memory.Cmp(minMemory) < 0 {
+		return field.ErrorList{field.Invalid(path, memory.String(),
+			fmt.Sprintf("SQL Server requires at least %s of memory", MSSQLMinMemory))}
+	}
+	// the memory SQL Server allocates outside of memory.memorylimitmb needs room within the container limit
+	if limit := in.MemoryLimitMB(); limit != nil && *limit < MSSQLMinMemoryLimitMB {
+		headroom := in.memoryHeadroomPercent()
+		required := (MSSQLMinMemoryLimitMB*100 + 100 - headroom - 1) / (100 - headroom)
+		return field.ErrorList{field.Invalid(path, memory.String(),
+			fmt.Sprintf("leaves %d MB to SQL Server after the %d%% headroom, less than the %d MB it requires. "+
+				"Set it to at least %dMi, or set spec.configuration.memoryLimitMB", *limit, headroom, MSSQLMinMemoryLimitMB, required))}
+	}
+	return nil
+}
+
+// validateImmutableFields rejects changes to the fields that can't be changed once the database is provisioned.
+func (in *MSSQL) validateImmutableFields(old *MSSQL) field.ErrorList {
+	var allErrs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if storageType(old.Spec.StorageType) != storageType(in.Spec.StorageType) {
+		allErrs = append(allErrs, field.Forbidden(spec.Child("storageType"), "field is immutable"))
+	}
+	if !reflect.DeepEqual(storageClassName(old.Spec.Storage), storageClassName(in.Spec.Storage)) {
+		allErrs = append(allErrs, field.Forbidden(spec.Child("storage", "storageClassName"), "field is immutable"))
+	}
+	if old.Spec.AuthSecret != nil && old.Spec.AuthSecret.Name != "" &&
+		(in.Spec.AuthSecret == nil || in.Spec.AuthSecret.Name != old.Spec.AuthSecret.Name) {
+		allErrs = append(allErrs, field.Forbidden(spec.Child("authSecret", "name"), "field is immutable"))
+	}
+	if oldAG := old.AvailabilityGroup(); oldAG != nil {
+		agPath := spec.Child("topology", "availabilityGroup")
+		newAG := in.AvailabilityGroup()
+		switch {
+		case newAG == nil:
+			allErrs = append(allErrs, field.Forbidden(agPath, "the availability group can't be removed"))
+		case oldAG.Name != "" && newAG.Name != oldAG.Name:
+			allErrs = append(allErrs, field.Forbidden(agPath.Child("name"), "field is immutable"))
+		case oldAG.ClusterType != "" && newAG.ClusterType != oldAG.ClusterType:
+			allErrs = append(allErrs, field.Forbidden(agPath.Child("clusterType"), "field is immutable"))
+		}
+	}
+	// the collation is only applied when the instance is set up
+	if collation(old.Spec.Configuration) != collation(in.Spec.Configuration) {
+		allErrs = append(allErrs, field.Forbidden(spec.Child("configuration", "collation"), "field is immutable"))
+	}
+	return allErrs
+}
+
+func collation(cfg *MSSQLConfiguration) string {
+	if cfg == nil {
+		return ""
+	}
+	return cfg.Collation
+}
+
+func storageClassName(storage *core.PersistentVolumeClaimSpec) *string {
+	if storage == nil {
+		return nil
+	}
+	return storage.StorageClassName
+}
+
+// storageType treats an unset storageType as Durable, so that defaulting an object created
+// before the defaulting webhook doesn't count as a change.
+func storageType(st dbapi.StorageType) dbapi.StorageType {
+	if st == "" {
+		return dbapi.StorageTypeDurable
+	}
+	return st
+}
@@ -0,0 +1,714 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	ofst "kmodules.xyz/offshoot-api/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newValidator(t *testing.T) *MSSQLValidator {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	versions := []*MSSQLVersion{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "2019-cu18"},
+			Spec: MSSQLVersionSpec{
+				Version:           "2019-CU18",
+				UpdateConstraints: MSSQLUpdateConstraints{Allowlist: []string{"2019-cu20", "2022-cu5"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "2019-cu20"},
+			Spec: MSSQLVersionSpec{
+				Version:           "2019-CU20",
+				UpdateConstraints: MSSQLUpdateConstraints{Denylist: []string{"2019-cu18"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "2022-cu5"},
+			Spec:       MSSQLVersionSpec{Version: "2022-CU5"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "2017-cu31"},
+			Spec:       MSSQLVersionSpec{Version: "2017-CU31"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "2019-cu10"},
+			Spec:       MSSQLVersionSpec{Version: "2019-CU10", Deprecated: true},
+		},
+	}
+	if err := core.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	for _, v := range versions {
+		builder = builder.WithObjects(v)
+	}
+	// volumes holding init scripts
+	for name, mode := range map[string]core.PersistentVolumeAccessMode{"init-rwo": core.ReadWriteOnce, "init-rox": core.ReadOnlyMany} {
+		builder = builder.WithObjects(&core.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       core.PersistentVolumeClaimSpec{AccessModes: []core.PersistentVolumeAccessMode{mode}},
+		})
+	}
+	// mssql.conf files of spec.configSecret
+	for name, conf := range map[string]string{"config": "[memory]\nmemorylimitmb = 4096\n", "config-port": "[network]\ntcpport = 1500\n"} {
+		builder = builder.WithObjects(&core.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Data:       map[string][]byte{MSSQLConfigFileName: []byte(conf)},
+		})
+	}
+	return &MSSQLValidator{Client: builder.Build()}
+}
+
+func validMSSQL() *MSSQL {
+	return &MSSQL{
+		Spec: MSSQLSpec{
+			Version:     "2019-cu18",
+			Replicas:    pointer.Int32P(1),
+			Edition:     MSSQLEditionDeveloper,
+			StorageType: dbapi.StorageTypeDurable,
+			Storage: &core.PersistentVolumeClaimSpec{
+				StorageClassName: pointer.StringP("standard"),
+				Resources: core.ResourceRequirements{
+					Requests: core.ResourceList{core.ResourceStorage: resource.MustParse("1Gi")},
+				},
+			},
+		},
+	}
+}
+
+func initFromPVC(name string) *dbapi.InitSpec {
+	return &dbapi.InitSpec{Script: &dbapi.ScriptSourceSpec{VolumeSource: core.VolumeSource{
+		PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{ClaimName: name},
+	}}}
+}
+
+func TestValidateCreate(t *testing.T) {
+	cases := []struct {
+		name    string
+		mutate  func(db *MSSQL)
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			mutate: func(db *MSSQL) {},
+		},
+		{
+			name:    "durable without storage",
+			mutate:  func(db *MSSQL) { db.Spec.Storage = nil },
+			wantErr: true,
+		},
+		{
+			name:    "durable without storage size",
+			mutate:  func(db *MSSQL) { db.Spec.Storage.Resources.Requests = nil },
+			wantErr: true,
+		},
+		{
+			name: "ephemeral with storage",
+			mutate: func(db *MSSQL) {
+				db.Spec.StorageType = dbapi.StorageTypeEphemeral
+			},
+			wantErr: true,
+		},
+		{
+			name: "ephemeral",
+			mutate: func(db *MSSQL) {
+				db.Spec.StorageType = dbapi.StorageTypeEphemeral
+				db.Spec.Storage = nil
+			},
+		},
+		{
+			name: "express with 3 replicas",
+			mutate: func(db *MSSQL) {
+				db.Spec.Edition = MSSQLEditionExpress
+				db.Spec.Replicas = pointer.Int32P(3)
+			},
+			wantErr: true,
+		},
+		{
+			name: "standard with 2 replicas",
+			mutate: func(db *MSSQL) {
+				db.Spec.Edition = MSSQLEditionStandard
+				db.Spec.Replicas = pointer.Int32P(2)
+			},
+		},
+		{
+			name: "standard with 3 replicas",
+			mutate: func(db *MSSQL) {
+				db.Spec.Edition = MSSQLEditionStandard
+				db.Spec.Replicas = pointer.Int32P(3)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "too many replicas",
+			mutate:  func(db *MSSQL) { db.Spec.Replicas = pointer.Int32P(10) },
+			wantErr: true,
+		},
+		{
+			name: "memory below the minimum",
+			mutate: func(db *MSSQL) {
+				db.Spec.PodTemplate = &ofst.PodTemplateSpec{Spec: ofst.PodSpec{Resources: core.ResourceRequirements{
+					Limits: core.ResourceList{core.ResourceMemory: resource.MustParse("1Gi")},
+				}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "memory without headroom",
+			mutate: func(db *MSSQL) {
+				db.Spec.PodTemplate = &ofst.PodTemplateSpec{Spec: ofst.PodSpec{Resources: core.ResourceRequirements{
+					Limits: core.ResourceList{core.ResourceMemory: resource.MustParse("2Gi")},
+				}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "minimum memory with an explicit memory limit",
+			mutate: func(db *MSSQL) {
+				db.Spec.PodTemplate = &ofst.PodTemplateSpec{Spec: ofst.PodSpec{Resources: core.ResourceRequirements{
+					Limits: core.ResourceList{core.ResourceMemory: resource.MustParse("2Gi")},
+				}}}
+				db.Spec.Configuration = &MSSQLConfiguration{MemoryLimitMB: pointer.Int32P(MSSQLMinMemoryLimitMB)}
+			},
+		},
+		{
+			name: "default memory",
+			mutate: func(db *MSSQL) {
+				db.Spec.PodTemplate = &ofst.PodTemplateSpec{Spec: ofst.PodSpec{Resources: MSSQLDefaultResources}}
+			},
+		},
+		{
+			name:    "unknown sslMode",
+			mutate:  func(db *MSSQL) { db.Spec.SSLMode = "verify-full" },
+			wantErr: true,
+		},
+		{
+			name: "halted with DoNotTerminate",
+			mutate: func(db *MSSQL) {
+				db.Spec.Halted = true
+				db.Spec.TerminationPolicy = dbapi.TerminationPolicyDoNotTerminate
+			},
+			wantErr: true,
+		},
+		{
+			name: "init script from a configMap",
+			mutate: func(db *MSSQL) {
+				db.Spec.Init = &dbapi.InitSpec{Script: &dbapi.ScriptSourceSpec{VolumeSource: core.VolumeSource{
+					ConfigMap: &core.ConfigMapVolumeSource{LocalObjectReference: core.LocalObjectReference{Name: "init"}},
+				}}}
+			},
+		},
+		{
+			name: "init script from a ReadOnlyMany PVC",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Init = initFromPVC("init-rox")
+			},
+		},
+		{
+			name: "init script from a ReadWriteOnce PVC of a single replica",
+			mutate: func(db *MSSQL) {
+				db.Spec.Init = initFromPVC("init-rwo")
+			},
+		},
+		{
+			name: "init script from a ReadWriteOnce PVC of several replicas",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Init = initFromPVC("init-rwo")
+			},
+			wantErr: true,
+		},
+		{
+			name: "init script from a missing PVC",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Init = initFromPVC("missing")
+			},
+			wantErr: true,
+		},
+		{
+			name: "config secret",
+			mutate: func(db *MSSQL) {
+				db.Spec.ConfigSecret = &core.LocalObjectReference{Name: "config"}
+			},
+		},
+		{
+			name: "config secret setting the tcp port",
+			mutate: func(db *MSSQL) {
+				db.Spec.ConfigSecret = &core.LocalObjectReference{Name: "config-port"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "config secret created later",
+			mutate: func(db *MSSQL) {
+				db.Spec.ConfigSecret = &core.LocalObjectReference{Name: "missing"}
+			},
+		},
+		{
+			name: "init script without a source",
+			mutate: func(db *MSSQL) {
+				db.Spec.Init = &dbapi.InitSpec{Script: &dbapi.ScriptSourceSpec{}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "init script path outside the volume",
+			mutate: func(db *MSSQL) {
+				db.Spec.Init = &dbapi.InitSpec{Script: &dbapi.ScriptSourceSpec{
+					ScriptPath: "../etc",
+					VolumeSource: core.VolumeSource{
+						Secret: &core.SecretVolumeSource{SecretName: "init"},
+					},
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "configuration",
+			mutate: func(db *MSSQL) {
+				db.Spec.Configuration = &MSSQLConfiguration{TraceFlags: []int32{1222, 3226}, SQLAgentEnabled: pointer.BoolP(true)}
+			},
+		},
+		{
+			name: "memory limit above the container limit",
+			mutate: func(db *MSSQL) {
+				db.Spec.PodTemplate = &ofst.PodTemplateSpec{Spec: ofst.PodSpec{Resources: core.ResourceRequirements{
+					Limits: core.ResourceList{core.ResourceMemory: resource.MustParse("4Gi")},
+				}}}
+				db.Spec.Configuration = &MSSQLConfiguration{MemoryLimitMB: pointer.Int32P(5000)}
+			},
+			wantErr: true,
+		},
+		{
+			name: "custom ports",
+			mutate: func(db *MSSQL) {
+				db.Spec.Port = pointer.Int32P(11433)
+				db.Spec.Endpoints = &MSSQLEndpoints{
+					Mirroring:       &MSSQLEndpoint{},
+					AdminConnection: &MSSQLEndpoint{Port: pointer.Int32P(11434)},
+				}
+			},
+		},
+		{
+			name: "mirroring on the database port",
+			mutate: func(db *MSSQL) {
+				db.Spec.Endpoints = &MSSQLEndpoints{Mirroring: &MSSQLEndpoint{Port: pointer.Int32P(1433)}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "database listening on the admin connection port",
+			mutate: func(db *MSSQL) {
+				db.Spec.Configuration = &MSSQLConfiguration{TCPPort: pointer.Int32P(MSSQLAdminPort)}
+				db.Spec.Endpoints = &MSSQLEndpoints{AdminConnection: &MSSQLEndpoint{Port: pointer.Int32P(11434)}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "tls",
+			mutate: func(db *MSSQL) {
+				db.Spec.SSLMode = MSSQLSSLModeAllowSSL
+				db.Spec.TLS = &kmapi.TLSConfig{IssuerRef: &core.TypedLocalObjectReference{
+					APIGroup: pointer.StringP(CertManagerGroup), Kind: CertManagerClusterIssuerKind, Name: "ca",
+				}}
+			},
+		},
+		{
+			name: "tls without an issuer",
+			mutate: func(db *MSSQL) {
+				db.Spec.TLS = &kmapi.TLSConfig{}
+			},
+			wantErr: true,
+		},
+		{
+			name: "tls with sslMode disabled",
+			mutate: func(db *MSSQL) {
+				db.Spec.SSLMode = MSSQLSSLModeDisabled
+				db.Spec.TLS = &kmapi.TLSConfig{IssuerRef: &core.TypedLocalObjectReference{
+					APIGroup: pointer.StringP(CertManagerGroup), Kind: CertManagerIssuerKind, Name: "ca",
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "forceEncryption without requireSSL",
+			mutate: func(db *MSSQL) {
+				db.Spec.SSLMode = MSSQLSSLModeAllowSSL
+				db.Spec.Configuration = &MSSQLConfiguration{ForceEncryption: pointer.BoolP(true)}
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative trace flag",
+			mutate: func(db *MSSQL) {
+				db.Spec.Configuration = &MSSQLConfiguration{TraceFlags: []int32{-1}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate trace flag",
+			mutate: func(db *MSSQL) {
+				db.Spec.Configuration = &MSSQLConfiguration{TraceFlags: []int32{1222, 1222}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "availability group",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					ClusterType: MSSQLClusterTypeNone,
+					Databases:   []string{"app", "audit_log"},
+				}}
+			},
+		},
+		{
+			name: "availability group on express",
+			mutate: func(db *MSSQL) {
+				db.Spec.Edition = MSSQLEditionExpress
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "availability group without hadr",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+				db.Spec.Configuration = &MSSQLConfiguration{HADREnabled: pointer.FalseP()}
+			},
+			wantErr: true,
+		},
+		{
+			name: "basic availability group with 2 databases",
+			mutate: func(db *MSSQL) {
+				db.Spec.Edition = MSSQLEditionStandard
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{Databases: []string{"app", "audit"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "system database in the availability group",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{Databases: []string{"MSDB"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid database name in the availability group",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{Databases: []string{"app]; DROP"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "automatic failover without a cluster manager",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					ClusterType: MSSQLClusterTypeNone,
+					Failover:    &MSSQLFailoverSpec{Automatic: pointer.TrueP()},
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "forced automatic failover without a cluster manager",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					ClusterType: MSSQLClusterTypeNone,
+					Failover:    &MSSQLFailoverSpec{Automatic: pointer.TrueP(), AllowDataLoss: true},
+				}}
+			},
+		},
+		{
+			name: "switchover",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+				db.Annotations = map[string]string{MSSQLSwitchoverAnnotation: db.OffshootName() + "-2"}
+			},
+		},
+		{
+			name: "switchover to an asynchronous replica",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{SynchronousReplicas: pointer.Int32P(2)}}
+				db.Annotations = map[string]string{MSSQLSwitchoverAnnotation: db.OffshootName() + "-2"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "synchronous pair & asynchronous replica",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					SynchronousReplicas:                     pointer.Int32P(2),
+					RequiredSynchronizedSecondariesToCommit: pointer.Int32P(1),
+					Replicas: []MSSQLAvailabilityReplicaSpec{
+						{Name: db.OffshootName() + "-2", BackupPriority: pointer.Int32P(100), ReadableSecondary: MSSQLReadableSecondaryAll},
+					},
+				}}
+			},
+		},
+		{
+			name: "more synchronized secondaries required than there are",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					SynchronousReplicas:                     pointer.Int32P(2),
+					RequiredSynchronizedSecondariesToCommit: pointer.Int32P(2),
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "configuration of an unknown replica",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					Replicas: []MSSQLAvailabilityReplicaSpec{{Name: "other-0"}},
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate replica configuration",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					Replicas: []MSSQLAvailabilityReplicaSpec{{Name: db.OffshootName() + "-1"}, {Name: db.OffshootName() + "-1"}},
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "readable secondary with the Standard edition",
+			mutate: func(db *MSSQL) {
+				db.Spec.Edition = MSSQLEditionStandard
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+					Replicas: []MSSQLAvailabilityReplicaSpec{{Name: db.OffshootName() + "-1", ReadableSecondary: MSSQLReadableSecondaryReadOnly}},
+				}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "switchover to an unknown pod",
+			mutate: func(db *MSSQL) {
+				db.Spec.Replicas = pointer.Int32P(3)
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+				db.Annotations = map[string]string{MSSQLSwitchoverAnnotation: db.OffshootName() + "-3"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "switchover without an availability group",
+			mutate: func(db *MSSQL) {
+				db.Annotations = map[string]string{MSSQLSwitchoverAnnotation: db.OffshootName() + "-0"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "standby service template",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+				db.Spec.ServiceTemplates = []dbapi.NamedServiceTemplateSpec{
+					{Alias: dbapi.PrimaryServiceAlias},
+					{Alias: dbapi.StandbyServiceAlias},
+				}
+			},
+		},
+		{
+			name: "standby service template without an availability group",
+			mutate: func(db *MSSQL) {
+				db.Spec.ServiceTemplates = []dbapi.NamedServiceTemplateSpec{{Alias: dbapi.StandbyServiceAlias}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown service template",
+			mutate: func(db *MSSQL) {
+				db.Spec.ServiceTemplates = []dbapi.NamedServiceTemplateSpec{{Alias: dbapi.StatsServiceAlias}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown version",
+			mutate:  func(db *MSSQL) { db.Spec.Version = "mcr.microsoft.com/mssql/server:2019-latest" },
+			wantErr: true,
+		},
+		{
+			name:    "deprecated version",
+			mutate:  func(db *MSSQL) { db.Spec.Version = "2019-cu10" },
+			wantErr: true,
+		},
+	}
+
+	v := newValidator(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := validMSSQL()
+			c.mutate(db)
+			if err := v.ValidateCreate(context.TODO(), db); (err != nil) != c.wantErr {
+				t.Errorf("ValidateCreate() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	cases := []struct {
+		name    string
+		mutate  func(db *MSSQL)
+		wantErr bool
+	}{
+		{
+			name:   "scale up",
+			mutate: func(db *MSSQL) { db.Spec.Replicas = pointer.Int32P(3) },
+		},
+		{
+			name: "change storageType",
+			mutate: func(db *MSSQL) {
+				db.Spec.StorageType = dbapi.StorageTypeEphemeral
+				db.Spec.Storage = nil
+			},
+			wantErr: true,
+		},
+		{
+			name:    "change storage class",
+			mutate:  func(db *MSSQL) { db.Spec.Storage.StorageClassName = pointer.StringP("fast") },
+			wantErr: true,
+		},
+		{
+			name: "change trace flags",
+			mutate: func(db *MSSQL) {
+				db.Spec.Configuration = &MSSQLConfiguration{TraceFlags: []int32{1222}}
+			},
+		},
+		{
+			name: "change collation",
+			mutate: func(db *MSSQL) {
+				db.Spec.Configuration = &MSSQLConfiguration{Collation: "Latin1_General_100_CI_AS_SC_UTF8"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "add an availability group",
+			mutate: func(db *MSSQL) {
+				db.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{}}
+			},
+		},
+		{
+			name:   "allowed version update",
+			mutate: func(db *MSSQL) { db.Spec.Version = "2022-cu5" },
+		},
+		{
+			name:    "version update not in the allowlist",
+			mutate:  func(db *MSSQL) { db.Spec.Version = "2017-cu31" },
+			wantErr: true,
+		},
+		{
+			name: "invalid change while being deleted",
+			mutate: func(db *MSSQL) {
+				db.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+				db.Spec.Storage.StorageClassName = pointer.StringP("fast")
+			},
+		},
+	}
+
+	v := newValidator(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := validMSSQL()
+			db := validMSSQL()
+			c.mutate(db)
+			if err := v.ValidateUpdate(context.TODO(), old, db); (err != nil) != c.wantErr {
+				t.Errorf("ValidateUpdate() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateAvailabilityGroup(t *testing.T) {
+	cases := []struct {
+		name    string
+		mutate  func(db *MSSQL)
+		wantErr bool
+	}{
+		{
+			name:   "add a database",
+			mutate: func(db *MSSQL) { db.Spec.Topology.AvailabilityGroup.Databases = []string{"app"} },
+		},
+		{
+			name:    "rename",
+			mutate:  func(db *MSSQL) { db.Spec.Topology.AvailabilityGroup.Name = "ag2" },
+			wantErr: true,
+		},
+		{
+			name:    "change cluster type",
+			mutate:  func(db *MSSQL) { db.Spec.Topology.AvailabilityGroup.ClusterType = MSSQLClusterTypeNone },
+			wantErr: true,
+		},
+		{
+			name:    "remove",
+			mutate:  func(db *MSSQL) { db.Spec.Topology = nil },
+			wantErr: true,
+		},
+	}
+
+	v := newValidator(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := validMSSQL()
+			old.Spec.Topology = &MSSQLTopology{AvailabilityGroup: &MSSQLAvailabilityGroupSpec{
+				Name:        "ag1",
+				ClusterType: MSSQLClusterTypeExternal,
+			}}
+			db := old.DeepCopy()
+			c.mutate(db)
+			if err := v.ValidateUpdate(context.TODO(), old, db); (err != nil) != c.wantErr {
+				t.Errorf("ValidateUpdate() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDelete(t *testing.T) {
+	v := newValidator(t)
+	db := validMSSQL()
+	if err := v.ValidateDelete(context.TODO(), db); err != nil {
+		t.Errorf("ValidateDelete() error = %v", err)
+	}
+	db.Spec.TerminationPolicy = dbapi.TerminationPolicyDoNotTerminate
+	if err := v.ValidateDelete(context.TODO(), db); err == nil {
+		t.Error("ValidateDelete() expected an error for DoNotTerminate")
+	}
+}
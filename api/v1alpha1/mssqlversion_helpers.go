@@ -0,0 +1,61 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"kubedb.dev/apimachinery/apis/kubedb"
+)
+
+func (in MSSQLVersion) ResourceShortCode() string {
+	return ResourceCodeMSSQLVersion
+}
+
+func (in MSSQLVersion) ResourceKind() string {
+	return ResourceKindMSSQLVersion
+}
+
+func (in MSSQLVersion) ResourceSingular() string {
+	return ResourceSingularMSSQLVersion
+}
+
+func (in MSSQLVersion) ResourcePlural() string {
+	return ResourcePluralMSSQLVersion
+}
+
+func (in MSSQLVersion) ResourceFQN() string {
+	return fmt.Sprintf("%s.%s", in.ResourcePlural(), kubedb.GroupName)
+}
+
+// IsUpdateAllowed reports whether a MSSQL running this version may be updated to the MSSQLVersion named target.
+// The denylist takes precedence over the allowlist, an empty allowlist accepts every version.
+func (in MSSQLVersion) IsUpdateAllowed(target string) bool {
+	for _, v := range in.Spec.UpdateConstraints.Denylist {
+		if v == target {
+			return false
+		}
+	}
+	if len(in.Spec.UpdateConstraints.Allowlist) == 0 {
+		return true
+	}
+	for _, v := range in.Spec.UpdateConstraints.Allowlist {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
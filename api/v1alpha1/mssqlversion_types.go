@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ResourceCodeMSSQLVersion     = "msversion"
+	ResourceKindMSSQLVersion     = "MSSQLVersion"
+	ResourceSingularMSSQLVersion = "mssqlversion"
+	ResourcePluralMSSQLVersion   = "mssqlversions"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=mssqlversions,singular=mssqlversion,scope=Cluster,shortName=msversion,categories={datastore,kubedb,appscode}
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".spec.version"
+// +kubebuilder:printcolumn:name="DB_IMAGE",type="string",JSONPath=".spec.db.image"
+// +kubebuilder:printcolumn:name="Deprecated",type="boolean",JSONPath=".spec.deprecated"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MSSQLVersion defines a MSSQL database version. The name of the object is referred by spec.version of a MSSQL.
+type MSSQLVersion struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MSSQLVersionSpec `json:"spec,omitempty"`
+}
+
+// MSSQLVersionSpec is the spec for MSSQL version
+type MSSQLVersionSpec struct {
+	// Version of SQL Server, i.e. 2019-CU18
+	Version string `json:"version"`
+	// Database Image
+	DB MSSQLVersionDatabase `json:"db"`
+	// Init container Image
+	InitContainer MSSQLVersionInitContainer `json:"initContainer"`
+	// Exporter Image
+	// +optional
+	Exporter MSSQLVersionExporter `json:"exporter,omitempty"`
+	// Coordinator Image
+	// +optional
+	Coordinator MSSQLVersionCoordinator `json:"coordinator,omitempty"`
+	// Deprecated versions usable but regarded as obsolete and best avoided, typically due to having been superseded.
+	// +optional
+	Deprecated bool `json:"deprecated,omitempty"`
+	// UpdateConstraints specifies the versions a MSSQL of this version may be updated to
+	// +optional
+	UpdateConstraints MSSQLUpdateConstraints `json:"updateConstraints,omitempty"`
+}
+
+// MSSQLVersionDatabase is the MSSQL Database image
+type MSSQLVersionDatabase struct {
+	Image string `json:"image"`
+}
+
+// MSSQLVersionInitContainer is the MSSQL Container initializer
+type MSSQLVersionInitContainer struct {
+	Image string `json:"image"`
+}
+
+// MSSQLVersionExporter is the image for the MSSQL exporter
+type MSSQLVersionExporter struct {
+	Image string `json:"image"`
+}
+
+// MSSQLVersionCoordinator is the image for coordinator
+type MSSQLVersionCoordinator struct {
+	Image string `json:"image"`
+}
+
+type MSSQLUpdateConstraints struct {
+	// List of the MSSQLVersion names accepted for an update. Empty indicates all accepted
+	// +optional
+	Allowlist []string `json:"allowlist,omitempty"`
+	// List of the MSSQLVersion names rejected for an update
+	// +optional
+	Denylist []string `json:"denylist,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MSSQLVersionList contains a list of MSSQLVersion
+type MSSQLVersionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MSSQLVersion `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MSSQLVersion{}, &MSSQLVersionList{})
+}
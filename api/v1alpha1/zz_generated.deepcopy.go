@@ -22,9 +22,11 @@ limitations under the License.
 package v1alpha1
 
 import (
-	"k8s.io/api/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
-	apiv1 "kmodules.xyz/monitoring-agent-api/api/v1"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	monitoring_agent_apiapiv1 "kmodules.xyz/monitoring-agent-api/api/v1"
 	offshoot_apiapiv1 "kmodules.xyz/offshoot-api/api/v1"
 	"kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
 )
@@ -35,7 +37,7 @@ func (in *MSSQL) DeepCopyInto(out *MSSQL) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQL.
@@ -56,6 +58,321 @@ func (in *MSSQL) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLAvailabilityGroupSpec) DeepCopyInto(out *MSSQLAvailabilityGroupSpec) {
+	*out = *in
+	if in.Databases != nil {
+		in, out := &in.Databases, &out.Databases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Failover != nil {
+		in, out := &in.Failover, &out.Failover
+		*out = new(MSSQLFailoverSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SynchronousReplicas != nil {
+		in, out := &in.SynchronousReplicas, &out.SynchronousReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RequiredSynchronizedSecondariesToCommit != nil {
+		in, out := &in.RequiredSynchronizedSecondariesToCommit, &out.RequiredSynchronizedSecondariesToCommit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = make([]MSSQLAvailabilityReplicaSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLAvailabilityGroupSpec.
+func (in *MSSQLAvailabilityGroupSpec) DeepCopy() *MSSQLAvailabilityGroupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLAvailabilityGroupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLAvailabilityGroupStatus) DeepCopyInto(out *MSSQLAvailabilityGroupStatus) {
+	*out = *in
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Databases != nil {
+		in, out := &in.Databases, &out.Databases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PrimaryUnreachableSince != nil {
+		in, out := &in.PrimaryUnreachableSince, &out.PrimaryUnreachableSince
+		*out = (*in).DeepCopy()
+	}
+	if in.LastFailover != nil {
+		in, out := &in.LastFailover, &out.LastFailover
+		*out = new(MSSQLFailoverStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PrimaryServicePause != nil {
+		in, out := &in.PrimaryServicePause, &out.PrimaryServicePause
+		*out = new(MSSQLServicePause)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLAvailabilityGroupStatus.
+func (in *MSSQLAvailabilityGroupStatus) DeepCopy() *MSSQLAvailabilityGroupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLAvailabilityGroupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLAvailabilityReplicaSpec) DeepCopyInto(out *MSSQLAvailabilityReplicaSpec) {
+	*out = *in
+	if in.BackupPriority != nil {
+		in, out := &in.BackupPriority, &out.BackupPriority
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLAvailabilityReplicaSpec.
+func (in *MSSQLAvailabilityReplicaSpec) DeepCopy() *MSSQLAvailabilityReplicaSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLAvailabilityReplicaSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLCertificateStatus) DeepCopyInto(out *MSSQLCertificateStatus) {
+	*out = *in
+	if in.NotBefore != nil {
+		in, out := &in.NotBefore, &out.NotBefore
+		*out = (*in).DeepCopy()
+	}
+	if in.NotAfter != nil {
+		in, out := &in.NotAfter, &out.NotAfter
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLCertificateStatus.
+func (in *MSSQLCertificateStatus) DeepCopy() *MSSQLCertificateStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLCertificateStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLConfiguration) DeepCopyInto(out *MSSQLConfiguration) {
+	*out = *in
+	if in.MemoryLimitMB != nil {
+		in, out := &in.MemoryLimitMB, &out.MemoryLimitMB
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MemoryHeadroomPercent != nil {
+		in, out := &in.MemoryHeadroomPercent, &out.MemoryHeadroomPercent
+		*out = new(int32)
+		**out = **in
+	}
+	if in.LCID != nil {
+		in, out := &in.LCID, &out.LCID
+		*out = new(int32)
+		**out = **in
+	}
+	if in.SQLAgentEnabled != nil {
+		in, out := &in.SQLAgentEnabled, &out.SQLAgentEnabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.TraceFlags != nil {
+		in, out := &in.TraceFlags, &out.TraceFlags
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.TCPPort != nil {
+		in, out := &in.TCPPort, &out.TCPPort
+		*out = new(int32)
+		**out = **in
+	}
+	if in.NumErrorLogs != nil {
+		in, out := &in.NumErrorLogs, &out.NumErrorLogs
+		*out = new(int32)
+		**out = **in
+	}
+	if in.HADREnabled != nil {
+		in, out := &in.HADREnabled, &out.HADREnabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ForceEncryption != nil {
+		in, out := &in.ForceEncryption, &out.ForceEncryption
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLConfiguration.
+func (in *MSSQLConfiguration) DeepCopy() *MSSQLConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLConfigurationStatus) DeepCopyInto(out *MSSQLConfigurationStatus) {
+	*out = *in
+	if in.Settings != nil {
+		in, out := &in.Settings, &out.Settings
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PendingRestart != nil {
+		in, out := &in.PendingRestart, &out.PendingRestart
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PendingSince != nil {
+		in, out := &in.PendingSince, &out.PendingSince
+		*out = (*in).DeepCopy()
+	}
+	if in.AppliedLive != nil {
+		in, out := &in.AppliedLive, &out.AppliedLive
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLConfigurationStatus.
+func (in *MSSQLConfigurationStatus) DeepCopy() *MSSQLConfigurationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLConfigurationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLEndpoint) DeepCopyInto(out *MSSQLEndpoint) {
+	*out = *in
+	if in.Port != nil {
+		in, out := &in.Port, &out.Port
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLEndpoint.
+func (in *MSSQLEndpoint) DeepCopy() *MSSQLEndpoint {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLEndpoint)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLEndpoints) DeepCopyInto(out *MSSQLEndpoints) {
+	*out = *in
+	if in.Mirroring != nil {
+		in, out := &in.Mirroring, &out.Mirroring
+		*out = new(MSSQLEndpoint)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AdminConnection != nil {
+		in, out := &in.AdminConnection, &out.AdminConnection
+		*out = new(MSSQLEndpoint)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLEndpoints.
+func (in *MSSQLEndpoints) DeepCopy() *MSSQLEndpoints {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLEndpoints)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLFailoverSpec) DeepCopyInto(out *MSSQLFailoverSpec) {
+	*out = *in
+	if in.Automatic != nil {
+		in, out := &in.Automatic, &out.Automatic
+		*out = new(bool)
+		**out = **in
+	}
+	if in.PrimaryTimeoutSeconds != nil {
+		in, out := &in.PrimaryTimeoutSeconds, &out.PrimaryTimeoutSeconds
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLFailoverSpec.
+func (in *MSSQLFailoverSpec) DeepCopy() *MSSQLFailoverSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLFailoverSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLFailoverStatus) DeepCopyInto(out *MSSQLFailoverStatus) {
+	*out = *in
+	if in.DetectedAt != nil {
+		in, out := &in.DetectedAt, &out.DetectedAt
+		*out = (*in).DeepCopy()
+	}
+	in.CompletedAt.DeepCopyInto(&out.CompletedAt)
+	if in.Duration != nil {
+		in, out := &in.Duration, &out.Duration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLFailoverStatus.
+func (in *MSSQLFailoverStatus) DeepCopy() *MSSQLFailoverStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLFailoverStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MSSQLList) DeepCopyInto(out *MSSQLList) {
 	*out = *in
@@ -88,6 +405,22 @@ func (in *MSSQLList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLServicePause) DeepCopyInto(out *MSSQLServicePause) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLServicePause.
+func (in *MSSQLServicePause) DeepCopy() *MSSQLServicePause {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLServicePause)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MSSQLSpec) DeepCopyInto(out *MSSQLSpec) {
 	*out = *in
@@ -98,17 +431,37 @@ func (in *MSSQLSpec) DeepCopyInto(out *MSSQLSpec) {
 	}
 	if in.Storage != nil {
 		in, out := &in.Storage, &out.Storage
-		*out = new(v1.PersistentVolumeClaimSpec)
+		*out = new(corev1.PersistentVolumeClaimSpec)
 		(*in).DeepCopyInto(*out)
 	}
 	if in.EphemeralStorage != nil {
 		in, out := &in.EphemeralStorage, &out.EphemeralStorage
-		*out = new(v1.EmptyDirVolumeSource)
+		*out = new(corev1.EmptyDirVolumeSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Port != nil {
+		in, out := &in.Port, &out.Port
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Topology != nil {
+		in, out := &in.Topology, &out.Topology
+		*out = new(MSSQLTopology)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Endpoints != nil {
+		in, out := &in.Endpoints, &out.Endpoints
+		*out = new(MSSQLEndpoints)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(apiv1.TLSConfig)
 		(*in).DeepCopyInto(*out)
 	}
 	if in.Monitor != nil {
 		in, out := &in.Monitor, &out.Monitor
-		*out = new(apiv1.AgentSpec)
+		*out = new(monitoring_agent_apiapiv1.AgentSpec)
 		(*in).DeepCopyInto(*out)
 	}
 	if in.AuthSecret != nil {
@@ -118,14 +471,24 @@ func (in *MSSQLSpec) DeepCopyInto(out *MSSQLSpec) {
 	}
 	if in.ConfigSecret != nil {
 		in, out := &in.ConfigSecret, &out.ConfigSecret
-		*out = new(v1.LocalObjectReference)
+		*out = new(corev1.LocalObjectReference)
 		**out = **in
 	}
+	if in.Configuration != nil {
+		in, out := &in.Configuration, &out.Configuration
+		*out = new(MSSQLConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.PodTemplate != nil {
 		in, out := &in.PodTemplate, &out.PodTemplate
 		*out = new(offshoot_apiapiv1.PodTemplateSpec)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Init != nil {
+		in, out := &in.Init, &out.Init
+		*out = new(v1alpha2.InitSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ServiceTemplates != nil {
 		in, out := &in.ServiceTemplates, &out.ServiceTemplates
 		*out = make([]v1alpha2.NamedServiceTemplateSpec, len(*in))
@@ -149,6 +512,35 @@ func (in *MSSQLSpec) DeepCopy() *MSSQLSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MSSQLStatus) DeepCopyInto(out *MSSQLStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]apiv1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.InitScripts != nil {
+		in, out := &in.InitScripts, &out.InitScripts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Configuration != nil {
+		in, out := &in.Configuration, &out.Configuration
+		*out = new(MSSQLConfigurationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Certificates != nil {
+		in, out := &in.Certificates, &out.Certificates
+		*out = make([]MSSQLCertificateStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.AvailabilityGroup != nil {
+		in, out := &in.AvailabilityGroup, &out.AvailabilityGroup
+		*out = new(MSSQLAvailabilityGroupStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLStatus.
@@ -160,3 +552,186 @@ func (in *MSSQLStatus) DeepCopy() *MSSQLStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLTopology) DeepCopyInto(out *MSSQLTopology) {
+	*out = *in
+	if in.AvailabilityGroup != nil {
+		in, out := &in.AvailabilityGroup, &out.AvailabilityGroup
+		*out = new(MSSQLAvailabilityGroupSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLTopology.
+func (in *MSSQLTopology) DeepCopy() *MSSQLTopology {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLTopology)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLUpdateConstraints) DeepCopyInto(out *MSSQLUpdateConstraints) {
+	*out = *in
+	if in.Allowlist != nil {
+		in, out := &in.Allowlist, &out.Allowlist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Denylist != nil {
+		in, out := &in.Denylist, &out.Denylist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLUpdateConstraints.
+func (in *MSSQLUpdateConstraints) DeepCopy() *MSSQLUpdateConstraints {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLUpdateConstraints)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersion) DeepCopyInto(out *MSSQLVersion) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersion.
+func (in *MSSQLVersion) DeepCopy() *MSSQLVersion {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersion)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *MSSQLVersion) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersionCoordinator) DeepCopyInto(out *MSSQLVersionCoordinator) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersionCoordinator.
+func (in *MSSQLVersionCoordinator) DeepCopy() *MSSQLVersionCoordinator {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersionCoordinator)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersionDatabase) DeepCopyInto(out *MSSQLVersionDatabase) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersionDatabase.
+func (in *MSSQLVersionDatabase) DeepCopy() *MSSQLVersionDatabase {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersionDatabase)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersionExporter) DeepCopyInto(out *MSSQLVersionExporter) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersionExporter.
+func (in *MSSQLVersionExporter) DeepCopy() *MSSQLVersionExporter {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersionExporter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersionInitContainer) DeepCopyInto(out *MSSQLVersionInitContainer) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersionInitContainer.
+func (in *MSSQLVersionInitContainer) DeepCopy() *MSSQLVersionInitContainer {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersionInitContainer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersionList) DeepCopyInto(out *MSSQLVersionList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]MSSQLVersion, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersionList.
+func (in *MSSQLVersionList) DeepCopy() *MSSQLVersionList {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersionList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *MSSQLVersionList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MSSQLVersionSpec) DeepCopyInto(out *MSSQLVersionSpec) {
+	*out = *in
+	out.DB = in.DB
+	out.InitContainer = in.InitContainer
+	out.Exporter = in.Exporter
+	out.Coordinator = in.Coordinator
+	in.UpdateConstraints.DeepCopyInto(&out.UpdateConstraints)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MSSQLVersionSpec.
+func (in *MSSQLVersionSpec) DeepCopy() *MSSQLVersionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MSSQLVersionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command coordinator is the sidecar of the pods of a MSSQL with an availability group. It keeps the role label
+// of its pod in line with the role of the local replica & serves the role & the health of the instance.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/coordinator"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+func main() {
+	var opts coordinator.Options
+	var listenAddr, sslMode, caFile string
+	var port int
+	var clusterType string
+	flag.StringVar(&opts.AvailabilityGroup, "availability-group", "", "The name of the availability group.")
+	flag.StringVar(&clusterType, "cluster-type", string(msapi.MSSQLClusterTypeExternal), "The cluster type of the availability group.")
+	flag.StringVar(&opts.Lease, "lease", "", "The name of the primary lease, the primary replica is fenced when its pod doesn't hold it.")
+	flag.IntVar(&port, "port", msapi.MSSQLDatabasePort, "The port SQL Server listens on.")
+	flag.StringVar(&sslMode, "ssl-mode", string(msapi.MSSQLSSLModeDisabled), "The sslMode of the MSSQL.")
+	flag.StringVar(&caFile, "ca-file", "", "The CA the certificate of the local instance is verified against, the system roots by default.")
+	flag.StringVar(&listenAddr, "listen-address", fmt.Sprintf(":%d", msapi.MSSQLCoordinatorPort), "The address the role & health endpoints bind to.")
+	flag.DurationVar(&opts.Interval, "interval", 5*time.Second, "The interval between two checks of the local instance.")
+	zapOpts := zap.Options{}
+	zapOpts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&zapOpts)))
+	log := ctrl.Log.WithName("coordinator")
+
+	opts.ClusterType = msapi.MSSQLClusterType(clusterType)
+	opts.PodName = os.Getenv("POD_NAME")
+	opts.Namespace = os.Getenv("POD_NAMESPACE")
+	if opts.PodName == "" || opts.Namespace == "" || opts.AvailabilityGroup == "" {
+		log.Error(errors.New("missing configuration"), "POD_NAME, POD_NAMESPACE & --availability-group are required")
+		os.Exit(1)
+	}
+
+	kc, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: clientgoscheme.Scheme})
+	if err != nil {
+		log.Error(err, "unable to create the kubernetes client")
+		os.Exit(1)
+	}
+	var ca []byte
+	if caFile != "" {
+		// issuers that don't provide their CA leave it out of the certificate secret
+		if ca, err = os.ReadFile(caFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error(err, "unable to read the CA", "file", caFile)
+			os.Exit(1)
+		}
+	}
+	// the server certificate names localhost, for the local clients
+	sql, err := sqlclient.NewClient("127.0.0.1", "localhost", int32(port), os.Getenv("MSSQL_SA_USERNAME"), os.Getenv("MSSQL_SA_PASSWORD"),
+		msapi.MSSQLSSLMode(sslMode), ca, sqlclient.Options{})
+	if err != nil {
+		log.Error(err, "unable to create the SQL client")
+		os.Exit(1)
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+	c := coordinator.New(kc, sql, opts, log)
+	srv := &http.Server{Addr: listenAddr, Handler: c.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go c.Run(ctx)
+
+	log.Info("starting coordinator", "pod", opts.PodName, "availabilityGroup", opts.AvailabilityGroup, "lease", opts.Lease)
+	if err = srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error(err, "problem running the coordinator")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,524 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	passgen "gomodules.xyz/password-generator"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// agEndpointName is the name of the mirroring endpoint, of the certificate it authenticates with & of the login
+	// the certificate belongs to. The same certificate is created on every instance, so that they trust each other
+	// without a domain.
+	agEndpointName = "kubedb_hadr"
+
+	// the keys of the endpoint secret
+	endpointMasterKeyPasswordKey = "master-key-password"
+	endpointLoginPasswordKey     = "login-password"
+	endpointCertPasswordKey      = "certificate-password"
+	endpointCertKey              = "endpoint.cer"
+	endpointPrivateKeyKey        = "endpoint.pvk"
+
+	mirroringEndpointQuery   = "SELECT CAST(port AS int) AS port FROM sys.tcp_endpoints WHERE name = @p1"
+	endpointCertificateQuery = "SELECT CERTENCODED(CERT_ID(@p1)) AS certificate, CERTPRIVATEKEY(CERT_ID(@p1), @p2) AS private_key"
+	agReplicasQuery          = "SELECT ar.replica_server_name AS name FROM sys.availability_replicas ar " +
+		"JOIN sys.availability_groups ag ON ag.group_id = ar.group_id WHERE ag.name = @p1"
+	agDatabasesQuery = "SELECT adc.database_name AS name FROM sys.availability_databases_cluster adc " +
+		"JOIN sys.availability_groups ag ON ag.group_id = adc.group_id WHERE ag.name = @p1"
+)
+
+// ensureAvailabilityGroup builds the availability group of spec.topology.availabilityGroup once the instances accept
+// connections. The mirroring endpoint is created on every instance, the availability group on the first one, then
+// the other instances join it as secondaries, the databases are added, the replicas are configured as declared, see
+// ensureReplicaConfiguration, & read-only connections are routed to the readable secondaries, see
+// ensureReadOnlyRouting. The coordinators label the pods with their role, so that the primary & standby services
+// select the primary & secondary replicas. The steps are idempotent & continue on the next reconcile when an
+// instance isn't there yet. An unreachable instance is skipped & reported, the others are managed meanwhile. A lost
+// primary is failed over first, see ensureFailover. A switchover requested through the annotation is done once the
+// primary is known, see ensureSwitchover, & the primary service resumes once it selects the new primary, see
+// ensurePrimaryServiceResumed. The primary is also switched over before a certificate rollout restarts it, see
+// ensureRolloutSwitchover. When spec.replicas is lowered, the primary is switched over to a replica that is
+// kept, the replicas scaled away are removed from the availability group, & only then is the StatefulSet scaled
+// down, see instanceCount.
+func (r *reconcileContext) ensureAvailabilityGroup() error {
+	ag := r.db.AvailabilityGroup()
+	if ag == nil || !kmapi.IsConditionTrue(r.db.Status.Conditions, dbapi.DatabaseAcceptingConnection) {
+		return nil
+	}
+	if failedOver, err := r.ensureFailover(); err != nil || failedOver {
+		return err
+	}
+	if err := r.ensurePrimaryServiceResumed(); err != nil {
+		return err
+	}
+	secret, err := r.ensureEndpointSecret(nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to ensure the endpoint secret")
+	}
+
+	instances := r.instanceCount()
+	clients := make([]sqlclient.Client, instances)
+	roles := make([]string, instances)
+	unreachable := sets.NewString()
+	for i := int32(0); i < instances; i++ {
+		// the first instance creates the certificate the others import
+		c, role, s, err := r.connectInstance(i, secret)
+		if err != nil {
+			unreachable.Insert(r.podName(i))
+			r.recordEvent(core.EventTypeWarning, EventReasonReplicaUnreachable, "Skipped pod %s of availability group %s: %v",
+				r.podName(i), ag.Name, err)
+			continue
+		}
+		clients[i], roles[i], secret = c, role, s
+	}
+
+	primary, err := r.ensurePrimaryReplica(clients, roles)
+	if err != nil || primary < 0 {
+		return err
+	}
+	if err = r.ensurePrimaryLease(r.podName(primary)); err != nil {
+		return err
+	}
+	if switched, err := r.ensureSwitchover(clients, roles, primary); err != nil || switched {
+		return err
+	}
+	if switched, err := r.ensureScaleDownSwitchover(clients, roles, primary); err != nil || switched {
+		return err
+	}
+	if switched, err := r.ensureRolloutSwitchover(clients, roles, primary); err != nil || switched {
+		return err
+	}
+	// a switchover waiting for its target was called off
+	if err = r.cancelSwitchover(); err != nil {
+		return err
+	}
+	if err = r.ensureReplicas(clients[primary], primary); err != nil {
+		return err
+	}
+	// the replicas scaled away are out of the availability group now
+	for i := *r.db.Spec.Replicas; i < instances; i++ {
+		roles[i] = ""
+	}
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		if clients[i] == nil {
+			continue
+		}
+		if roles[i] == sqlclient.ReplicaRoleResolving && ag.ClusterType == msapi.MSSQLClusterTypeExternal {
+			// i.e. the old primary, back after a failover
+			if err = clients[i].ExecScript(r.ctx, []string{
+				sqlclient.ExternalClusterSessionContext,
+				fmt.Sprintf("ALTER AVAILABILITY GROUP %s SET (ROLE = SECONDARY)", quoteName(ag.Name)),
+			}); err != nil {
+				return fmt.Errorf("failed to demote pod %s: %w", r.podName(i), err)
+			}
+			roles[i] = sqlclient.ReplicaRoleSecondary
+			r.recordEvent(core.EventTypeNormal, EventReasonDemoted, "Pod %s is a secondary replica of availability group %s", r.podName(i), ag.Name)
+		}
+		if roles[i] != "" {
+			continue
+		}
+		if err = clients[i].ExecScript(r.ctx, []string{
+			fmt.Sprintf("ALTER AVAILABILITY GROUP %s JOIN WITH (CLUSTER_TYPE = %s)", quoteName(ag.Name), clusterType(ag)),
+			fmt.Sprintf("ALTER AVAILABILITY GROUP %s GRANT CREATE ANY DATABASE", quoteName(ag.Name)),
+		}); err != nil {
+			return fmt.Errorf("instance %d failed to join availability group %s: %w", i, ag.Name, err)
+		}
+		roles[i] = sqlclient.ReplicaRoleSecondary
+		r.recordEvent(core.EventTypeNormal, EventReasonReplicaJoined, "Pod %s joined availability group %s", r.podName(i), ag.Name)
+	}
+
+	databases, err := r.ensureAvailabilityDatabases(clients[primary])
+	if err != nil {
+		return err
+	}
+	if err = r.ensureReplicaConfiguration(clients[primary]); err != nil {
+		return err
+	}
+	if err = r.ensureReadOnlyRouting(clients[primary]); err != nil {
+		return err
+	}
+
+	status := &msapi.MSSQLAvailabilityGroupStatus{
+		Name:      ag.Name,
+		Primary:   r.podName(primary),
+		Databases: databases,
+	}
+	previous := sets.NewString()
+	if old := r.db.Status.AvailabilityGroup; old != nil {
+		status.PrimaryUnreachableSince = old.PrimaryUnreachableSince
+		status.LastFailover = old.LastFailover
+		status.PrimaryServicePause = old.PrimaryServicePause
+		previous.Insert(old.Replicas...)
+	}
+	for i, role := range roles {
+		name := r.podName(int32(i))
+		// an unreachable replica stays a member until it is back, unless it is scaled away
+		if role != "" || (int32(i) < *r.db.Spec.Replicas && unreachable.Has(name) && previous.Has(name)) {
+			status.Replicas = append(status.Replicas, name)
+		}
+	}
+	if reflect.DeepEqual(status, r.db.Status.AvailabilityGroup) {
+		return nil
+	}
+	return r.updateStatus(func(in *msapi.MSSQLStatus) {
+		// the health checker sets primaryUnreachableSince concurrently, keep its latest value
+		status.PrimaryUnreachableSince = nil
+		if in.AvailabilityGroup != nil {
+			status.PrimaryUnreachableSince = in.AvailabilityGroup.PrimaryUnreachableSince
+		}
+		in.AvailabilityGroup = status
+	})
+}
+
+// ensureEndpointSecret creates the secret holding the passwords that protect the endpoint certificate on the
+// instances, generating the missing ones, & adds data to it.
+func (r *reconcileContext) ensureEndpointSecret(data map[string][]byte) (*core.Secret, error) {
+	obj, vt, err := r.createOrPatch(&core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.db.EndpointSecretName(),
+			Namespace: r.db.Namespace,
+		},
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*core.Secret)
+		in.Labels = r.db.OffshootLabels()
+		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+		if in.Data == nil {
+			in.Data = map[string][]byte{}
+		}
+		for _, key := range []string{endpointMasterKeyPasswordKey, endpointLoginPasswordKey, endpointCertPasswordKey} {
+			if len(in.Data[key]) == 0 {
+				in.Data[key] = []byte(passgen.GenerateForCharset(dbapi.DefaultPasswordLength, passgen.AlphaNum))
+			}
+		}
+		for key, value := range data {
+			in.Data[key] = value
+		}
+		return in
+	})
+	r.recordApply("Secret", r.db.EndpointSecretName(), vt, err)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*core.Secret), nil
+}
+
+// ensureMirroringEndpoint creates the master key, the certificate, its login & the mirroring endpoint of an
+// instance. The certificate is generated by the first instance & stored in the endpoint secret, the others import it.
+func (r *reconcileContext) ensureMirroringEndpoint(c sqlclient.Client, secret *core.Secret) (*core.Secret, error) {
+	cert, hasCert := secret.Data[endpointCertKey]
+	rows, err := c.Query(r.ctx, mirroringEndpointQuery, agEndpointName)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 && hasCert {
+		return secret, nil
+	}
+
+	certificate := fmt.Sprintf("IF CERT_ID(N'%[1]s') IS NULL CREATE CERTIFICATE [%[1]s] AUTHORIZATION [%[1]s] "+
+		"WITH SUBJECT = N'KubeDB availability group endpoint', EXPIRY_DATE = '99991231'", agEndpointName)
+	if hasCert {
+		certificate = fmt.Sprintf("IF CERT_ID(N'%[1]s') IS NULL CREATE CERTIFICATE [%[1]s] AUTHORIZATION [%[1]s] "+
+			"FROM BINARY = 0x%[2]X WITH PRIVATE KEY (BINARY = 0x%[3]X, DECRYPTION BY PASSWORD = %[4]s)",
+			agEndpointName, cert, secret.Data[endpointPrivateKeyKey], quoteString(string(secret.Data[endpointCertPasswordKey])))
+	}
+	err = c.ExecScript(r.ctx, []string{
+		fmt.Sprintf("IF NOT EXISTS (SELECT * FROM sys.symmetric_keys WHERE name = '##MS_DatabaseMasterKey##') "+
+			"CREATE MASTER KEY ENCRYPTION BY PASSWORD = %s", quoteString(string(secret.Data[endpointMasterKeyPasswordKey]))),
+		fmt.Sprintf("IF SUSER_ID(N'%[1]s') IS NULL CREATE LOGIN [%[1]s] WITH PASSWORD = %[2]s",
+			agEndpointName, quoteString(string(secret.Data[endpointLoginPasswordKey]))),
+		fmt.Sprintf("IF USER_ID(N'%[1]s') IS NULL CREATE USER [%[1]s] FOR LOGIN [%[1]s]", agEndpointName),
+		certificate,
+		fmt.Sprintf("IF NOT EXISTS (SELECT * FROM sys.tcp_endpoints WHERE name = N'%[1]s') "+
+			"CREATE ENDPOINT [%[1]s] STATE = STARTED AS TCP (LISTENER_PORT = %[2]d) "+
+			"FOR DATABASE_MIRRORING (ROLE = ALL, AUTHENTICATION = CERTIFICATE [%[1]s], ENCRYPTION = REQUIRED ALGORITHM AES)",
+			agEndpointName, r.db.MirroringPort()),
+		fmt.Sprintf("GRANT CONNECT ON ENDPOINT::[%[1]s] TO [%[1]s]", agEndpointName),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the mirroring endpoint")
+	}
+	if hasCert {
+		return secret, nil
+	}
+
+	rows, err = c.Query(r.ctx, endpointCertificateQuery, agEndpointName, string(secret.Data[endpointCertPasswordKey]))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 || rows[0]["certificate"] == nil || rows[0]["private_key"] == nil {
+		return nil, fmt.Errorf("failed to export certificate %s", agEndpointName)
+	}
+	return r.ensureEndpointSecret(map[string][]byte{
+		endpointCertKey:       []byte(fmt.Sprint(rows[0]["certificate"])),
+		endpointPrivateKeyKey: []byte(fmt.Sprint(rows[0]["private_key"])),
+	})
+}
+
+// connectInstance returns the client of the instance with the given ordinal & the role of its replica, once its
+// mirroring endpoint is in place. The endpoint secret is returned with the certificate the instance created, if any.
+func (r *reconcileContext) connectInstance(ordinal int32, secret *core.Secret) (sqlclient.Client, string, *core.Secret, error) {
+	c, err := r.SQLClients.Instance(r.ctx, r.db, ordinal)
+	if err != nil {
+		return nil, "", secret, err
+	}
+	updated, err := r.ensureMirroringEndpoint(c, secret)
+	if err != nil {
+		return nil, "", secret, err
+	}
+	role, err := r.localReplicaRole(c)
+	if err != nil {
+		return nil, "", updated, err
+	}
+	return c, role, updated, nil
+}
+
+// instanceCount is the number of instances of the MSSQL, i.e. the replicas of the StatefulSet. Once spec.replicas is
+// lowered, the pods scaled away are kept until ensureAvailabilityGroup removed them from the availability group.
+func (r *reconcileContext) instanceCount() int32 {
+	count := *r.db.Spec.Replicas
+	status := r.db.Status.AvailabilityGroup
+	if r.db.AvailabilityGroup() == nil || status == nil {
+		return count
+	}
+	for _, name := range append([]string{status.Primary}, status.Replicas...) {
+		if ordinal := r.ordinalOf(name); ordinal >= count {
+			count = ordinal + 1
+		}
+	}
+	return count
+}
+
+// localReplicaRole returns the role of an instance in the availability group, empty if it hasn't joined.
+func (r *reconcileContext) localReplicaRole(c sqlclient.Client) (string, error) {
+	rows, err := c.Query(r.ctx, sqlclient.LocalReplicaRoleQuery, r.db.AvailabilityGroup().Name)
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	return fmt.Sprint(rows[0]["role"]), nil
+}
+
+// ensurePrimaryReplica returns the ordinal of the primary replica, -1 if there is none yet. The availability group
+// is created on the first instance if no instance has joined it. With the External cluster type the replicas come
+// back RESOLVING after a restart, so the holder of the primary lease is promoted again. So is a primary that
+// fenced itself while it kept the lease, see ensurePrimaryLease. The clients of unreachable instances are nil.
+func (r *reconcileContext) ensurePrimaryReplica(clients []sqlclient.Client, roles []string) (int32, error) {
+	ag := r.db.AvailabilityGroup()
+	joined, reachable := false, true
+	for i, role := range roles {
+		if role == sqlclient.ReplicaRolePrimary {
+			return int32(i), nil
+		}
+		joined = joined || role != ""
+		reachable = reachable && clients[i] != nil
+	}
+
+	if !joined && !reachable {
+		r.Log.Info("Waiting for the instances to find the availability group", "availabilityGroup", ag.Name)
+		return -1, nil
+	}
+	if !joined {
+		if r.db.Status.AvailabilityGroup != nil {
+			err := fmt.Errorf("availability group %s is not found on any instance", ag.Name)
+			r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
+			return -1, err
+		}
+		return -1, r.createAvailabilityGroup(clients[0])
+	}
+
+	// the holder of the primary lease, which the last known primary holds unless a failover moved it
+	lastPrimary := ""
+	if status := r.db.Status.AvailabilityGroup; status != nil {
+		lastPrimary = status.Primary
+	}
+	holder := lastPrimary
+	lease, err := r.getPrimaryLease()
+	if err != nil {
+		return -1, err
+	}
+	if lease != nil {
+		holder = pointer.String(lease.Spec.HolderIdentity)
+	}
+	candidate := int32(0)
+	if holder != "" {
+		candidate = r.ordinalOf(holder)
+	}
+	if candidate < 0 || int(candidate) >= len(roles) || roles[candidate] == "" {
+		r.Log.Info("Waiting for the primary replica of the availability group", "availabilityGroup", ag.Name, "holder", holder)
+		return -1, nil
+	}
+
+	var batches []string
+	switch {
+	case ag.ClusterType == msapi.MSSQLClusterTypeExternal:
+		batches = []string{
+			sqlclient.ExternalClusterSessionContext,
+			fmt.Sprintf("ALTER AVAILABILITY GROUP %s FAILOVER", quoteName(ag.Name)),
+		}
+	case r.podName(candidate) == lastPrimary && roles[candidate] == sqlclient.ReplicaRoleSecondary:
+		// fenced by its coordinator, it has everything the secondaries have
+		batches = []string{fmt.Sprintf("ALTER AVAILABILITY GROUP %s FORCE_FAILOVER_ALLOW_DATA_LOSS", quoteName(ag.Name))}
+	default:
+		r.Log.Info("Waiting for the primary replica of the availability group", "availabilityGroup", ag.Name, "holder", holder)
+		return -1, nil
+	}
+	if err = clients[candidate].ExecScript(r.ctx, batches); err != nil {
+		return -1, fmt.Errorf("failed to promote pod %s: %w", r.podName(candidate), err)
+	}
+	roles[candidate] = sqlclient.ReplicaRolePrimary
+	r.recordEvent(core.EventTypeNormal, EventReasonPromoted, "Promoted pod %s to the primary replica of availability group %s",
+		r.podName(candidate), ag.Name)
+	return candidate, nil
+}
+
+// createAvailabilityGroup creates the availability group on the first instance with all the replicas. The other
+// instances join it on the next reconcile.
+func (r *reconcileContext) createAvailabilityGroup(c sqlclient.Client) error {
+	ag := r.db.AvailabilityGroup()
+	options := "CLUSTER_TYPE = " + clusterType(ag)
+	if r.db.Spec.Edition == msapi.MSSQLEditionStandard {
+		options += ", BASIC"
+	}
+	var replicas []string
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		replicas = append(replicas, r.replicaSpec(i))
+	}
+	err := c.ExecScript(r.ctx, []string{
+		fmt.Sprintf("CREATE AVAILABILITY GROUP %s WITH (%s) FOR REPLICA ON %s", quoteName(ag.Name), options, strings.Join(replicas, ", ")),
+		fmt.Sprintf("ALTER AVAILABILITY GROUP %s GRANT CREATE ANY DATABASE", quoteName(ag.Name)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create availability group %s: %w", ag.Name, err)
+	}
+	r.recordEvent(core.EventTypeNormal, EventReasonAvailabilityGroupCreated, "Created availability group %s on pod %s", ag.Name, r.podName(0))
+	return r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: ag.Name}
+	})
+}
+
+// ensureReplicas adds the new pods to the availability group & removes the ones scaled away. The primary is never
+// among them, see ensureScaleDownSwitchover.
+func (r *reconcileContext) ensureReplicas(c sqlclient.Client, primary int32) error {
+	ag := r.db.AvailabilityGroup()
+	rows, err := c.Query(r.ctx, agReplicasQuery, ag.Name)
+	if err != nil {
+		return err
+	}
+	existing := sets.NewString()
+	for _, row := range rows {
+		existing.Insert(fmt.Sprint(row["name"]))
+	}
+	desired := sets.NewString()
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		desired.Insert(r.podName(i))
+		if !existing.Has(r.podName(i)) {
+			stmt := fmt.Sprintf("ALTER AVAILABILITY GROUP %s ADD REPLICA ON %s", quoteName(ag.Name), r.replicaSpec(i))
+			if err = c.Exec(r.ctx, stmt); err != nil {
+				return fmt.Errorf("failed to add pod %s to availability group %s: %w", r.podName(i), ag.Name, err)
+			}
+		}
+	}
+	for _, name := range existing.Difference(desired).List() {
+		if name == r.podName(primary) {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER AVAILABILITY GROUP %s REMOVE REPLICA ON %s", quoteName(ag.Name), quoteString(name))
+		if err = c.Exec(r.ctx, stmt); err != nil {
+			return fmt.Errorf("failed to remove pod %s from availability group %s: %w", name, ag.Name, err)
+		}
+		r.recordEvent(core.EventTypeNormal, EventReasonReplicaRemoved, "Removed pod %s from availability group %s", name, ag.Name)
+	}
+	return nil
+}
+
+// ensureAvailabilityDatabases adds the databases of the spec to the availability group. They are created if
+// missing & backed up first, as the availability group requires the full recovery model & a full backup. The
+// backup is COPY_ONLY & discarded, so that it doesn't take part in the backup chain of the user. The secondaries
+// are seeded automatically.
+func (r *reconcileContext) ensureAvailabilityDatabases(c sqlclient.Client) ([]string, error) {
+	ag := r.db.AvailabilityGroup()
+	rows, err := c.Query(r.ctx, agDatabasesQuery, ag.Name)
+	if err != nil {
+		return nil, err
+	}
+	existing := sets.NewString()
+	for _, row := range rows {
+		existing.Insert(fmt.Sprint(row["name"]))
+	}
+	for _, name := range ag.Databases {
+		if existing.Has(name) {
+			continue
+		}
+		err = c.ExecScript(r.ctx, []string{
+			fmt.Sprintf("IF DB_ID(%s) IS NULL CREATE DATABASE %s", quoteString(name), quoteName(name)),
+			fmt.Sprintf("ALTER DATABASE %s SET RECOVERY FULL", quoteName(name)),
+			fmt.Sprintf("BACKUP DATABASE %s TO DISK = N'/dev/null' WITH COPY_ONLY", quoteName(name)),
+			fmt.Sprintf("ALTER AVAILABILITY GROUP %s ADD DATABASE %s", quoteName(ag.Name), quoteName(name)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to add database %s to availability group %s: %w", name, ag.Name, err)
+		}
+		existing.Insert(name)
+		r.Log.Info("Added database to the availability group", "database", name)
+	}
+	return existing.List(), nil
+}
+
+// replicaSpec is the replica definition of the pod with the given ordinal. SQL Server names the replicas after
+// the host name, which is the name of the pod.
+func (r *reconcileContext) replicaSpec(ordinal int32) string {
+	failoverMode := "MANUAL"
+	if r.db.AvailabilityGroup().ClusterType == msapi.MSSQLClusterTypeExternal {
+		failoverMode = "EXTERNAL"
+	}
+	return fmt.Sprintf("%s WITH (ENDPOINT_URL = N'TCP://%s:%d', AVAILABILITY_MODE = %s, "+
+		"FAILOVER_MODE = %s, SEEDING_MODE = AUTOMATIC)",
+		quoteString(r.podName(ordinal)), sqlclient.InstanceHost(r.db, ordinal), r.db.MirroringPort(),
+		r.availabilityMode(ordinal), failoverMode)
+}
+
+func (r *reconcileContext) podName(ordinal int32) string {
+	return fmt.Sprintf("%s-%d", r.db.OffshootName(), ordinal)
+}
+
+func clusterType(ag *msapi.MSSQLAvailabilityGroupSpec) string {
+	return strings.ToUpper(string(ag.ClusterType))
+}
+
+// quoteName quotes an identifier, like QUOTENAME.
+func quoteName(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// quoteString quotes a unicode string literal.
+func quoteString(s string) string {
+	return "N'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+)
+
+func newAvailabilityGroupTestContext(t *testing.T) (*reconcileContext, *sqlfake.Factory) {
+	db := newTestMSSQL()
+	r, sqlClients := newTestReconciler(t, db)
+	rc := &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:   dbapi.DatabaseAcceptingConnection,
+			Status: core.ConditionTrue,
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(0); i < *db.Spec.Replicas; i++ {
+		err = rc.Client.Create(rc.ctx, &core.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      rc.podName(i),
+			Namespace: db.Namespace,
+			Labels:    db.OffshootSelectors(),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rc, sqlClients
+}
+
+// executed tells whether the client ran a statement containing s.
+func executed(c *sqlfake.Client, s string) bool {
+	for _, stmt := range c.Executed {
+		if strings.Contains(stmt, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func podRoles(t *testing.T, rc *reconcileContext) map[string]string {
+	var pods core.PodList
+	if err := rc.Client.List(rc.ctx, &pods); err != nil {
+		t.Fatal(err)
+	}
+	roles := map[string]string{}
+	for _, pod := range pods.Items {
+		roles[pod.Name] = pod.Labels[dbapi.LabelRole]
+	}
+	return roles
+}
+
+func TestEnsureAvailabilityGroup(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	first := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0))
+	second := sqlClients.Client(sqlclient.InstanceHost(rc.db, 1))
+	first.Results[endpointCertificateQuery] = []sqlclient.Row{{"certificate": "cert", "private_key": "key"}}
+
+	// creates the endpoints & the availability group
+	if err := rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if !executed(first, "WITH SUBJECT") || !executed(first, "LISTENER_PORT = 5022") {
+		t.Errorf("instance 0 didn't create the certificate & the endpoint: %v", first.Executed)
+	}
+	if !executed(second, fmt.Sprintf("FROM BINARY = 0x%X WITH PRIVATE KEY (BINARY = 0x%X", "cert", "key")) {
+		t.Errorf("instance 1 didn't import the certificate: %v", second.Executed)
+	}
+	create := "CREATE AVAILABILITY GROUP [mssql] WITH (CLUSTER_TYPE = EXTERNAL) FOR REPLICA ON " +
+		"N'mssql-0' WITH (ENDPOINT_URL = N'TCP://mssql-0.mssql-pods.demo.svc:5022', AVAILABILITY_MODE = SYNCHRONOUS_COMMIT, " +
+		"FAILOVER_MODE = EXTERNAL, SEEDING_MODE = AUTOMATIC), N'mssql-1' WITH ("
+	if !executed(first, create) {
+		t.Errorf("instance 0 didn't create the availability group: %v", first.Executed)
+	}
+	var secret core.Secret
+	err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.EndpointSecretName()}, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data[endpointCertKey]) != "cert" || len(secret.Data[endpointMasterKeyPasswordKey]) == 0 {
+		t.Errorf("unexpected endpoint secret data %v", secret.Data)
+	}
+	if rc.db.Status.AvailabilityGroup == nil {
+		t.Fatal("availability group status is not set")
+	}
+
+	// the first instance is the primary, the second one joins & the database is added
+	rc.db.Spec.Topology.AvailabilityGroup.Databases = []string{"app"}
+	first.Executed, second.Executed = nil, nil
+	for _, c := range []*sqlfake.Client{first, second} {
+		c.Results[mirroringEndpointQuery] = []sqlclient.Row{{"port": int64(5022)}}
+	}
+	first.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+	first.Results[agReplicasQuery] = []sqlclient.Row{{"name": "mssql-0"}, {"name": "mssql-1"}, {"name": "mssql-2"}}
+	if err = rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if !executed(second, "ALTER AVAILABILITY GROUP [mssql] JOIN WITH (CLUSTER_TYPE = EXTERNAL)") {
+		t.Errorf("instance 1 didn't join: %v", second.Executed)
+	}
+	for _, stmt := range []string{
+		"ALTER AVAILABILITY GROUP [mssql] REMOVE REPLICA ON N'mssql-2'",
+		"ALTER DATABASE [app] SET RECOVERY FULL",
+		"BACKUP DATABASE [app] TO DISK = N'/dev/null' WITH COPY_ONLY",
+		"ALTER AVAILABILITY GROUP [mssql] ADD DATABASE [app]",
+	} {
+		if !executed(first, stmt) {
+			t.Errorf("instance 0 didn't run %q: %v", stmt, first.Executed)
+		}
+	}
+	if executed(first, "CREATE AVAILABILITY GROUP") || executed(first, "ADD REPLICA") {
+		t.Errorf("instance 0 changed the replicas: %v", first.Executed)
+	}
+	// the coordinators label the pods
+	want := map[string]string{"mssql-0": "", "mssql-1": ""}
+	if got := podRoles(t, rc); !reflect.DeepEqual(got, want) {
+		t.Errorf("pod roles = %v, want %v", got, want)
+	}
+	if holder := getPrimaryLease(t, rc).Spec.HolderIdentity; pointer.String(holder) != "mssql-0" {
+		t.Errorf("primary lease holder = %s, want mssql-0", pointer.String(holder))
+	}
+	wantStatus := &msapi.MSSQLAvailabilityGroupStatus{
+		Name:      "mssql",
+		Primary:   "mssql-0",
+		Replicas:  []string{"mssql-0", "mssql-1"},
+		Databases: []string{"app"},
+	}
+	if !reflect.DeepEqual(rc.db.Status.AvailabilityGroup, wantStatus) {
+		t.Errorf("availability group status = %+v, want %+v", rc.db.Status.AvailabilityGroup, wantStatus)
+	}
+}
+
+func TestEnsureAvailabilityGroupPromotesLastPrimary(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: "mssql", Primary: "mssql-1"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rc.ensureEndpointSecret(map[string][]byte{endpointCertKey: []byte("cert"), endpointPrivateKeyKey: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	// both instances restarted & wait for the cluster manager
+	for i := int32(0); i < 2; i++ {
+		c := sqlClients.Client(sqlclient.InstanceHost(rc.db, i))
+		c.Results[mirroringEndpointQuery] = []sqlclient.Row{{"port": int64(5022)}}
+		c.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleResolving}}
+	}
+	second := sqlClients.Client(sqlclient.InstanceHost(rc.db, 1))
+	second.Results[agReplicasQuery] = []sqlclient.Row{{"name": "mssql-0"}, {"name": "mssql-1"}}
+	replicasConfigured(rc, second)
+
+	if err = rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	wantExecuted := []string{
+		"EXEC sp_set_session_context @key = N'external_cluster', @value = N'yes'",
+		"ALTER AVAILABILITY GROUP [mssql] FAILOVER",
+	}
+	if !reflect.DeepEqual(second.Executed, wantExecuted) {
+		t.Errorf("instance 1 executed %v, want %v", second.Executed, wantExecuted)
+	}
+	// the other instance is demoted to a secondary
+	wantExecuted = []string{
+		"EXEC sp_set_session_context @key = N'external_cluster', @value = N'yes'",
+		"ALTER AVAILABILITY GROUP [mssql] SET (ROLE = SECONDARY)",
+	}
+	if first := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0)); !reflect.DeepEqual(first.Executed, wantExecuted) {
+		t.Errorf("instance 0 executed %v, want %v", first.Executed, wantExecuted)
+	}
+}
+
+func TestEnsureAvailabilityGroupPromotesFencedPrimary(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	rc.db.Spec.Topology.AvailabilityGroup.ClusterType = msapi.MSSQLClusterTypeNone
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: "mssql", Primary: "mssql-0"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPrimaryLease(t, rc, "mssql-0", 0)
+	if _, err = rc.ensureEndpointSecret(map[string][]byte{endpointCertKey: []byte("cert"), endpointPrivateKeyKey: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	// the coordinator of mssql-0 fenced it while it lost the API server, but it kept the lease
+	for i := int32(0); i < 2; i++ {
+		c := sqlClients.Client(sqlclient.InstanceHost(rc.db, i))
+		c.Results[mirroringEndpointQuery] = []sqlclient.Row{{"port": int64(5022)}}
+		c.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	}
+	first := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0))
+	first.Results[agReplicasQuery] = []sqlclient.Row{{"name": "mssql-0"}, {"name": "mssql-1"}}
+	replicasConfigured(rc, first)
+
+	if err = rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ALTER AVAILABILITY GROUP [mssql] FORCE_FAILOVER_ALLOW_DATA_LOSS"}
+	if !reflect.DeepEqual(first.Executed, want) {
+		t.Errorf("instance 0 executed %v, want %v", first.Executed, want)
+	}
+	if second := sqlClients.Client(sqlclient.InstanceHost(rc.db, 1)); len(second.Executed) != 0 {
+		t.Errorf("instance 1 executed %v", second.Executed)
+	}
+}
+
+func TestEnsureAvailabilityGroupPrimaryWithoutLease(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	createPrimaryLease(t, rc, "mssql-1", 0)
+	if _, err := rc.ensureEndpointSecret(map[string][]byte{endpointCertKey: []byte("cert"), endpointPrivateKeyKey: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(0); i < 2; i++ {
+		c := sqlClients.Client(sqlclient.InstanceHost(rc.db, i))
+		c.Results[mirroringEndpointQuery] = []sqlclient.Row{{"port": int64(5022)}}
+		c.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	}
+	// i.e. a partitioned old primary
+	sqlClients.Client(sqlclient.InstanceHost(rc.db, 0)).Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+
+	if err := rc.ensureAvailabilityGroup(); err == nil {
+		t.Error("expected an error while mssql-1 holds the primary lease")
+	}
+}
+
+func TestEnsureAvailabilityGroupSkipsUnreachableReplica(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	rc.db.Spec.Replicas = pointer.Int32P(3)
+	recorder := record.NewFakeRecorder(10)
+	rc.Recorder = recorder
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{
+			Name:     "mssql",
+			Primary:  "mssql-0",
+			Replicas: []string{"mssql-0", "mssql-1", "mssql-2"},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPrimaryLease(t, rc, "mssql-0", 0)
+	if _, err = rc.ensureEndpointSecret(map[string][]byte{endpointCertKey: []byte("cert"), endpointPrivateKeyKey: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(0); i < 3; i++ {
+		c := sqlClients.Client(sqlclient.InstanceHost(rc.db, i))
+		c.Results[mirroringEndpointQuery] = []sqlclient.Row{{"port": int64(5022)}}
+		c.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	}
+	first := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0))
+	first.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+	first.Results[agReplicasQuery] = []sqlclient.Row{{"name": "mssql-0"}, {"name": "mssql-1"}, {"name": "mssql-2"}}
+	replicasConfigured(rc, first)
+	sqlClients.Client(sqlclient.InstanceHost(rc.db, 1)).QueryErr = errors.New("connection refused")
+
+	// the other replicas are managed meanwhile
+	if err = rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if !containsEvent(events, EventReasonReplicaUnreachable, "mssql-1") {
+		t.Errorf("events = %q, want mssql-1 to be reported unreachable", events)
+	}
+	if executed(first, "REMOVE REPLICA") {
+		t.Errorf("instance 0 removed a replica: %v", first.Executed)
+	}
+	if got := rc.db.Status.AvailabilityGroup.Replicas; !reflect.DeepEqual(got, []string{"mssql-0", "mssql-1", "mssql-2"}) {
+		t.Errorf("replicas = %v, want the unreachable mssql-1 to stay a member", got)
+	}
+}
+
+func containsEvent(events []string, reason, substr string) bool {
+	for _, event := range events {
+		if strings.Contains(event, reason) && strings.Contains(event, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEnsureAvailabilityGroupScaleDown(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	// spec.replicas is lowered from 3 to 2 while mssql-2 is the primary
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{
+			Name:      "mssql",
+			Primary:   "mssql-2",
+			Replicas:  []string{"mssql-0", "mssql-1", "mssql-2"},
+			Databases: []string{"app"},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPrimaryLease(t, rc, "mssql-2", 0)
+	if _, err = rc.ensureEndpointSecret(map[string][]byte{endpointCertKey: []byte("cert"), endpointPrivateKeyKey: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := rc.instanceCount(); n != 3 {
+		t.Errorf("instance count = %d, want the StatefulSet to keep 3 pods", n)
+	}
+	clients := make([]*sqlfake.Client, 3)
+	for i := int32(0); i < 3; i++ {
+		clients[i] = sqlClients.Client(sqlclient.InstanceHost(rc.db, i))
+		clients[i].Results[mirroringEndpointQuery] = []sqlclient.Row{{"port": int64(5022)}}
+		clients[i].Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	}
+	clients[2].Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+	clients[2].Results[synchronizedQuery] = []sqlclient.Row{{"databases": int64(1), "synchronized": int64(1)}}
+
+	// the primary is switched over to a replica that is kept first
+	if err = rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if !executed(clients[2], "SET (ROLE = SECONDARY)") || !executed(clients[0], "ALTER AVAILABILITY GROUP [mssql] FAILOVER") {
+		t.Errorf("instance 2 executed %v, instance 0 executed %v", clients[2].Executed, clients[0].Executed)
+	}
+	if executed(clients[0], "REMOVE REPLICA") {
+		t.Errorf("instance 0 removed a replica before the switchover: %v", clients[0].Executed)
+	}
+	if status := rc.db.Status.AvailabilityGroup; status.Primary != "mssql-0" || status.LastFailover == nil || status.LastFailover.Reason != "scale down" {
+		t.Errorf("availability group status = %+v", status)
+	}
+
+	// then the replica scaled away is removed, & the StatefulSet can be scaled down
+	clients[0].Executed = nil
+	clients[0].Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+	clients[2].Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	clients[0].Results[agReplicasQuery] = []sqlclient.Row{{"name": "mssql-0"}, {"name": "mssql-1"}, {"name": "mssql-2"}}
+	clients[0].Results[agDatabasesQuery] = []sqlclient.Row{{"name": "app"}}
+	replicasConfigured(rc, clients[0])
+	if err = rc.ensureAvailabilityGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if !executed(clients[0], "ALTER AVAILABILITY GROUP [mssql] REMOVE REPLICA ON N'mssql-2'") {
+		t.Errorf("instance 0 executed %v, want mssql-2 removed", clients[0].Executed)
+	}
+	if got := rc.db.Status.AvailabilityGroup.Replicas; !reflect.DeepEqual(got, []string{"mssql-0", "mssql-1"}) {
+		t.Errorf("replicas = %v", got)
+	}
+	if n := rc.instanceCount(); n != 2 {
+		t.Errorf("instance count = %d, want 2", n)
+	}
+}
@@ -17,16 +17,23 @@ limitations under the License.
 package controllers
 
 import (
+	"strings"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kutil "kmodules.xyz/client-go"
 	clientutil "kmodules.xyz/client-go/client"
 	coreutil "kmodules.xyz/client-go/core/v1"
 	api "kubedb.dev/apimachinery/apis"
 	msapi "kubedb.dev/mssql/api/v1alpha1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 )
 
-func (r *MSSQLReconciler) ensureFinalizers() error {
+func (r *reconcileContext) ensureFinalizers() error {
 	if !coreutil.HasFinalizer(r.db.ObjectMeta, api.Finalizer) {
 		_, _, err := clientutil.CreateOrPatch(r.ctx, r.Client, &msapi.MSSQL{
 			ObjectMeta: metav1.ObjectMeta{
@@ -42,12 +49,13 @@ func (r *MSSQLReconciler) ensureFinalizers() error {
 			return err
 		}
 		r.Log.Info("Added Finalizers")
+		r.recordEvent(core.EventTypeNormal, EventReasonFinalizerAdded, "Added finalizer %s", api.Finalizer)
 	}
 
 	return nil
 }
 
-func (r *MSSQLReconciler) removeFinalizers() error { // call it, only if MSSQL is marked for deletion
+func (r *reconcileContext) removeFinalizers() error { // call it, only if MSSQL is marked for deletion
 	if coreutil.HasFinalizer(r.db.ObjectMeta, api.Finalizer) {
 		_, _, err := clientutil.CreateOrPatch(r.ctx, r.Client, &msapi.MSSQL{
 			ObjectMeta: r.db.ObjectMeta,
@@ -60,21 +68,67 @@ func (r *MSSQLReconciler) removeFinalizers() error { // call it, only if MSSQL i
 			return err
 		}
 		r.Log.Info("Removed Finalizers")
+		r.recordEvent(core.EventTypeNormal, EventReasonFinalizerRemoved, "Removed finalizer %s", api.Finalizer)
 	}
 	return nil
 }
 
 // requeueWithError is a wrapper around logging an error message
 // then passes the error through to the controller manager
-func (r *MSSQLReconciler) requeueWithError(msg string, err error) (ctrl.Result, error) {
+func (r *reconcileContext) requeueWithError(msg string, err error) (ctrl.Result, error) {
 	r.Log.Error(err, msg)
 	return ctrl.Result{}, err
 }
 
-func (r *MSSQLReconciler) isMarkedForDeletion() bool {
+// requeueIn asks for the MSSQL to be reconciled again within d, e.g. once a timeout is up, as nothing else might
+// trigger a reconcile then. The earliest request wins.
+func (r *reconcileContext) requeueIn(d time.Duration) {
+	if d > 0 && (r.requeueAfter == 0 || d < r.requeueAfter) {
+		r.requeueAfter = d
+	}
+}
+
+func (r *reconcileContext) isMarkedForDeletion() bool {
 	return !r.db.GetDeletionTimestamp().IsZero()
 }
 
-func (r *MSSQLReconciler) getOwnerRef() *metav1.OwnerReference {
+func (r *reconcileContext) getOwnerRef() *metav1.OwnerReference {
 	return metav1.NewControllerRef(r.db, msapi.GroupVersion.WithKind(msapi.ResourceKindMSSQL))
 }
+
+// createOrPatch works like clientutil.CreateOrPatch, except that an object the transform leaves unchanged is not
+// patched & is reported as unchanged. So a steady state neither sends requests nor records events.
+func (r *reconcileContext) createOrPatch(obj client.Object, transform clientutil.TransformFunc) (client.Object, kutil.VerbType, error) {
+	err := r.Client.Get(r.ctx, client.ObjectKeyFromObject(obj), obj)
+	if kerr.IsNotFound(err) {
+		obj = transform(obj.DeepCopyObject().(client.Object), true)
+		return obj, kutil.VerbCreated, r.Client.Create(r.ctx, obj)
+	}
+	if err != nil {
+		return nil, kutil.VerbUnchanged, err
+	}
+
+	gvk, err := apiutil.GVKForObject(obj, r.Client.Scheme())
+	if err != nil {
+		return nil, kutil.VerbUnchanged, err
+	}
+	// the built-in types, i.e. the ones of a group without a domain, support strategic merge patches
+	var patch client.Patch
+	if !strings.ContainsRune(gvk.Group, '.') {
+		patch = client.StrategicMergeFrom(obj)
+	} else {
+		patch = client.MergeFrom(obj)
+	}
+	mod := transform(obj.DeepCopyObject().(client.Object), false)
+	data, err := patch.Data(mod)
+	if err != nil {
+		return nil, kutil.VerbUnchanged, err
+	}
+	if string(data) == "{}" {
+		return mod, kutil.VerbUnchanged, nil
+	}
+	if err = r.Client.Patch(r.ctx, mod, patch); err != nil {
+		return nil, kutil.VerbUnchanged, err
+	}
+	return mod, kutil.VerbPatched, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/mssqlconf"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultConfig returns the settings the operator renders into every mssql.conf.
+func (r *reconcileContext) defaultConfig() mssqlconf.Config {
+	cfg := mssqlconf.Config{}
+	cfg.Set("network", "tcpport", strconv.Itoa(int(r.db.ServerPort())))
+	cfg.Set("sqlagent", "enabled", "false")
+	return mssqlconf.Merge(cfg, r.tlsConfig())
+}
+
+// ensureConfigSecret renders the mssql.conf of the database into the config secret. The user's mssql.conf from
+// spec.configSecret is merged over the operator defaults, then spec.configuration over both. The reserved settings
+// can't be set through spec.configSecret, the webhook rejects them. Those added to the secret later are dropped &
+// reported. memory.memorylimitmb is not reserved: a value of spec.configSecret takes precedence over the one derived
+// from the container memory limit.
+// The init container copies the file into the data directory before SQL Server starts, so a change of
+// spec.configSecret is pending until the pods are restarted, see ensureConfiguration.
+func (r *reconcileContext) ensureConfigSecret() error {
+	defaults := r.defaultConfig()
+	userCfg := mssqlconf.Config{}
+
+	if r.db.Spec.ConfigSecret != nil {
+		parsed, problems, err := r.getUserConfig()
+		if err != nil {
+			return err
+		}
+		userCfg = parsed.Valid()
+		for _, setting := range msapi.MSSQLReservedSettings {
+			if _, ok := userCfg.Get(setting[0], setting[1]); ok {
+				problems = append(problems, fmt.Errorf("%s.%s is managed by the operator, use %s", setting[0], setting[1], setting[2]))
+				userCfg.Delete(setting[0], setting[1])
+			}
+		}
+		if err = r.checkUserMemoryLimit(userCfg); err != nil {
+			problems = append(problems, err)
+			userCfg.Delete("memory", "memorylimitmb")
+		}
+		r.userConf = userCfg
+		if err = r.setConfigurationCondition(problems); err != nil {
+			return err
+		}
+	} else if kmapi.HasCondition(r.db.Status.Conditions, msapi.DatabaseConfigurationValid) {
+		err := r.updateStatus(func(status *msapi.MSSQLStatus) {
+			status.Conditions = kmapi.RemoveCondition(status.Conditions, msapi.DatabaseConfigurationValid)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg := mssqlconf.Merge(defaults, userCfg, r.configurationConf())
+	_, vt, err := r.createOrPatch(&core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.db.ConfigSecretName(),
+			Namespace: r.db.Namespace,
+		},
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*core.Secret)
+		in.Labels = r.db.OffshootLabels()
+		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+		in.StringData = nil
+		in.Data = map[string][]byte{
+			msapi.MSSQLConfigFileName: []byte(cfg.String()),
+		}
+		return in
+	})
+	r.recordApply("Secret", r.db.ConfigSecretName(), vt, err)
+	return err
+}
+
+// checkUserMemoryLimit checks the memory.memorylimitmb of spec.configSecret against the limits of SQL Server & of
+// the database container.
+func (r *reconcileContext) checkUserMemoryLimit(userCfg mssqlconf.Config) error {
+	v, ok := userCfg.Get("memory", "memorylimitmb")
+	if !ok {
+		return nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || limit < msapi.MSSQLMinMemoryLimitMB {
+		return fmt.Errorf("memory.memorylimitmb must be a number of MB, at least %d", msapi.MSSQLMinMemoryLimitMB)
+	}
+	if r.db.Spec.PodTemplate != nil {
+		memory, ok := r.db.Spec.PodTemplate.Spec.Resources.Limits[core.ResourceMemory]
+		if ok && limit*1024*1024 > memory.Value() {
+			return fmt.Errorf("memory.memorylimitmb must not exceed the memory limit of the container, %s", memory.String())
+		}
+	}
+	return nil
+}
+
+// getUserConfig parses the mssql.conf of spec.configSecret. The problems found in it are returned separately
+// from the errors that prevent reading it at all.
+func (r *reconcileContext) getUserConfig() (mssqlconf.Config, []error, error) {
+	var secret core.Secret
+	err := r.Client.Get(r.ctx, types.NamespacedName{
+		Name:      r.db.Spec.ConfigSecret.Name,
+		Namespace: r.db.Namespace,
+	}, &secret)
+	if err != nil {
+		if kerr.IsNotFound(err) {
+			err = fmt.Errorf("config secret %q not found for MSSQL %s/%s", r.db.Spec.ConfigSecret.Name, r.db.Namespace, r.db.Name)
+			r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
+		}
+		return nil, nil, err
+	}
+	data, ok := secret.Data[msapi.MSSQLConfigFileName]
+	if !ok {
+		return mssqlconf.Config{}, []error{fmt.Errorf("key %q is missing", msapi.MSSQLConfigFileName)}, nil
+	}
+	cfg, problems := mssqlconf.Parse(string(data))
+	problems = append(problems, cfg.Validate()...)
+	return cfg, problems, nil
+}
+
+func (r *reconcileContext) setConfigurationCondition(problems []error) error {
+	valid := len(problems) == 0
+	message := fmt.Sprintf("%s of config secret %q is valid", msapi.MSSQLConfigFileName, r.db.Spec.ConfigSecret.Name)
+	if !valid {
+		msgs := make([]string, 0, len(problems))
+		for _, p := range problems {
+			msgs = append(msgs, p.Error())
+		}
+		message = fmt.Sprintf("%s of config secret %q has been applied without the invalid settings: %s",
+			msapi.MSSQLConfigFileName, r.db.Spec.ConfigSecret.Name, strings.Join(msgs, "; "))
+	}
+
+	_, cond := kmapi.GetCondition(r.db.Status.Conditions, msapi.DatabaseConfigurationValid)
+	if cond != nil && cond.Status == conditionStatus(valid) && cond.Message == message && cond.ObservedGeneration == r.db.Generation {
+		return nil
+	}
+	if !valid {
+		r.recordEvent(core.EventTypeWarning, EventReasonInvalid, message)
+	}
+	return r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               msapi.DatabaseConfigurationValid,
+			Status:             conditionStatus(valid),
+			Reason:             reasonFor(valid, msapi.ConfigurationAccepted, msapi.InvalidConfiguration),
+			ObservedGeneration: r.db.Generation,
+			Message:            message,
+		})
+	})
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+)
+
+func newConfigTestContext(t *testing.T, conf string) *reconcileContext {
+	db := newTestMSSQL()
+	db.Spec.ConfigSecret = &core.LocalObjectReference{Name: "custom-config"}
+	r, _ := newTestReconciler(t, db)
+	err := r.Client.Create(context.TODO(), &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "custom-config", Namespace: db.Namespace},
+		Data:       map[string][]byte{msapi.MSSQLConfigFileName: []byte(conf)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}
+}
+
+func renderedConfig(t *testing.T, rc *reconcileContext) string {
+	var secret core.Secret
+	err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.ConfigSecretName()}, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(secret.Data[msapi.MSSQLConfigFileName])
+}
+
+func TestEnsureConfigSecret(t *testing.T) {
+	rc := newConfigTestContext(t, "[language]\nlcid = 1031\n[sqlagent]\nenabled = true\n")
+	if err := rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	want := `[hadr]
+hadrenabled = 1
+
+[language]
+lcid = 1031
+
+[memory]
+memorylimitmb = 2048
+
+[network]
+tcpport = 1433
+
+[sqlagent]
+enabled = true
+`
+	if got := renderedConfig(t, rc); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabaseConfigurationValid) {
+		t.Error("expected ConfigurationValid to be true")
+	}
+}
+
+func TestEnsureConfigSecretInvalid(t *testing.T) {
+	rc := newConfigTestContext(t, "[network]\ntcpport = 1500\nbogus = 1\n[memory]\nmemorylimitmb = 3072\n")
+	if err := rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	want := `[hadr]
+hadrenabled = 1
+
+[memory]
+memorylimitmb = 2048
+
+[network]
+tcpport = 1433
+
+[sqlagent]
+enabled = false
+`
+	if got := renderedConfig(t, rc); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	_, cond := kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabaseConfigurationValid)
+	if cond == nil || cond.Status != core.ConditionFalse || cond.Reason != msapi.InvalidConfiguration {
+		t.Errorf("unexpected ConfigurationValid condition %+v", cond)
+	}
+}
+
+func TestEnsureConfigSecretMemoryLimit(t *testing.T) {
+	rc := newConfigTestContext(t, "[memory]\nmemorylimitmb = 2304\n")
+	if err := rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	// the value of spec.configSecret takes precedence over the one derived from the container memory limit
+	if got := renderedConfig(t, rc); !strings.Contains(got, "memorylimitmb = 2304\n") {
+		t.Errorf("expected memorylimitmb = 2304 in:\n%s", got)
+	}
+	if got := rc.configurationEnv(); !hasEnv(got, "MSSQL_MEMORY_LIMIT_MB", "2304") {
+		t.Errorf("expected MSSQL_MEMORY_LIMIT_MB=2304 in %v", got)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabaseConfigurationValid) {
+		t.Error("expected ConfigurationValid to be true")
+	}
+
+	// spec.configuration takes precedence over both
+	rc.db.Spec.Configuration = &msapi.MSSQLConfiguration{MemoryLimitMB: pointer.Int32P(2048)}
+	if err := rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if got := renderedConfig(t, rc); !strings.Contains(got, "memorylimitmb = 2048\n") {
+		t.Errorf("expected memorylimitmb = 2048 in:\n%s", got)
+	}
+	if got := rc.configurationEnv(); !hasEnv(got, "MSSQL_MEMORY_LIMIT_MB", "2048") {
+		t.Errorf("expected MSSQL_MEMORY_LIMIT_MB=2048 in %v", got)
+	}
+}
+
+func TestEnsureConfigSecretMemoryLimitAboveContainer(t *testing.T) {
+	rc := newConfigTestContext(t, "[memory]\nmemorylimitmb = 4096\n")
+	if err := rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if got := renderedConfig(t, rc); !strings.Contains(got, "memorylimitmb = 2048\n") {
+		t.Errorf("expected the derived memorylimitmb = 2048 in:\n%s", got)
+	}
+	if !kmapi.IsConditionFalse(rc.db.Status.Conditions, msapi.DatabaseConfigurationValid) {
+		t.Error("expected ConfigurationValid to be false")
+	}
+}
+
+func TestEnsureConfigSecretChangePendingRestart(t *testing.T) {
+	rc := newConfigTestContext(t, "[language]\nlcid = 1031\n")
+	ensure := func() {
+		if err := rc.ensureConfigSecret(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rc.ensureConfiguration(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ensure()
+	if status := rc.db.Status.Configuration; status == nil || status.Settings["configSecret"] == "" || len(status.PendingRestart) != 0 {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+
+	var secret core.Secret
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: "custom-config"}, &secret); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[msapi.MSSQLConfigFileName] = []byte("[language]\nlcid = 1036\n")
+	if err := rc.Client.Update(rc.ctx, &secret); err != nil {
+		t.Fatal(err)
+	}
+	ensure()
+	if got := renderedConfig(t, rc); !strings.Contains(got, "lcid = 1036") {
+		t.Errorf("rendered config:\n%s", got)
+	}
+	status := rc.db.Status.Configuration
+	if len(status.PendingRestart) != 1 || status.PendingRestart[0] != "configSecret" || status.PendingSince == nil {
+		t.Errorf("expected configSecret to be pending, got %+v", status)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabasePendingRestart) {
+		t.Errorf("expected condition %s to be true", msapi.DatabasePendingRestart)
+	}
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/mssqlconf"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// settingApply tells how a change of a setting reaches the running instances.
+type settingApply string
+
+const (
+	// applyOnRestart settings are read by SQL Server on startup only
+	applyOnRestart settingApply = "Restart"
+	// applyLive settings are applied to the running instances through T-SQL as well
+	applyLive settingApply = "Live"
+	// applyOnSetup settings are only used when the instance is set up. The webhook keeps them immutable.
+	applyOnSetup settingApply = "Setup"
+)
+
+// settingApplies lists how each field of spec.configuration is applied.
+var settingApplies = map[string]settingApply{
+	"memoryLimitMB":    applyOnRestart,
+	"collation":        applyOnSetup,
+	"lcid":             applyOnRestart,
+	"timeZone":         applyOnRestart,
+	"sqlAgentEnabled":  applyOnRestart,
+	"defaultDataDir":   applyOnRestart,
+	"defaultLogDir":    applyOnRestart,
+	"defaultBackupDir": applyOnRestart,
+	"traceFlags":       applyLive,
+	"tcpPort":          applyOnRestart,
+	"numErrorLogs":     applyOnRestart,
+	"hadrEnabled":      applyOnRestart,
+	"forceEncryption":  applyOnRestart,
+	"configSecret":     applyOnRestart,
+}
+
+// setting is a field of spec.configuration, rendered into mssql.conf and/or an environment variable.
+type setting struct {
+	// name is the json name of the field
+	name string
+	// value is compared to detect changes
+	value string
+	env   string
+	conf  mssqlconf.Config
+}
+
+func newSetting(name, value, section, key, env string) setting {
+	s := setting{name: name, value: value, env: env, conf: mssqlconf.Config{}}
+	if section != "" {
+		s.conf.Set(section, key, value)
+	}
+	return s
+}
+
+// configurationSettings returns the settings that are set in spec.configuration, and the memory limit derived
+// from the container resources unless spec.configSecret sets it.
+func (r *reconcileContext) configurationSettings() []setting {
+	var settings []setting
+	// the memory limit follows spec.podTemplate.spec.resources, so a change of it needs a restart as well
+	if limit := r.memoryLimitMB(); limit != nil {
+		settings = append(settings, newSetting("memoryLimitMB", strconv.Itoa(int(*limit)), "memory", "memorylimitmb", "MSSQL_MEMORY_LIMIT_MB"))
+	}
+	// the settings of spec.configSecret are tracked by their hash, SQL Server reads mssql.conf on startup only
+	if r.db.Spec.ConfigSecret != nil {
+		settings = append(settings, setting{name: "configSecret", value: r.userConfHash(), conf: mssqlconf.Config{}})
+	}
+	cfg := r.db.Spec.Configuration
+	if cfg == nil {
+		return settings
+	}
+	addInt := func(name string, v *int32, section, key, env string) {
+		if v != nil {
+			settings = append(settings, newSetting(name, strconv.Itoa(int(*v)), section, key, env))
+		}
+	}
+	addBool := func(name string, v *bool, section, key, env string) {
+		if v != nil {
+			settings = append(settings, newSetting(name, strconv.FormatBool(*v), section, key, env))
+		}
+	}
+	// addFlag is for the settings SQL Server reads as 0 or 1
+	addFlag := func(name string, v *bool, section, key, env string) {
+		if v != nil {
+			value := "0"
+			if *v {
+				value = "1"
+			}
+			settings = append(settings, newSetting(name, value, section, key, env))
+		}
+	}
+	addString := func(name, v, section, key, env string) {
+		if v != "" {
+			settings = append(settings, newSetting(name, v, section, key, env))
+		}
+	}
+
+	addString("collation", cfg.Collation, "", "", "MSSQL_COLLATION")
+	addInt("lcid", cfg.LCID, "language", "lcid", "MSSQL_LCID")
+	addString("timeZone", cfg.TimeZone, "", "", "TZ")
+	addBool("sqlAgentEnabled", cfg.SQLAgentEnabled, "sqlagent", "enabled", "MSSQL_AGENT_ENABLED")
+	addString("defaultDataDir", cfg.DefaultDataDir, "filelocation", "defaultdatadir", "MSSQL_DATA_DIR")
+	addString("defaultLogDir", cfg.DefaultLogDir, "filelocation", "defaultlogdir", "MSSQL_LOG_DIR")
+	addString("defaultBackupDir", cfg.DefaultBackupDir, "filelocation", "defaultbackupdir", "MSSQL_BACKUP_DIR")
+	if len(cfg.TraceFlags) > 0 {
+		s := setting{name: "traceFlags", value: joinTraceFlags(cfg.TraceFlags), conf: mssqlconf.Config{}}
+		for i, flag := range cfg.TraceFlags {
+			s.conf.Set("traceflag", fmt.Sprintf("traceflag%d", i), strconv.Itoa(int(flag)))
+		}
+		settings = append(settings, s)
+	}
+	addInt("tcpPort", cfg.TCPPort, "network", "tcpport", "MSSQL_TCP_PORT")
+	addInt("numErrorLogs", cfg.NumErrorLogs, "errorlog", "numerrorlogs", "")
+	addFlag("hadrEnabled", cfg.HADREnabled, "hadr", "hadrenabled", "MSSQL_ENABLE_HADR")
+	addFlag("forceEncryption", cfg.ForceEncryption, "network", "forceencryption", "")
+	return settings
+}
+
+// memoryLimitMB is the memory.memorylimitmb of SQL Server. spec.configuration.memoryLimitMB takes precedence over
+// the value of spec.configSecret, which takes precedence over the one derived from the container memory limit.
+func (r *reconcileContext) memoryLimitMB() *int32 {
+	if cfg := r.db.Spec.Configuration; cfg == nil || cfg.MemoryLimitMB == nil {
+		if v, ok := r.userConf.Get("memory", "memorylimitmb"); ok {
+			if limit, err := strconv.ParseInt(v, 10, 32); err == nil {
+				return pointer.Int32P(int32(limit))
+			}
+		}
+	}
+	return r.db.MemoryLimitMB()
+}
+
+// userConfHash is the sha256 of the settings of spec.configSecret that are rendered into mssql.conf, but
+// memory.memorylimitmb, which is tracked as memoryLimitMB.
+func (r *reconcileContext) userConfHash() string {
+	cfg := mssqlconf.Merge(r.userConf)
+	cfg.Delete("memory", "memorylimitmb")
+	sum := sha256.Sum256([]byte(cfg.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func joinTraceFlags(flags []int32) string {
+	s := make([]string, 0, len(flags))
+	for _, f := range flags {
+		s = append(s, strconv.Itoa(int(f)))
+	}
+	return strings.Join(s, ",")
+}
+
+func splitTraceFlags(s string) sets.String {
+	if s == "" {
+		return sets.NewString()
+	}
+	return sets.NewString(strings.Split(s, ",")...)
+}
+
+// configurationConf returns the mssql.conf settings of spec.configuration.
+func (r *reconcileContext) configurationConf() mssqlconf.Config {
+	cfg := mssqlconf.Config{}
+	for _, s := range r.configurationSettings() {
+		cfg = mssqlconf.Merge(cfg, s.conf)
+	}
+	return cfg
+}
+
+// configurationEnv returns the environment variables of spec.configuration.
+func (r *reconcileContext) configurationEnv() []core.EnvVar {
+	var envs []core.EnvVar
+	for _, s := range r.configurationSettings() {
+		if s.env != "" {
+			envs = append(envs, core.EnvVar{Name: s.env, Value: s.value})
+		}
+	}
+	return envs
+}
+
+// ensureConfiguration records the changes of spec.configuration & spec.configSecret in status.configuration. The changes of the live
+// settings are applied to the running instances; the others are listed as pending until every pod has been
+// restarted after the change.
+func (r *reconcileContext) ensureConfiguration() error {
+	desired := map[string]string{}
+	for _, s := range r.configurationSettings() {
+		desired[s.name] = s.value
+	}
+
+	old := r.db.Status.Configuration
+	if old == nil {
+		if len(desired) == 0 {
+			return nil
+		}
+		// the pods are built with these settings from the start
+		return r.updateStatus(func(status *msapi.MSSQLStatus) {
+			status.Configuration = &msapi.MSSQLConfigurationStatus{Settings: desired}
+		})
+	}
+
+	next := old.DeepCopy()
+	if changed := changedSettings(old.Settings, desired); len(changed) > 0 {
+		var live, pending []string
+		for _, name := range changed {
+			if settingApplies[name] != applyLive {
+				pending = append(pending, name)
+				continue
+			}
+			if err := r.applyLive(name, old.Settings[name], desired[name]); err != nil {
+				// mssql.conf has it anyway, so a restart applies it
+				r.Log.Info("Failed to apply setting to the running instances", "setting", name, "error", err.Error())
+				r.recordEvent(core.EventTypeWarning, EventReasonFailedToApply,
+					"Failed to apply %s to the running instances, it takes effect on restart: %v", name, err)
+				pending = append(pending, name)
+				continue
+			}
+			live = append(live, name)
+		}
+		next.Settings = desired
+		next.AppliedLive = live
+		if len(pending) > 0 {
+			next.PendingRestart = sets.NewString(next.PendingRestart...).Insert(pending...).List()
+			if next.PendingSince == nil {
+				now := metav1.Now()
+				next.PendingSince = &now
+			}
+			r.recordEvent(core.EventTypeNormal, EventReasonPendingRestart,
+				"Changed setting(s) %s take effect once the pods are restarted", strings.Join(pending, ", "))
+		}
+	}
+
+	if next.PendingSince != nil {
+		restarted, err := r.allInstancesStartedAfter(next.PendingSince.Time)
+		if err != nil {
+			return err
+		}
+		if restarted {
+			next.PendingRestart = nil
+			next.PendingSince = nil
+		}
+	}
+
+	conditions := r.pendingRestartConditions(r.db.Status.Conditions, next.PendingRestart)
+	if equality.Semantic.DeepEqual(old, next) && equality.Semantic.DeepEqual(r.db.Status.Conditions, conditions) {
+		return nil
+	}
+	return r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Configuration = next
+		status.Conditions = r.pendingRestartConditions(status.Conditions, next.PendingRestart)
+	})
+}
+
+// pendingRestartConditions returns the conditions with the PendingRestart condition telling whether the given
+// settings wait for the pods to be restarted. The condition is only added once a setting is pending.
+func (r *reconcileContext) pendingRestartConditions(conditions []kmapi.Condition, pending []string) []kmapi.Condition {
+	conditions = append([]kmapi.Condition(nil), conditions...)
+	if len(pending) > 0 {
+		return kmapi.SetCondition(conditions, kmapi.Condition{
+			Type:               msapi.DatabasePendingRestart,
+			Status:             core.ConditionTrue,
+			Reason:             msapi.SettingsChanged,
+			ObservedGeneration: r.db.Generation,
+			Message: fmt.Sprintf("Changed setting(s) %s take effect once the pods are restarted. "+
+				"The StatefulSet is updated OnDelete, delete the pods one at a time, the primary last", strings.Join(pending, ", ")),
+		})
+	}
+	if !kmapi.HasCondition(conditions, msapi.DatabasePendingRestart) {
+		return conditions
+	}
+	return kmapi.SetCondition(conditions, kmapi.Condition{
+		Type:               msapi.DatabasePendingRestart,
+		Status:             core.ConditionFalse,
+		Reason:             msapi.PodsRestarted,
+		ObservedGeneration: r.db.Generation,
+		Message:            "Every pod runs with the current settings",
+	})
+}
+
+// changedSettings returns the names of the settings that were added, removed or changed, in lexical order.
+func changedSettings(old, desired map[string]string) []string {
+	changed := sets.NewString()
+	for name, v := range desired {
+		if ov, ok := old[name]; !ok || ov != v {
+			changed.Insert(name)
+		}
+	}
+	for name := range old {
+		if _, ok := desired[name]; !ok {
+			changed.Insert(name)
+		}
+	}
+	return changed.List()
+}
+
+// applyLive applies the change of a live setting to every instance.
+func (r *reconcileContext) applyLive(name, oldValue, newValue string) error {
+	if name != "traceFlags" {
+		return fmt.Errorf("%s can't be applied live", name)
+	}
+	oldFlags, newFlags := splitTraceFlags(oldValue), splitTraceFlags(newValue)
+	var statements []string
+	for _, flag := range newFlags.Difference(oldFlags).List() {
+		statements = append(statements, fmt.Sprintf("DBCC TRACEON(%s, -1)", flag))
+	}
+	for _, flag := range oldFlags.Difference(newFlags).List() {
+		statements = append(statements, fmt.Sprintf("DBCC TRACEOFF(%s, -1)", flag))
+	}
+
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		c, err := r.SQLClients.Instance(r.ctx, r.db, i)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range statements {
+			if err = c.Exec(r.ctx, stmt); err != nil {
+				return fmt.Errorf("instance %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// allInstancesStartedAfter reports whether the database container of every replica has been (re)started after t.
+func (r *reconcileContext) allInstancesStartedAfter(t time.Time) (bool, error) {
+	var pods core.PodList
+	err := r.Client.List(r.ctx, &pods, client.InNamespace(r.db.Namespace), client.MatchingLabels(r.db.OffshootSelectors()))
+	if err != nil {
+		return false, err
+	}
+	if int32(len(pods.Items)) < *r.db.Spec.Replicas {
+		return false, nil
+	}
+	for _, pod := range pods.Items {
+		startedAt := containerStartedAt(&pod, msapi.MSSQLContainerName)
+		if startedAt == nil || startedAt.Time.Before(t) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func containerStartedAt(pod *core.Pod, name string) *metav1.Time {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == name && status.State.Running != nil {
+			return &status.State.Running.StartedAt
+		}
+	}
+	return nil
+}
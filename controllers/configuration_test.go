@@ -0,0 +1,217 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+)
+
+func newConfigurationTestContext(t *testing.T, cfg *msapi.MSSQLConfiguration) (*reconcileContext, *sqlfake.Factory) {
+	db := newTestMSSQL()
+	db.Spec.Configuration = cfg
+	r, sqlClients := newTestReconciler(t, db)
+	return &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}, sqlClients
+}
+
+func TestConfigurationRendering(t *testing.T) {
+	rc, _ := newConfigurationTestContext(t, &msapi.MSSQLConfiguration{
+		MemoryLimitMB:   pointer.Int32P(4096),
+		Collation:       "Latin1_General_100_CI_AS_SC_UTF8",
+		SQLAgentEnabled: pointer.BoolP(true),
+		TraceFlags:      []int32{1222, 3226},
+		TCPPort:         pointer.Int32P(1533),
+	})
+
+	wantEnv := []core.EnvVar{
+		{Name: "MSSQL_MEMORY_LIMIT_MB", Value: "4096"},
+		{Name: "MSSQL_COLLATION", Value: "Latin1_General_100_CI_AS_SC_UTF8"},
+		{Name: "MSSQL_AGENT_ENABLED", Value: "true"},
+		{Name: "MSSQL_TCP_PORT", Value: "1533"},
+	}
+	if got := rc.configurationEnv(); !reflect.DeepEqual(got, wantEnv) {
+		t.Errorf("env = %v, want %v", got, wantEnv)
+	}
+
+	if err := rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	want := `[memory]
+memorylimitmb = 4096
+
+[network]
+tcpport = 1533
+
+[sqlagent]
+enabled = true
+
+[traceflag]
+traceflag0 = 1222
+traceflag1 = 3226
+`
+	if got := renderedConfig(t, rc); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEnsureConfigurationPendingRestart(t *testing.T) {
+	rc, _ := newConfigurationTestContext(t, &msapi.MSSQLConfiguration{MemoryLimitMB: pointer.Int32P(4096)})
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	status := rc.db.Status.Configuration
+	if status == nil || status.Settings["memoryLimitMB"] != "4096" || len(status.PendingRestart) != 0 {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+
+	rc.db.Spec.Configuration.MemoryLimitMB = pointer.Int32P(8192)
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	status = rc.db.Status.Configuration
+	if !reflect.DeepEqual(status.PendingRestart, []string{"memoryLimitMB"}) || status.PendingSince == nil {
+		t.Fatalf("expected memoryLimitMB to be pending, got %+v", status)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabasePendingRestart) {
+		t.Errorf("expected condition %s to be true", msapi.DatabasePendingRestart)
+	}
+
+	// the settings stay pending until every pod has been restarted after the change
+	for i, startedAt := range []time.Time{status.PendingSince.Add(time.Minute), status.PendingSince.Add(-time.Minute)} {
+		err := rc.Client.Create(rc.ctx, &core.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%d", rc.db.OffshootName(), i),
+				Namespace: rc.db.Namespace,
+				Labels:    rc.db.OffshootSelectors(),
+			},
+			Status: core.PodStatus{ContainerStatuses: []core.ContainerStatus{{
+				Name:  msapi.MSSQLContainerName,
+				State: core.ContainerState{Running: &core.ContainerStateRunning{StartedAt: metav1.NewTime(startedAt)}},
+			}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.db.Status.Configuration.PendingRestart) == 0 {
+		t.Fatal("expected memoryLimitMB to stay pending until every pod is restarted")
+	}
+	var pod core.Pod
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.OffshootName() + "-1"}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.ContainerStatuses[0].State.Running.StartedAt = metav1.NewTime(status.PendingSince.Add(time.Minute))
+	if err := rc.Client.Status().Update(rc.ctx, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if status = rc.db.Status.Configuration; len(status.PendingRestart) != 0 || status.PendingSince != nil {
+		t.Errorf("expected no pending settings, got %+v", status)
+	}
+	_, cond := kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabasePendingRestart)
+	if cond == nil || cond.Status != core.ConditionFalse || cond.Reason != msapi.PodsRestarted {
+		t.Errorf("unexpected %s condition %+v", msapi.DatabasePendingRestart, cond)
+	}
+}
+
+func TestEnsureConfigurationNoPendingRestartCondition(t *testing.T) {
+	rc, _ := newConfigurationTestContext(t, &msapi.MSSQLConfiguration{TraceFlags: []int32{1222}})
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	rc.db.Spec.Configuration.TraceFlags = []int32{3226}
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if kmapi.HasCondition(rc.db.Status.Conditions, msapi.DatabasePendingRestart) {
+		t.Errorf("unexpected condition %s for a live setting", msapi.DatabasePendingRestart)
+	}
+}
+
+func TestEnsureConfigurationLiveTraceFlags(t *testing.T) {
+	rc, sqlClients := newConfigurationTestContext(t, &msapi.MSSQLConfiguration{TraceFlags: []int32{1222}})
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.db.Spec.Configuration.TraceFlags = []int32{3226}
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	status := rc.db.Status.Configuration
+	if !reflect.DeepEqual(status.AppliedLive, []string{"traceFlags"}) || len(status.PendingRestart) != 0 {
+		t.Errorf("expected traceFlags to be applied live, got %+v", status)
+	}
+	want := []string{"DBCC TRACEON(3226, -1)", "DBCC TRACEOFF(1222, -1)"}
+	for i := int32(0); i < *rc.db.Spec.Replicas; i++ {
+		if got := sqlClients.Client(sqlclient.InstanceHost(rc.db, i)).Executed; !reflect.DeepEqual(got, want) {
+			t.Errorf("instance %d executed %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestEnsureConfigurationMemoryFollowsResources(t *testing.T) {
+	rc, _ := newConfigurationTestContext(t, nil)
+	if got := rc.getEnvList(); !hasEnv(got, "MSSQL_MEMORY_LIMIT_MB", "2048") {
+		t.Errorf("expected MSSQL_MEMORY_LIMIT_MB=2048 in %v", got)
+	}
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.db.Spec.PodTemplate.Spec.Resources.Limits[core.ResourceMemory] = resource.MustParse("8Gi")
+	if got := rc.getEnvList(); !hasEnv(got, "MSSQL_MEMORY_LIMIT_MB", "6553") {
+		t.Errorf("expected MSSQL_MEMORY_LIMIT_MB=6553 in %v", got)
+	}
+	if err := rc.ensureConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if status := rc.db.Status.Configuration; !reflect.DeepEqual(status.PendingRestart, []string{"memoryLimitMB"}) {
+		t.Errorf("expected memoryLimitMB to be pending, got %+v", status)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabasePendingRestart) {
+		t.Errorf("expected condition %s to be true", msapi.DatabasePendingRestart)
+	}
+}
+
+func hasEnv(envs []core.EnvVar, name, value string) bool {
+	for _, env := range envs {
+		if env.Name == name {
+			return env.Value == value
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+)
+
+func newCoordinatorTestContext(t *testing.T) *reconcileContext {
+	db := newTestMSSQL()
+	r, _ := newTestReconciler(t, db)
+	return &reconcileContext{
+		MSSQLReconciler: r,
+		ctx:             context.TODO(),
+		Log:             logr.Discard(),
+		db:              db,
+		version: &msapi.MSSQLVersion{
+			ObjectMeta: metav1.ObjectMeta{Name: "2019-cu18"},
+			Spec:       msapi.MSSQLVersionSpec{Coordinator: msapi.MSSQLVersionCoordinator{Image: "mssql-coordinator:test"}},
+		},
+	}
+}
+
+func TestCoordinatorSidecar(t *testing.T) {
+	rc := newCoordinatorTestContext(t)
+	sidecars, err := rc.getSidecars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sidecars) != 1 || sidecars[0].Name != msapi.MSSQLCoordinatorContainerName {
+		t.Fatalf("sidecars = %v", sidecars)
+	}
+	c := sidecars[0]
+	if !contains(c.Args, "--availability-group=mssql") || !contains(c.Args, "--port=1433") || !contains(c.Args, "--lease=mssql") {
+		t.Errorf("args = %v", c.Args)
+	}
+	if !hasEnv(c.Env, "POD_NAME", "") || hasEnv(c.Env, "ACCEPT_EULA", "Y") {
+		t.Errorf("env = %v", c.Env)
+	}
+	if c.ReadinessProbe == nil || c.ReadinessProbe.HTTPGet == nil || c.ReadinessProbe.HTTPGet.Path != "/readyz" {
+		t.Errorf("readiness probe = %v", c.ReadinessProbe)
+	}
+	if len(c.VolumeMounts) != 0 {
+		t.Errorf("volume mounts without tls = %v", c.VolumeMounts)
+	}
+
+	// the certificate of the local instance is verified against the CA of the server certificate secret
+	rc.db.Spec.TLS = &kmapi.TLSConfig{}
+	if sidecars, err = rc.getSidecars(); err != nil {
+		t.Fatal(err)
+	}
+	c = sidecars[0]
+	if !contains(c.Args, "--ca-file=/etc/mssql-tls/ca.crt") {
+		t.Errorf("args with tls = %v", c.Args)
+	}
+	if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].Name != msapi.MSSQLTLSVolumeName || !c.VolumeMounts[0].ReadOnly {
+		t.Errorf("volume mounts with tls = %v", c.VolumeMounts)
+	}
+
+	rc.version.Spec.Coordinator.Image = ""
+	if _, err = rc.getSidecars(); err == nil {
+		t.Error("expected an error without a coordinator image")
+	}
+
+	rc.db.Spec.Replicas = pointer.Int32P(1)
+	rc.db.Spec.Topology = nil
+	if sidecars, err = rc.getSidecars(); err != nil || len(sidecars) != 0 {
+		t.Errorf("standalone sidecars = %v, %v", sidecars, err)
+	}
+}
+
+func TestLeaseLivenessProbe(t *testing.T) {
+	rc := newCoordinatorTestContext(t)
+	probe := rc.getLeaseLivenessProbe()
+	if probe.HTTPGet == nil || probe.HTTPGet.Path != "/leasez" || probe.HTTPGet.Port.IntValue() != msapi.MSSQLCoordinatorPort {
+		t.Errorf("probe handler = %+v", probe.ProbeHandler)
+	}
+	// SQL Server is restarted before the primary lease of 30s expires
+	if probe.PeriodSeconds != 3 || probe.FailureThreshold != 2 {
+		t.Errorf("probe = %+v", probe)
+	}
+
+	opts := workloadOptions{livenessProbe: probe, podTemplate: rc.db.Spec.PodTemplate}
+	if c := getMainContainer(opts, "mssql:test"); c.LivenessProbe != probe {
+		t.Errorf("liveness probe of SQL Server = %+v", c.LivenessProbe)
+	}
+}
+
+func TestEnsureCoordinatorRBAC(t *testing.T) {
+	rc := newCoordinatorTestContext(t)
+	if err := rc.ensureCoordinatorRBAC(); err != nil {
+		t.Fatal(err)
+	}
+	key := types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.OffshootName()}
+	if err := rc.Client.Get(rc.ctx, key, &core.ServiceAccount{}); err != nil {
+		t.Errorf("service account: %v", err)
+	}
+	var role rbac.Role
+	if err := rc.Client.Get(rc.ctx, key, &role); err != nil {
+		t.Fatal(err)
+	}
+	if len(role.Rules) != 2 || !contains(role.Rules[0].Verbs, "patch") ||
+		!contains(role.Rules[1].Verbs, "update") || !contains(role.Rules[1].ResourceNames, rc.db.PrimaryLeaseName()) {
+		t.Errorf("role rules = %v", role.Rules)
+	}
+	var binding rbac.RoleBinding
+	if err := rc.Client.Get(rc.ctx, key, &binding); err != nil {
+		t.Fatal(err)
+	}
+	if len(binding.Subjects) != 1 || binding.Subjects[0].Name != rc.db.ServiceAccountName() {
+		t.Errorf("role binding subjects = %v", binding.Subjects)
+	}
+
+	// the service account of spec.podTemplate is bound instead
+	rc = newCoordinatorTestContext(t)
+	rc.db.Spec.PodTemplate.Spec.ServiceAccountName = "custom"
+	if err := rc.ensureCoordinatorRBAC(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Client.Get(rc.ctx, key, &core.ServiceAccount{}); err == nil {
+		t.Error("service account is created although spec.podTemplate names one")
+	}
+	if err := rc.Client.Get(rc.ctx, key, &binding); err != nil {
+		t.Fatal(err)
+	}
+	if binding.Subjects[0].Name != "custom" {
+		t.Errorf("role binding subjects = %v", binding.Subjects)
+	}
+}
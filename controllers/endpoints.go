@@ -0,0 +1,57 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+)
+
+const (
+	remoteAdminConnectionsQuery  = "SELECT CAST(value_in_use AS int) AS value FROM sys.configurations WHERE name = 'remote admin connections'"
+	enableRemoteAdminConnections = "EXEC sp_configure 'remote admin connections', 1; RECONFIGURE;"
+)
+
+// ensureAdminConnections enables the remote admin connections on every instance when spec.endpoints.adminConnection
+// is set. SQL Server only accepts the dedicated admin connection from the local host otherwise. The option is left
+// as is when the endpoint is removed.
+func (r *reconcileContext) ensureAdminConnections() error {
+	if r.db.AdminServicePort() == 0 || !kmapi.IsConditionTrue(r.db.Status.Conditions, dbapi.DatabaseAcceptingConnection) {
+		return nil
+	}
+
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		c, err := r.SQLClients.Instance(r.ctx, r.db, i)
+		if err != nil {
+			return err
+		}
+		rows, err := c.Query(r.ctx, remoteAdminConnectionsQuery)
+		if err != nil {
+			return fmt.Errorf("instance %d: %w", i, err)
+		}
+		if len(rows) == 1 && fmt.Sprint(rows[0]["value"]) == "1" {
+			continue
+		}
+		if err = c.Exec(r.ctx, enableRemoteAdminConnections); err != nil {
+			return fmt.Errorf("instance %d: %w", i, err)
+		}
+		r.Log.Info("Enabled remote admin connections", "instance", i)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	ofst "kmodules.xyz/offshoot-api/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+)
+
+func newEndpointsTestContext(t *testing.T) (*reconcileContext, *sqlfake.Factory) {
+	db := newTestMSSQL()
+	db.Spec.Port = pointer.Int32P(11433)
+	db.Spec.Endpoints = &msapi.MSSQLEndpoints{
+		Mirroring:       &msapi.MSSQLEndpoint{},
+		AdminConnection: &msapi.MSSQLEndpoint{Port: pointer.Int32P(11434)},
+	}
+	r, sqlClients := newTestReconciler(t, db)
+	return &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}, sqlClients
+}
+
+func servicePorts(t *testing.T, rc *reconcileContext, name string) map[string]int32 {
+	var svc core.Service
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: name}, &svc); err != nil {
+		t.Fatal(err)
+	}
+	ports := map[string]int32{}
+	for _, p := range svc.Spec.Ports {
+		if p.TargetPort.StrVal != p.Name {
+			t.Errorf("service %s: port %s targets %s", name, p.Name, p.TargetPort.String())
+		}
+		ports[p.Name] = p.Port
+	}
+	return ports
+}
+
+func TestEndpointPorts(t *testing.T) {
+	rc, _ := newEndpointsTestContext(t)
+	if err := rc.ensurePrimaryService(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.ensureGoverningServices(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int32{msapi.MSSQLDatabasePortName: 11433, msapi.MSSQLAdminPortName: 11434}
+	if got := servicePorts(t, rc, rc.db.PrimaryServiceName()); !reflect.DeepEqual(got, want) {
+		t.Errorf("primary service ports = %v, want %v", got, want)
+	}
+	want[msapi.MSSQLMirroringPortName] = msapi.MSSQLMirroringPort
+	if got := servicePorts(t, rc, rc.db.GoverningServiceName()); !reflect.DeepEqual(got, want) {
+		t.Errorf("governing service ports = %v, want %v", got, want)
+	}
+
+	got := map[string]int32{}
+	for _, p := range rc.getContainerPorts() {
+		got[p.Name] = p.ContainerPort
+	}
+	want = map[string]int32{
+		msapi.MSSQLDatabasePortName:  11433,
+		msapi.MSSQLMirroringPortName: msapi.MSSQLMirroringPort,
+		msapi.MSSQLAdminPortName:     msapi.MSSQLAdminPort,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("container ports = %v, want %v", got, want)
+	}
+}
+
+func TestEnsureAdminConnections(t *testing.T) {
+	rc, sqlClients := newEndpointsTestContext(t)
+	rc.db.Status.Conditions = kmapi.SetCondition(rc.db.Status.Conditions, kmapi.Condition{
+		Type:   dbapi.DatabaseAcceptingConnection,
+		Status: core.ConditionTrue,
+	})
+	// the second instance has it enabled already
+	sqlClients.Client(sqlclient.InstanceHost(rc.db, 1)).Results = map[string][]sqlclient.Row{
+		remoteAdminConnectionsQuery: {{"value": int64(1)}},
+	}
+
+	if err := rc.ensureAdminConnections(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0)).Executed; !reflect.DeepEqual(got, []string{enableRemoteAdminConnections}) {
+		t.Errorf("instance 0 executed %v", got)
+	}
+	if got := sqlClients.Client(sqlclient.InstanceHost(rc.db, 1)).Executed; len(got) != 0 {
+		t.Errorf("instance 1 executed %v", got)
+	}
+}
+
+func TestEnsureStandbyService(t *testing.T) {
+	rc, _ := newEndpointsTestContext(t)
+	rc.db.Spec.ServiceTemplates = []dbapi.NamedServiceTemplateSpec{{
+		Alias: dbapi.StandbyServiceAlias,
+		ServiceTemplateSpec: ofst.ServiceTemplateSpec{
+			ObjectMeta: ofst.ObjectMeta{Annotations: map[string]string{"team": "reports"}},
+			Spec:       ofst.ServiceSpec{Type: core.ServiceTypeLoadBalancer},
+		},
+	}}
+	if err := rc.ensureStandbyService(); err != nil {
+		t.Fatal(err)
+	}
+
+	var svc core.Service
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: "mssql-standby"}, &svc); err != nil {
+		t.Fatal(err)
+	}
+	if svc.Spec.Selector[dbapi.LabelRole] != msapi.DatabasePodSecondary {
+		t.Errorf("standby service selects %v", svc.Spec.Selector)
+	}
+	if svc.Spec.Type != core.ServiceTypeLoadBalancer || svc.Annotations["team"] != "reports" {
+		t.Errorf("standby service doesn't follow its template: type %s, annotations %v", svc.Spec.Type, svc.Annotations)
+	}
+	want := map[string]int32{msapi.MSSQLDatabasePortName: 11433, msapi.MSSQLAdminPortName: 11434}
+	if got := servicePorts(t, rc, svc.Name); !reflect.DeepEqual(got, want) {
+		t.Errorf("standby service ports = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	kutil "kmodules.xyz/client-go"
+)
+
+// Reasons of the events recorded on the MSSQL objects
+const (
+	EventReasonSuccessful        = "Successful"
+	EventReasonFailedToApply     = "FailedToApply"
+	EventReasonFailedToDelete    = "FailedToDelete"
+	EventReasonInvalid           = "Invalid"
+	EventReasonAuthSecretMissing = "AuthSecretMissing"
+	EventReasonVersionMissing    = "VersionMissing"
+	EventReasonFinalizerAdded    = "FinalizerAdded"
+	EventReasonFinalizerRemoved  = "FinalizerRemoved"
+	EventReasonPhaseChanged      = "PhaseChanged"
+	EventReasonHalted            = "Halted"
+	EventReasonTerminating       = "Terminating"
+	EventReasonInitialized       = "Initialized"
+	EventReasonInitScriptFailed  = "InitScriptFailed"
+	EventReasonPendingRestart    = "PendingRestart"
+	EventReasonRestarting        = "Restarting"
+	EventReasonCertExpiring      = "CertificateExpiring"
+
+	EventReasonAvailabilityGroupCreated = "AvailabilityGroupCreated"
+	EventReasonReplicaJoined            = "ReplicaJoined"
+	EventReasonReplicaRemoved           = "ReplicaRemoved"
+	EventReasonReplicaUnreachable       = "ReplicaUnreachable"
+	EventReasonPromoted                 = "Promoted"
+	EventReasonDemoted                  = "Demoted"
+	EventReasonFailoverStarted          = "FailoverStarted"
+	EventReasonFailoverSucceeded        = "FailoverSucceeded"
+	EventReasonFailoverFailed           = "FailoverFailed"
+	EventReasonSwitchoverStarted        = "SwitchoverStarted"
+	EventReasonSwitchoverSucceeded      = "SwitchoverSucceeded"
+	EventReasonSwitchoverFailed         = "SwitchoverFailed"
+)
+
+// NewEventBroadcaster returns the broadcaster of the events recorded by the reconciler. Similar events of an object
+// are aggregated, and the spam filter lets a burst of events per object through, refilled at one event per 5 minutes
+// afterwards. So a failing reconcile loop doesn't flood the events.
+func NewEventBroadcaster() record.EventBroadcaster {
+	return record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: 10,
+		QPS:       1. / 300.,
+	})
+}
+
+// recordEvent records an event on the MSSQL object of the current request.
+func (r *reconcileContext) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(r.db, eventType, reason, messageFmt, args...)
+}
+
+// recordApply records the outcome of a CreateOrPatch call for the given resource.
+// Nothing is recorded when the resource is unchanged, so that a steady state doesn't produce events.
+func (r *reconcileContext) recordApply(kind, name string, vt kutil.VerbType, err error) {
+	if err != nil {
+		r.recordEvent(core.EventTypeWarning, EventReasonFailedToApply, "Failed to apply %s %q: %v", kind, name, err)
+		return
+	}
+	if vt != kutil.VerbUnchanged {
+		r.recordEvent(core.EventTypeNormal, EventReasonSuccessful, "Successfully %s %s %q", vt, kind, name)
+	}
+}
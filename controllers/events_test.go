@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventSink stores the events written to the API server, by object & reason.
+type eventSink struct {
+	mu     sync.Mutex
+	writes int
+	counts map[string]int32
+}
+
+func (s *eventSink) store(event *core.Event) (*core.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	s.counts[event.InvolvedObject.Name+"/"+event.Reason] = event.Count
+	return event, nil
+}
+
+func (s *eventSink) Create(event *core.Event) (*core.Event, error) { return s.store(event) }
+
+func (s *eventSink) Update(event *core.Event) (*core.Event, error) { return s.store(event) }
+
+func (s *eventSink) Patch(event *core.Event, _ []byte) (*core.Event, error) { return s.store(event) }
+
+func (s *eventSink) state() (int, map[string]int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[string]int32{}
+	for k, v := range s.counts {
+		counts[k] = v
+	}
+	return s.writes, counts
+}
+
+func TestRecordEventSpamFilter(t *testing.T) {
+	sink := &eventSink{counts: map[string]int32{}}
+	broadcaster := NewEventBroadcaster()
+	broadcaster.StartRecordingToSink(sink)
+	defer broadcaster.Shutdown()
+
+	db := newTestMSSQL()
+	db.UID = types.UID("mssql")
+	r, _ := newTestReconciler(t, db)
+	r.Recorder = broadcaster.NewRecorder(r.Scheme, core.EventSource{Component: "mssql-controller"})
+	rc := &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}
+
+	// a failing reconcile loop records the same event over & over
+	for i := 0; i < 15; i++ {
+		rc.recordEvent(core.EventTypeWarning, EventReasonFailedToApply, "Failed to apply %s %q: %v", "StatefulSet", "mssql", "conflict")
+	}
+	other := newTestMSSQL()
+	other.Name = "other"
+	other.UID = types.UID("other")
+	(&reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: other}).
+		recordEvent(core.EventTypeNormal, EventReasonPhaseChanged, "Phase changed to %s", "Ready")
+
+	// the burst of 10 events of the first object, then the event of the second object
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		writes, _ := sink.state()
+		return writes >= 11, nil
+	})
+	if err != nil {
+		t.Fatal("events are not written")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	writes, counts := sink.state()
+	if writes != 11 {
+		t.Errorf("%d events written, want 11", writes)
+	}
+	// identical events are de-duplicated into a single event with a count
+	if count := counts["mssql/"+EventReasonFailedToApply]; count != 10 {
+		t.Errorf("event count = %d, want 10", count)
+	}
+	if count := counts["other/"+EventReasonPhaseChanged]; count != 1 {
+		t.Errorf("event count of another object = %d, want 1", count)
+	}
+}
+
+func TestReconcileEvents(t *testing.T) {
+	rc, req := newReconcileTestContext(t)
+	recorder := record.NewFakeRecorder(100)
+	rc.Recorder = recorder
+
+	if _, err := rc.reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	var reasons []string
+	for len(recorder.Events) > 0 {
+		reasons = append(reasons, strings.Fields(<-recorder.Events)[1])
+	}
+	for _, reason := range []string{EventReasonFinalizerAdded, EventReasonSuccessful} {
+		if !strings.Contains(strings.Join(reasons, " "), reason) {
+			t.Errorf("no %s event in %v", reason, reasons)
+		}
+	}
+
+	// a steady state doesn't produce events
+	if _, err := rc.reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	for len(recorder.Events) > 0 {
+		t.Errorf("unexpected event %q", <-recorder.Events)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// failoverCandidateQuery returns how far the local replica is caught up: its availability mode, the sequence
+// number of the availability group it last heard of & the lowest hardened LSN of its databases.
+const failoverCandidateQuery = "SELECT ar.availability_mode_desc AS availability_mode, ag.sequence_number AS sequence_number, " +
+	"CAST(MIN(drs.last_hardened_lsn) AS varchar(32)) AS last_hardened_lsn " +
+	"FROM sys.availability_groups ag " +
+	"JOIN sys.availability_replicas ar ON ar.group_id = ag.group_id " +
+	"JOIN sys.dm_hadr_availability_replica_states rs ON rs.replica_id = ar.replica_id AND rs.is_local = 1 " +
+	"LEFT JOIN sys.dm_hadr_database_replica_states drs ON drs.replica_id = ar.replica_id AND drs.is_local = 1 " +
+	"WHERE ag.name = @p1 GROUP BY ar.availability_mode_desc, ag.sequence_number"
+
+// failoverCandidate is a secondary replica that can take over the primary role.
+type failoverCandidate struct {
+	ordinal        int32
+	synchronous    bool
+	sequenceNumber *big.Int
+	lsn            *big.Int
+}
+
+// caughtUpWith tells whether the candidate has at least everything the other one has.
+func (c *failoverCandidate) caughtUpWith(o *failoverCandidate) bool {
+	if n := c.sequenceNumber.Cmp(o.sequenceNumber); n != 0 {
+		return n > 0
+	}
+	return c.lsn.Cmp(o.lsn) >= 0
+}
+
+// ensureFailover promotes a secondary when the primary replica has been lost for
+// spec.topology.availabilityGroup.failover.primaryTimeoutSeconds. The primary is lost when both the health checker
+// can't reach it, see status.availabilityGroup.primaryUnreachableSince, and its coordinator stopped renewing the
+// primary lease, i.e. it has fenced itself or its SQL Server was restarted, see getLeaseLivenessProbe. The
+// synchronous secondary that is the most caught up is promoted, any secondary with allowDataLoss. It gets the lease
+// before it is promoted. Meanwhile the reconcile is requeued for when the timeout or the lease is up. It returns
+// whether the primary moved.
+func (r *reconcileContext) ensureFailover() (bool, error) {
+	ag := r.db.AvailabilityGroup()
+	status := r.db.Status.AvailabilityGroup
+	if ag.Failover == nil || ag.Failover.Automatic == nil || !*ag.Failover.Automatic ||
+		status == nil || status.Primary == "" || status.PrimaryUnreachableSince == nil {
+		return false, nil
+	}
+	timeout := time.Duration(*ag.Failover.PrimaryTimeoutSeconds) * time.Second
+	if unreachable := time.Since(status.PrimaryUnreachableSince.Time); unreachable < timeout {
+		r.requeueIn(timeout - unreachable)
+		return false, nil
+	}
+	lease, err := r.getPrimaryLease()
+	if err != nil || lease == nil {
+		return false, err
+	}
+	holder := pointer.String(lease.Spec.HolderIdentity)
+	var reason string
+	switch {
+	case holder != status.Primary:
+		// the lease was handed over, but the promotion failed
+		reason = fmt.Sprintf("pod %s holds the primary lease", holder)
+	case leaseExpired(lease, time.Now()):
+		reason = fmt.Sprintf("the primary lease was last renewed at %s", lease.Spec.RenewTime.UTC().Format(time.RFC3339))
+	default:
+		// the coordinator of the primary may still renew it, look again once it would have expired
+		r.requeueIn(time.Until(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)))
+		return false, nil
+	}
+	old := r.ordinalOf(status.Primary)
+
+	var best *failoverCandidate
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		if i == old || (holder != status.Primary && r.podName(i) != holder) {
+			continue
+		}
+		candidate, err := r.failoverCandidate(i)
+		if err != nil {
+			r.Log.Info("Replica can't take over the primary role", "replica", r.podName(i), "error", err.Error())
+			continue
+		}
+		if !candidate.synchronous && !ag.Failover.AllowDataLoss {
+			continue
+		}
+		if best == nil || (candidate.synchronous && !best.synchronous) ||
+			(candidate.synchronous == best.synchronous && candidate.caughtUpWith(best)) {
+			best = candidate
+		}
+	}
+	if best == nil {
+		err = fmt.Errorf("primary %s is lost (%s) but no secondary can take over", status.Primary, reason)
+		r.recordEvent(core.EventTypeWarning, EventReasonFailoverFailed, err.Error())
+		return false, err
+	}
+
+	to := r.podName(best.ordinal)
+	r.recordEvent(core.EventTypeNormal, EventReasonFailoverStarted, "Failing over availability group %s from pod %s to pod %s: %s",
+		ag.Name, status.Primary, to, reason)
+	if holder != to {
+		if err = r.acquirePrimaryLease(lease, to); err != nil {
+			r.recordEvent(core.EventTypeWarning, EventReasonFailoverFailed, "Failed to fail over availability group %s to pod %s: %v", ag.Name, to, err)
+			return false, err
+		}
+	}
+	forced, err := r.promote(best)
+	if err != nil {
+		r.recordEvent(core.EventTypeWarning, EventReasonFailoverFailed, "Failed to fail over availability group %s to pod %s: %v", ag.Name, to, err)
+		return false, err
+	}
+
+	now := metav1.Now()
+	record := &msapi.MSSQLFailoverStatus{
+		From:            status.Primary,
+		To:              to,
+		Reason:          reason,
+		DataLossAllowed: forced,
+		DetectedAt:      status.PrimaryUnreachableSince.DeepCopy(),
+		CompletedAt:     now,
+		Duration:        &metav1.Duration{Duration: now.Sub(status.PrimaryUnreachableSince.Time).Round(time.Second)},
+	}
+	r.recordEvent(core.EventTypeNormal, EventReasonFailoverSucceeded, "Pod %s is the primary replica of availability group %s, the database was not writable for %s",
+		to, ag.Name, record.Duration.Duration)
+
+	err = r.updateStatus(func(in *msapi.MSSQLStatus) {
+		if in.AvailabilityGroup == nil {
+			in.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: ag.Name}
+		}
+		in.AvailabilityGroup.Primary = to
+		in.AvailabilityGroup.PrimaryUnreachableSince = nil
+		in.AvailabilityGroup.LastFailover = record
+		in.AvailabilityGroup.PrimaryServicePause = nil
+	})
+	if err != nil {
+		return true, err
+	}
+	// the old primary restarts to rejoin as a secondary. The deletion is no fence, a partitioned node may never see
+	// it: the coordinator of the old primary fenced it when the primary lease expired.
+	return true, r.deletePod(status.Primary)
+}
+
+// failoverCandidate queries how far the replica of the given ordinal is caught up.
+func (r *reconcileContext) failoverCandidate(ordinal int32) (*failoverCandidate, error) {
+	c, err := r.SQLClients.Instance(r.ctx, r.db, ordinal)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.Query(r.ctx, failoverCandidateQuery, r.db.AvailabilityGroup().Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("not joined to availability group %s", r.db.AvailabilityGroup().Name)
+	}
+	return &failoverCandidate{
+		ordinal:        ordinal,
+		synchronous:    fmt.Sprint(rows[0]["availability_mode"]) == "SYNCHRONOUS_COMMIT",
+		sequenceNumber: parseNumber(rows[0]["sequence_number"]),
+		lsn:            parseNumber(rows[0]["last_hardened_lsn"]),
+	}, nil
+}
+
+// promote makes the candidate the primary replica. A synchronous candidate fails over without data loss, the
+// others or the None cluster type need allowDataLoss. It returns whether the failover was forced.
+func (r *reconcileContext) promote(candidate *failoverCandidate) (bool, error) {
+	ag := r.db.AvailabilityGroup()
+	c, err := r.SQLClients.Instance(r.ctx, r.db, candidate.ordinal)
+	if err != nil {
+		return false, err
+	}
+	var batches []string
+	if ag.ClusterType == msapi.MSSQLClusterTypeExternal {
+		batches = append(batches, sqlclient.ExternalClusterSessionContext)
+	}
+	if ag.ClusterType == msapi.MSSQLClusterTypeExternal && candidate.synchronous {
+		err = c.ExecScript(r.ctx, append(batches, fmt.Sprintf("ALTER AVAILABILITY GROUP %s FAILOVER", quoteName(ag.Name))))
+		if err == nil || !ag.Failover.AllowDataLoss {
+			return false, err
+		}
+		r.Log.Info("Failover without data loss failed, forcing it", "error", err.Error())
+	}
+	if !ag.Failover.AllowDataLoss {
+		return false, fmt.Errorf("pod %s can't take over without allowDataLoss", r.podName(candidate.ordinal))
+	}
+	err = c.ExecScript(r.ctx, append(batches, fmt.Sprintf("ALTER AVAILABILITY GROUP %s FORCE_FAILOVER_ALLOW_DATA_LOSS", quoteName(ag.Name))))
+	return err == nil, err
+}
+
+// deletePod deletes a pod, for the statefulset to recreate it.
+func (r *reconcileContext) deletePod(name string) error {
+	err := r.Client.Delete(r.ctx, &core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: r.db.Namespace, Name: name}})
+	return client.IgnoreNotFound(err)
+}
+
+// ordinalOf returns the ordinal of a pod of the MSSQL object, -1 if the name isn't one of them.
+func (r *reconcileContext) ordinalOf(podName string) int32 {
+	prefix := r.db.OffshootName() + "-"
+	if !strings.HasPrefix(podName, prefix) {
+		return -1
+	}
+	ordinal, err := strconv.ParseInt(strings.TrimPrefix(podName, prefix), 10, 32)
+	if err != nil {
+		return -1
+	}
+	return int32(ordinal)
+}
+
+// setPrimaryReachable records since when the health checker can't reach the primary replica.
+func (r *reconcileContext) setPrimaryReachable(reachable bool) error {
+	status := r.db.Status.AvailabilityGroup
+	if status == nil || status.Primary == "" || reachable == (status.PrimaryUnreachableSince == nil) {
+		return nil
+	}
+	return r.updateStatus(func(in *msapi.MSSQLStatus) {
+		if in.AvailabilityGroup == nil {
+			return
+		}
+		if reachable {
+			in.AvailabilityGroup.PrimaryUnreachableSince = nil
+		} else if in.AvailabilityGroup.PrimaryUnreachableSince == nil {
+			now := metav1.Now()
+			in.AvailabilityGroup.PrimaryUnreachableSince = &now
+		}
+	})
+}
+
+// parseNumber parses the numbers of the SQL results, LSNs don't fit in an int64.
+func parseNumber(v interface{}) *big.Int {
+	n, ok := new(big.Int).SetString(strings.TrimSpace(fmt.Sprint(v)), 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return n
+}
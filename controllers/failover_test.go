@@ -0,0 +1,220 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+)
+
+// newFailoverTestContext returns a context whose primary mssql-0 has been unreachable for the given duration,
+// & hasn't renewed the primary lease since.
+func newFailoverTestContext(t *testing.T, unreachableFor time.Duration) (*reconcileContext, *sqlfake.Factory) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	createPrimaryLease(t, rc, "mssql-0", unreachableFor)
+	since := metav1.NewTime(time.Now().Add(-unreachableFor))
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{
+			Name:                    "mssql",
+			Primary:                 "mssql-0",
+			Replicas:                []string{"mssql-0", "mssql-1"},
+			PrimaryUnreachableSince: &since,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc, sqlClients
+}
+
+func setCandidate(sqlClients *sqlfake.Factory, db *msapi.MSSQL, ordinal int32, mode string, sequenceNumber int64, lsn string) *sqlfake.Client {
+	c := sqlClients.Client(sqlclient.InstanceHost(db, ordinal))
+	c.Results[failoverCandidateQuery] = []sqlclient.Row{{
+		"availability_mode": mode,
+		"sequence_number":   sequenceNumber,
+		"last_hardened_lsn": lsn,
+	}}
+	return c
+}
+
+func TestEnsureFailover(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, time.Minute)
+	second := setCandidate(sqlClients, rc.db, 1, "SYNCHRONOUS_COMMIT", 4, "38000000042400001")
+
+	failedOver, err := rc.ensureFailover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failedOver {
+		t.Fatal("expected a failover")
+	}
+	wantExecuted := []string{
+		"EXEC sp_set_session_context @key = N'external_cluster', @value = N'yes'",
+		"ALTER AVAILABILITY GROUP [mssql] FAILOVER",
+	}
+	if !reflect.DeepEqual(second.Executed, wantExecuted) {
+		t.Errorf("instance 1 executed %v, want %v", second.Executed, wantExecuted)
+	}
+	// the old primary is restarted
+	err = rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: "demo", Name: "mssql-0"}, &core.Pod{})
+	if !kerr.IsNotFound(err) {
+		t.Errorf("expected pod mssql-0 to be deleted, got %v", err)
+	}
+	if lease := getPrimaryLease(t, rc); pointer.String(lease.Spec.HolderIdentity) != "mssql-1" || pointer.Int32(lease.Spec.LeaseTransitions) != 1 {
+		t.Errorf("primary lease = %+v, want it held by mssql-1", lease.Spec)
+	}
+
+	status := rc.db.Status.AvailabilityGroup
+	if status.Primary != "mssql-1" || status.PrimaryUnreachableSince != nil {
+		t.Errorf("availability group status = %+v", status)
+	}
+	last := status.LastFailover
+	if last == nil || last.From != "mssql-0" || last.To != "mssql-1" || last.DataLossAllowed ||
+		!strings.HasPrefix(last.Reason, "the primary lease was last renewed at") || last.Duration == nil || last.Duration.Duration < time.Minute {
+		t.Errorf("last failover = %+v", last)
+	}
+}
+
+func TestEnsureFailoverWaitsForPrimaryTimeout(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, 10*time.Second)
+	second := setCandidate(sqlClients, rc.db, 1, "SYNCHRONOUS_COMMIT", 4, "38000000042400001")
+
+	failedOver, err := rc.ensureFailover()
+	if err != nil || failedOver {
+		t.Fatalf("ensureFailover() = %v, %v, want no failover", failedOver, err)
+	}
+	if len(second.Executed) != 0 {
+		t.Errorf("instance 1 executed %v", second.Executed)
+	}
+	// the reconcile comes back once the 30s timeout is up
+	if rc.requeueAfter <= 15*time.Second || rc.requeueAfter > 20*time.Second {
+		t.Errorf("requeue after %s, want 20s", rc.requeueAfter)
+	}
+}
+
+func TestEnsureFailoverPrimaryLeaseRenewed(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, time.Minute)
+	second := setCandidate(sqlClients, rc.db, 1, "SYNCHRONOUS_COMMIT", 4, "38000000042400001")
+	lease := getPrimaryLease(t, rc)
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: time.Now()}
+	if err := rc.Client.Update(rc.ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// the coordinator of the primary still renews the lease, i.e. only the operator lost it
+	failedOver, err := rc.ensureFailover()
+	if err != nil || failedOver {
+		t.Fatalf("ensureFailover() = %v, %v, want no failover", failedOver, err)
+	}
+	if len(second.Executed) != 0 {
+		t.Errorf("instance 1 executed %v", second.Executed)
+	}
+	if duration := time.Duration(pointer.Int32(lease.Spec.LeaseDurationSeconds)) * time.Second; rc.requeueAfter <= 0 || rc.requeueAfter > duration {
+		t.Errorf("requeue after %s, want it within the lease duration %s", rc.requeueAfter, duration)
+	}
+}
+
+func TestEnsureFailoverResumesHandedOverLease(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, time.Minute)
+	rc.db.Spec.Replicas = pointer.Int32P(3)
+	// the lease was handed to mssql-1, but its promotion failed
+	lease := getPrimaryLease(t, rc)
+	lease.Spec.HolderIdentity = pointer.StringP("mssql-1")
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: time.Now()}
+	if err := rc.Client.Update(rc.ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	second := setCandidate(sqlClients, rc.db, 1, "SYNCHRONOUS_COMMIT", 4, "38000000042400001")
+	third := setCandidate(sqlClients, rc.db, 2, "SYNCHRONOUS_COMMIT", 4, "38000000042600001")
+
+	if _, err := rc.ensureFailover(); err != nil {
+		t.Fatal(err)
+	}
+	if !executed(second, "FAILOVER") || len(third.Executed) != 0 {
+		t.Errorf("instance 1 executed %v, instance 2 executed %v, want instance 1 to fail over", second.Executed, third.Executed)
+	}
+	if rc.db.Status.AvailabilityGroup.Primary != "mssql-1" {
+		t.Errorf("primary = %s, want mssql-1", rc.db.Status.AvailabilityGroup.Primary)
+	}
+}
+
+func TestEnsureFailoverPicksMostCaughtUpSecondary(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, time.Minute)
+	rc.db.Spec.Replicas = pointer.Int32P(3)
+	second := setCandidate(sqlClients, rc.db, 1, "SYNCHRONOUS_COMMIT", 4, "38000000042400001")
+	third := setCandidate(sqlClients, rc.db, 2, "SYNCHRONOUS_COMMIT", 4, "38000000042600001")
+
+	if _, err := rc.ensureFailover(); err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Executed) != 0 || !executed(third, "FAILOVER") {
+		t.Errorf("instance 1 executed %v, instance 2 executed %v, want instance 2 to fail over", second.Executed, third.Executed)
+	}
+	if rc.db.Status.AvailabilityGroup.Primary != "mssql-2" {
+		t.Errorf("primary = %s, want mssql-2", rc.db.Status.AvailabilityGroup.Primary)
+	}
+}
+
+func TestEnsureFailoverAsynchronousSecondary(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, time.Minute)
+	second := setCandidate(sqlClients, rc.db, 1, "ASYNCHRONOUS_COMMIT", 4, "38000000042400001")
+
+	if _, err := rc.ensureFailover(); err == nil {
+		t.Error("expected an error without a synchronous secondary")
+	}
+	if len(second.Executed) != 0 {
+		t.Errorf("instance 1 executed %v", second.Executed)
+	}
+
+	rc.db.Spec.Topology.AvailabilityGroup.Failover.AllowDataLoss = true
+	if _, err := rc.ensureFailover(); err != nil {
+		t.Fatal(err)
+	}
+	if !executed(second, "ALTER AVAILABILITY GROUP [mssql] FORCE_FAILOVER_ALLOW_DATA_LOSS") {
+		t.Errorf("instance 1 executed %v, want a forced failover", second.Executed)
+	}
+	if last := rc.db.Status.AvailabilityGroup.LastFailover; last == nil || !last.DataLossAllowed {
+		t.Errorf("last failover = %+v, want data loss allowed", last)
+	}
+}
+
+func TestEnsureFailoverClusterTypeNone(t *testing.T) {
+	rc, sqlClients := newFailoverTestContext(t, time.Minute)
+	ag := rc.db.Spec.Topology.AvailabilityGroup
+	ag.ClusterType = msapi.MSSQLClusterTypeNone
+	ag.Failover.AllowDataLoss = true
+	second := setCandidate(sqlClients, rc.db, 1, "SYNCHRONOUS_COMMIT", 4, "38000000042400001")
+
+	if _, err := rc.ensureFailover(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ALTER AVAILABILITY GROUP [mssql] FORCE_FAILOVER_ALLOW_DATA_LOSS"}
+	if !reflect.DeepEqual(second.Executed, want) {
+		t.Errorf("instance 1 executed %v, want %v", second.Executed, want)
+	}
+}
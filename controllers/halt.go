@@ -0,0 +1,86 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"gomodules.xyz/pointer"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// halt parks a MSSQL with spec.halted set. The StatefulSet is scaled down to zero & the services are deleted.
+// PVCs, secrets & the finalizer are kept, so that unsetting spec.halted brings the database back with the same data.
+func (r *reconcileContext) halt() error {
+	r.stopHealthCheck()
+
+	var sts apps.StatefulSet
+	err := r.Client.Get(r.ctx, types.NamespacedName{
+		Name:      r.db.OffshootName(),
+		Namespace: r.db.Namespace,
+	}, &sts)
+	if err != nil && !kerr.IsNotFound(err) {
+		return err
+	}
+	if err == nil && pointer.Int32(sts.Spec.Replicas) != 0 {
+		patch := client.MergeFrom(sts.DeepCopy())
+		sts.Spec.Replicas = pointer.Int32P(0)
+		if err = r.Client.Patch(r.ctx, &sts, patch); err != nil {
+			return err
+		}
+		r.Log.Info("Scaled down statefulSet", "name", sts.Name)
+		r.recordEvent(core.EventTypeNormal, EventReasonHalted, "Scaled down StatefulSet %q to 0 replicas", sts.Name)
+	}
+
+	for _, name := range []string{r.db.PrimaryServiceName(), r.db.StandbyServiceName(), r.db.GoverningServiceName()} {
+		err = r.Client.Delete(r.ctx, &core.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: r.db.Namespace,
+			},
+		})
+		if err != nil && !kerr.IsNotFound(err) {
+			r.recordEvent(core.EventTypeWarning, EventReasonFailedToDelete, "Failed to delete Service %q: %v", name, err)
+			return err
+		}
+	}
+
+	oldPhase := r.db.Status.Phase
+	err = r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               dbapi.DatabaseHalted,
+			Status:             core.ConditionTrue,
+			Reason:             dbapi.DatabaseHaltedSuccessfully,
+			ObservedGeneration: r.db.Generation,
+			Message:            fmt.Sprintf("MSSQL %s/%s has been halted", r.db.Namespace, r.db.Name),
+		})
+		status.Phase = msapi.MSSQL{Status: *status}.GetPhase()
+		status.ObservedGeneration = r.db.Generation
+	})
+	if err != nil {
+		return err
+	}
+	r.recordPhaseChange(oldPhase)
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"gomodules.xyz/pointer"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// setHalted patches spec.halted of the MSSQL object & reconciles it.
+func setHalted(t *testing.T, rc *reconcileContext, req ctrl.Request, halted bool) {
+	var db msapi.MSSQL
+	if err := rc.Client.Get(rc.ctx, req.NamespacedName, &db); err != nil {
+		t.Fatal(err)
+	}
+	patch := client.MergeFrom(db.DeepCopy())
+	db.Spec.Halted = halted
+	if err := rc.Client.Patch(rc.ctx, &db, patch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// existingServices returns which of the primary, standby & governing services exist.
+func existingServices(t *testing.T, rc *reconcileContext) []bool {
+	var exist []bool
+	for _, name := range []string{rc.db.PrimaryServiceName(), rc.db.StandbyServiceName(), rc.db.GoverningServiceName()} {
+		err := rc.Client.Get(rc.ctx, client.ObjectKey{Namespace: rc.db.Namespace, Name: name}, &core.Service{})
+		if err != nil && !kerr.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		exist = append(exist, err == nil)
+	}
+	return exist
+}
+
+func statefulSetReplicas(t *testing.T, rc *reconcileContext) int32 {
+	var sts apps.StatefulSet
+	if err := rc.Client.Get(rc.ctx, client.ObjectKey{Namespace: rc.db.Namespace, Name: rc.db.OffshootName()}, &sts); err != nil {
+		t.Fatal(err)
+	}
+	return pointer.Int32(sts.Spec.Replicas)
+}
+
+func TestHaltAndResume(t *testing.T) {
+	rc, req := newReconcileTestContext(t)
+	if _, err := rc.reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	pvc := &core.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Name:      "data-" + rc.podName(0),
+		Namespace: rc.db.Namespace,
+		Labels:    rc.db.OffshootSelectors(),
+	}}
+	if err := rc.Client.Create(rc.ctx, pvc); err != nil {
+		t.Fatal(err)
+	}
+
+	setHalted(t, rc, req, true)
+	if replicas := statefulSetReplicas(t, rc); replicas != 0 {
+		t.Errorf("halted statefulSet has %d replicas, want 0", replicas)
+	}
+	for i, exists := range existingServices(t, rc) {
+		if exists {
+			t.Errorf("service %d of a halted MSSQL exists", i)
+		}
+	}
+	if err := rc.Client.Get(rc.ctx, client.ObjectKeyFromObject(pvc), &core.PersistentVolumeClaim{}); err != nil {
+		t.Errorf("PVC of a halted MSSQL: %v", err)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, dbapi.DatabaseHalted) {
+		t.Errorf("condition %s is not set", dbapi.DatabaseHalted)
+	}
+	if rc.db.Status.Phase != dbapi.DatabasePhaseHalted {
+		t.Errorf("phase = %s, want %s", rc.db.Status.Phase, dbapi.DatabasePhaseHalted)
+	}
+
+	setHalted(t, rc, req, false)
+	if replicas := statefulSetReplicas(t, rc); replicas != *rc.db.Spec.Replicas {
+		t.Errorf("resumed statefulSet has %d replicas, want %d", replicas, *rc.db.Spec.Replicas)
+	}
+	for i, exists := range existingServices(t, rc) {
+		if !exists {
+			t.Errorf("service %d of a resumed MSSQL is missing", i)
+		}
+	}
+	if err := rc.Client.Get(rc.ctx, client.ObjectKeyFromObject(pvc), &core.PersistentVolumeClaim{}); err != nil {
+		t.Errorf("PVC of a resumed MSSQL: %v", err)
+	}
+	if kmapi.HasCondition(rc.db.Status.Conditions, dbapi.DatabaseHalted) {
+		t.Errorf("condition %s is kept", dbapi.DatabaseHalted)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/client-go/tools/healthchecker"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// healthCheckKey is the key of the health checker goroutine of a MSSQL object.
+func healthCheckKey(db *msapi.MSSQL) string {
+	return db.Namespace + "/" + db.Name
+}
+
+// startHealthCheck starts the health checker of the MSSQL object, or updates its period if it is already running.
+func (r *reconcileContext) startHealthCheck() {
+	if r.HealthChecker == nil {
+		return
+	}
+	r.HealthChecker.Start(healthCheckKey(r.db), r.db.Spec.HealthChecker, r.checkHealth)
+}
+
+// stopHealthCheck stops the health checker of the MSSQL object, if any, & releases its connections.
+func (r *reconcileContext) stopHealthCheck() {
+	if r.HealthChecker != nil {
+		r.HealthChecker.Stop(healthCheckKey(r.db))
+	}
+	if r.SQLClients != nil {
+		r.SQLClients.Close(r.db)
+	}
+}
+
+// checkHealth is run by the health checker every spec.healthChecker.periodSeconds. It connects to each instance
+// through the SQL clients & runs a probe query. Unless spec.healthChecker.disableWriteCheck is set, a row is
+// written through the primary service too.
+// The AcceptingConnection & Ready conditions are only turned false after spec.healthChecker.failureThreshold
+// consecutive failures of the same kind. With an availability group, the time the primary replica became
+// unreachable is recorded for the failover.
+func (r *MSSQLReconciler) checkHealth(key string, card *healthchecker.HealthCard) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		klog.Errorf("invalid health check key %q: %v", key, err)
+		return
+	}
+	rc := &reconcileContext{
+		MSSQLReconciler: r,
+		ctx:             context.Background(),
+		Log:             ctrl.Log.WithName("health-checker").WithValues("mssql", key),
+	}
+	rc.db, err = rc.getMSSQL(types.NamespacedName{Namespace: namespace, Name: name})
+	if err != nil {
+		if kerr.IsNotFound(err) {
+			r.HealthChecker.Stop(key)
+			// connections are released by terminate(), unless the finalizer got removed by someone else
+			r.SQLClients.Close(&msapi.MSSQL{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
+			return
+		}
+		rc.Log.Error(err, "Failed to get MSSQL")
+		return
+	}
+	if rc.isMarkedForDeletion() || rc.db.Spec.Halted {
+		return
+	}
+	card.SetThreshold(*rc.db.Spec.HealthChecker.FailureThreshold)
+
+	ctx, cancel := context.WithTimeout(rc.ctx, time.Duration(*rc.db.Spec.HealthChecker.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	accepting := int32(0)
+	replicas := *rc.db.Spec.Replicas
+	var pingErr error
+	primaryReachable := true
+	primary := int32(-1)
+	if status := rc.db.Status.AvailabilityGroup; status != nil {
+		primary = rc.ordinalOf(status.Primary)
+	}
+	for i := int32(0); i < replicas; i++ {
+		c, err := r.SQLClients.Instance(ctx, rc.db, i)
+		if err != nil {
+			rc.onHealthCheckFailure(card, healthchecker.HealthCheckClientFailure, false, err)
+			return
+		}
+		if err = c.Ping(ctx); err != nil {
+			pingErr = fmt.Errorf("instance %s: %w", sqlclient.InstanceHost(rc.db, i), err)
+			primaryReachable = primaryReachable && i != primary
+			continue
+		}
+		accepting++
+	}
+	if err = rc.setPrimaryReachable(primaryReachable); err != nil {
+		rc.Log.Error(err, "Failed to update the availability group status")
+	}
+	if pingErr != nil {
+		rc.onHealthCheckFailure(card, healthchecker.HealthCheckPingFailure, accepting > 0, pingErr)
+		return
+	}
+
+	if !rc.db.Spec.HealthChecker.DisableWriteCheck {
+		if err = rc.checkWrite(ctx); err != nil {
+			rc.onHealthCheckFailure(card, healthchecker.HealthCheckWriteFailure, true, err)
+			return
+		}
+	}
+
+	card.Clear()
+	rc.setHealthConditions(true, true, fmt.Sprintf("%d/%d instance(s) are accepting connections", accepting, replicas))
+}
+
+// onHealthCheckFailure updates the conditions once the failure threshold of the health checker has been reached.
+func (r *reconcileContext) onHealthCheckFailure(card *healthchecker.HealthCard, label healthchecker.HealthCheckFailureLabel, accepting bool, err error) {
+	if !card.HasFailed(label, err) {
+		return
+	}
+	r.Log.Info("Health check failed", "reason", label, "error", err.Error())
+	r.setHealthConditions(accepting, false, fmt.Sprintf("%s: %v", label, err))
+}
+
+func (r *reconcileContext) setHealthConditions(accepting, ready bool, message string) {
+	oldPhase := r.db.Status.Phase
+	err := r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               dbapi.DatabaseAcceptingConnection,
+			Status:             conditionStatus(accepting),
+			Reason:             reasonFor(accepting, dbapi.DatabaseAcceptingConnectionRequest, dbapi.DatabaseNotAcceptingConnectionRequest),
+			ObservedGeneration: r.db.Generation,
+			Message:            message,
+		})
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               dbapi.DatabaseReady,
+			Status:             conditionStatus(ready),
+			Reason:             reasonFor(ready, dbapi.ReadinessCheckSucceeded, dbapi.ReadinessCheckFailed),
+			ObservedGeneration: r.db.Generation,
+			Message:            message,
+		})
+		r.setProvisionedIfReady(status)
+		status.Phase = msapi.MSSQL{Status: *status}.GetPhase()
+	})
+	if err != nil {
+		r.Log.Error(err, "Failed to update the health conditions")
+		return
+	}
+	r.recordPhaseChange(oldPhase)
+}
+
+// checkWrite upserts a row of the write check table through the primary service, creating the database
+// & the table if needed.
+func (r *reconcileContext) checkWrite(ctx context.Context) error {
+	c, err := r.SQLClients.Primary(ctx, r.db)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		fmt.Sprintf("IF DB_ID('%[1]s') IS NULL CREATE DATABASE [%[1]s]", healthchecker.KubeDBSystemDatabase),
+		fmt.Sprintf("IF OBJECT_ID('[%[1]s].dbo.[%[2]s]') IS NULL EXEC [%[1]s].sys.sp_executesql "+
+			"N'CREATE TABLE dbo.[%[2]s] (id INT PRIMARY KEY, last_write DATETIME2 NOT NULL)'",
+			healthchecker.KubeDBSystemDatabase, healthchecker.KubeDBWriteCheckTable),
+		fmt.Sprintf("MERGE [%[1]s].dbo.[%[2]s] AS t USING (SELECT 1 AS id) AS s ON t.id = s.id "+
+			"WHEN MATCHED THEN UPDATE SET last_write = SYSUTCDATETIME() "+
+			"WHEN NOT MATCHED THEN INSERT (id, last_write) VALUES (1, SYSUTCDATETIME());",
+			healthchecker.KubeDBSystemDatabase, healthchecker.KubeDBWriteCheckTable),
+	}
+	for _, stmt := range statements {
+		if err = c.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/client-go/tools/healthchecker"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+func getConditions(t *testing.T, r *MSSQLReconciler) []kmapi.Condition {
+	var db msapi.MSSQL
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: "demo", Name: "mssql"}, &db); err != nil {
+		t.Fatal(err)
+	}
+	return db.Status.Conditions
+}
+
+func TestCheckHealth(t *testing.T) {
+	db := newTestMSSQL()
+	r, sqlClients := newTestReconciler(t, db)
+
+	r.checkHealth("demo/mssql", &healthchecker.HealthCard{})
+	conditions := getConditions(t, r)
+	for _, c := range []string{dbapi.DatabaseAcceptingConnection, dbapi.DatabaseReady, dbapi.DatabaseProvisioned} {
+		if !kmapi.IsConditionTrue(conditions, c) {
+			t.Errorf("expected condition %s to be true, got %+v", c, conditions)
+		}
+	}
+	if n := len(sqlClients.Client(sqlclient.PrimaryHost(db)).Executed); n != 3 {
+		t.Errorf("expected 3 write check statements on the primary, got %d", n)
+	}
+}
+
+func TestCheckHealthDisableWriteCheck(t *testing.T) {
+	db := newTestMSSQL()
+	db.Spec.HealthChecker.DisableWriteCheck = true
+	r, sqlClients := newTestReconciler(t, db)
+
+	r.checkHealth("demo/mssql", &healthchecker.HealthCard{})
+	if !kmapi.IsConditionTrue(getConditions(t, r), dbapi.DatabaseReady) {
+		t.Error("expected the database to be Ready")
+	}
+	if n := len(sqlClients.Client(sqlclient.PrimaryHost(db)).Executed); n != 0 {
+		t.Errorf("expected no write check statements, got %d", n)
+	}
+}
+
+func TestCheckHealthFailureThreshold(t *testing.T) {
+	db := newTestMSSQL()
+	r, sqlClients := newTestReconciler(t, db)
+	card := &healthchecker.HealthCard{}
+
+	r.checkHealth("demo/mssql", card)
+	sqlClients.Client(sqlclient.InstanceHost(db, 1)).PingErr = errors.New("connection refused")
+
+	// the first failure is below the threshold
+	r.checkHealth("demo/mssql", card)
+	if !kmapi.IsConditionTrue(getConditions(t, r), dbapi.DatabaseReady) {
+		t.Error("expected the database to stay Ready below the failure threshold")
+	}
+
+	r.checkHealth("demo/mssql", card)
+	conditions := getConditions(t, r)
+	if kmapi.IsConditionTrue(conditions, dbapi.DatabaseReady) {
+		t.Error("expected the database not to be Ready once the failure threshold is reached")
+	}
+	if !kmapi.IsConditionTrue(conditions, dbapi.DatabaseAcceptingConnection) {
+		t.Error("expected the database to keep accepting connections through the healthy instance")
+	}
+}
+
+func TestCheckHealthMissingAuthSecret(t *testing.T) {
+	db := newTestMSSQL()
+	r, sqlClients := newTestReconciler(t, db)
+	sqlClients.Err = errors.New(`secrets "mssql-auth" not found`)
+	card := &healthchecker.HealthCard{}
+
+	// the first failure is below the threshold
+	r.checkHealth("demo/mssql", card)
+	if conditions := getConditions(t, r); len(conditions) != 0 {
+		t.Errorf("expected no condition below the failure threshold, got %+v", conditions)
+	}
+
+	r.checkHealth("demo/mssql", card)
+	conditions := getConditions(t, r)
+	for _, c := range []string{dbapi.DatabaseAcceptingConnection, dbapi.DatabaseReady} {
+		if !kmapi.IsConditionFalse(conditions, c) {
+			t.Errorf("expected condition %s to be false, got %+v", c, conditions)
+		}
+	}
+}
+
+func TestCheckHealthHalted(t *testing.T) {
+	db := newTestMSSQL()
+	db.Spec.Halted = true
+	// the default threshold fails on the first check
+	db.Spec.HealthChecker.FailureThreshold = nil
+	r, sqlClients := newTestReconciler(t, db)
+	sqlClients.Err = errors.New("unreachable")
+
+	r.checkHealth("demo/mssql", &healthchecker.HealthCard{})
+	if conditions := getConditions(t, r); len(conditions) != 0 {
+		t.Errorf("expected a halted database not to be checked, got %+v", conditions)
+	}
+}
+
+func TestCheckHealthPrimaryUnreachable(t *testing.T) {
+	db := newTestMSSQL()
+	db.Status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: "mssql", Primary: "mssql-1"}
+	r, sqlClients := newTestReconciler(t, db)
+	availabilityGroup := func() *msapi.MSSQLAvailabilityGroupStatus {
+		var db msapi.MSSQL
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: "demo", Name: "mssql"}, &db); err != nil {
+			t.Fatal(err)
+		}
+		return db.Status.AvailabilityGroup
+	}
+
+	sqlClients.Client(sqlclient.InstanceHost(db, 1)).PingErr = errors.New("connection refused")
+	r.checkHealth("demo/mssql", &healthchecker.HealthCard{})
+	since := availabilityGroup().PrimaryUnreachableSince
+	if since == nil {
+		t.Fatal("expected the primary to be marked unreachable")
+	}
+	// the first time it became unreachable is kept
+	r.checkHealth("demo/mssql", &healthchecker.HealthCard{})
+	if got := availabilityGroup().PrimaryUnreachableSince; got == nil || !got.Equal(since) {
+		t.Errorf("primaryUnreachableSince = %v, want %v", got, since)
+	}
+
+	sqlClients.Client(sqlclient.InstanceHost(db, 1)).PingErr = nil
+	r.checkHealth("demo/mssql", &healthchecker.HealthCard{})
+	if got := availabilityGroup().PrimaryUnreachableSince; got != nil {
+		t.Errorf("primaryUnreachableSince = %v, want it cleared", got)
+	}
+}
+
+func TestCheckHealthConcurrentReconcile(t *testing.T) {
+	db := newTestMSSQL()
+	db.Status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: "mssql", Primary: "mssql-1"}
+	r, sqlClients := newTestReconciler(t, db)
+	// the reconciler works on a copy read before the health checker writes the status
+	rc := &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard()}
+	var err error
+	if rc.db, err = rc.getMSSQL(types.NamespacedName{Namespace: "demo", Name: "mssql"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlClients.Client(sqlclient.InstanceHost(db, 1)).PingErr = errors.New("connection refused")
+	card := &healthchecker.HealthCard{}
+	for i := 0; i < 2; i++ {
+		r.checkHealth("demo/mssql", card)
+	}
+
+	if err = rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = rc.pendingRestartConditions(status.Conditions, []string{"max server memory (MB)"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conditions := getConditions(t, r)
+	for _, c := range []string{dbapi.DatabaseAcceptingConnection, msapi.DatabasePendingRestart} {
+		if !kmapi.HasCondition(conditions, c) {
+			t.Errorf("expected condition %s, got %+v", c, conditions)
+		}
+	}
+	if rc.db.Status.AvailabilityGroup.PrimaryUnreachableSince == nil {
+		t.Error("expected the reconciler to keep primaryUnreachableSince set by the health checker")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"kmodules.xyz/client-go/tools/healthchecker"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestReconciler returns a MSSQLReconciler on top of a fake client holding db & of an in-memory SQL Server.
+func newTestReconciler(t *testing.T, db *msapi.MSSQL) (*MSSQLReconciler, *sqlfake.Factory) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := msapi.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	sqlClients := sqlfake.NewFactory()
+	return &MSSQLReconciler{
+		Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(db).Build(),
+		Scheme:        scheme,
+		HealthChecker: healthchecker.NewHealthChecker(),
+		SQLClients:    sqlClients,
+	}, sqlClients
+}
+
+func newTestMSSQL() *msapi.MSSQL {
+	db := &msapi.MSSQL{
+		ObjectMeta: metav1.ObjectMeta{Name: "mssql", Namespace: "demo"},
+		Spec: msapi.MSSQLSpec{
+			Version:  "2019-cu18",
+			Replicas: pointer.Int32P(2),
+		},
+	}
+	db.SetDefaults()
+	db.Spec.HealthChecker.FailureThreshold = pointer.Int32P(2)
+	return db
+}
+
+// newReconcileTestContext returns the context of a full reconcile of a durable MSSQL, with its MSSQLVersion in place.
+func newReconcileTestContext(t *testing.T) (*reconcileContext, ctrl.Request) {
+	db := newTestMSSQL()
+	db.Spec.Storage = &core.PersistentVolumeClaimSpec{}
+	r, _ := newTestReconciler(t, db)
+	err := r.Client.Create(context.TODO(), &msapi.MSSQLVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: db.Spec.Version},
+		Spec: msapi.MSSQLVersionSpec{
+			Version:     "2019-CU18",
+			DB:          msapi.MSSQLVersionDatabase{Image: "mcr.microsoft.com/mssql/server:2019-CU18-ubuntu-20.04"},
+			Coordinator: msapi.MSSQLVersionCoordinator{Image: "ghcr.io/kubedb/mssql-coordinator:v0.1.0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard()}
+	return rc, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(db)}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+const (
+	// listInitScriptsQuery lists the .sql files of a directory of the server. The init scripts volume is
+	// mounted into the database container, so that the scripts of a PVC are read by the server.
+	listInitScriptsQuery = "SELECT file_or_directory_name AS name FROM sys.dm_os_enumerate_filesystem(@p1, @p2) WHERE is_directory = 0"
+	// readInitScriptQuery reads a file of the server as bytes, SINGLE_CLOB would convert it from the code page of
+	// the server. BULK only accepts a literal path.
+	readInitScriptQuery = "SELECT BulkColumn AS script FROM OPENROWSET(BULK N'%s', SINGLE_BLOB) AS s"
+
+	initPingTimeout = 10 * time.Second
+)
+
+func (r *reconcileContext) hasInitScript() bool {
+	return r.db.Spec.Init != nil && r.db.Spec.Init.Script != nil
+}
+
+func (r *reconcileContext) initScriptsDir() string {
+	return path.Join(msapi.MSSQLInitScriptsPath, r.db.Spec.Init.Script.ScriptPath)
+}
+
+// ensureInitScripts runs the init scripts of a new database against its first instance, in lexical order.
+// status.initScripts records every script that succeeded, so that a restart of the pods or of the operator
+// never runs a script twice. A failing script may have partially run, so it stops the initialization until
+// spec.init changes. Then the failed script & the following ones are run.
+func (r *reconcileContext) ensureInitScripts() error {
+	if !r.hasInitScript() || kmapi.IsConditionTrue(r.db.Status.Conditions, msapi.DatabaseInitialized) {
+		return nil
+	}
+	initHash, err := r.initSpecHash()
+	if err != nil {
+		return err
+	}
+	if r.db.Status.InitFailedSpecHash == initHash {
+		r.Log.V(1).Info("An init script failed, waiting for spec.init to change")
+		return nil
+	}
+	if !kmapi.HasCondition(r.db.Status.Conditions, msapi.DatabaseInitialized) {
+		if kmapi.IsConditionTrue(r.db.Status.Conditions, dbapi.DatabaseProvisioned) {
+			// spec.init was added to a database that already holds data
+			return r.setInitializedCondition(true, msapi.InitSkippedForExistingDatabase,
+				"The init scripts are only run for a new database")
+		}
+		// keeps the database from being marked as Provisioned until the scripts have been run
+		err = r.setInitializedCondition(false, msapi.InitScriptsPending, "Waiting for the database to accept connections")
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := r.SQLClients.Instance(r.ctx, r.db, 0)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, initPingTimeout)
+	err = c.Ping(ctx)
+	cancel()
+	if err != nil {
+		// the server is still starting, the reconcile is requeued until the database becomes Ready
+		r.Log.V(1).Info("Database is not accepting connections yet, init scripts are pending", "error", err.Error())
+		return nil
+	}
+
+	scripts, err := r.listInitScripts(c)
+	if err != nil {
+		return err
+	}
+	done := sets.NewString(r.db.Status.InitScripts...)
+	for _, script := range scripts {
+		if done.Has(script.name) {
+			continue
+		}
+		if err = r.runInitScript(c, script); err != nil {
+			r.recordEvent(core.EventTypeWarning, EventReasonInitScriptFailed, "Init script %q failed: %v", script.name, err)
+			serr := r.updateStatus(func(status *msapi.MSSQLStatus) {
+				status.InitFailedSpecHash = initHash
+				status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+					Type:               msapi.DatabaseInitialized,
+					Status:             core.ConditionFalse,
+					Reason:             msapi.InitScriptFailed,
+					ObservedGeneration: r.db.Generation,
+					Message:            fmt.Sprintf("Init script %q failed, change spec.init to retry: %v", script.name, err),
+				})
+			})
+			if serr != nil {
+				return serr
+			}
+			return fmt.Errorf("init script %q failed: %w", script.name, err)
+		}
+		err = r.updateStatus(func(status *msapi.MSSQLStatus) {
+			status.InitScripts = append(status.InitScripts, script.name)
+			status.InitFailedSpecHash = ""
+		})
+		if err != nil {
+			return err
+		}
+		r.Log.Info("Ran init script", "script", script.name)
+	}
+
+	r.recordEvent(core.EventTypeNormal, EventReasonInitialized, "Ran %d init script(s)", len(scripts))
+	return r.setInitializedCondition(true, msapi.InitScriptsSucceeded, fmt.Sprintf("%d init script(s) have been run", len(scripts)))
+}
+
+// initScript is a .sql file of the init scripts directory.
+type initScript struct {
+	name string
+	read func() ([]byte, error)
+}
+
+// listInitScripts returns the .sql files of the init scripts directory, in lexical order. The scripts of a
+// ConfigMap or a Secret are read through the API, those of a PVC by the server from the volume mounted into the
+// database container.
+func (r *reconcileContext) listInitScripts(c sqlclient.Client) ([]initScript, error) {
+	files, ok, err := r.getInitScriptObjectFiles()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return r.listServerInitScripts(c)
+	}
+	dir := path.Clean(r.db.Spec.Init.Script.ScriptPath)
+	var scripts []initScript
+	for _, file := range sets.StringKeySet(files).List() {
+		if path.Dir(file) != dir || path.Ext(file) != ".sql" {
+			continue
+		}
+		data := files[file]
+		scripts = append(scripts, initScript{name: path.Base(file), read: func() ([]byte, error) { return data, nil }})
+	}
+	return scripts, nil
+}
+
+// getInitScriptObjectFiles returns the content of the ConfigMap or the Secret of spec.init.script by path in the
+// volume, following the items. It returns false for the other sources.
+func (r *reconcileContext) getInitScriptObjectFiles() (map[string][]byte, bool, error) {
+	source := r.db.Spec.Init.Script
+	var data map[string][]byte
+	var items []core.KeyToPath
+	switch {
+	case source.ConfigMap != nil:
+		var cm core.ConfigMap
+		err := r.Client.Get(r.ctx, types.NamespacedName{Namespace: r.db.Namespace, Name: source.ConfigMap.Name}, &cm)
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to get the init scripts of ConfigMap %s: %w", source.ConfigMap.Name, err)
+		}
+		data = make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+		for k, v := range cm.Data {
+			data[k] = []byte(v)
+		}
+		for k, v := range cm.BinaryData {
+			data[k] = v
+		}
+		items = source.ConfigMap.Items
+	case source.Secret != nil:
+		var secret core.Secret
+		err := r.Client.Get(r.ctx, types.NamespacedName{Namespace: r.db.Namespace, Name: source.Secret.SecretName}, &secret)
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to get the init scripts of Secret %s: %w", source.Secret.SecretName, err)
+		}
+		data, items = secret.Data, source.Secret.Items
+	default:
+		return nil, false, nil
+	}
+	if len(items) == 0 {
+		return data, true, nil
+	}
+	files := make(map[string][]byte, len(items))
+	for _, item := range items {
+		if v, ok := data[item.Key]; ok {
+			files[path.Clean(item.Path)] = v
+		}
+	}
+	return files, true, nil
+}
+
+// listServerInitScripts lists the .sql files of the init scripts directory of the server.
+func (r *reconcileContext) listServerInitScripts(c sqlclient.Client) ([]initScript, error) {
+	rows, err := c.Query(r.ctx, listInitScriptsQuery, r.initScriptsDir(), "*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the init scripts of %s: %w", r.initScriptsDir(), err)
+	}
+	scripts := make([]initScript, 0, len(rows))
+	for _, row := range rows {
+		file := path.Join(r.initScriptsDir(), fmt.Sprint(row["name"]))
+		scripts = append(scripts, initScript{name: fmt.Sprint(row["name"]), read: func() ([]byte, error) {
+			rows, err := c.Query(r.ctx, fmt.Sprintf(readInitScriptQuery, strings.ReplaceAll(file, "'", "''")))
+			if err != nil {
+				return nil, err
+			}
+			if len(rows) != 1 {
+				return nil, fmt.Errorf("no content")
+			}
+			if data, ok := rows[0]["script"].([]byte); ok {
+				return data, nil
+			}
+			return []byte(fmt.Sprint(rows[0]["script"])), nil
+		}})
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].name < scripts[j].name })
+	return scripts, nil
+}
+
+// runInitScript runs the batches of a script. The scripts are UTF-8, with or without a byte order mark, & sent
+// to the server as is, so that their non-ASCII identifiers & literals are kept.
+func (r *reconcileContext) runInitScript(c sqlclient.Client, script initScript) error {
+	data, err := script.read()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", script.name, err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return fmt.Errorf("%s is not UTF-8 encoded", script.name)
+	}
+	return c.ExecScript(r.ctx, sqlclient.SplitBatches(string(data)))
+}
+
+// initSpecHash is the sha256 of spec.init.
+func (r *reconcileContext) initSpecHash() (string, error) {
+	data, err := json.Marshal(r.db.Spec.Init)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (r *reconcileContext) setInitializedCondition(initialized bool, reason, message string) error {
+	return r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               msapi.DatabaseInitialized,
+			Status:             conditionStatus(initialized),
+			Reason:             reason,
+			ObservedGeneration: r.db.Generation,
+			Message:            message,
+		})
+	})
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+)
+
+func newInitTestContext(t *testing.T) (*reconcileContext, *sqlfake.Client) {
+	db := newTestMSSQL()
+	db.Spec.Init = &dbapi.InitSpec{
+		Script: &dbapi.ScriptSourceSpec{
+			VolumeSource: core.VolumeSource{
+				ConfigMap: &core.ConfigMapVolumeSource{LocalObjectReference: core.LocalObjectReference{Name: "init"}},
+			},
+		},
+	}
+	r, sqlClients := newTestReconciler(t, db)
+	for _, name := range []string{"init", "init-fixed"} {
+		err := r.Client.Create(context.TODO(), &core.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: db.Namespace},
+			Data: map[string]string{
+				"02-data.sql":   "INSERT INTO app.dbo.t VALUES (1)",
+				"01-schema.sql": "CREATE DATABASE app\nGO\nUSE app\ngo\nCREATE TABLE t (id INT)\n",
+				"README.md":     "not a script",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}, sqlClients.Client(sqlclient.InstanceHost(db, 0))
+}
+
+func TestEnsureInitScripts(t *testing.T) {
+	rc, c := newInitTestContext(t)
+
+	if err := rc.ensureInitScripts(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE DATABASE app\n", "\nUSE app\n", "\nCREATE TABLE t (id INT)\n", "INSERT INTO app.dbo.t VALUES (1)"}
+	if !reflect.DeepEqual(c.Executed, want) {
+		t.Errorf("executed batches = %q, want %q", c.Executed, want)
+	}
+	if !reflect.DeepEqual(rc.db.Status.InitScripts, []string{"01-schema.sql", "02-data.sql"}) {
+		t.Errorf("status.initScripts = %v", rc.db.Status.InitScripts)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabaseInitialized) {
+		t.Error("expected DatabaseInitialized to be true")
+	}
+
+	// nothing is run again
+	c.Executed = nil
+	if err := rc.ensureInitScripts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Executed) != 0 {
+		t.Errorf("expected no batches to be run again, got %q", c.Executed)
+	}
+}
+
+func TestEnsureInitScriptsFailure(t *testing.T) {
+	rc, c := newInitTestContext(t)
+	c.ExecErr = errors.New("There is already an object named 't' in the database")
+
+	if err := rc.ensureInitScripts(); err == nil {
+		t.Fatal("expected an error")
+	}
+	_, cond := kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabaseInitialized)
+	if cond == nil || cond.Status != core.ConditionFalse || cond.Reason != msapi.InitScriptFailed {
+		t.Errorf("unexpected DatabaseInitialized condition %+v", cond)
+	}
+	if len(rc.db.Status.InitScripts) != 0 {
+		t.Errorf("status.initScripts = %v", rc.db.Status.InitScripts)
+	}
+
+	// the database must not be marked as Provisioned while the scripts are failing
+	rc.setHealthConditions(true, true, "")
+	if kmapi.IsConditionTrue(rc.db.Status.Conditions, dbapi.DatabaseProvisioned) {
+		t.Error("expected the database not to be Provisioned")
+	}
+}
+
+func TestEnsureInitScriptsRetryOnSpecChange(t *testing.T) {
+	rc, c := newInitTestContext(t)
+	c.ExecErr = errors.New("Incorrect syntax near 'TABEL'")
+	if err := rc.ensureInitScripts(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// a partially run script is not run again with the same spec.init
+	c.ExecErr = nil
+	if err := rc.ensureInitScripts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Executed) != 0 {
+		t.Errorf("executed %v after a failure", c.Executed)
+	}
+	if !kmapi.IsConditionFalse(rc.db.Status.Conditions, msapi.DatabaseInitialized) {
+		t.Error("expected the database not to be initialized")
+	}
+
+	rc.db.Spec.Init.Script.ConfigMap.Name = "init-fixed"
+	if err := rc.ensureInitScripts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Executed) != 4 {
+		t.Errorf("executed %v, want the batches of both scripts", c.Executed)
+	}
+	if !kmapi.IsConditionTrue(rc.db.Status.Conditions, msapi.DatabaseInitialized) {
+		t.Error("expected the database to be initialized")
+	}
+	if rc.db.Status.InitFailedSpecHash != "" {
+		t.Errorf("status.initFailedSpecHash = %s", rc.db.Status.InitFailedSpecHash)
+	}
+}
+
+func TestEnsureInitScriptsExistingDatabase(t *testing.T) {
+	rc, c := newInitTestContext(t)
+	rc.setHealthConditions(true, true, "")
+
+	if err := rc.ensureInitScripts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Executed) != 0 {
+		t.Errorf("expected no batches to be run, got %q", c.Executed)
+	}
+	_, cond := kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabaseInitialized)
+	if cond == nil || cond.Reason != msapi.InitSkippedForExistingDatabase {
+		t.Errorf("unexpected DatabaseInitialized condition %+v", cond)
+	}
+}
+
+func TestEnsureInitScriptsNonASCII(t *testing.T) {
+	rc, c := newInitTestContext(t)
+	rc.db.Spec.Init.Script.ConfigMap.Items = []core.KeyToPath{{Key: "café.sql", Path: "sql/01-café.sql"}}
+	rc.db.Spec.Init.Script.ScriptPath = "sql"
+	err := rc.Client.Create(rc.ctx, &core.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "init-utf8", Namespace: rc.db.Namespace},
+		Data:       map[string]string{"café.sql": "\ufeffINSERT INTO [Größe] VALUES (N'Crème brûlée 日本')"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.db.Spec.Init.Script.ConfigMap.Name = "init-utf8"
+
+	if err = rc.ensureInitScripts(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"INSERT INTO [Größe] VALUES (N'Crème brûlée 日本')"}
+	if !reflect.DeepEqual(c.Executed, want) {
+		t.Errorf("executed batches = %q, want %q", c.Executed, want)
+	}
+	if !reflect.DeepEqual(rc.db.Status.InitScripts, []string{"01-café.sql"}) {
+		t.Errorf("status.initScripts = %v", rc.db.Status.InitScripts)
+	}
+}
+
+func TestEnsureInitScriptsPersistentVolumeClaim(t *testing.T) {
+	rc, c := newInitTestContext(t)
+	rc.db.Spec.Init.Script.VolumeSource = core.VolumeSource{
+		PersistentVolumeClaim: &core.PersistentVolumeClaimVolumeSource{ClaimName: "init"},
+	}
+	c.Results[listInitScriptsQuery] = []sqlclient.Row{{"name": "02-bad.sql"}, {"name": "01-data.sql"}}
+	// the server returns the bytes of the file
+	c.Results[fmt.Sprintf(readInitScriptQuery, "/init-scripts/01-data.sql")] = []sqlclient.Row{
+		{"script": []byte("INSERT INTO t VALUES (N'Ünïcödé')")},
+	}
+	c.Results[fmt.Sprintf(readInitScriptQuery, "/init-scripts/02-bad.sql")] = []sqlclient.Row{
+		{"script": []byte{0xff, 0xfe, 'S', 0}},
+	}
+
+	if err := rc.ensureInitScripts(); err == nil {
+		t.Fatal("expected an error for a script that is not UTF-8")
+	}
+	want := []string{"INSERT INTO t VALUES (N'Ünïcödé')"}
+	if !reflect.DeepEqual(c.Executed, want) {
+		t.Errorf("executed batches = %q, want %q", c.Executed, want)
+	}
+	if !reflect.DeepEqual(rc.db.Status.InitScripts, []string{"01-data.sql"}) {
+		t.Errorf("status.initScripts = %v", rc.db.Status.InitScripts)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"gomodules.xyz/pointer"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kutil "kmodules.xyz/client-go"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+)
+
+// The primary lease is the single source of truth for which pod is the primary replica of an availability group.
+// Its holder is set by the operator only: when the availability group is created & when it fails over. The
+// coordinator of the holder renews it, while its instance answers. The coordinator of a primary replica fences the
+// instance, demoting it, as soon as another pod holds the lease or it couldn't renew the lease for a third of its
+// duration. As the coordinator can only fence while it runs, the liveness probe of SQL Server fails when the
+// coordinator is down or didn't fence in time, & the kubelet restarts SQL Server, see getLeaseLivenessProbe. The
+// operator only hands the lease to another pod once it hasn't been renewed for its whole duration, so the old
+// primary has stopped taking writes before the new one is promoted, as long as the clocks of the nodes are less than
+// a quarter of the lease duration apart.
+
+// getPrimaryLease returns the primary lease, nil if it isn't created yet.
+func (r *reconcileContext) getPrimaryLease() (*coordination.Lease, error) {
+	var lease coordination.Lease
+	err := r.Client.Get(r.ctx, types.NamespacedName{Namespace: r.db.Namespace, Name: r.db.PrimaryLeaseName()}, &lease)
+	if kerr.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// ensurePrimaryLease creates the primary lease for the primary replica. The lease is taken over if it expired,
+// i.e. when the primary moved while the operator wasn't looking. It fails while another pod holds it, the
+// coordinator of the primary replica fences it meanwhile.
+func (r *reconcileContext) ensurePrimaryLease(primary string) error {
+	lease, err := r.getPrimaryLease()
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		now := metav1.NowMicro()
+		lease = &coordination.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.db.PrimaryLeaseName(),
+				Namespace: r.db.Namespace,
+				Labels:    r.db.OffshootLabels(),
+			},
+			Spec: coordination.LeaseSpec{
+				HolderIdentity:       pointer.StringP(primary),
+				LeaseDurationSeconds: pointer.Int32P(r.primaryLeaseDurationSeconds()),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+				LeaseTransitions:     pointer.Int32P(0),
+			},
+		}
+		coreutil.EnsureOwnerReference(&lease.ObjectMeta, r.getOwnerRef())
+		err = r.Client.Create(r.ctx, lease)
+		r.recordApply("Lease", lease.Name, kutil.VerbCreated, err)
+		return err
+	}
+
+	holder := pointer.String(lease.Spec.HolderIdentity)
+	if holder == primary {
+		if pointer.Int32(lease.Spec.LeaseDurationSeconds) == r.primaryLeaseDurationSeconds() {
+			return nil
+		}
+		lease.Spec.LeaseDurationSeconds = pointer.Int32P(r.primaryLeaseDurationSeconds())
+		return r.Client.Update(r.ctx, lease)
+	}
+	if !leaseExpired(lease, time.Now()) {
+		err = fmt.Errorf("pod %s is the primary replica but pod %s holds the primary lease", primary, holder)
+		r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
+		return err
+	}
+	return r.acquirePrimaryLease(lease, primary)
+}
+
+// acquirePrimaryLease hands the lease to the given pod. The update fails if the lease was renewed meanwhile.
+func (r *reconcileContext) acquirePrimaryLease(lease *coordination.Lease, holder string) error {
+	now := metav1.NowMicro()
+	lease.Spec.HolderIdentity = pointer.StringP(holder)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32P(r.primaryLeaseDurationSeconds())
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseTransitions = pointer.Int32P(pointer.Int32(lease.Spec.LeaseTransitions) + 1)
+	if err := r.Client.Update(r.ctx, lease); err != nil {
+		return fmt.Errorf("failed to hand the primary lease to pod %s: %w", holder, err)
+	}
+	r.Log.Info("Handed the primary lease over", "holder", holder)
+	return nil
+}
+
+// primaryLeaseDurationSeconds is spec.topology.availabilityGroup.failover.primaryTimeoutSeconds.
+func (r *reconcileContext) primaryLeaseDurationSeconds() int32 {
+	if f := r.db.AvailabilityGroup().Failover; f != nil && f.PrimaryTimeoutSeconds != nil {
+		return *f.PrimaryTimeoutSeconds
+	}
+	return msapi.MSSQLDefaultPrimaryTimeoutSeconds
+}
+
+// leaseExpired tells whether the lease hasn't been renewed for its whole duration.
+func leaseExpired(lease *coordination.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"gomodules.xyz/pointer"
+	coordination "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// createPrimaryLease creates the primary lease held by holder & last renewed renewedAgo.
+func createPrimaryLease(t *testing.T, rc *reconcileContext, holder string, renewedAgo time.Duration) {
+	renewed := metav1.NewMicroTime(time.Now().Add(-renewedAgo))
+	err := rc.Client.Create(rc.ctx, &coordination.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: rc.db.PrimaryLeaseName(), Namespace: rc.db.Namespace},
+		Spec: coordination.LeaseSpec{
+			HolderIdentity:       pointer.StringP(holder),
+			LeaseDurationSeconds: pointer.Int32P(30),
+			RenewTime:            &renewed,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getPrimaryLease(t *testing.T, rc *reconcileContext) *coordination.Lease {
+	var lease coordination.Lease
+	key := types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.PrimaryLeaseName()}
+	if err := rc.Client.Get(rc.ctx, key, &lease); err != nil {
+		t.Fatal(err)
+	}
+	return &lease
+}
+
+func TestEnsurePrimaryLease(t *testing.T) {
+	rc, _ := newAvailabilityGroupTestContext(t)
+	if err := rc.ensurePrimaryLease("mssql-0"); err != nil {
+		t.Fatal(err)
+	}
+	lease := getPrimaryLease(t, rc)
+	if pointer.String(lease.Spec.HolderIdentity) != "mssql-0" || pointer.Int32(lease.Spec.LeaseDurationSeconds) != 30 ||
+		lease.Spec.RenewTime == nil || len(lease.OwnerReferences) != 1 {
+		t.Errorf("primary lease = %+v", lease)
+	}
+
+	// the lease duration follows primaryTimeoutSeconds
+	rc.db.Spec.Topology.AvailabilityGroup.Failover.PrimaryTimeoutSeconds = pointer.Int32P(20)
+	if err := rc.ensurePrimaryLease("mssql-0"); err != nil {
+		t.Fatal(err)
+	}
+	if d := getPrimaryLease(t, rc).Spec.LeaseDurationSeconds; pointer.Int32(d) != 20 {
+		t.Errorf("lease duration = %d, want 20", pointer.Int32(d))
+	}
+
+	// another primary doesn't get the lease while it is renewed
+	if err := rc.ensurePrimaryLease("mssql-1"); err == nil {
+		t.Error("expected an error while mssql-0 holds the lease")
+	}
+	if holder := getPrimaryLease(t, rc).Spec.HolderIdentity; pointer.String(holder) != "mssql-0" {
+		t.Errorf("lease holder = %s, want mssql-0", pointer.String(holder))
+	}
+}
+
+func TestEnsurePrimaryLeaseExpired(t *testing.T) {
+	rc, _ := newAvailabilityGroupTestContext(t)
+	createPrimaryLease(t, rc, "mssql-0", time.Minute)
+
+	if err := rc.ensurePrimaryLease("mssql-1"); err != nil {
+		t.Fatal(err)
+	}
+	lease := getPrimaryLease(t, rc)
+	if pointer.String(lease.Spec.HolderIdentity) != "mssql-1" || pointer.Int32(lease.Spec.LeaseTransitions) != 1 ||
+		leaseExpired(lease, time.Now()) {
+		t.Errorf("primary lease = %+v, want it renewed for mssql-1", lease.Spec)
+	}
+}
@@ -17,13 +17,18 @@ limitations under the License.
 package controllers
 
 import (
+	"fmt"
+	"path"
+
+	"gomodules.xyz/pointer"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	coreutil "kmodules.xyz/client-go/core/v1"
 	ofst "kmodules.xyz/offshoot-api/api/v1"
 	msapi "kubedb.dev/mssql/api/v1alpha1"
 )
 
-func (r *MSSQLReconciler) ensureNodes() error {
+func (r *reconcileContext) ensureNodes() error {
 	args, err := r.getArgs()
 	if err != nil {
 		return err
@@ -31,16 +36,22 @@ func (r *MSSQLReconciler) ensureNodes() error {
 	envList := r.getEnvList()
 
 	podTemplate := r.db.Spec.PodTemplate
-	initContnr, initvolumes, err := r.installInitContainer(podTemplate, r.db.Spec.ConfigSecret)
+	initContnr, initvolumes, err := r.installInitContainer(podTemplate)
+	if err != nil {
+		return err
+	}
+
+	sidecars, err := r.getSidecars()
 	if err != nil {
 		return err
 	}
 
 	opts := workloadOptions{
-		stsName:   r.db.OffshootName(),
-		labels:    r.db.OffshootLabels(),
-		selectors: r.db.OffshootSelectors(),
-		args:      args,
+		stsName:        r.db.OffshootName(),
+		labels:         r.db.OffshootLabels(),
+		selectors:      r.db.OffshootSelectors(),
+		podAnnotations: r.getPodAnnotations(),
+		args:           args,
 		cmd: func() []string {
 			return []string{}
 		}(),
@@ -50,24 +61,67 @@ func (r *MSSQLReconciler) ensureNodes() error {
 		podTemplate:    podTemplate,
 		pvcSpec:        r.db.Spec.Storage,
 		emptyDirSpec:   r.db.Spec.EphemeralStorage,
-		replicas:       r.db.Spec.Replicas,
+		replicas:       pointer.Int32P(r.instanceCount()),
+		ports:          r.getContainerPorts(),
+		sidecars:       sidecars,
 		volumes:        r.getVolumes(initvolumes, podTemplate),
 		volumeMount:    r.getVolumeMounts(podTemplate),
 	}
 
+	if r.db.AvailabilityGroup() != nil {
+		opts.serviceAccountName = r.db.ServiceAccountName()
+		opts.livenessProbe = r.getLeaseLivenessProbe()
+	}
+
 	_, _, err = r.ensureStatefulSet(opts)
 	if err != nil {
 	}
 	return err
 }
 
-func (r *MSSQLReconciler) getArgs() ([]string, error) {
+func (r *reconcileContext) getArgs() ([]string, error) {
 	var args []string
 	return args, nil
 }
 
-func (r *MSSQLReconciler) getEnvList() []core.EnvVar {
-	return []core.EnvVar{
+// getPodAnnotations returns the annotations the operator sets on the pods.
+func (r *reconcileContext) getPodAnnotations() map[string]string {
+	annotations := map[string]string{}
+	if cert := r.db.GetCertificateStatus(msapi.MSSQLServerCert); r.tlsEnabled() && cert != nil && cert.Hash != "" {
+		// a new certificate changes the template, see ensureCertificateRollout
+		annotations[msapi.MSSQLTLSHashAnnotation] = cert.Hash
+	}
+	return annotations
+}
+
+// getContainerPorts returns the named ports of the main container. The services target them by name.
+func (r *reconcileContext) getContainerPorts() []core.ContainerPort {
+	ports := []core.ContainerPort{
+		{
+			Name:          msapi.MSSQLDatabasePortName,
+			ContainerPort: r.db.ServerPort(),
+			Protocol:      core.ProtocolTCP,
+		},
+	}
+	if port := r.db.MirroringPort(); port != 0 {
+		ports = append(ports, core.ContainerPort{
+			Name:          msapi.MSSQLMirroringPortName,
+			ContainerPort: port,
+			Protocol:      core.ProtocolTCP,
+		})
+	}
+	if r.db.AdminServicePort() != 0 {
+		ports = append(ports, core.ContainerPort{
+			Name:          msapi.MSSQLAdminPortName,
+			ContainerPort: msapi.MSSQLAdminPort,
+			Protocol:      core.ProtocolTCP,
+		})
+	}
+	return ports
+}
+
+func (r *reconcileContext) getEnvList() []core.EnvVar {
+	envs := []core.EnvVar{
 		{
 			Name: "POD_NAME",
 			ValueFrom: &core.EnvVarSource{
@@ -95,7 +149,7 @@ func (r *MSSQLReconciler) getEnvList() []core.EnvVar {
 			ValueFrom: &core.EnvVarSource{
 				SecretKeyRef: &core.SecretKeySelector{
 					LocalObjectReference: core.LocalObjectReference{
-						Name: r.db.Spec.AuthSecret.Name,
+						Name: r.db.GetAuthSecretName(),
 					},
 					Key: core.BasicAuthUsernameKey,
 				},
@@ -106,7 +160,7 @@ func (r *MSSQLReconciler) getEnvList() []core.EnvVar {
 			ValueFrom: &core.EnvVarSource{
 				SecretKeyRef: &core.SecretKeySelector{
 					LocalObjectReference: core.LocalObjectReference{
-						Name: r.db.Spec.AuthSecret.Name,
+						Name: r.db.GetAuthSecretName(),
 					},
 					Key: core.BasicAuthPasswordKey,
 				},
@@ -121,46 +175,185 @@ func (r *MSSQLReconciler) getEnvList() []core.EnvVar {
 			Value: "Y",
 		},
 	}
+	return coreutil.UpsertEnvVars(envs, r.configurationEnv()...)
+}
+
+// getSidecars returns the containers running beside SQL Server. The pods of an availability group run the
+// coordinator, which labels the pod with the role of its replica & serves the readiness of the instance.
+func (r *reconcileContext) getSidecars() ([]core.Container, error) {
+	ag := r.db.AvailabilityGroup()
+	if ag == nil {
+		return nil, nil
+	}
+	if r.version.Spec.Coordinator.Image == "" {
+		err := fmt.Errorf("MSSQLVersion %s has no coordinator image, which the availability group requires", r.version.Name)
+		r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
+		return nil, err
+	}
+
+	var envs []core.EnvVar
+	for _, env := range r.getEnvList() {
+		switch env.Name {
+		case "POD_NAME", "POD_NAMESPACE", "MSSQL_SA_USERNAME", "MSSQL_SA_PASSWORD":
+			envs = append(envs, env)
+		}
+	}
+	args := []string{
+		"--availability-group=" + ag.Name,
+		"--cluster-type=" + string(ag.ClusterType),
+		"--lease=" + r.db.PrimaryLeaseName(),
+		fmt.Sprintf("--port=%d", r.db.ServerPort()),
+		fmt.Sprintf("--ssl-mode=%s", r.db.Spec.SSLMode),
+		fmt.Sprintf("--listen-address=:%d", msapi.MSSQLCoordinatorPort),
+	}
+	var mounts []core.VolumeMount
+	if r.tlsEnabled() {
+		// the coordinator verifies the certificate of the local instance
+		args = append(args, "--ca-file="+path.Join(msapi.MSSQLTLSPath, msapi.MSSQLTLSCAKey))
+		mounts = append(mounts, core.VolumeMount{
+			Name:      msapi.MSSQLTLSVolumeName,
+			MountPath: msapi.MSSQLTLSPath,
+			ReadOnly:  true,
+		})
+	}
+	return []core.Container{
+		{
+			Name:            msapi.MSSQLCoordinatorContainerName,
+			Image:           r.version.Spec.Coordinator.Image,
+			ImagePullPolicy: core.PullIfNotPresent,
+			Args:            args,
+			Env:             envs,
+			VolumeMounts:    mounts,
+			Ports: []core.ContainerPort{
+				{
+					Name:          msapi.MSSQLCoordinatorPortName,
+					ContainerPort: msapi.MSSQLCoordinatorPort,
+					Protocol:      core.ProtocolTCP,
+				},
+			},
+			ReadinessProbe: &core.Probe{
+				ProbeHandler: core.ProbeHandler{
+					HTTPGet: &core.HTTPGetAction{
+						Path: "/readyz",
+						Port: intstr.FromString(msapi.MSSQLCoordinatorPortName),
+					},
+				},
+				PeriodSeconds:    10,
+				FailureThreshold: 3,
+			},
+			LivenessProbe: &core.Probe{
+				ProbeHandler: core.ProbeHandler{
+					HTTPGet: &core.HTTPGetAction{
+						Path: "/healthz",
+						Port: intstr.FromString(msapi.MSSQLCoordinatorPortName),
+					},
+				},
+				PeriodSeconds:    10,
+				FailureThreshold: 3,
+			},
+		},
+	}, nil
+}
+
+// getLeaseLivenessProbe returns the liveness probe of SQL Server in the pods of an availability group. It fails once
+// the coordinator is down, or when the local primary replica outlived the primary lease without being fenced, so
+// that SQL Server is restarted before the lease expires & another replica is promoted. The probe fails at most a
+// third of the lease duration after the last renewal, & restarts SQL Server within two more tenths.
+func (r *reconcileContext) getLeaseLivenessProbe() *core.Probe {
+	period := r.primaryLeaseDurationSeconds() / 10
+	if period < 1 {
+		period = 1
+	}
+	return &core.Probe{
+		ProbeHandler: core.ProbeHandler{
+			HTTPGet: &core.HTTPGetAction{
+				Path: "/leasez",
+				// a named port only resolves among the ports of the probed container
+				Port: intstr.FromInt(msapi.MSSQLCoordinatorPort),
+			},
+		},
+		PeriodSeconds:    period,
+		TimeoutSeconds:   1,
+		FailureThreshold: 2,
+		// SQL Server recovers from its log, it is stopped before it takes more writes
+		TerminationGracePeriodSeconds: pointer.Int64P(1),
+	}
 }
 
 func getCommonVolumesAndMounts() ([]core.Volume, []core.VolumeMount) {
 	return nil, nil
 }
 
-func (r *MSSQLReconciler) installInitContainer(
-	podTemplate *ofst.PodTemplateSpec,
-	configSecret *core.LocalObjectReference,
-) (*core.Container, []core.Volume, error) {
+// installInitContainer returns the init container that writes the mssql.conf rendered by ensureConfigSecret
+// into the data directory, along with the volumes it needs.
+func (r *reconcileContext) installInitContainer(podTemplate *ofst.PodTemplateSpec) (*core.Container, []core.Volume, error) {
 	var pt ofst.PodTemplateSpec
 	if podTemplate != nil {
 		pt = *podTemplate
 	}
 	initVolumes, mounts := getCommonVolumesAndMounts()
 
-	if configSecret != nil {
-	}
+	initVolumes = append(initVolumes, core.Volume{
+		Name: msapi.MSSQLConfigVolumeName,
+		VolumeSource: core.VolumeSource{
+			Secret: &core.SecretVolumeSource{
+				SecretName: r.db.ConfigSecretName(),
+			},
+		},
+	})
+	mounts = append(mounts,
+		core.VolumeMount{
+			Name:      msapi.MSSQLConfigVolumeName,
+			MountPath: msapi.MSSQLConfigSourcePath,
+			ReadOnly:  true,
+		},
+		core.VolumeMount{
+			Name:      msapi.MSSQLDataDirectoryName,
+			MountPath: msapi.MSSQLDataDirectoryPath,
+		},
+	)
 
 	return &core.Container{
 		Name:            msapi.MSSQLInstallContainerName,
-		Image:           "busybox",
+		Image:           r.version.Spec.InitContainer.Image,
 		ImagePullPolicy: core.PullIfNotPresent,
 		Command:         []string{"/bin/sh"},
 		Env: func() []core.EnvVar {
 			return []core.EnvVar{}
 		}(),
-		Args:         []string{},
+		Args: []string{
+			"-c",
+			fmt.Sprintf("cp %s %s",
+				path.Join(msapi.MSSQLConfigSourcePath, msapi.MSSQLConfigFileName),
+				path.Join(msapi.MSSQLDataDirectoryPath, msapi.MSSQLConfigFileName)),
+		},
 		VolumeMounts: mounts,
 		Resources:    pt.Spec.Resources,
 	}, initVolumes, nil
 }
 
-func (r *MSSQLReconciler) getVolumeMounts(podTemplate *ofst.PodTemplateSpec) []core.VolumeMount {
+func (r *reconcileContext) getVolumeMounts(podTemplate *ofst.PodTemplateSpec) []core.VolumeMount {
 	mounts := []core.VolumeMount{
 		{
 			Name:      msapi.MSSQLWorkDirectoryName,
 			MountPath: msapi.MSSQLWorkDirectoryPath,
 		},
 	}
+	if r.hasInitScript() {
+		// the scripts are read by the server itself, see runInitScripts
+		mounts = append(mounts, core.VolumeMount{
+			Name:      msapi.MSSQLInitScriptsVolumeName,
+			MountPath: msapi.MSSQLInitScriptsPath,
+			ReadOnly:  true,
+		})
+	}
+	if r.tlsEnabled() {
+		mounts = append(mounts, core.VolumeMount{
+			Name:      msapi.MSSQLTLSVolumeName,
+			MountPath: msapi.MSSQLTLSPath,
+			ReadOnly:  true,
+		})
+	}
 	return upsertCustomVolumeMounts(mounts, podTemplate)
 }
 
@@ -173,7 +366,7 @@ func upsertCustomVolumeMounts(mounts []core.VolumeMount, podTemplate *ofst.PodTe
 	return mounts
 }
 
-func (r *MSSQLReconciler) getVolumes(initVolumes []core.Volume, podTemplate *ofst.PodTemplateSpec) []core.Volume {
+func (r *reconcileContext) getVolumes(initVolumes []core.Volume, podTemplate *ofst.PodTemplateSpec) []core.Volume {
 	var volumes []core.Volume
 	volumes = coreutil.UpsertVolume(volumes, initVolumes...)
 
@@ -183,6 +376,24 @@ func (r *MSSQLReconciler) getVolumes(initVolumes []core.Volume, podTemplate *ofs
 			EmptyDir: &core.EmptyDirVolumeSource{},
 		},
 	})
+	if r.hasInitScript() {
+		volumes = coreutil.UpsertVolume(volumes, core.Volume{
+			Name:         msapi.MSSQLInitScriptsVolumeName,
+			VolumeSource: r.db.Spec.Init.Script.VolumeSource,
+		})
+	}
+	if r.tlsEnabled() {
+		volumes = coreutil.UpsertVolume(volumes, core.Volume{
+			Name: msapi.MSSQLTLSVolumeName,
+			VolumeSource: core.VolumeSource{
+				Secret: &core.SecretVolumeSource{
+					SecretName: r.db.GetCertSecretName(msapi.MSSQLServerCert),
+					// SQL Server runs as the mssql user, which reads the key through the fsGroup
+					DefaultMode: pointer.Int32P(0o440),
+				},
+			},
+		})
+	}
 	return upsertCustomVolumes(volumes, podTemplate)
 }
 
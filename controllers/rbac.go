@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ensureCoordinatorRBAC lets the coordinator sidecar of an availability group read & label the pods, and renew the
+// primary lease. The service account is only created when spec.podTemplate doesn't name one.
+func (r *reconcileContext) ensureCoordinatorRBAC() error {
+	if r.db.AvailabilityGroup() == nil {
+		return nil
+	}
+	name := r.db.OffshootName()
+	saName := r.db.ServiceAccountName()
+	if saName == name {
+		_, vt, err := r.createOrPatch(&core.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: saName, Namespace: r.db.Namespace},
+		}, func(obj client.Object, createOp bool) client.Object {
+			in := obj.(*core.ServiceAccount)
+			in.Labels = r.db.OffshootLabels()
+			coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+			return in
+		})
+		r.recordApply("ServiceAccount", saName, vt, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, vt, err := r.createOrPatch(&rbac.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: r.db.Namespace},
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*rbac.Role)
+		in.Labels = r.db.OffshootLabels()
+		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+		in.Rules = []rbac.PolicyRule{
+			{
+				APIGroups: []string{core.GroupName},
+				Resources: []string{"pods"},
+				Verbs:     []string{"get", "patch"},
+			},
+			{
+				APIGroups:     []string{coordination.GroupName},
+				Resources:     []string{"leases"},
+				ResourceNames: []string{r.db.PrimaryLeaseName()},
+				Verbs:         []string{"get", "update"},
+			},
+		}
+		return in
+	})
+	r.recordApply("Role", name, vt, err)
+	if err != nil {
+		return err
+	}
+
+	_, vt, err = r.createOrPatch(&rbac.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: r.db.Namespace},
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*rbac.RoleBinding)
+		in.Labels = r.db.OffshootLabels()
+		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+		in.RoleRef = rbac.RoleRef{
+			APIGroup: rbac.GroupName,
+			Kind:     "Role",
+			Name:     name,
+		}
+		in.Subjects = []rbac.Subject{
+			{
+				Kind:      rbac.ServiceAccountKind,
+				Name:      saName,
+				Namespace: r.db.Namespace,
+			},
+		}
+		return in
+	})
+	r.recordApply("RoleBinding", name, vt, err)
+	return err
+}
@@ -18,37 +18,85 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"github.com/go-logr/logr"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
 	kerr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/healthchecker"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
 
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
 	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/mssqlconf"
+	"kubedb.dev/mssql/pkg/sqlclient"
 )
 
 // MSSQLReconciler reconciles a MSSQL object
 type MSSQLReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
-	ctx    context.Context
-	Log    logr.Logger
-	db     *msapi.MSSQL
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// HealthChecker runs the periodic database health checks of the MSSQL objects
+	HealthChecker *healthchecker.HealthChecker
+	// SQLClients hands out the connections to the SQL Server instances
+	SQLClients sqlclient.Factory
+	// MaxConcurrentReconciles is the maximum number of MSSQL objects reconciled in parallel. Defaults to 1.
+	MaxConcurrentReconciles int
+}
+
+// reconcileContext holds the state of a single reconcile request. The MSSQLReconciler is shared by all the workers,
+// so anything specific to a request must live here.
+type reconcileContext struct {
+	*MSSQLReconciler
+	ctx context.Context
+	Log logr.Logger
+	db  *msapi.MSSQL
+	// version is the MSSQLVersion catalog entry spec.version refers to
+	version *msapi.MSSQLVersion
+	// userConf holds the valid settings of spec.configSecret, once the config secret has been rendered
+	userConf mssqlconf.Config
+	// requeueAfter is the earliest time a step waiting on a timeout wants to be reconciled again, see requeueIn
+	requeueAfter time.Duration
 }
 
 //+kubebuilder:rbac:groups=microsoft.kubedb.com,resources=mssqls,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=microsoft.kubedb.com,resources=mssqls/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=microsoft.kubedb.com,resources=mssqls/finalizers,verbs=update
+//+kubebuilder:rbac:groups=microsoft.kubedb.com,resources=mssqlversions,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=services;secrets,verbs=get;list;watch;create;patch;update;delete
+//+kubebuilder:rbac:groups=core,resources=endpoints;configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;patch;update;delete
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;patch;delete
+//+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;patch;delete
 
 func (r *MSSQLReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	r.ctx = ctx
-	r.Log = log.FromContext(ctx)
+	rc := &reconcileContext{
+		MSSQLReconciler: r,
+		ctx:             ctx,
+		Log:             log.FromContext(ctx),
+	}
+	return rc.reconcile(req)
+}
 
+func (r *reconcileContext) reconcile(req ctrl.Request) (ctrl.Result, error) {
 	mssql, err := r.getMSSQL(req.NamespacedName)
 	if err != nil {
 		if kerr.IsNotFound(err) {
@@ -59,11 +107,12 @@ func (r *MSSQLReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	r.db = mssql
 	klog.Infof("Got the mssql Object : %v/%v", r.db.Namespace, r.db.Name)
 
-	// if MSSQL instance is marked for deletion, remove the finalizers & abort reconcile
+	// if MSSQL instance is marked for deletion, clean up according to the terminationPolicy & abort reconcile
 	if r.isMarkedForDeletion() {
-		err = r.removeFinalizers()
+		err = r.terminate()
 		if err != nil {
-			return r.requeueWithError("Failed to remove finalizers", err)
+			r.recordEvent(core.EventTypeWarning, EventReasonFailedToDelete, "Failed to terminate: %v", err)
+			return r.requeueWithError("Failed to terminate", err)
 		}
 		return ctrl.Result{}, nil
 	}
@@ -72,15 +121,35 @@ func (r *MSSQLReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return r.requeueWithError("Failed to ensure finalizers", err)
 	}
 
-	//TODO:
-	// Update MSSQL phase from current conditions
-	// r.updatePhaseFromCondition(ctx, r.db)
+	err = r.ensureProvisioningStarted()
+	if err != nil {
+		return r.requeueWithError("Failed to update status", err)
+	}
+
+	if r.db.Spec.Halted {
+		err = r.halt()
+		if err != nil {
+			return r.requeueWithError("Failed to halt", err)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	r.version, err = r.getMSSQLVersion()
+	if err != nil {
+		r.recordEvent(core.EventTypeWarning, EventReasonVersionMissing, err.Error())
+		return r.requeueWithError("Failed to get MSSQLVersion", err)
+	}
 
 	err = r.ensurePrimaryService()
 	if err != nil {
 		return r.requeueWithError("Failed to ensure service", err)
 	}
 
+	err = r.ensureStandbyService()
+	if err != nil {
+		return r.requeueWithError("Failed to ensure service", err)
+	}
+
 	err = r.ensureGoverningServices()
 	if err != nil {
 		return r.requeueWithError("Failed to ensure service", err)
@@ -91,26 +160,115 @@ func (r *MSSQLReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return r.requeueWithError("Failed to ensure secrets", err)
 	}
 
+	err = r.ensureTLS()
+	if err != nil {
+		return r.requeueWithError("Failed to ensure TLS", err)
+	}
+
+	err = r.ensureCoordinatorRBAC()
+	if err != nil {
+		return r.requeueWithError("Failed to ensure RBAC of the coordinator", err)
+	}
+
+	err = r.ensureConfigSecret()
+	if err != nil {
+		return r.requeueWithError("Failed to ensure config secret", err)
+	}
+
 	err = r.ensureNodes()
 	if err != nil {
 		return r.requeueWithError("Failed to ensure nodes", err)
 	}
+	r.startHealthCheck()
 
-	return ctrl.Result{}, nil
+	err = r.ensureCertificateRollout()
+	if err != nil {
+		return r.requeueWithError("Failed to restart the pods for the renewed certificate", err)
+	}
+
+	err = r.ensureConfiguration()
+	if err != nil {
+		return r.requeueWithError("Failed to ensure configuration", err)
+	}
+
+	err = r.ensureAvailabilityGroup()
+	if err != nil {
+		return r.requeueWithError("Failed to ensure availability group", err)
+	}
+
+	err = r.ensureAdminConnections()
+	if err != nil {
+		return r.requeueWithError("Failed to enable remote admin connections", err)
+	}
+
+	err = r.ensureInitScripts()
+	if err != nil {
+		return r.requeueWithError("Failed to run init scripts", err)
+	}
+
+	// Update MSSQL phase from current conditions
+	err = r.updatePhaseFromCondition()
+	if err != nil {
+		return r.requeueWithError("Failed to update phase", err)
+	}
+	if r.db.Status.Phase != dbapi.DatabasePhaseReady {
+		// pods are not watched, keep polling until the database becomes Ready
+		r.requeueIn(dbapi.HealthCheckInterval)
+	}
+
+	return ctrl.Result{RequeueAfter: r.requeueAfter}, nil
 }
 
-func (r *MSSQLReconciler) getMSSQL(meta types.NamespacedName) (*msapi.MSSQL, error) {
+func (r *reconcileContext) getMSSQL(meta types.NamespacedName) (*msapi.MSSQL, error) {
 	var db msapi.MSSQL
-	err := r.Client.Get(context.TODO(), meta, &db)
+	err := r.Client.Get(r.ctx, meta, &db)
 	if err != nil {
 		return nil, err
 	}
+	// The defaulting webhook sets these on admission. Apply them in memory too, for the objects stored
+	// without the webhook. The controller never writes the spec back.
+	db.SetDefaults()
 	return &db, nil
 }
 
+func (r *reconcileContext) getMSSQLVersion() (*msapi.MSSQLVersion, error) {
+	var version msapi.MSSQLVersion
+	err := r.Client.Get(r.ctx, types.NamespacedName{Name: r.db.Spec.Version}, &version)
+	if err != nil {
+		if kerr.IsNotFound(err) {
+			return nil, fmt.Errorf("MSSQLVersion %q of MSSQL %s/%s not found", r.db.Spec.Version, r.db.Namespace, r.db.Name)
+		}
+		return nil, err
+	}
+	return &version, nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
+// Changes to the owned workload, services & secrets and to the referred secrets trigger a reconcile, so that
+// drift is reverted. Status only updates of the MSSQL object itself are ignored.
 func (r *MSSQLReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.HealthChecker == nil {
+		r.HealthChecker = healthchecker.NewHealthChecker()
+	}
+	if r.SQLClients == nil {
+		r.SQLClients = sqlclient.NewFactory(mgr.GetClient(), sqlclient.Options{})
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &msapi.MSSQL{}, secretIndexKey, indexSecrets); err != nil {
+		return err
+	}
+
+	owned := builder.WithPredicates(predicate.ResourceVersionChangedPredicate{})
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&msapi.MSSQL{}).
+		// the switchover annotation doesn't change the generation
+		For(&msapi.MSSQL{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Owns(&apps.StatefulSet{}, owned).
+		Owns(&core.Service{}, owned).
+		Owns(&core.Secret{}, owned).
+		Watches(
+			&source.Kind{Type: &core.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecret),
+			owned,
+		).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
@@ -0,0 +1,92 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	apps "k8s.io/api/apps/v1"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	api "kubedb.dev/apimachinery/apis"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TestReconcileParallel reconciles several MSSQL objects at once through the same MSSQLReconciler, the way the
+// controller does with MaxConcurrentReconciles > 1. Run it with -race to catch shared per-request state.
+func TestReconcileParallel(t *testing.T) {
+	rc, req := newReconcileTestContext(t)
+	r := rc.MSSQLReconciler
+	var db msapi.MSSQL
+	if err := r.Client.Get(rc.ctx, req.NamespacedName, &db); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []ctrl.Request{req}
+	for i := 1; i < 8; i++ {
+		obj := db.DeepCopy()
+		obj.ResourceVersion = ""
+		obj.Name = fmt.Sprintf("mssql-%d", i)
+		obj.Spec.AuthSecret = nil
+		obj.SetDefaults()
+		if err := r.Client.Create(rc.ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(obj)})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(requests))
+	for _, req := range requests {
+		wg.Add(1)
+		go func(req ctrl.Request) {
+			defer wg.Done()
+			// a single object is never reconciled in parallel with itself
+			for i := 0; i < 3; i++ {
+				if _, err := r.Reconcile(rc.ctx, req); err != nil {
+					errs <- fmt.Errorf("%s: %w", req, err)
+					return
+				}
+			}
+		}(req)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, req := range requests {
+		var obj msapi.MSSQL
+		if err := r.Client.Get(rc.ctx, req.NamespacedName, &obj); err != nil {
+			t.Fatal(err)
+		}
+		if !coreutil.HasFinalizer(obj.ObjectMeta, api.Finalizer) {
+			t.Errorf("%s has no finalizer", req)
+		}
+		var sts apps.StatefulSet
+		if err := r.Client.Get(rc.ctx, req.NamespacedName, &sts); err != nil {
+			t.Errorf("StatefulSet of %s: %v", req, err)
+		} else if sts.Spec.ServiceName != obj.GoverningServiceName() {
+			t.Errorf("StatefulSet of %s is governed by service %s", req, sts.Spec.ServiceName)
+		}
+		(&reconcileContext{MSSQLReconciler: r, ctx: rc.ctx, Log: rc.Log, db: &obj}).stopHealthCheck()
+	}
+}
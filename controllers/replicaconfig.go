@@ -0,0 +1,144 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+const (
+	// agReplicaConfigQuery returns the configuration of the replicas of the availability group. It runs on the
+	// primary replica.
+	agReplicaConfigQuery = "SELECT ar.replica_server_name AS name, ar.availability_mode_desc AS availability_mode, " +
+		"CAST(ar.backup_priority AS int) AS backup_priority, ar.secondary_role_allow_connections_desc AS allow_connections, " +
+		"ISNULL(ar.read_only_routing_url, '') AS routing_url FROM sys.availability_replicas ar " +
+		"JOIN sys.availability_groups ag ON ag.group_id = ar.group_id WHERE ag.name = @p1"
+	agRequiredSynchronizedQuery = "SELECT CAST(required_synchronized_secondaries_to_commit AS int) AS required " +
+		"FROM sys.availability_groups WHERE name = @p1"
+
+	availabilityModeSynchronous  = "SYNCHRONOUS_COMMIT"
+	availabilityModeAsynchronous = "ASYNCHRONOUS_COMMIT"
+)
+
+// ensureReplicaConfiguration keeps the replicas of the availability group as spec.topology.availabilityGroup
+// declares them: their availability mode, backup priority, the connections they accept as secondaries & where the
+// read-only connections are routed to them. REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT is lowered before the
+// availability modes change & raised after, so that the primary never waits for more synchronous secondaries than
+// there are. It runs on the primary replica.
+func (r *reconcileContext) ensureReplicaConfiguration(c sqlclient.Client) error {
+	ag := r.db.AvailabilityGroup()
+	rows, err := c.Query(r.ctx, agRequiredSynchronizedQuery, ag.Name)
+	if err != nil {
+		return err
+	}
+	var required, currentRequired int64
+	if ag.RequiredSynchronizedSecondariesToCommit != nil {
+		required = int64(*ag.RequiredSynchronizedSecondariesToCommit)
+	}
+	if len(rows) > 0 {
+		currentRequired = parseNumber(rows[0]["required"]).Int64()
+	}
+	if required < currentRequired {
+		if err = r.setRequiredSynchronizedSecondaries(c, required); err != nil {
+			return err
+		}
+	}
+
+	rows, err = c.Query(r.ctx, agReplicaConfigQuery, ag.Name)
+	if err != nil {
+		return err
+	}
+	current := map[string]sqlclient.Row{}
+	for _, row := range rows {
+		current[fmt.Sprint(row["name"])] = row
+	}
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		name := r.podName(i)
+		row, ok := current[name]
+		if !ok {
+			// not added yet
+			continue
+		}
+		replica := r.db.AvailabilityReplica(name)
+		var stmts []string
+		if mode := r.availabilityMode(i); fmt.Sprint(row["availability_mode"]) != mode {
+			stmts = append(stmts, r.modifyReplica(name, "AVAILABILITY_MODE = "+mode))
+		}
+		if parseNumber(row["backup_priority"]).Int64() != int64(*replica.BackupPriority) {
+			stmts = append(stmts, r.modifyReplica(name, fmt.Sprintf("BACKUP_PRIORITY = %d", *replica.BackupPriority)))
+		}
+		if allow := allowConnections(replica.ReadableSecondary); fmt.Sprint(row["allow_connections"]) != allow {
+			stmts = append(stmts, r.modifyReplica(name, fmt.Sprintf("SECONDARY_ROLE (ALLOW_CONNECTIONS = %s)", allow)))
+		}
+		// basic availability groups don't route connections
+		url := fmt.Sprintf("TCP://%s:%d", sqlclient.InstanceHost(r.db, i), r.db.ServerPort())
+		if r.db.Spec.Edition != msapi.MSSQLEditionStandard && fmt.Sprint(row["routing_url"]) != url {
+			stmts = append(stmts, r.modifyReplica(name, fmt.Sprintf("SECONDARY_ROLE (READ_ONLY_ROUTING_URL = %s)", quoteString(url))))
+		}
+		if len(stmts) == 0 {
+			continue
+		}
+		if err = c.ExecScript(r.ctx, stmts); err != nil {
+			return fmt.Errorf("failed to configure the replica of pod %s: %w", name, err)
+		}
+		r.Log.Info("Configured the availability replica", "replica", name)
+	}
+
+	if required > currentRequired {
+		return r.setRequiredSynchronizedSecondaries(c, required)
+	}
+	return nil
+}
+
+func (r *reconcileContext) setRequiredSynchronizedSecondaries(c sqlclient.Client, n int64) error {
+	ag := r.db.AvailabilityGroup()
+	stmt := fmt.Sprintf("ALTER AVAILABILITY GROUP %s SET (REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT = %d)", quoteName(ag.Name), n)
+	if err := c.Exec(r.ctx, stmt); err != nil {
+		return fmt.Errorf("failed to require %d synchronized secondaries in availability group %s: %w", n, ag.Name, err)
+	}
+	r.Log.Info("Set the synchronized secondaries required to commit", "required", n)
+	return nil
+}
+
+// availabilityMode is the availability mode of the replica of the pod with the given ordinal, the first
+// spec.topology.availabilityGroup.synchronousReplicas pods commit synchronously.
+func (r *reconcileContext) availabilityMode(ordinal int32) string {
+	if ordinal < r.db.SynchronousReplicas() {
+		return availabilityModeSynchronous
+	}
+	return availabilityModeAsynchronous
+}
+
+func (r *reconcileContext) modifyReplica(name, option string) string {
+	return fmt.Sprintf("ALTER AVAILABILITY GROUP %s MODIFY REPLICA ON %s WITH (%s)",
+		quoteName(r.db.AvailabilityGroup().Name), quoteString(name), option)
+}
+
+// allowConnections is the ALLOW_CONNECTIONS option of the secondary role, as sys.availability_replicas shows it.
+func allowConnections(readable msapi.MSSQLReadableSecondary) string {
+	switch readable {
+	case msapi.MSSQLReadableSecondaryReadOnly:
+		return "READ_ONLY"
+	case msapi.MSSQLReadableSecondaryAll:
+		return "ALL"
+	default:
+		return "NO"
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gomodules.xyz/pointer"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+)
+
+// replicasConfigured makes the primary replica report the replicas configured with the defaults & read-only
+// routing between all of them.
+func replicasConfigured(rc *reconcileContext, primary *sqlfake.Client) {
+	var replicas, lists []sqlclient.Row
+	for i := int32(0); i < *rc.db.Spec.Replicas; i++ {
+		replicas = append(replicas, sqlclient.Row{
+			"name":              rc.podName(i),
+			"availability_mode": availabilityModeSynchronous,
+			"backup_priority":   int64(msapi.MSSQLDefaultBackupPriority),
+			"allow_connections": "READ_ONLY",
+			"routing_url":       fmt.Sprintf("TCP://%s:%d", sqlclient.InstanceHost(rc.db, i), rc.db.ServerPort()),
+		})
+		for j := int32(0); j < *rc.db.Spec.Replicas; j++ {
+			if i != j {
+				lists = append(lists, sqlclient.Row{"name": rc.podName(i), "routed_to": rc.podName(j)})
+			}
+		}
+	}
+	primary.Results[agReplicaConfigQuery] = replicas
+	primary.Results[agRoutingListQuery] = lists
+	primary.Results[agRequiredSynchronizedQuery] = []sqlclient.Row{{"required": int64(0)}}
+}
+
+func TestEnsureReplicaConfiguration(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	rc.db.Spec.Replicas = pointer.Int32P(3)
+	primary := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0))
+	replicasConfigured(rc, primary)
+	// a new replica has no routing URL yet
+	primary.Results[agReplicaConfigQuery][2]["routing_url"] = ""
+
+	if err := rc.ensureReplicaConfiguration(primary); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-2' WITH (SECONDARY_ROLE (READ_ONLY_ROUTING_URL = N'TCP://mssql-2.mssql-pods.demo.svc:1433'))",
+	}
+	if !reflect.DeepEqual(primary.Executed, want) {
+		t.Errorf("executed %v, want %v", primary.Executed, want)
+	}
+
+	// a synchronous pair & an asynchronous replica that doesn't take backups nor connections
+	primary.Executed = nil
+	replicasConfigured(rc, primary)
+	ag := rc.db.Spec.Topology.AvailabilityGroup
+	ag.SynchronousReplicas = pointer.Int32P(2)
+	ag.RequiredSynchronizedSecondariesToCommit = pointer.Int32P(1)
+	ag.Replicas = []msapi.MSSQLAvailabilityReplicaSpec{
+		{Name: "mssql-1", ReadableSecondary: msapi.MSSQLReadableSecondaryAll},
+		{Name: "mssql-2", BackupPriority: pointer.Int32P(0), ReadableSecondary: msapi.MSSQLReadableSecondaryNo},
+	}
+	if err := rc.ensureReplicaConfiguration(primary); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-1' WITH (SECONDARY_ROLE (ALLOW_CONNECTIONS = ALL))",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-2' WITH (AVAILABILITY_MODE = ASYNCHRONOUS_COMMIT)",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-2' WITH (BACKUP_PRIORITY = 0)",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-2' WITH (SECONDARY_ROLE (ALLOW_CONNECTIONS = NO))",
+		"ALTER AVAILABILITY GROUP [mssql] SET (REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT = 1)",
+	}
+	if !reflect.DeepEqual(primary.Executed, want) {
+		t.Errorf("executed %v, want %v", primary.Executed, want)
+	}
+
+	// the requirement is lowered before a replica commits asynchronously
+	primary.Executed = nil
+	primary.Results[agRequiredSynchronizedQuery] = []sqlclient.Row{{"required": int64(1)}}
+	ag.SynchronousReplicas = pointer.Int32P(1)
+	ag.RequiredSynchronizedSecondariesToCommit = nil
+	ag.Replicas = nil
+	if err := rc.ensureReplicaConfiguration(primary); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"ALTER AVAILABILITY GROUP [mssql] SET (REQUIRED_SYNCHRONIZED_SECONDARIES_TO_COMMIT = 0)",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-1' WITH (AVAILABILITY_MODE = ASYNCHRONOUS_COMMIT)",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-2' WITH (AVAILABILITY_MODE = ASYNCHRONOUS_COMMIT)",
+	}
+	if !reflect.DeepEqual(primary.Executed, want) {
+		t.Errorf("executed %v, want %v", primary.Executed, want)
+	}
+}
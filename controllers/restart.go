@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sort"
+
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ensureCertificateRollout restarts the pods started with an older server certificate, since SQL Server only
+// reads it on startup & the StatefulSet is updated OnDelete. The pods are restarted one at a time, the secondaries
+// first & the primary last. The next pod is only deleted once all of them are back & ready. The primary of an
+// availability group hands over its role before it is restarted, see ensureRolloutSwitchover.
+func (r *reconcileContext) ensureCertificateRollout() error {
+	outdated, err := r.outdatedPods()
+	if err != nil || len(outdated) == 0 {
+		return err
+	}
+	if isPrimaryPod(&outdated[0]) && r.db.AvailabilityGroup() != nil {
+		return nil
+	}
+	return r.restartOutdatedPod(outdated)
+}
+
+// outdatedPods returns the pods started with an older server certificate, in restart order, see sortForRestart.
+// There are none while a restart is in progress.
+func (r *reconcileContext) outdatedPods() ([]core.Pod, error) {
+	cert := r.db.GetCertificateStatus(msapi.MSSQLServerCert)
+	if !r.tlsEnabled() || cert == nil || cert.Hash == "" {
+		return nil, nil
+	}
+
+	var pods core.PodList
+	err := r.Client.List(r.ctx, &pods, client.InNamespace(r.db.Namespace), client.MatchingLabels(r.db.OffshootSelectors()))
+	if err != nil {
+		return nil, err
+	}
+	if int32(len(pods.Items)) < *r.db.Spec.Replicas {
+		return nil, nil
+	}
+	var outdated []core.Pod
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || !isPodReady(&pod) {
+			// a restart is still in progress
+			return nil, nil
+		}
+		if pod.Annotations[msapi.MSSQLTLSHashAnnotation] != cert.Hash {
+			outdated = append(outdated, pod)
+		}
+	}
+	sortForRestart(outdated)
+	return outdated, nil
+}
+
+// restartOutdatedPod deletes the first of the outdated pods.
+func (r *reconcileContext) restartOutdatedPod(outdated []core.Pod) error {
+	pod := outdated[0]
+	r.recordEvent(core.EventTypeNormal, EventReasonRestarting,
+		"Restarting pod %s to load the renewed server certificate, %d pod(s) left", pod.Name, len(outdated))
+	if err := r.Client.Delete(r.ctx, &pod); err != nil && !kerr.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// sortForRestart orders the pods so that the primary comes last, the others by descending ordinal.
+func sortForRestart(pods []core.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		pi, pj := isPrimaryPod(&pods[i]), isPrimaryPod(&pods[j])
+		if pi != pj {
+			return pj
+		}
+		return pods[i].Name > pods[j].Name
+	})
+}
+
+func isPrimaryPod(pod *core.Pod) bool {
+	return pod.Labels[dbapi.LabelRole] == dbapi.DatabasePodPrimary
+}
+
+func isPodReady(pod *core.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == core.PodReady {
+			return cond.Status == core.ConditionTrue
+		}
+	}
+	return false
+}
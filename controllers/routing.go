@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+// agRoutingListQuery returns the read-only routing lists of the replicas, one row per routing target. It runs on
+// the primary replica.
+const agRoutingListQuery = "SELECT ar.replica_server_name AS name, ro.replica_server_name AS routed_to " +
+	"FROM sys.availability_read_only_routing_lists rl " +
+	"JOIN sys.availability_replicas ar ON ar.replica_id = rl.replica_id " +
+	"JOIN sys.availability_replicas ro ON ro.replica_id = rl.read_only_replica_id " +
+	"JOIN sys.availability_groups ag ON ag.group_id = ar.group_id WHERE ag.name = @p1"
+
+// ensureReadOnlyRouting configures read-only routing: a connection with ApplicationIntent=ReadOnly to the primary
+// replica, e.g. through the primary service, is redirected to the readable secondaries, balanced between them. The
+// replicas get their routing URL in ensureReplicaConfiguration. Clients follow the redirection to the pod DNS
+// names, which resolve inside the cluster only. It runs on the primary replica. Basic availability groups, i.e.
+// the Standard edition, have no readable secondaries.
+func (r *reconcileContext) ensureReadOnlyRouting(c sqlclient.Client) error {
+	if r.db.Spec.Edition == msapi.MSSQLEditionStandard {
+		return nil
+	}
+	rows, err := c.Query(r.ctx, agRoutingListQuery, r.db.AvailabilityGroup().Name)
+	if err != nil {
+		return err
+	}
+	routingLists := map[string][]string{}
+	for _, row := range rows {
+		name := fmt.Sprint(row["name"])
+		routingLists[name] = append(routingLists[name], fmt.Sprint(row["routed_to"]))
+	}
+
+	var readable []string
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		if r.db.AvailabilityReplica(r.podName(i)).ReadableSecondary != msapi.MSSQLReadableSecondaryNo {
+			readable = append(readable, r.podName(i))
+		}
+	}
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		name := r.podName(i)
+		targets := routingTargets(readable, name)
+		if sets.NewString(routingLists[name]...).Equal(sets.NewString(targets...)) {
+			continue
+		}
+		stmt := r.modifyReplica(name, fmt.Sprintf("PRIMARY_ROLE (READ_ONLY_ROUTING_LIST = %s)", routingList(targets)))
+		if err = c.Exec(r.ctx, stmt); err != nil {
+			return fmt.Errorf("failed to configure read-only routing of pod %s: %w", name, err)
+		}
+		r.Log.Info("Configured read-only routing", "replica", name, "routingList", targets)
+	}
+	return nil
+}
+
+// routingTargets returns the readable secondaries while the given replica is the primary. Read-only connections
+// go to the primary itself when it's the only readable replica.
+func routingTargets(readable []string, primary string) []string {
+	var targets []string
+	for _, name := range readable {
+		if name != primary {
+			targets = append(targets, name)
+		}
+	}
+	if len(targets) == 0 {
+		return []string{primary}
+	}
+	return targets
+}
+
+// routingList is a load-balanced read-only routing list of the replicas.
+func routingList(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteString(name))
+	}
+	return "((" + strings.Join(quoted, ", ") + "))"
+}
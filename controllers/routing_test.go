@@ -0,0 +1,72 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"gomodules.xyz/pointer"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+func TestEnsureReadOnlyRouting(t *testing.T) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	rc.db.Spec.Replicas = pointer.Int32P(3)
+	primary := sqlClients.Client(sqlclient.InstanceHost(rc.db, 0))
+
+	if err := rc.ensureReadOnlyRouting(primary); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-0' WITH (PRIMARY_ROLE (READ_ONLY_ROUTING_LIST = ((N'mssql-1', N'mssql-2'))))",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-1' WITH (PRIMARY_ROLE (READ_ONLY_ROUTING_LIST = ((N'mssql-0', N'mssql-2'))))",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-2' WITH (PRIMARY_ROLE (READ_ONLY_ROUTING_LIST = ((N'mssql-0', N'mssql-1'))))",
+	}
+	if !reflect.DeepEqual(primary.Executed, want) {
+		t.Errorf("executed %v, want %v", primary.Executed, want)
+	}
+
+	// only the routing lists that differ are modified, the secondaries that aren't readable are left out
+	primary.Executed = nil
+	replicasConfigured(rc, primary)
+	rc.db.Spec.Topology.AvailabilityGroup.Replicas = []msapi.MSSQLAvailabilityReplicaSpec{
+		{Name: "mssql-2", ReadableSecondary: msapi.MSSQLReadableSecondaryNo},
+	}
+	if err := rc.ensureReadOnlyRouting(primary); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-0' WITH (PRIMARY_ROLE (READ_ONLY_ROUTING_LIST = ((N'mssql-1'))))",
+		"ALTER AVAILABILITY GROUP [mssql] MODIFY REPLICA ON N'mssql-1' WITH (PRIMARY_ROLE (READ_ONLY_ROUTING_LIST = ((N'mssql-0'))))",
+	}
+	if !reflect.DeepEqual(primary.Executed, want) {
+		t.Errorf("executed %v, want %v", primary.Executed, want)
+	}
+
+	// basic availability groups have no readable secondaries
+	primary.Executed = nil
+	primary.Results[agRoutingListQuery] = nil
+	rc.db.Spec.Edition = msapi.MSSQLEditionStandard
+	if err := rc.ensureReadOnlyRouting(primary); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.Executed) != 0 {
+		t.Errorf("configured read-only routing of a basic availability group: %v", primary.Executed)
+	}
+}
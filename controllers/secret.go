@@ -24,7 +24,6 @@ import (
 	kerr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	cu "kmodules.xyz/client-go/client"
 	coreutil "kmodules.xyz/client-go/core/v1"
 	metautil "kmodules.xyz/client-go/meta"
 	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
@@ -32,7 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func (r MSSQLReconciler) ensureAuthSecret() error {
+func (r *reconcileContext) ensureAuthSecret() error {
 	if r.db.Spec.AuthSecret != nil && r.db.Spec.AuthSecret.ExternallyManaged {
 		return r.ensureExternalAuthSecret()
 	}
@@ -42,9 +41,11 @@ func (r MSSQLReconciler) ensureAuthSecret() error {
 	return nil
 }
 
-func (r MSSQLReconciler) ensureExternalAuthSecret() error {
+func (r *reconcileContext) ensureExternalAuthSecret() error {
 	if r.db.Spec.AuthSecret.Name == "" {
-		return fmt.Errorf("externally managed auth secret name is missing for MSSQL %s/%s", r.db.Namespace, r.db.Name)
+		err := fmt.Errorf("externally managed auth secret name is missing for MSSQL %s/%s", r.db.Namespace, r.db.Name)
+		r.recordEvent(core.EventTypeWarning, EventReasonAuthSecretMissing, err.Error())
+		return err
 	}
 	// validate spec of the auth secret. make sure that have the keys 'username', 'password'
 	var secret core.Secret
@@ -54,7 +55,8 @@ func (r MSSQLReconciler) ensureExternalAuthSecret() error {
 	}, &secret)
 	if err != nil {
 		if kerr.IsNotFound(err) {
-			return fmt.Errorf("externally managed auth secret \"%s\" not found for MSSQL %s/%s", r.db.Spec.AuthSecret.Name, r.db.Namespace, r.db.Name)
+			err = fmt.Errorf("externally managed auth secret \"%s\" not found for MSSQL %s/%s", r.db.Spec.AuthSecret.Name, r.db.Namespace, r.db.Name)
+			r.recordEvent(core.EventTypeWarning, EventReasonAuthSecretMissing, err.Error())
 		}
 		return err
 	}
@@ -68,7 +70,7 @@ func (r MSSQLReconciler) ensureExternalAuthSecret() error {
 //      - check the secret labels are not associated with a different db
 //      - validate required keys
 
-func (r *MSSQLReconciler) ensureInternalAuthSecret() error {
+func (r *reconcileContext) ensureInternalAuthSecret() error {
 	secretName := r.db.GetAuthSecretName()
 	var secret core.Secret
 	err := r.Client.Get(r.ctx, types.NamespacedName{
@@ -85,7 +87,7 @@ func (r *MSSQLReconciler) ensureInternalAuthSecret() error {
 		// secret exists but labels indicate different db
 		if secret.Labels[metautil.NameLabelKey] != r.db.ResourceFQN() ||
 			secret.Labels[metautil.InstanceLabelKey] != r.db.Name {
-			return fmt.Errorf(`auth secret "%v/%v" associated with %s %s but expected to be associated with %s %s`,
+			err = fmt.Errorf(`auth secret "%v/%v" associated with %s %s but expected to be associated with %s %s`,
 				r.db.Namespace,
 				secretName,
 				secret.Labels[metautil.NameLabelKey],
@@ -93,30 +95,17 @@ func (r *MSSQLReconciler) ensureInternalAuthSecret() error {
 				r.db.ResourceFQN(),
 				r.db.Name,
 			)
+			r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
+			return err
 		}
 		if err := r.validateAuthSecret(&secret); err != nil {
 			return err
 		}
 	}
-
-	ms, _, err := cu.CreateOrPatch(r.ctx, r.Client, &msapi.MSSQL{
-		ObjectMeta: r.db.ObjectMeta,
-	}, func(obj client.Object, createOp bool) client.Object {
-		in := obj.(*msapi.MSSQL)
-		if in.Spec.AuthSecret == nil {
-			in.Spec.AuthSecret = &dbapi.SecretReference{}
-		}
-		in.Spec.AuthSecret.Name = secretName
-		return in
-	})
-	if err != nil {
-		return err
-	}
-	r.db.Spec.AuthSecret = ms.(*msapi.MSSQL).Spec.AuthSecret
 	return nil
 }
 
-func (r *MSSQLReconciler) createAuthSecret() error {
+func (r *reconcileContext) createAuthSecret() error {
 	secret := &core.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      r.db.GetAuthSecretName(),
@@ -129,21 +118,23 @@ func (r *MSSQLReconciler) createAuthSecret() error {
 			core.BasicAuthPasswordKey: []byte(passgen.Generate(dbapi.DefaultPasswordLength)),
 		},
 	}
-	_, _, err := cu.CreateOrPatch(r.ctx, r.Client, secret, func(obj client.Object, createOp bool) client.Object {
+	_, vt, err := r.createOrPatch(secret, func(obj client.Object, createOp bool) client.Object {
 		in := obj.(*core.Secret)
 		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
 		return in
 	})
+	r.recordApply("Secret", secret.Name, vt, err)
 	return err
 }
 
-func (r *MSSQLReconciler) validateAuthSecret(secret *core.Secret) error {
+func (r *reconcileContext) validateAuthSecret(secret *core.Secret) error {
 	// verify if the desired key ["password", "username"] exist or not (when secret is managed by the user)
-	if _, ok := secret.Data[core.BasicAuthUsernameKey]; !ok {
-		return fmt.Errorf("key \"%s\" doesn't exists inside spec data for secret %s/%s", core.BasicAuthUsernameKey, secret.Namespace, secret.Name)
-	}
-	if _, ok := secret.Data[core.BasicAuthPasswordKey]; !ok {
-		return fmt.Errorf("key \"%s\" doesn't exists inside spec data for secret %s/%s", core.BasicAuthPasswordKey, secret.Namespace, secret.Name)
+	for _, key := range []string{core.BasicAuthUsernameKey, core.BasicAuthPasswordKey} {
+		if _, ok := secret.Data[key]; !ok {
+			err := fmt.Errorf("key \"%s\" doesn't exists inside spec data for secret %s/%s", key, secret.Namespace, secret.Name)
+			r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
+			return err
+		}
 	}
 	return nil
 }
@@ -17,11 +17,10 @@ limitations under the License.
 package controllers
 
 import (
+	apps "k8s.io/api/apps/v1"
 	core "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
-	kutil "kmodules.xyz/client-go"
-	cu "kmodules.xyz/client-go/client"
 	coreutil "kmodules.xyz/client-go/core/v1"
 	ofst "kmodules.xyz/offshoot-api/api/v1"
 	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
@@ -29,14 +28,14 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func (r *MSSQLReconciler) ensurePrimaryService() error {
+func (r *reconcileContext) ensurePrimaryService() error {
 	svcTemplate := dbapi.GetServiceTemplate(r.db.Spec.ServiceTemplates, dbapi.PrimaryServiceAlias)
 	svcMeta := metav1.ObjectMeta{
 		Name:      r.db.PrimaryServiceName(),
 		Namespace: r.db.Namespace,
 	}
 
-	_, _, err := cu.CreateOrPatch(r.ctx, r.Client, &core.Service{
+	_, vt, err := r.createOrPatch(&core.Service{
 		ObjectMeta: svcMeta,
 	}, func(obj client.Object, createOp bool) client.Object {
 		in := obj.(*core.Service)
@@ -45,22 +44,78 @@ func (r *MSSQLReconciler) ensurePrimaryService() error {
 		in.Annotations = svcTemplate.Annotations
 
 		in.Spec.Selector = r.db.OffshootSelectors()
-		if r.db.Spec.Replicas != nil && *r.db.Spec.Replicas > 1 {
+		// the pods are labeled with their role by their coordinator
+		if r.db.AvailabilityGroup() != nil {
 			in.Spec.Selector[dbapi.LabelRole] = dbapi.DatabasePodPrimary
+			if status := r.db.Status.AvailabilityGroup; status != nil && status.PrimaryServicePause != nil {
+				// a switchover holds the new connections until the new primary is labeled, see pausePrimaryService
+				in.Spec.Selector[apps.StatefulSetPodNameLabel] = status.PrimaryServicePause.Pod
+			}
 		}
-		in.Spec.Ports = coreutil.MergeServicePorts(in.Spec.Ports, []core.ServicePort{
-			{
-				Name:       msapi.MSSQLDatabasePortName,
-				Port:       msapi.MSSQLDatabasePort,
-				TargetPort: intstr.FromString(msapi.MSSQLDatabasePortName),
-			},
-		})
+		in.Spec.Ports = coreutil.MergeServicePorts(in.Spec.Ports, r.getServicePorts(false))
+		copyFromServiceTemplateSpec(in, svcTemplate.Spec)
+		return in
+	})
+	r.recordApply("Service", svcMeta.Name, vt, err)
+	return err
+}
+
+// ensureStandbyService creates the service of the secondary replicas of the availability group, for read-only
+// workloads. It honors the service template of the standby alias.
+func (r *reconcileContext) ensureStandbyService() error {
+	if r.db.AvailabilityGroup() == nil {
+		return nil
+	}
+	svcTemplate := dbapi.GetServiceTemplate(r.db.Spec.ServiceTemplates, dbapi.StandbyServiceAlias)
+	svcMeta := metav1.ObjectMeta{
+		Name:      r.db.StandbyServiceName(),
+		Namespace: r.db.Namespace,
+	}
+
+	_, vt, err := r.createOrPatch(&core.Service{
+		ObjectMeta: svcMeta,
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*core.Service)
+		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+		in.Labels = r.db.ServiceLabels(dbapi.StandbyServiceAlias, svcTemplate.Labels)
+		in.Annotations = svcTemplate.Annotations
+
+		in.Spec.Selector = r.db.OffshootSelectors(map[string]string{dbapi.LabelRole: msapi.DatabasePodSecondary})
+		in.Spec.Ports = coreutil.MergeServicePorts(in.Spec.Ports, r.getServicePorts(false))
 		copyFromServiceTemplateSpec(in, svcTemplate.Spec)
 		return in
 	})
+	r.recordApply("Service", svcMeta.Name, vt, err)
 	return err
 }
 
+// getServicePorts returns the ports of the services, targeting the named ports of the main container.
+// The mirroring endpoint is only used between the replicas, through the governing service.
+func (r *reconcileContext) getServicePorts(mirroring bool) []core.ServicePort {
+	ports := []core.ServicePort{
+		{
+			Name:       msapi.MSSQLDatabasePortName,
+			Port:       r.db.ServicePort(),
+			TargetPort: intstr.FromString(msapi.MSSQLDatabasePortName),
+		},
+	}
+	if port := r.db.MirroringPort(); mirroring && port != 0 {
+		ports = append(ports, core.ServicePort{
+			Name:       msapi.MSSQLMirroringPortName,
+			Port:       port,
+			TargetPort: intstr.FromString(msapi.MSSQLMirroringPortName),
+		})
+	}
+	if port := r.db.AdminServicePort(); port != 0 {
+		ports = append(ports, core.ServicePort{
+			Name:       msapi.MSSQLAdminPortName,
+			Port:       port,
+			TargetPort: intstr.FromString(msapi.MSSQLAdminPortName),
+		})
+	}
+	return ports
+}
+
 func copyFromServiceTemplateSpec(in *core.Service, svcSpec ofst.ServiceSpec) {
 	in.Spec.Ports = ofst.PatchServicePorts(in.Spec.Ports, svcSpec.Ports)
 	if svcSpec.ClusterIP != "" {
@@ -78,13 +133,13 @@ func copyFromServiceTemplateSpec(in *core.Service, svcSpec ofst.ServiceSpec) {
 	}
 }
 
-func (r *MSSQLReconciler) ensureGoverningServices() error {
+func (r *reconcileContext) ensureGoverningServices() error {
 	svcFunc := func(svcName string, labels, selectors map[string]string) error {
 		svcMeta := metav1.ObjectMeta{
 			Name:      svcName,
 			Namespace: r.db.Namespace,
 		}
-		_, vt, err := cu.CreateOrPatch(r.ctx, r.Client, &core.Service{
+		_, vt, err := r.createOrPatch(&core.Service{
 			ObjectMeta: svcMeta,
 		}, func(obj client.Object, createOp bool) client.Object {
 			in := obj.(*core.Service)
@@ -95,19 +150,12 @@ func (r *MSSQLReconciler) ensureGoverningServices() error {
 			in.Spec.Type = core.ServiceTypeClusterIP
 			in.Spec.ClusterIP = core.ClusterIPNone // headless service
 			in.Spec.PublishNotReadyAddresses = true
-			in.Spec.Ports = coreutil.MergeServicePorts(in.Spec.Ports, []core.ServicePort{
-				{
-					Name:       msapi.MSSQLDatabasePortName,
-					Port:       msapi.MSSQLDatabasePort,
-					TargetPort: intstr.FromString(msapi.MSSQLDatabasePortName),
-				},
-			})
+			in.Spec.Ports = coreutil.MergeServicePorts(in.Spec.Ports, r.getServicePorts(true))
 
 			return in
 		})
 
-		if err == nil && vt != kutil.VerbUnchanged {
-		}
+		r.recordApply("Service", svcName, vt, err)
 		return err
 	}
 
@@ -24,9 +24,7 @@ import (
 	kerr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/klog/v2"
 	kutil "kmodules.xyz/client-go"
-	cu "kmodules.xyz/client-go/client"
 	coreutil "kmodules.xyz/client-go/core/v1"
 	metautil "kmodules.xyz/client-go/meta"
 	ofst "kmodules.xyz/offshoot-api/api/v1"
@@ -40,6 +38,8 @@ type workloadOptions struct {
 	stsName   string
 	labels    map[string]string
 	selectors map[string]string
+	// podAnnotations are added to the annotations of spec.podTemplate
+	podAnnotations map[string]string
 
 	// db container options
 	// cmd, args, envList & volumeMount of the main(`mssql`) container
@@ -47,6 +47,11 @@ type workloadOptions struct {
 	args        []string
 	envList     []core.EnvVar
 	volumeMount []core.VolumeMount
+	ports       []core.ContainerPort
+	// livenessProbe of the main container, it replaces the one of spec.podTemplate if set
+	livenessProbe *core.Probe
+	// sidecars run beside the main container
+	sidecars []core.Container
 
 	// pod Template level options
 	replicas       *int32                          // sts.Spec.Replicas
@@ -56,21 +61,24 @@ type workloadOptions struct {
 	emptyDirSpec   *core.EmptyDirVolumeSource      // sts.Spec.Template.Spec.Volumes if storageType != Ephemeral
 	initContainers []core.Container                // sts.Spec.Template.Spec.InitContainers
 	volumes        []core.Volume                   // sts.Spec.Template.Spec.Volumes
+	// serviceAccountName overrides the service account of spec.podTemplate, if set
+	serviceAccountName string
 }
 
-func (r *MSSQLReconciler) ensureStatefulSet(opts workloadOptions) (*apps.StatefulSet, kutil.VerbType, error) {
+func (r *reconcileContext) ensureStatefulSet(opts workloadOptions) (*apps.StatefulSet, kutil.VerbType, error) {
 	var pt ofst.PodTemplateSpec
 	if opts.podTemplate != nil {
 		pt = *opts.podTemplate
 	}
 	if err := r.checkStatefulSet(opts.stsName); err != nil {
+		r.recordEvent(core.EventTypeWarning, EventReasonInvalid, err.Error())
 		return nil, kutil.VerbUnchanged, err
 	}
 	stsMeta := metav1.ObjectMeta{
 		Name:      opts.stsName,
 		Namespace: r.db.Namespace,
 	}
-	statefulSet, vt, err := cu.CreateOrPatch(r.ctx, r.Client, &apps.StatefulSet{
+	statefulSet, vt, err := r.createOrPatch(&apps.StatefulSet{
 		ObjectMeta: stsMeta,
 	}, func(obj client.Object, createOp bool) client.Object {
 		in := obj.(*apps.StatefulSet)
@@ -88,16 +96,21 @@ func (r *MSSQLReconciler) ensureStatefulSet(opts workloadOptions) (*apps.Statefu
 		in.Spec.Template.Spec.InitContainers = coreutil.UpsertContainers(in.Spec.Template.Spec.InitContainers, opts.initContainers)
 
 		// containers
-		in.Spec.Template.Spec.Containers = coreutil.UpsertContainer(in.Spec.Template.Spec.Containers, getMainContainer(opts, r.db.Spec.Version))
+		in.Spec.Template.Spec.Containers = coreutil.UpsertContainer(in.Spec.Template.Spec.Containers, getMainContainer(opts, r.version.Spec.DB.Image))
+		in.Spec.Template.Spec.Containers = coreutil.UpsertContainers(in.Spec.Template.Spec.Containers, opts.sidecars)
 
 		// volumes
 		in.Spec.Template.Spec.Volumes = coreutil.UpsertVolume(in.Spec.Template.Spec.Volumes, opts.volumes...)
 		in = upsertDataVolume(in, opts.pvcSpec, opts.emptyDirSpec, r.db.Spec.StorageType)
 		copyFromPodTemplate(in, pt)
+		if opts.serviceAccountName != "" {
+			in.Spec.Template.Spec.ServiceAccountName = opts.serviceAccountName
+		}
+		in.Spec.Template.Annotations = metautil.OverwriteKeys(nil, pt.Annotations, opts.podAnnotations)
 		return in
 	})
+	r.recordApply("StatefulSet", opts.stsName, vt, err)
 	if err != nil {
-		klog.Info("+++++++++++++++++  ensure statefull set ", err)
 		return nil, kutil.VerbUnchanged, err
 	}
 	return statefulSet.(*apps.StatefulSet), vt, err
@@ -130,7 +143,7 @@ func copyFromPodTemplate(in *apps.StatefulSet, pt ofst.PodTemplateSpec) {
 }
 
 // if a statefulSet is already there that doesn't contain the required labels -> return err. otherwise nil
-func (r *MSSQLReconciler) checkStatefulSet(stsName string) error {
+func (r *reconcileContext) checkStatefulSet(stsName string) error {
 	var sts apps.StatefulSet
 	err := r.Client.Get(r.ctx, types.NamespacedName{
 		Name:      stsName,
@@ -165,6 +178,9 @@ func getMainContainer(opts workloadOptions, dbImage string) core.Container {
 	if livenessProbe != nil && structs.IsZero(*livenessProbe) {
 		livenessProbe = nil
 	}
+	if opts.livenessProbe != nil {
+		livenessProbe = opts.livenessProbe
+	}
 
 	return core.Container{
 		Name:            msapi.MSSQLContainerName,
@@ -172,13 +188,7 @@ func getMainContainer(opts workloadOptions, dbImage string) core.Container {
 		ImagePullPolicy: core.PullIfNotPresent,
 		Command:         opts.cmd,
 		Args:            metautil.UpsertArgumentList(opts.args, pt.Spec.Args),
-		Ports: []core.ContainerPort{
-			{
-				Name:          msapi.MSSQLDatabasePortName,
-				ContainerPort: msapi.MSSQLDatabasePort,
-				Protocol:      core.ProtocolTCP,
-			},
-		},
+		Ports:           opts.ports,
 		Env:             coreutil.UpsertEnvVars(opts.envList, pt.Spec.Env...),
 		Resources:       pt.Spec.Resources,
 		SecurityContext: pt.Spec.ContainerSecurityContext,
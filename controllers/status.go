@@ -0,0 +1,156 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// updateStatus patches the status subresource of the MSSQL object using the given transform function.
+// The health checker writes the status concurrently with the reconciler, so the patch is conditioned on the
+// resourceVersion it was computed from & the transform is applied again to the latest object on a conflict.
+// r.db.Status is synced with the patched object afterwards.
+func (r *reconcileContext) updateStatus(transform func(status *msapi.MSSQLStatus)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		in := &msapi.MSSQL{}
+		if err := r.Get(r.ctx, client.ObjectKeyFromObject(r.db), in); err != nil {
+			return err
+		}
+		patch := client.MergeFromWithOptions(in.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		transform(&in.Status)
+		if err := r.Status().Patch(r.ctx, in, patch); err != nil {
+			return err
+		}
+		r.db.Status = in.Status
+		return nil
+	})
+}
+
+func (r *reconcileContext) ensureProvisioningStarted() error {
+	if kmapi.HasCondition(r.db.Status.Conditions, dbapi.DatabaseProvisioningStarted) {
+		return nil
+	}
+	return r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               dbapi.DatabaseProvisioningStarted,
+			Status:             core.ConditionTrue,
+			Reason:             dbapi.DatabaseProvisioningStartedSuccessfully,
+			ObservedGeneration: r.db.Generation,
+			Message:            fmt.Sprintf("The KubeDB operator has started the provisioning of MSSQL: %s/%s", r.db.Namespace, r.db.Name),
+		})
+		status.Phase = dbapi.DatabasePhaseProvisioning
+	})
+}
+
+// updatePhaseFromCondition refreshes the workload related conditions, then derives the phase from them.
+// AcceptingConnection & Ready are maintained by the health checker.
+func (r *reconcileContext) updatePhaseFromCondition() error {
+	var sts apps.StatefulSet
+	err := r.Client.Get(r.ctx, types.NamespacedName{
+		Name:      r.db.OffshootName(),
+		Namespace: r.db.Namespace,
+	}, &sts)
+	if err != nil && !kerr.IsNotFound(err) {
+		return err
+	}
+
+	var desired, ready int32
+	if sts.Spec.Replicas != nil {
+		desired = *sts.Spec.Replicas
+	}
+	ready = sts.Status.ReadyReplicas
+	allReady := desired > 0 && ready == desired
+	gen := r.db.Generation
+	oldPhase := r.db.Status.Phase
+
+	err = r.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               dbapi.DatabaseReplicaReady,
+			Status:             conditionStatus(allReady),
+			Reason:             reasonFor(allReady, dbapi.AllReplicasAreReady, dbapi.SomeReplicasAreNotReady),
+			ObservedGeneration: gen,
+			Message:            fmt.Sprintf("%d/%d replica(s) are ready", ready, desired),
+		})
+
+		r.setProvisionedIfReady(status)
+
+		// the workload is being reconciled, so the database is not halted (anymore)
+		status.Conditions = kmapi.RemoveCondition(status.Conditions, dbapi.DatabaseHalted)
+
+		status.Phase = msapi.MSSQL{Status: *status}.GetPhase()
+		status.ObservedGeneration = gen
+	})
+	if err != nil {
+		return err
+	}
+	r.recordPhaseChange(oldPhase)
+	return nil
+}
+
+// setProvisionedIfReady marks the database as Provisioned the first time it becomes Ready, after the init scripts
+// have been run.
+func (r *reconcileContext) setProvisionedIfReady(status *msapi.MSSQLStatus) {
+	initialized := !kmapi.HasCondition(status.Conditions, msapi.DatabaseInitialized) ||
+		kmapi.IsConditionTrue(status.Conditions, msapi.DatabaseInitialized)
+	if initialized && kmapi.IsConditionTrue(status.Conditions, dbapi.DatabaseReady) &&
+		!kmapi.IsConditionTrue(status.Conditions, dbapi.DatabaseProvisioned) {
+		status.Conditions = kmapi.SetCondition(status.Conditions, kmapi.Condition{
+			Type:               dbapi.DatabaseProvisioned,
+			Status:             core.ConditionTrue,
+			Reason:             dbapi.DatabaseSuccessfullyProvisioned,
+			ObservedGeneration: r.db.Generation,
+			Message:            fmt.Sprintf("The KubeDB operator has successfully provisioned MSSQL: %s/%s", r.db.Namespace, r.db.Name),
+		})
+	}
+}
+
+// recordPhaseChange records an event if the phase has moved away from oldPhase.
+// Moving into NotReady or Critical is recorded as a warning.
+func (r *reconcileContext) recordPhaseChange(oldPhase dbapi.DatabasePhase) {
+	phase := r.db.Status.Phase
+	if phase == oldPhase {
+		return
+	}
+	eventType := core.EventTypeNormal
+	if phase == dbapi.DatabasePhaseNotReady || phase == dbapi.DatabasePhaseCritical {
+		eventType = core.EventTypeWarning
+	}
+	r.recordEvent(eventType, EventReasonPhaseChanged, "Phase changed from %q to %q", oldPhase, phase)
+}
+
+func conditionStatus(ok bool) core.ConditionStatus {
+	if ok {
+		return core.ConditionTrue
+	}
+	return core.ConditionFalse
+}
+
+func reasonFor(ok bool, success, failure string) string {
+	if ok {
+		return success
+	}
+	return failure
+}
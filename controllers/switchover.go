@@ -0,0 +1,490 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	cu "kmodules.xyz/client-go/client"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// synchronizedQuery returns the number of databases of the availability group, & how many of them are
+// SYNCHRONIZED on the replica named by the second argument. It runs on the primary replica.
+const synchronizedQuery = "SELECT " +
+	"(SELECT COUNT(*) FROM sys.availability_databases_cluster adc WHERE adc.group_id = ag.group_id) AS databases, " +
+	"(SELECT COUNT(*) FROM sys.dm_hadr_database_replica_states drs " +
+	"JOIN sys.availability_replicas ar ON ar.replica_id = drs.replica_id " +
+	"WHERE ar.group_id = ag.group_id AND ar.replica_server_name = @p2 AND drs.synchronization_state_desc = 'SYNCHRONIZED') AS synchronized " +
+	"FROM sys.availability_groups ag WHERE ag.name = @p1"
+
+// hardenedLSNQuery returns the last hardened LSN of the local replica of each database of the availability group.
+// On a demoted primary, that is the end of its log.
+const hardenedLSNQuery = "SELECT CAST(drs.group_database_id AS varchar(36)) AS database_id, " +
+	"CAST(drs.last_hardened_lsn AS varchar(32)) AS last_hardened_lsn " +
+	"FROM sys.dm_hadr_database_replica_states drs " +
+	"JOIN sys.availability_groups ag ON ag.group_id = drs.group_id " +
+	"WHERE drs.is_local = 1 AND ag.name = @p1"
+
+var (
+	// switchoverSyncTimeout bounds the wait for the target of a switchover to be SYNCHRONIZED
+	switchoverSyncTimeout = 2 * time.Minute
+	// switchoverPollInterval is how soon the synchronization of the target, & then the primary service, is checked
+	// again
+	switchoverPollInterval = 5 * time.Second
+	// switchoverHardenTimeout bounds the wait for the target to harden the end of the log of the demoted primary
+	switchoverHardenTimeout = 10 * time.Second
+	// switchoverHardenInterval is the interval between two checks of the log of the target
+	switchoverHardenInterval = 100 * time.Millisecond
+)
+
+// ensureSwitchover moves the primary role to the pod named by the switchover annotation, see switchover. It returns
+// whether the switchover is done or in progress, the rest of the availability group waits for the next reconcile
+// then. The annotation is removed once the primary moved.
+func (r *reconcileContext) ensureSwitchover(clients []sqlclient.Client, roles []string, primary int32) (bool, error) {
+	target, ok := r.db.Annotations[msapi.MSSQLSwitchoverAnnotation]
+	if !ok {
+		return false, nil
+	}
+	ag := r.db.AvailabilityGroup()
+	to := r.ordinalOf(target)
+	if to == primary {
+		return false, r.removeSwitchoverAnnotation()
+	}
+	if to < 0 || int(to) >= len(clients) || roles[to] == "" {
+		// the request can't be fulfilled, whatever the next reconciles find
+		r.recordEvent(core.EventTypeWarning, EventReasonSwitchoverFailed, "Can't switch over to pod %s, it isn't a replica of availability group %s",
+			target, ag.Name)
+		return false, r.removeSwitchoverAnnotation()
+	}
+	if switched, err := r.switchover(clients, roles, primary, to, "switchover requested"); err != nil || !switched {
+		return true, err
+	}
+	return true, r.removeSwitchoverAnnotation()
+}
+
+// ensureScaleDownSwitchover moves the primary role to the first synchronous secondary that is kept, when
+// spec.replicas is lowered below the ordinal of the primary. It returns whether the switchover is done or in
+// progress.
+func (r *reconcileContext) ensureScaleDownSwitchover(clients []sqlclient.Client, roles []string, primary int32) (bool, error) {
+	if primary < *r.db.Spec.Replicas {
+		return false, nil
+	}
+	ag := r.db.AvailabilityGroup()
+	for i := int32(0); i < *r.db.Spec.Replicas && i < r.db.SynchronousReplicas(); i++ {
+		if roles[i] == sqlclient.ReplicaRoleSecondary {
+			_, err := r.switchover(clients, roles, primary, i, "scale down")
+			return true, err
+		}
+	}
+	err := fmt.Errorf("can't scale down availability group %s before pod %s hands over the primary role, no synchronous secondary is kept",
+		ag.Name, r.podName(primary))
+	r.recordEvent(core.EventTypeWarning, EventReasonSwitchoverFailed, err.Error())
+	return false, err
+}
+
+// ensureRolloutSwitchover moves the primary role to the first synchronous secondary once the primary is the last
+// pod ensureCertificateRollout has to restart, so that it restarts as a secondary. Without a synchronous secondary,
+// the primary is restarted right away. It returns whether the switchover is done or in progress.
+func (r *reconcileContext) ensureRolloutSwitchover(clients []sqlclient.Client, roles []string, primary int32) (bool, error) {
+	outdated, err := r.outdatedPods()
+	if err != nil || len(outdated) == 0 || outdated[0].Name != r.podName(primary) {
+		return false, err
+	}
+	for i := int32(0); i < *r.db.Spec.Replicas && i < r.db.SynchronousReplicas(); i++ {
+		if roles[i] == sqlclient.ReplicaRoleSecondary {
+			_, err = r.switchover(clients, roles, primary, i, "certificate rollout")
+			return true, err
+		}
+	}
+	return false, r.restartOutdatedPod(outdated)
+}
+
+// switchover moves the primary role to the replica with the ordinal to, without data loss. Until the target is
+// SYNCHRONIZED, the SwitchingOver condition is set & the reconcile is requeued, for up to switchoverSyncTimeout.
+// Then new connections through the primary service are held, the primary is demoted, the target gets the primary
+// lease & is promoted, see switchPrimary. The coordinators then move the role labels, & the primary service resumes
+// once it selects the target, see ensurePrimaryServiceResumed. The time the connections were held is recorded in
+// status.availabilityGroup.lastFailover. It returns whether the primary moved.
+func (r *reconcileContext) switchover(clients []sqlclient.Client, roles []string, primary, to int32, reason string) (bool, error) {
+	ag := r.db.AvailabilityGroup()
+	from, target := r.podName(primary), r.podName(to)
+
+	waiting := fmt.Sprintf("Waiting for pod %s to be SYNCHRONIZED to switch over availability group %s from pod %s", target, ag.Name, from)
+	started := r.switchoverStarted(waiting)
+	if started == nil {
+		r.recordEvent(core.EventTypeNormal, EventReasonSwitchoverStarted, "Switching over availability group %s from pod %s to pod %s",
+			ag.Name, from, target)
+	}
+	synchronized, err := r.synchronized(clients[primary], target)
+	if err != nil {
+		r.recordEvent(core.EventTypeWarning, EventReasonSwitchoverFailed, "Failed to switch over to pod %s: %v", target, err)
+		return false, err
+	}
+	if !synchronized {
+		if started == nil {
+			r.requeueIn(switchoverPollInterval)
+			return false, r.setSwitchingOver(core.ConditionTrue, msapi.WaitingForSynchronization, waiting)
+		}
+		if time.Since(started.Time) < switchoverSyncTimeout {
+			r.requeueIn(switchoverPollInterval)
+			return false, nil
+		}
+		err = fmt.Errorf("pod %s is not SYNCHRONIZED after %s", target, switchoverSyncTimeout)
+		r.recordEvent(core.EventTypeWarning, EventReasonSwitchoverFailed, "Failed to switch over to pod %s: %v", target, err)
+		// the next reconcile starts over
+		return false, utilerrors.NewAggregate([]error{err, r.setSwitchingOver(core.ConditionFalse, msapi.SwitchoverTimedOut, err.Error())})
+	}
+	if started == nil {
+		now := metav1.Now()
+		started = &now
+	}
+
+	pause, err := r.pausePrimaryService(target)
+	if err != nil {
+		return false, err
+	}
+	if err = r.switchPrimary(clients, primary, to); err != nil {
+		r.recordEvent(core.EventTypeWarning, EventReasonSwitchoverFailed, "Failed to switch over to pod %s: %v", target, err)
+		return false, utilerrors.NewAggregate([]error{err, r.resumePrimaryService()})
+	}
+	roles[primary] = sqlclient.ReplicaRoleSecondary
+	roles[to] = sqlclient.ReplicaRolePrimary
+
+	// completed once the primary service selects the target
+	now := metav1.Now()
+	record := &msapi.MSSQLFailoverStatus{
+		From:        from,
+		To:          target,
+		Reason:      reason,
+		DetectedAt:  started,
+		CompletedAt: now,
+		Duration:    &metav1.Duration{Duration: now.Sub(pause.Since.Time).Round(time.Millisecond)},
+	}
+	r.requeueIn(switchoverPollInterval)
+	return true, r.updateStatus(func(in *msapi.MSSQLStatus) {
+		if in.AvailabilityGroup == nil {
+			in.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{Name: ag.Name}
+		}
+		in.AvailabilityGroup.Primary = target
+		in.AvailabilityGroup.LastFailover = record
+		in.Conditions = kmapi.SetCondition(in.Conditions, kmapi.Condition{
+			Type:               msapi.DatabaseSwitchingOver,
+			Status:             core.ConditionTrue,
+			Reason:             msapi.WaitingForPrimaryService,
+			ObservedGeneration: r.db.Generation,
+			Message:            fmt.Sprintf("Pod %s is the primary replica of availability group %s, waiting for the primary service to select it", target, ag.Name),
+		})
+	})
+}
+
+// pausePrimaryService holds the new connections through the primary service, by restricting it to the pod that
+// is about to become the primary replica, see ensurePrimaryService. The pod isn't labeled primary yet.
+func (r *reconcileContext) pausePrimaryService(pod string) (*msapi.MSSQLServicePause, error) {
+	pause := &msapi.MSSQLServicePause{Pod: pod, Since: metav1.Now()}
+	err := r.updateStatus(func(in *msapi.MSSQLStatus) {
+		if in.AvailabilityGroup != nil {
+			in.AvailabilityGroup.PrimaryServicePause = pause
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pause, r.ensurePrimaryService()
+}
+
+// resumePrimaryService lets the primary service select the labeled primary replica again.
+func (r *reconcileContext) resumePrimaryService() error {
+	err := r.updateStatus(func(in *msapi.MSSQLStatus) {
+		if in.AvailabilityGroup != nil {
+			in.AvailabilityGroup.PrimaryServicePause = nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return r.ensurePrimaryService()
+}
+
+// ensurePrimaryServiceResumed ends the pause of the primary service of a switchover, once the service selects the
+// new primary replica, i.e. its coordinator labeled it & it is ready. The time the connections were held is
+// recorded in status.availabilityGroup.lastFailover. A pause for a pod that isn't the primary, as the primary moved
+// meanwhile, is dropped.
+func (r *reconcileContext) ensurePrimaryServiceResumed() error {
+	status := r.db.Status.AvailabilityGroup
+	if status == nil || status.PrimaryServicePause == nil {
+		return nil
+	}
+	pause := status.PrimaryServicePause
+	if pause.Pod != status.Primary {
+		return r.resumePrimaryService()
+	}
+	selected, err := r.primaryServiceSelects(pause.Pod)
+	if err != nil {
+		return err
+	}
+	if !selected {
+		r.requeueIn(switchoverPollInterval)
+		return nil
+	}
+
+	now := metav1.Now()
+	held := now.Sub(pause.Since.Time).Round(time.Millisecond)
+	err = r.updateStatus(func(in *msapi.MSSQLStatus) {
+		if in.AvailabilityGroup == nil {
+			return
+		}
+		if last := in.AvailabilityGroup.LastFailover; last != nil && last.To == pause.Pod {
+			last.CompletedAt = now
+			last.Duration = &metav1.Duration{Duration: held}
+		}
+		in.AvailabilityGroup.PrimaryServicePause = nil
+		in.Conditions = r.switchingOverConditions(in.Conditions, core.ConditionFalse, msapi.SwitchoverCompleted,
+			fmt.Sprintf("The primary service selects pod %s", pause.Pod))
+	})
+	if err != nil {
+		return err
+	}
+	r.recordEvent(core.EventTypeNormal, EventReasonSwitchoverSucceeded, "Pod %s is the primary replica of availability group %s, new connections were held for %s",
+		pause.Pod, r.db.AvailabilityGroup().Name, held)
+	return r.ensurePrimaryService()
+}
+
+// primaryServiceSelects tells whether the endpoints of the primary service point at the ready pod.
+func (r *reconcileContext) primaryServiceSelects(pod string) (bool, error) {
+	var endpoints core.Endpoints
+	err := r.Client.Get(r.ctx, client.ObjectKey{Namespace: r.db.Namespace, Name: r.db.PrimaryServiceName()}, &endpoints)
+	if err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.TargetRef != nil && address.TargetRef.Kind == "Pod" && address.TargetRef.Name == pod {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// synchronized tells whether the databases of the availability group are SYNCHRONIZED on the target, as seen by
+// the primary replica.
+func (r *reconcileContext) synchronized(primary sqlclient.Client, target string) (bool, error) {
+	rows, err := primary.Query(r.ctx, synchronizedQuery, r.db.AvailabilityGroup().Name, target)
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0 && parseNumber(rows[0]["synchronized"]).Cmp(parseNumber(rows[0]["databases"])) >= 0, nil
+}
+
+// switchoverStarted returns since when the switchover described by the message waits for its target, nil if it
+// doesn't yet.
+func (r *reconcileContext) switchoverStarted(message string) *metav1.Time {
+	_, cond := kmapi.GetCondition(r.db.Status.Conditions, msapi.DatabaseSwitchingOver)
+	if cond == nil || cond.Status != core.ConditionTrue || cond.Message != message {
+		return nil
+	}
+	return &cond.LastTransitionTime
+}
+
+// cancelSwitchover ends the SwitchingOver condition of a switchover that waited for its target, when no switchover
+// is requested anymore.
+func (r *reconcileContext) cancelSwitchover() error {
+	_, cond := kmapi.GetCondition(r.db.Status.Conditions, msapi.DatabaseSwitchingOver)
+	if cond == nil || cond.Status != core.ConditionTrue || cond.Reason != msapi.WaitingForSynchronization {
+		return nil
+	}
+	return r.setSwitchingOver(core.ConditionFalse, msapi.SwitchoverCancelled, "No switchover is requested")
+}
+
+// setSwitchingOver updates the SwitchingOver condition, see switchingOverConditions.
+func (r *reconcileContext) setSwitchingOver(status core.ConditionStatus, reason, message string) error {
+	conditions := r.switchingOverConditions(append([]kmapi.Condition(nil), r.db.Status.Conditions...), status, reason, message)
+	if equality.Semantic.DeepEqual(r.db.Status.Conditions, conditions) {
+		return nil
+	}
+	return r.updateStatus(func(in *msapi.MSSQLStatus) {
+		in.Conditions = r.switchingOverConditions(in.Conditions, status, reason, message)
+	})
+}
+
+// switchingOverConditions returns the conditions with the SwitchingOver condition set. It is only set to false over
+// an existing condition, i.e. once a switchover waited for its target.
+func (r *reconcileContext) switchingOverConditions(conditions []kmapi.Condition, status core.ConditionStatus, reason, message string) []kmapi.Condition {
+	if status == core.ConditionFalse && !kmapi.IsConditionTrue(conditions, msapi.DatabaseSwitchingOver) {
+		return conditions
+	}
+	return kmapi.SetCondition(conditions, kmapi.Condition{
+		Type:               msapi.DatabaseSwitchingOver,
+		Status:             status,
+		Reason:             reason,
+		ObservedGeneration: r.db.Generation,
+		Message:            message,
+	})
+}
+
+// switchPrimary demotes the primary replica, hands the primary lease to the target & promotes it. The old primary
+// is promoted again if the target can't be. The None cluster type promotes with a forced failover, so the target
+// has to have hardened the whole log of the demoted primary first, see waitForHardened.
+func (r *reconcileContext) switchPrimary(clients []sqlclient.Client, primary, target int32) error {
+	ag := r.db.AvailabilityGroup()
+	var demote []string
+	if ag.ClusterType == msapi.MSSQLClusterTypeExternal {
+		demote = append(demote, sqlclient.ExternalClusterSessionContext)
+	}
+	demote = append(demote, fmt.Sprintf("ALTER AVAILABILITY GROUP %s SET (ROLE = SECONDARY)", quoteName(ag.Name)))
+	if err := clients[primary].ExecScript(r.ctx, demote); err != nil {
+		return fmt.Errorf("failed to demote pod %s: %w", r.podName(primary), err)
+	}
+	if ag.ClusterType == msapi.MSSQLClusterTypeNone {
+		if err := r.waitForHardened(clients[primary], clients[target], r.podName(target)); err != nil {
+			// the lease didn't move, bring the old primary back
+			return utilerrors.NewAggregate([]error{err, r.setPrimaryRole(clients[primary])})
+		}
+	}
+
+	err := r.handPrimaryLease(r.podName(target))
+	if err == nil {
+		if err = r.setPrimaryRole(clients[target]); err == nil {
+			if err = r.resumeDataMovement(clients[primary]); err != nil {
+				// the databases stay suspended on the old primary, which doesn't stop the switchover
+				r.Log.Error(err, "Failed to resume the data movement", "replica", r.podName(primary))
+			}
+			return nil
+		}
+		err = fmt.Errorf("failed to promote pod %s: %w", r.podName(target), err)
+	}
+	// the target didn't take over, bring the old primary back
+	if rollbackErr := r.handPrimaryLease(r.podName(primary)); rollbackErr != nil {
+		return utilerrors.NewAggregate([]error{err, rollbackErr})
+	}
+	return utilerrors.NewAggregate([]error{err, r.setPrimaryRole(clients[primary])})
+}
+
+// waitForHardened waits until the target hardened the log of every database up to the end of the log of the
+// demoted primary, so that the transactions committed after the SYNCHRONIZED check aren't lost. No transaction is
+// committed meanwhile, so the target catches up within switchoverHardenTimeout.
+func (r *reconcileContext) waitForHardened(primary, target sqlclient.Client, targetName string) error {
+	deadline := time.Now().Add(switchoverHardenTimeout)
+	for {
+		behind, err := r.logBehind(primary, target)
+		if err != nil || behind == "" {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pod %s didn't harden the log of database %s up to the end of the log of the primary in %s",
+				targetName, behind, switchoverHardenTimeout)
+		}
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(switchoverHardenInterval):
+		}
+	}
+}
+
+// logBehind returns the id of a database whose last hardened LSN on the target is behind the one on the primary,
+// empty if there is none.
+func (r *reconcileContext) logBehind(primary, target sqlclient.Client) (string, error) {
+	ag := r.db.AvailabilityGroup()
+	primaryRows, err := primary.Query(r.ctx, hardenedLSNQuery, ag.Name)
+	if err != nil {
+		return "", err
+	}
+	targetRows, err := target.Query(r.ctx, hardenedLSNQuery, ag.Name)
+	if err != nil {
+		return "", err
+	}
+	hardened := map[string]string{}
+	for _, row := range targetRows {
+		hardened[fmt.Sprint(row["database_id"])] = fmt.Sprint(row["last_hardened_lsn"])
+	}
+	for _, row := range primaryRows {
+		id := fmt.Sprint(row["database_id"])
+		lsn, ok := hardened[id]
+		if !ok || parseNumber(lsn).Cmp(parseNumber(row["last_hardened_lsn"])) < 0 {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// handPrimaryLease hands the primary lease to the given pod.
+func (r *reconcileContext) handPrimaryLease(holder string) error {
+	lease, err := r.getPrimaryLease()
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return r.ensurePrimaryLease(holder)
+	}
+	return r.acquirePrimaryLease(lease, holder)
+}
+
+// setPrimaryRole promotes a demoted, synchronized replica. Without a cluster manager, that takes a forced failover,
+// which doesn't lose data as no replica took writes meanwhile.
+func (r *reconcileContext) setPrimaryRole(c sqlclient.Client) error {
+	ag := r.db.AvailabilityGroup()
+	if ag.ClusterType == msapi.MSSQLClusterTypeExternal {
+		return c.ExecScript(r.ctx, []string{
+			sqlclient.ExternalClusterSessionContext,
+			fmt.Sprintf("ALTER AVAILABILITY GROUP %s FAILOVER", quoteName(ag.Name)),
+		})
+	}
+	return c.Exec(r.ctx, fmt.Sprintf("ALTER AVAILABILITY GROUP %s FORCE_FAILOVER_ALLOW_DATA_LOSS", quoteName(ag.Name)))
+}
+
+// resumeDataMovement resumes the databases of a replica demoted without a cluster manager, which suspends them.
+func (r *reconcileContext) resumeDataMovement(c sqlclient.Client) error {
+	if r.db.AvailabilityGroup().ClusterType == msapi.MSSQLClusterTypeExternal || r.db.Status.AvailabilityGroup == nil {
+		return nil
+	}
+	var batches []string
+	for _, name := range r.db.Status.AvailabilityGroup.Databases {
+		batches = append(batches, fmt.Sprintf("ALTER DATABASE %s SET HADR RESUME", quoteName(name)))
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+	return c.ExecScript(r.ctx, batches)
+}
+
+func (r *reconcileContext) removeSwitchoverAnnotation() error {
+	_, _, err := cu.CreateOrPatch(r.ctx, r.Client, &msapi.MSSQL{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.db.Name,
+			Namespace: r.db.Namespace,
+		},
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*msapi.MSSQL)
+		delete(in.Annotations, msapi.MSSQLSwitchoverAnnotation)
+		return in
+	})
+	if err != nil {
+		return err
+	}
+	delete(r.db.Annotations, msapi.MSSQLSwitchoverAnnotation)
+	return nil
+}
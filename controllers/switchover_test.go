@@ -0,0 +1,313 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gomodules.xyz/pointer"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newSwitchoverTestContext returns a context whose primary mssql-0 is asked to switch over to mssql-1.
+func newSwitchoverTestContext(t *testing.T, clusterType msapi.MSSQLClusterType) (*reconcileContext, []sqlclient.Client, []string) {
+	rc, sqlClients := newAvailabilityGroupTestContext(t)
+	rc.db.Spec.Topology.AvailabilityGroup.ClusterType = clusterType
+	createPrimaryLease(t, rc, "mssql-0", 0)
+	err := rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		status.AvailabilityGroup = &msapi.MSSQLAvailabilityGroupStatus{
+			Name:      "mssql",
+			Primary:   "mssql-0",
+			Replicas:  []string{"mssql-0", "mssql-1"},
+			Databases: []string{"app"},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := []string{sqlclient.ReplicaRolePrimary, sqlclient.ReplicaRoleSecondary}
+
+	patch := client.MergeFrom(rc.db.DeepCopy())
+	rc.db.Annotations = map[string]string{msapi.MSSQLSwitchoverAnnotation: "mssql-1"}
+	if err = rc.Client.Patch(rc.ctx, rc.db, patch); err != nil {
+		t.Fatal(err)
+	}
+	rc.db.SetDefaults()
+	rc.db.Spec.Topology.AvailabilityGroup.ClusterType = clusterType
+
+	clients := []sqlclient.Client{
+		sqlClients.Client(sqlclient.InstanceHost(rc.db, 0)),
+		sqlClients.Client(sqlclient.InstanceHost(rc.db, 1)),
+	}
+	clients[0].(*sqlfake.Client).Results[synchronizedQuery] = []sqlclient.Row{{"databases": int64(1), "synchronized": int64(1)}}
+	return rc, clients, roles
+}
+
+func switchoverAnnotation(t *testing.T, rc *reconcileContext) (string, bool) {
+	var db msapi.MSSQL
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: "demo", Name: "mssql"}, &db); err != nil {
+		t.Fatal(err)
+	}
+	target, ok := db.Annotations[msapi.MSSQLSwitchoverAnnotation]
+	return target, ok
+}
+
+func TestEnsureSwitchover(t *testing.T) {
+	rc, clients, roles := newSwitchoverTestContext(t, msapi.MSSQLClusterTypeExternal)
+	first, second := clients[0].(*sqlfake.Client), clients[1].(*sqlfake.Client)
+
+	switched, err := rc.ensureSwitchover(clients, roles, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !switched {
+		t.Fatal("expected a switchover")
+	}
+	wantFirst := []string{sqlclient.ExternalClusterSessionContext, "ALTER AVAILABILITY GROUP [mssql] SET (ROLE = SECONDARY)"}
+	if !reflect.DeepEqual(first.Executed, wantFirst) {
+		t.Errorf("instance 0 executed %v, want %v", first.Executed, wantFirst)
+	}
+	wantSecond := []string{sqlclient.ExternalClusterSessionContext, "ALTER AVAILABILITY GROUP [mssql] FAILOVER"}
+	if !reflect.DeepEqual(second.Executed, wantSecond) {
+		t.Errorf("instance 1 executed %v, want %v", second.Executed, wantSecond)
+	}
+	if !reflect.DeepEqual(roles, []string{sqlclient.ReplicaRoleSecondary, sqlclient.ReplicaRolePrimary}) {
+		t.Errorf("roles = %v", roles)
+	}
+	if holder := getPrimaryLease(t, rc).Spec.HolderIdentity; pointer.String(holder) != "mssql-1" {
+		t.Errorf("primary lease holder = %s, want mssql-1", pointer.String(holder))
+	}
+	status := rc.db.Status.AvailabilityGroup
+	if status.Primary != "mssql-1" || status.LastFailover == nil || status.LastFailover.From != "mssql-0" ||
+		status.LastFailover.Reason != "switchover requested" || status.LastFailover.Duration == nil {
+		t.Errorf("availability group status = %+v, last failover = %+v", status, status.LastFailover)
+	}
+	if target, ok := switchoverAnnotation(t, rc); ok {
+		t.Errorf("switchover annotation %q is not removed", target)
+	}
+
+	// new connections are held until the primary service selects mssql-1
+	if pause := status.PrimaryServicePause; pause == nil || pause.Pod != "mssql-1" {
+		t.Fatalf("primary service pause = %+v", pause)
+	}
+	if selector := primaryServiceSelector(t, rc); selector[apps.StatefulSetPodNameLabel] != "mssql-1" {
+		t.Errorf("primary service selector = %v, want it restricted to mssql-1", selector)
+	}
+	if err = rc.ensurePrimaryServiceResumed(); err != nil {
+		t.Fatal(err)
+	}
+	if rc.db.Status.AvailabilityGroup.PrimaryServicePause == nil {
+		t.Error("expected the primary service to be held until it selects mssql-1")
+	}
+	err = rc.Client.Create(rc.ctx, &core.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: rc.db.PrimaryServiceName()},
+		Subsets: []core.EndpointSubset{{
+			Addresses: []core.EndpointAddress{{IP: "10.0.0.2", TargetRef: &core.ObjectReference{Kind: "Pod", Name: "mssql-1"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.ensurePrimaryServiceResumed(); err != nil {
+		t.Fatal(err)
+	}
+	status = rc.db.Status.AvailabilityGroup
+	if status.PrimaryServicePause != nil || status.LastFailover.CompletedAt.Before(status.LastFailover.DetectedAt) {
+		t.Errorf("availability group status = %+v, last failover = %+v", status, status.LastFailover)
+	}
+	if selector := primaryServiceSelector(t, rc); selector[apps.StatefulSetPodNameLabel] != "" {
+		t.Errorf("primary service selector = %v, want it resumed", selector)
+	}
+	if _, cond := kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabaseSwitchingOver); cond == nil || cond.Reason != msapi.SwitchoverCompleted {
+		t.Errorf("SwitchingOver condition = %+v, want it completed", cond)
+	}
+}
+
+func primaryServiceSelector(t *testing.T, rc *reconcileContext) map[string]string {
+	var svc core.Service
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: "demo", Name: rc.db.PrimaryServiceName()}, &svc); err != nil {
+		t.Fatal(err)
+	}
+	return svc.Spec.Selector
+}
+
+func TestEnsureSwitchoverInvalidTarget(t *testing.T) {
+	rc, clients, roles := newSwitchoverTestContext(t, msapi.MSSQLClusterTypeExternal)
+	roles[1] = ""
+
+	// mssql-1 didn't join, the request is dropped
+	switched, err := rc.ensureSwitchover(clients, roles, 0)
+	if err != nil || switched {
+		t.Fatalf("ensureSwitchover() = %v, %v, want no switchover", switched, err)
+	}
+	if target, ok := switchoverAnnotation(t, rc); ok {
+		t.Errorf("switchover annotation %q is not removed", target)
+	}
+	if len(clients[0].(*sqlfake.Client).Executed) != 0 {
+		t.Errorf("instance 0 executed %v", clients[0].(*sqlfake.Client).Executed)
+	}
+}
+
+func TestEnsureSwitchoverClusterTypeNone(t *testing.T) {
+	defer func(timeout time.Duration) { switchoverHardenTimeout = timeout }(switchoverHardenTimeout)
+	switchoverHardenTimeout = 10 * time.Millisecond
+
+	rc, clients, roles := newSwitchoverTestContext(t, msapi.MSSQLClusterTypeNone)
+	first, second := clients[0].(*sqlfake.Client), clients[1].(*sqlfake.Client)
+	first.Results[hardenedLSNQuery] = []sqlclient.Row{{"database_id": "6d3c", "last_hardened_lsn": "38000000042400001"}}
+	second.Results[hardenedLSNQuery] = []sqlclient.Row{{"database_id": "6d3c", "last_hardened_lsn": "38000000040000001"}}
+
+	// a transaction committed after the SYNCHRONIZED check isn't on mssql-1 yet, the forced failover would lose it
+	if _, err := rc.ensureSwitchover(clients, roles, 0); err == nil {
+		t.Fatal("expected an error while mssql-1 is behind the end of the log of mssql-0")
+	}
+	if executed(second, "FORCE_FAILOVER_ALLOW_DATA_LOSS") || !executed(first, "FORCE_FAILOVER_ALLOW_DATA_LOSS") {
+		t.Errorf("instance 0 executed %v, instance 1 executed %v, want mssql-0 promoted back", first.Executed, second.Executed)
+	}
+	if holder := getPrimaryLease(t, rc).Spec.HolderIdentity; pointer.String(holder) != "mssql-0" {
+		t.Errorf("primary lease holder = %s, want mssql-0", pointer.String(holder))
+	}
+	if rc.db.Status.AvailabilityGroup.PrimaryServicePause != nil {
+		t.Error("expected the primary service to resume")
+	}
+
+	first.Executed = nil
+	second.Results[hardenedLSNQuery] = []sqlclient.Row{{"database_id": "6d3c", "last_hardened_lsn": "38000000042400001"}}
+	if _, err := rc.ensureSwitchover(clients, roles, 0); err != nil {
+		t.Fatal(err)
+	}
+	wantFirst := []string{"ALTER AVAILABILITY GROUP [mssql] SET (ROLE = SECONDARY)", "ALTER DATABASE [app] SET HADR RESUME"}
+	if !reflect.DeepEqual(first.Executed, wantFirst) {
+		t.Errorf("instance 0 executed %v, want %v", first.Executed, wantFirst)
+	}
+	wantSecond := []string{"ALTER AVAILABILITY GROUP [mssql] FORCE_FAILOVER_ALLOW_DATA_LOSS"}
+	if !reflect.DeepEqual(second.Executed, wantSecond) {
+		t.Errorf("instance 1 executed %v, want %v", second.Executed, wantSecond)
+	}
+}
+
+func TestEnsureSwitchoverWaitsForSynchronized(t *testing.T) {
+	rc, clients, roles := newSwitchoverTestContext(t, msapi.MSSQLClusterTypeExternal)
+	first, second := clients[0].(*sqlfake.Client), clients[1].(*sqlfake.Client)
+	first.Results[synchronizedQuery] = []sqlclient.Row{{"databases": int64(1), "synchronized": int64(0)}}
+
+	// the reconcile comes back instead of waiting for mssql-1
+	switched, err := rc.ensureSwitchover(clients, roles, 0)
+	if err != nil || !switched {
+		t.Fatalf("ensureSwitchover() = %v, %v, want the switchover in progress", switched, err)
+	}
+	if len(first.Executed) != 0 || len(second.Executed) != 0 {
+		t.Errorf("instance 0 executed %v, instance 1 executed %v", first.Executed, second.Executed)
+	}
+	if rc.requeueAfter != switchoverPollInterval {
+		t.Errorf("requeue after %s, want %s", rc.requeueAfter, switchoverPollInterval)
+	}
+	_, cond := kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabaseSwitchingOver)
+	if cond == nil || cond.Status != core.ConditionTrue || cond.Reason != msapi.WaitingForSynchronization {
+		t.Fatalf("SwitchingOver condition = %+v, want it waiting for the synchronization", cond)
+	}
+	if target, _ := switchoverAnnotation(t, rc); target != "mssql-1" {
+		t.Errorf("switchover annotation = %q, want it kept", target)
+	}
+
+	// the wait goes on from where it was, up to the timeout
+	err = rc.updateStatus(func(status *msapi.MSSQLStatus) {
+		for i := range status.Conditions {
+			if status.Conditions[i].Type == msapi.DatabaseSwitchingOver {
+				status.Conditions[i].LastTransitionTime = metav1.NewTime(time.Now().Add(-switchoverSyncTimeout))
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rc.ensureSwitchover(clients, roles, 0); err == nil {
+		t.Error("expected an error once mssql-1 is not SYNCHRONIZED in time")
+	}
+	if len(first.Executed) != 0 || len(second.Executed) != 0 {
+		t.Errorf("instance 0 executed %v, instance 1 executed %v", first.Executed, second.Executed)
+	}
+	if _, cond = kmapi.GetCondition(rc.db.Status.Conditions, msapi.DatabaseSwitchingOver); cond.Status != core.ConditionFalse || cond.Reason != msapi.SwitchoverTimedOut {
+		t.Errorf("SwitchingOver condition = %+v, want it timed out", cond)
+	}
+
+	// the next attempt switches over once mssql-1 caught up
+	first.Results[synchronizedQuery] = []sqlclient.Row{{"databases": int64(1), "synchronized": int64(1)}}
+	if _, err = rc.ensureSwitchover(clients, roles, 0); err != nil {
+		t.Fatal(err)
+	}
+	if rc.db.Status.AvailabilityGroup.Primary != "mssql-1" {
+		t.Errorf("primary = %s, want mssql-1", rc.db.Status.AvailabilityGroup.Primary)
+	}
+}
+
+func TestEnsureSwitchoverRollsBack(t *testing.T) {
+	rc, clients, roles := newSwitchoverTestContext(t, msapi.MSSQLClusterTypeExternal)
+	first, second := clients[0].(*sqlfake.Client), clients[1].(*sqlfake.Client)
+	second.ExecErr = errors.New("timeout")
+
+	if _, err := rc.ensureSwitchover(clients, roles, 0); err == nil {
+		t.Error("expected an error when the target can't be promoted")
+	}
+	if !executed(first, "SET (ROLE = SECONDARY)") || !executed(first, "ALTER AVAILABILITY GROUP [mssql] FAILOVER") {
+		t.Errorf("instance 0 executed %v, want it demoted & promoted back", first.Executed)
+	}
+	if holder := getPrimaryLease(t, rc).Spec.HolderIdentity; pointer.String(holder) != "mssql-0" {
+		t.Errorf("primary lease holder = %s, want mssql-0", pointer.String(holder))
+	}
+}
+
+func TestEnsureRolloutSwitchover(t *testing.T) {
+	rc, clients, roles := newSwitchoverTestContext(t, msapi.MSSQLClusterTypeExternal)
+	rc.db.Spec.TLS = &kmapi.TLSConfig{}
+	rc.db.Status.Certificates = []msapi.MSSQLCertificateStatus{{Alias: msapi.MSSQLServerCert, Hash: "new"}}
+	for i, pod := range []*core.Pod{newRolloutPod(rc, 0, "old", true), newRolloutPod(rc, 1, "new", false)} {
+		if err := rc.Client.Update(rc.ctx, pod); err != nil {
+			t.Fatalf("pod %d: %v", i, err)
+		}
+	}
+
+	switched, err := rc.ensureRolloutSwitchover(clients, roles, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !switched || rc.db.Status.AvailabilityGroup.Primary != "mssql-1" {
+		t.Fatalf("switched = %v, availability group status = %+v", switched, rc.db.Status.AvailabilityGroup)
+	}
+	if reason := rc.db.Status.AvailabilityGroup.LastFailover.Reason; reason != "certificate rollout" {
+		t.Errorf("last failover reason = %q", reason)
+	}
+	var pod core.Pod
+	if err = rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: "demo", Name: "mssql-0"}, &pod); err != nil {
+		t.Errorf("expected the former primary to be kept for ensureCertificateRollout: %v", err)
+	}
+	// the rollout waits for the coordinators to move the role label
+	if switched, err = rc.ensureRolloutSwitchover(clients, roles, 1); err != nil || switched {
+		t.Errorf("switched = %v, err = %v, want nothing to do for the new primary", switched, err)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// terminate cleans up the offshoot resources of a MSSQL that is marked for deletion, depending on
+// spec.terminationPolicy. The finalizer is removed at the end, unless the policy is DoNotTerminate.
+//
+//	DoNotTerminate : nothing is deleted, the MSSQL object stays until the policy gets changed
+//	Halt           : PVCs & secrets are kept
+//	Delete         : PVCs are deleted, secrets are kept
+//	WipeOut        : PVCs & secrets are deleted
+//
+// The StatefulSet & Services are garbage collected through their owner reference in every case.
+//
+// The webhook rejects deleting a DoNotTerminate MSSQL, so the policy is only met here when the webhook got bypassed.
+// Such an object stays in Terminating with a warning event recorded on every reconcile; patching
+// spec.terminationPolicy is the only way out.
+func (r *reconcileContext) terminate() error {
+	switch r.db.Spec.TerminationPolicy {
+	case dbapi.TerminationPolicyDoNotTerminate:
+		r.Log.Info("TerminationPolicy is DoNotTerminate, change it to delete the MSSQL object")
+		r.recordEvent(core.EventTypeWarning, EventReasonTerminating,
+			"TerminationPolicy is %s, change it to delete the MSSQL object", dbapi.TerminationPolicyDoNotTerminate)
+		return nil
+	case dbapi.TerminationPolicyHalt:
+		if err := r.releaseSecrets(); err != nil {
+			return err
+		}
+	case dbapi.TerminationPolicyWipeOut:
+		if err := r.deletePVCs(); err != nil {
+			return err
+		}
+		// no backup integration exists yet, so secrets are the only remaining data
+		if err := r.deleteSecrets(); err != nil {
+			return err
+		}
+	default: // dbapi.TerminationPolicyDelete
+		if err := r.deletePVCs(); err != nil {
+			return err
+		}
+		if err := r.releaseSecrets(); err != nil {
+			return err
+		}
+	}
+	r.stopHealthCheck()
+	r.recordEvent(core.EventTypeNormal, EventReasonTerminating,
+		"Cleaned up according to terminationPolicy %s", r.db.Spec.TerminationPolicy)
+	return r.removeFinalizers()
+}
+
+// deletePVCs deletes the PVCs created from the volumeClaimTemplates of the StatefulSet.
+// StatefulSet controller labels them with the pod selectors.
+func (r *reconcileContext) deletePVCs() error {
+	var pvcs core.PersistentVolumeClaimList
+	err := r.Client.List(r.ctx, &pvcs, client.InNamespace(r.db.Namespace), client.MatchingLabels(r.db.OffshootSelectors()))
+	if err != nil {
+		return err
+	}
+	for i := range pvcs.Items {
+		if err = r.Client.Delete(r.ctx, &pvcs.Items[i]); err != nil && !kerr.IsNotFound(err) {
+			return err
+		}
+	}
+	r.Log.Info("Deleted PVCs", "count", len(pvcs.Items))
+	return nil
+}
+
+// deleteSecrets deletes the secrets created by the operator. Externally managed secrets are not labeled
+// with the offshoot selectors, so they are left untouched.
+func (r *reconcileContext) deleteSecrets() error {
+	var secrets core.SecretList
+	err := r.Client.List(r.ctx, &secrets, client.InNamespace(r.db.Namespace), client.MatchingLabels(r.db.OffshootSelectors()))
+	if err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		if err = r.Client.Delete(r.ctx, &secrets.Items[i]); err != nil && !kerr.IsNotFound(err) {
+			return err
+		}
+	}
+	r.Log.Info("Deleted secrets", "count", len(secrets.Items))
+	return nil
+}
+
+// releaseSecrets removes the owner reference of the MSSQL object from the operator created secrets,
+// so that they survive the garbage collection.
+func (r *reconcileContext) releaseSecrets() error {
+	var secrets core.SecretList
+	err := r.Client.List(r.ctx, &secrets, client.InNamespace(r.db.Namespace), client.MatchingLabels(r.db.OffshootSelectors()))
+	if err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if owned, _ := coreutil.IsOwnedBy(secret, r.db); !owned {
+			continue
+		}
+		patch := client.MergeFrom(secret.DeepCopy())
+		coreutil.RemoveOwnerReference(secret, r.db)
+		if err = r.Client.Patch(r.ctx, secret, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
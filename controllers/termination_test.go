@@ -0,0 +1,169 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	api "kubedb.dev/apimachinery/apis"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newTerminationTestContext returns the context of a MSSQL marked for deletion, owning a PVC & a secret, next to
+// the PVC & the secret of another MSSQL in the same namespace.
+func newTerminationTestContext(t *testing.T, policy dbapi.TerminationPolicy) (*reconcileContext, *record.FakeRecorder) {
+	db := newTestMSSQL()
+	db.Finalizers = []string{api.Finalizer}
+	db.Spec.TerminationPolicy = policy
+	r, _ := newTestReconciler(t, db)
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+	rc := &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}
+
+	other := newTestMSSQL()
+	other.Name = "other"
+	for _, owner := range []*msapi.MSSQL{db, other} {
+		objs := []client.Object{
+			&core.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-" + owner.Name + "-0"}},
+			&core.Secret{ObjectMeta: metav1.ObjectMeta{Name: owner.Name + "-auth"}},
+		}
+		for _, obj := range objs {
+			obj.SetNamespace(owner.Namespace)
+			obj.SetLabels(owner.OffshootSelectors())
+			obj.SetOwnerReferences([]metav1.OwnerReference{
+				*metav1.NewControllerRef(owner, msapi.GroupVersion.WithKind(msapi.ResourceKindMSSQL)),
+			})
+			if err := rc.Client.Create(rc.ctx, obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := rc.Client.Delete(rc.ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Client.Get(rc.ctx, client.ObjectKeyFromObject(db), rc.db); err != nil {
+		t.Fatal(err)
+	}
+	if !rc.isMarkedForDeletion() {
+		t.Fatal("MSSQL is not marked for deletion")
+	}
+	return rc, recorder
+}
+
+// checkOffshoots tells whether the PVC & the secret of the given MSSQL exist & whether the secret is still owned.
+func checkOffshoots(t *testing.T, rc *reconcileContext, name string) (pvc, secret, owned bool) {
+	key := client.ObjectKey{Namespace: rc.db.Namespace, Name: "data-" + name + "-0"}
+	err := rc.Client.Get(rc.ctx, key, &core.PersistentVolumeClaim{})
+	if err != nil && !kerr.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	pvc = err == nil
+
+	var s core.Secret
+	key.Name = name + "-auth"
+	err = rc.Client.Get(rc.ctx, key, &s)
+	if err != nil && !kerr.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	secret = err == nil
+	owned = len(s.OwnerReferences) > 0
+	return pvc, secret, owned
+}
+
+// isFinalized tells whether the finalizer is gone, i.e. the MSSQL object is deleted or about to be.
+func isFinalized(t *testing.T, rc *reconcileContext) bool {
+	var db msapi.MSSQL
+	err := rc.Client.Get(rc.ctx, client.ObjectKeyFromObject(rc.db), &db)
+	if kerr.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return !coreutil.HasFinalizer(db.ObjectMeta, api.Finalizer)
+}
+
+func TestTerminate(t *testing.T) {
+	cases := []struct {
+		policy dbapi.TerminationPolicy
+		pvc    bool
+		secret bool
+		owned  bool
+	}{
+		{policy: dbapi.TerminationPolicyHalt, pvc: true, secret: true, owned: false},
+		{policy: dbapi.TerminationPolicyDelete, pvc: false, secret: true, owned: false},
+		{policy: dbapi.TerminationPolicyWipeOut, pvc: false, secret: false},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			rc, _ := newTerminationTestContext(t, tc.policy)
+			if err := rc.terminate(); err != nil {
+				t.Fatal(err)
+			}
+
+			pvc, secret, owned := checkOffshoots(t, rc, rc.db.Name)
+			if pvc != tc.pvc {
+				t.Errorf("PVC exists: %v, want %v", pvc, tc.pvc)
+			}
+			if secret != tc.secret {
+				t.Errorf("secret exists: %v, want %v", secret, tc.secret)
+			}
+			if secret && owned != tc.owned {
+				t.Errorf("secret owned: %v, want %v", owned, tc.owned)
+			}
+			if pvc, secret, owned = checkOffshoots(t, rc, "other"); !pvc || !secret || !owned {
+				t.Errorf("offshoots of another MSSQL got touched: pvc=%v secret=%v owned=%v", pvc, secret, owned)
+			}
+			if !isFinalized(t, rc) {
+				t.Error("finalizer is not removed")
+			}
+		})
+	}
+}
+
+func TestTerminateDoNotTerminate(t *testing.T) {
+	rc, recorder := newTerminationTestContext(t, dbapi.TerminationPolicyDoNotTerminate)
+	if err := rc.terminate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if pvc, secret, owned := checkOffshoots(t, rc, rc.db.Name); !pvc || !secret || !owned {
+		t.Errorf("offshoots got touched: pvc=%v secret=%v owned=%v", pvc, secret, owned)
+	}
+	if isFinalized(t, rc) {
+		t.Error("finalizer is removed")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, core.EventTypeWarning+" "+EventReasonTerminating) {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Error("no warning event is recorded")
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	coreutil "kmodules.xyz/client-go/core/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/mssqlconf"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// certificateGVK is the cert-manager Certificate. It is handled as unstructured, so that the operator doesn't
+// depend on the cert-manager API.
+var certificateGVK = schema.GroupVersionKind{
+	Group:   msapi.CertManagerGroup,
+	Version: msapi.CertManagerVersion,
+	Kind:    msapi.CertManagerCertificateKind,
+}
+
+const (
+	// certExpiryWarning is how long before its expiry a certificate is warned about. cert-manager renews them
+	// earlier by default, so a warning means the renewal is failing.
+	certExpiryWarning = 7 * 24 * time.Hour
+)
+
+func (r *reconcileContext) tlsEnabled() bool {
+	return r.db.Spec.TLS != nil
+}
+
+// tlsConfig returns the mssql.conf settings of the server certificate. spec.sslMode decides whether the clients
+// must encrypt their connections, encryption is optional by default.
+func (r *reconcileContext) tlsConfig() mssqlconf.Config {
+	cfg := mssqlconf.Config{}
+	if r.tlsEnabled() {
+		cfg.Set("network", "tlscert", path.Join(msapi.MSSQLTLSPath, core.TLSCertKey))
+		cfg.Set("network", "tlskey", path.Join(msapi.MSSQLTLSPath, core.TLSPrivateKeyKey))
+		cfg.Set("network", "tlsprotocols", "1.2")
+	}
+	if r.db.Spec.SSLMode == msapi.MSSQLSSLModeRequireSSL {
+		cfg.Set("network", "forceencryption", "1")
+	}
+	return cfg
+}
+
+// ensureTLS requests the server certificate from cert-manager & publishes its CA to the clients.
+func (r *reconcileContext) ensureTLS() error {
+	if !r.tlsEnabled() {
+		return r.removeTLS()
+	}
+
+	if err := r.ensureServerCertificate(); err != nil {
+		return err
+	}
+
+	var certSecret core.Secret
+	err := r.Client.Get(r.ctx, types.NamespacedName{
+		Namespace: r.db.Namespace,
+		Name:      r.db.GetCertSecretName(msapi.MSSQLServerCert),
+	}, &certSecret)
+	if kerr.IsNotFound(err) {
+		r.Log.V(1).Info("Waiting for the server certificate to be issued")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = r.ensureCASecret(&certSecret); err != nil {
+		return err
+	}
+	return r.updateCertificateStatus(msapi.MSSQLServerCert, &certSecret)
+}
+
+func (r *reconcileContext) ensureServerCertificate() error {
+	_, spec := kmapi.GetCertificate(r.db.Spec.TLS.Certificates, string(msapi.MSSQLServerCert))
+	if spec == nil {
+		spec = &kmapi.CertificateSpec{}
+	}
+	issuer := r.db.Spec.TLS.IssuerRef
+	if spec.IssuerRef != nil {
+		issuer = spec.IssuerRef
+	}
+	if issuer == nil {
+		return fmt.Errorf("spec.tls.issuerRef of MSSQL %s/%s is not set", r.db.Namespace, r.db.Name)
+	}
+
+	certSpec := map[string]interface{}{
+		"secretName":  r.db.GetCertSecretName(msapi.MSSQLServerCert),
+		"commonName":  r.db.PrimaryServiceName(),
+		"dnsNames":    toInterfaces(append(r.serverDNSNames(), spec.DNSNames...)),
+		"ipAddresses": toInterfaces(append([]string{"127.0.0.1"}, spec.IPAddresses...)),
+		"usages":      []interface{}{"server auth", "digital signature", "key encipherment"},
+		"issuerRef": map[string]interface{}{
+			"group": msapi.CertManagerGroup,
+			"kind":  issuer.Kind,
+			"name":  issuer.Name,
+		},
+	}
+	if spec.Duration != nil {
+		certSpec["duration"] = spec.Duration.Duration.String()
+	}
+	if spec.RenewBefore != nil {
+		certSpec["renewBefore"] = spec.RenewBefore.Duration.String()
+	}
+	if spec.PrivateKey != nil && spec.PrivateKey.Encoding != "" {
+		certSpec["privateKey"] = map[string]interface{}{"encoding": string(spec.PrivateKey.Encoding)}
+	}
+	if spec.Subject != nil {
+		subject := map[string]interface{}{}
+		for key, values := range map[string][]string{
+			"organizations":       spec.Subject.Organizations,
+			"countries":           spec.Subject.Countries,
+			"organizationalUnits": spec.Subject.OrganizationalUnits,
+			"localities":          spec.Subject.Localities,
+			"provinces":           spec.Subject.Provinces,
+			"streetAddresses":     spec.Subject.StreetAddresses,
+			"postalCodes":         spec.Subject.PostalCodes,
+		} {
+			if len(values) > 0 {
+				subject[key] = toInterfaces(values)
+			}
+		}
+		if spec.Subject.SerialNumber != "" {
+			subject["serialNumber"] = spec.Subject.SerialNumber
+		}
+		certSpec["subject"] = subject
+	}
+
+	name := r.db.CertificateName(msapi.MSSQLServerCert)
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetNamespace(r.db.Namespace)
+	cert.SetName(name)
+	_, vt, err := r.createOrPatch(cert, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*unstructured.Unstructured)
+		in.SetLabels(r.db.OffshootLabels())
+		om := metav1.ObjectMeta{OwnerReferences: in.GetOwnerReferences()}
+		coreutil.EnsureOwnerReference(&om, r.getOwnerRef())
+		in.SetOwnerReferences(om.OwnerReferences)
+		in.Object["spec"] = certSpec
+		return in
+	})
+	r.recordApply("Certificate", name, vt, err)
+	return err
+}
+
+// serverDNSNames are the names the clients reach SQL Server through: the primary service, the governing service
+// & each pod.
+func (r *reconcileContext) serverDNSNames() []string {
+	ns := r.db.Namespace
+	var names []string
+	for _, svc := range []string{r.db.PrimaryServiceName(), r.db.GoverningServiceName()} {
+		names = append(names, svc, fmt.Sprintf("%s.%s", svc, ns), fmt.Sprintf("%s.%s.svc", svc, ns))
+	}
+	names = append(names, fmt.Sprintf("*.%s.%s.svc", r.db.GoverningServiceName(), ns))
+	for i := int32(0); i < *r.db.Spec.Replicas; i++ {
+		pod := fmt.Sprintf("%s-%d", r.db.OffshootName(), i)
+		names = append(names, pod, fmt.Sprintf("%s.%s.%s.svc", pod, r.db.GoverningServiceName(), ns))
+	}
+	return append(names, "localhost")
+}
+
+// ensureCASecret copies the CA of the server certificate into the <name>-ca secret, so that the applications can
+// trust it without access to the server key.
+func (r *reconcileContext) ensureCASecret(certSecret *core.Secret) error {
+	ca, ok := certSecret.Data[msapi.MSSQLTLSCAKey]
+	if !ok || len(ca) == 0 {
+		r.Log.Info("The issuer of the server certificate doesn't provide its CA", "secret", certSecret.Name)
+		return nil
+	}
+
+	_, vt, err := r.createOrPatch(&core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.db.CASecretName(),
+			Namespace: r.db.Namespace,
+		},
+	}, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*core.Secret)
+		in.Labels = r.db.OffshootLabels()
+		coreutil.EnsureOwnerReference(&in.ObjectMeta, r.getOwnerRef())
+		in.Data = map[string][]byte{msapi.MSSQLTLSCAKey: ca}
+		return in
+	})
+	r.recordApply("Secret", r.db.CASecretName(), vt, err)
+	return err
+}
+
+// removeTLS deletes the Certificate & the CA secret once spec.tls is unset. Either may be missing, the CA secret
+// when the issuer doesn't provide the CA, the Certificate kind when cert-manager isn't installed.
+func (r *reconcileContext) removeTLS() error {
+	if len(r.db.Status.Certificates) > 0 {
+		err := r.updateStatus(func(status *msapi.MSSQLStatus) {
+			status.Certificates = nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetNamespace(r.db.Namespace)
+	cert.SetName(r.db.CertificateName(msapi.MSSQLServerCert))
+	err := r.Client.Delete(r.ctx, cert)
+	if err != nil && !kerr.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		return err
+	}
+	removed := err == nil
+
+	err = r.Client.Delete(r.ctx, &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: r.db.Namespace, Name: r.db.CASecretName()},
+	})
+	if err != nil && !kerr.IsNotFound(err) {
+		return err
+	}
+	if removed {
+		r.recordEvent(core.EventTypeNormal, EventReasonSuccessful, "Removed the server certificate, spec.tls is unset")
+	}
+	return nil
+}
+
+// updateCertificateStatus records the hash & the validity of a certificate secret in the status. A warning is
+// recorded while the certificate is close to or past its expiry.
+func (r *reconcileContext) updateCertificateStatus(alias msapi.MSSQLCertificateAlias, secret *core.Secret) error {
+	status := msapi.MSSQLCertificateStatus{
+		Alias:      alias,
+		SecretName: secret.Name,
+		Hash:       secretHash(secret),
+	}
+	if cert, err := parseCertificate(secret.Data[core.TLSCertKey]); err != nil {
+		r.Log.Info("Failed to parse the certificate", "secret", secret.Name, "error", err.Error())
+	} else {
+		status.SerialNumber = cert.SerialNumber.String()
+		status.NotBefore = &metav1.Time{Time: cert.NotBefore}
+		status.NotAfter = &metav1.Time{Time: cert.NotAfter}
+		if remaining := time.Until(cert.NotAfter); remaining < certExpiryWarning {
+			r.recordEvent(core.EventTypeWarning, EventReasonCertExpiring,
+				"The %s certificate of secret %q expires at %s", alias, secret.Name, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	if old := r.db.GetCertificateStatus(alias); old != nil && equality.Semantic.DeepEqual(*old, status) {
+		return nil
+	}
+	return r.updateStatus(func(in *msapi.MSSQLStatus) {
+		for i := range in.Certificates {
+			if in.Certificates[i].Alias == alias {
+				in.Certificates[i] = status
+				return
+			}
+		}
+		in.Certificates = append(in.Certificates, status)
+	})
+}
+
+// secretHash is the sha256 of the content of a secret.
+func secretHash(secret *core.Secret) string {
+	h := sha256.New()
+	for _, key := range sets.StringKeySet(secret.Data).List() {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write(secret.Data[key])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseCertificate returns the first certificate of a PEM bundle, the leaf one.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func toInterfaces(values []string) []interface{} {
+	out := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+	}
+	return out
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+)
+
+func newTLSTestContext(t *testing.T) *reconcileContext {
+	db := newTestMSSQL()
+	db.Spec.SSLMode = ""
+	db.Spec.TLS = &kmapi.TLSConfig{
+		IssuerRef: &core.TypedLocalObjectReference{
+			APIGroup: pointer.StringP(msapi.CertManagerGroup),
+			Kind:     msapi.CertManagerIssuerKind,
+			Name:     "mssql-ca",
+		},
+	}
+	db.SetDefaults()
+	r, _ := newTestReconciler(t, db)
+	return &reconcileContext{MSSQLReconciler: r, ctx: context.TODO(), Log: logr.Discard(), db: db}
+}
+
+func getServerCertificate(rc *reconcileContext) (*unstructured.Unstructured, error) {
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	err := rc.Client.Get(rc.ctx, types.NamespacedName{
+		Namespace: rc.db.Namespace,
+		Name:      rc.db.CertificateName(msapi.MSSQLServerCert),
+	}, cert)
+	return cert, err
+}
+
+func TestEnsureTLS(t *testing.T) {
+	rc := newTLSTestContext(t)
+	if rc.db.Spec.SSLMode != msapi.MSSQLSSLModeRequireSSL {
+		t.Errorf("sslMode = %s, want %s", rc.db.Spec.SSLMode, msapi.MSSQLSSLModeRequireSSL)
+	}
+	if err := rc.ensureTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := getServerCertificate(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "name"); name != "mssql-ca" {
+		t.Errorf("issuerRef.name = %s", name)
+	}
+	dnsNames, _, _ := unstructured.NestedStringSlice(cert.Object, "spec", "dnsNames")
+	for _, want := range []string{"mssql.demo.svc", "mssql-pods.demo.svc", "mssql-1.mssql-pods.demo.svc"} {
+		if !contains(dnsNames, want) {
+			t.Errorf("dnsNames %v don't include %s", dnsNames, want)
+		}
+	}
+
+	// cert-manager issues the certificate
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	err = rc.Client.Create(rc.ctx, &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: rc.db.GetCertSecretName(msapi.MSSQLServerCert), Namespace: rc.db.Namespace},
+		Data: map[string][]byte{
+			msapi.MSSQLTLSCAKey:   []byte("ca"),
+			core.TLSCertKey:       newTestCertificate(t, notAfter),
+			core.TLSPrivateKeyKey: []byte("key"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.ensureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	status := rc.db.GetCertificateStatus(msapi.MSSQLServerCert)
+	if status == nil || status.Hash == "" || status.NotAfter == nil || !status.NotAfter.Time.Equal(notAfter) {
+		t.Errorf("unexpected certificate status %+v", status)
+	}
+	if got := rc.getPodAnnotations()[msapi.MSSQLTLSHashAnnotation]; got != status.Hash {
+		t.Errorf("pod annotation = %q, want %q", got, status.Hash)
+	}
+	var ca core.Secret
+	if err = rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.CASecretName()}, &ca); err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.Data) != 1 || string(ca.Data[msapi.MSSQLTLSCAKey]) != "ca" {
+		t.Errorf("unexpected CA secret data %v", ca.Data)
+	}
+
+	if err = rc.ensureConfigSecret(); err != nil {
+		t.Fatal(err)
+	}
+	conf := renderedConfig(t, rc)
+	for _, want := range []string{"forceencryption = 1", "tlscert = /etc/mssql-tls/tls.crt", "tlskey = /etc/mssql-tls/tls.key"} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("mssql.conf doesn't include %q:\n%s", want, conf)
+		}
+	}
+}
+
+func TestRemoveTLS(t *testing.T) {
+	rc := newTLSTestContext(t)
+	if err := rc.ensureServerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	err := rc.Client.Create(rc.ctx, &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: rc.db.CASecretName(), Namespace: rc.db.Namespace},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc.db.Spec.TLS = nil
+	if err = rc.ensureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getServerCertificate(rc); !kerr.IsNotFound(err) {
+		t.Errorf("expected the Certificate to be deleted, got %v", err)
+	}
+	var ca core.Secret
+	err = rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: rc.db.Namespace, Name: rc.db.CASecretName()}, &ca)
+	if !kerr.IsNotFound(err) {
+		t.Errorf("expected the CA secret to be deleted, got %v", err)
+	}
+}
+
+func TestRemoveTLSWithoutCASecret(t *testing.T) {
+	rc := newTLSTestContext(t)
+	// the issuer doesn't provide the CA, so no CA secret is published
+	if err := rc.ensureServerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.db.Spec.TLS = nil
+	if err := rc.ensureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getServerCertificate(rc); !kerr.IsNotFound(err) {
+		t.Errorf("expected the Certificate to be deleted, got %v", err)
+	}
+	// nothing is left to remove
+	if err := rc.ensureTLS(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCertificate(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "mssql"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newRolloutPod(rc *reconcileContext, ordinal int, hash string, primary bool) *core.Pod {
+	pod := &core.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%d", rc.db.OffshootName(), ordinal),
+			Namespace:   rc.db.Namespace,
+			Labels:      rc.db.OffshootSelectors(),
+			Annotations: map[string]string{msapi.MSSQLTLSHashAnnotation: hash},
+		},
+		Status: core.PodStatus{Conditions: []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}}},
+	}
+	if primary {
+		pod.Labels = map[string]string{dbapi.LabelRole: dbapi.DatabasePodPrimary}
+		for k, v := range rc.db.OffshootSelectors() {
+			pod.Labels[k] = v
+		}
+	}
+	return pod
+}
+
+func TestEnsureCertificateRollout(t *testing.T) {
+	rc := newTLSTestContext(t)
+	rc.db.Spec.Replicas = pointer.Int32P(3)
+	rc.db.Status.Certificates = []msapi.MSSQLCertificateStatus{{Alias: msapi.MSSQLServerCert, Hash: "new"}}
+	for i, pod := range []*core.Pod{
+		newRolloutPod(rc, 0, "old", true),
+		newRolloutPod(rc, 1, "old", false),
+		newRolloutPod(rc, 2, "new", false),
+	} {
+		if err := rc.Client.Create(rc.ctx, pod); err != nil {
+			t.Fatalf("pod %d: %v", i, err)
+		}
+	}
+
+	remaining := func() []string {
+		var pods core.PodList
+		if err := rc.Client.List(rc.ctx, &pods); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, pod := range pods.Items {
+			names = append(names, pod.Name)
+		}
+		return names
+	}
+
+	// the outdated secondary goes first
+	if err := rc.ensureCertificateRollout(); err != nil {
+		t.Fatal(err)
+	}
+	if got := remaining(); !reflect.DeepEqual(got, []string{"mssql-0", "mssql-2"}) {
+		t.Fatalf("pods = %v, want the secondary mssql-1 to be restarted", got)
+	}
+	// nothing happens until the restarted pod is back
+	if err := rc.ensureCertificateRollout(); err != nil {
+		t.Fatal(err)
+	}
+	if got := remaining(); len(got) != 2 {
+		t.Fatalf("pods = %v, want no restart while a pod is missing", got)
+	}
+
+	if err := rc.Client.Create(rc.ctx, newRolloutPod(rc, 1, "new", false)); err != nil {
+		t.Fatal(err)
+	}
+	// the primary hands over its role first, see ensureRolloutSwitchover
+	if err := rc.ensureCertificateRollout(); err != nil {
+		t.Fatal(err)
+	}
+	if got := remaining(); len(got) != 3 {
+		t.Fatalf("pods = %v, want the primary mssql-0 to be kept until it is switched over", got)
+	}
+
+	var pod core.Pod
+	if err := rc.Client.Get(rc.ctx, types.NamespacedName{Namespace: "demo", Name: "mssql-0"}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	delete(pod.Labels, dbapi.LabelRole)
+	if err := rc.Client.Update(rc.ctx, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.ensureCertificateRollout(); err != nil {
+		t.Fatal(err)
+	}
+	if got := remaining(); !reflect.DeepEqual(got, []string{"mssql-1", "mssql-2"}) {
+		t.Fatalf("pods = %v, want the former primary mssql-0 to be restarted last", got)
+	}
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
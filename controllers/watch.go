@@ -0,0 +1,65 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// secretIndexKey indexes the MSSQL objects by the names of the secrets they refer to.
+// The referred secrets may be managed outside of the operator, so they are not necessarily owned by the MSSQL.
+const secretIndexKey = ".spec.secrets"
+
+func indexSecrets(obj client.Object) []string {
+	db := obj.(*msapi.MSSQL)
+	secrets := []string{db.GetAuthSecretName()}
+	if db.Spec.ConfigSecret != nil && db.Spec.ConfigSecret.Name != "" {
+		secrets = append(secrets, db.Spec.ConfigSecret.Name)
+	}
+	if db.Spec.TLS != nil {
+		// issued by cert-manager, its CA is published once it is ready
+		secrets = append(secrets, db.GetCertSecretName(msapi.MSSQLServerCert))
+	}
+	return secrets
+}
+
+// requestsForSecret maps a secret to the MSSQL objects that refer to it.
+func (r *MSSQLReconciler) requestsForSecret(secret client.Object) []reconcile.Request {
+	var dbs msapi.MSSQLList
+	err := r.Client.List(context.TODO(), &dbs,
+		client.InNamespace(secret.GetNamespace()),
+		client.MatchingFields{secretIndexKey: secret.GetName()},
+	)
+	if err != nil {
+		klog.Errorf("failed to list MSSQL objects referring to secret %s/%s: %v", secret.GetNamespace(), secret.GetName(), err)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(dbs.Items))
+	for _, db := range dbs.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: db.Namespace, Name: db.Name},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// indexedClient evaluates the secretIndexKey field selector through indexSecrets, as the cache of the manager does.
+// The fake client ignores field selectors.
+type indexedClient struct {
+	client.Client
+}
+
+func (c indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	dbs, ok := list.(*msapi.MSSQLList)
+	if !ok || listOpts.FieldSelector == nil {
+		return nil
+	}
+	var items []msapi.MSSQL
+	for _, db := range dbs.Items {
+		for _, name := range indexSecrets(&db) {
+			if listOpts.FieldSelector.Matches(fields.Set{secretIndexKey: name}) {
+				items = append(items, db)
+				break
+			}
+		}
+	}
+	dbs.Items = items
+	return nil
+}
+
+func TestRequestsForSecret(t *testing.T) {
+	db := newTestMSSQL()
+	db.Spec.ConfigSecret = &core.LocalObjectReference{Name: "mssql-config"}
+	r, _ := newTestReconciler(t, db)
+
+	other := newTestMSSQL()
+	other.Name = "other"
+	other.Spec.AuthSecret = &dbapi.SecretReference{LocalObjectReference: core.LocalObjectReference{Name: "shared-auth"}}
+	prod := newTestMSSQL()
+	prod.Namespace = "prod"
+	for _, obj := range []*msapi.MSSQL{other, prod} {
+		if err := r.Client.Create(context.TODO(), obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Client = indexedClient{Client: r.Client}
+
+	cases := []struct {
+		secret types.NamespacedName
+		want   []reconcile.Request
+	}{
+		{
+			secret: types.NamespacedName{Namespace: "demo", Name: "mssql-auth"},
+			want:   []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(db)}},
+		},
+		{
+			secret: types.NamespacedName{Namespace: "demo", Name: "mssql-config"},
+			want:   []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(db)}},
+		},
+		{
+			secret: types.NamespacedName{Namespace: "demo", Name: "shared-auth"},
+			want:   []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(other)}},
+		},
+		{
+			secret: types.NamespacedName{Namespace: "prod", Name: "mssql-auth"},
+			want:   []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(prod)}},
+		},
+		{
+			secret: types.NamespacedName{Namespace: "demo", Name: "unrelated"},
+			want:   []reconcile.Request{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.secret.String(), func(t *testing.T) {
+			secret := &core.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: c.secret.Namespace, Name: c.secret.Name}}
+			if got := r.requestsForSecret(secret); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("requestsForSecret() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
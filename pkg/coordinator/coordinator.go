@@ -0,0 +1,263 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package coordinator runs beside SQL Server in the pods of an availability group. It keeps the role label of its
+// pod in line with the role of the local replica & reports the role & the health of the instance over HTTP. It
+// renews the primary lease while its pod holds it, & fences the local replica when it is the primary without
+// holding the lease. The coordinator only fences while it runs, so the liveness of SQL Server is tied to the renewal
+// of the lease, see Handler: a primary whose coordinator crashed or hangs is restarted before the lease expires.
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Options of a Coordinator. Zero durations are replaced by the defaults.
+type Options struct {
+	// PodName & Namespace identify the pod the coordinator runs in
+	PodName   string
+	Namespace string
+	// AvailabilityGroup is the name of the availability group of the MSSQL
+	AvailabilityGroup string
+	// ClusterType of the availability group
+	ClusterType msapi.MSSQLClusterType
+	// Lease is the name of the primary lease, see Fence. Empty disables fencing.
+	Lease string
+	// Interval between two checks of the local instance. Defaults to 5s, at most a fifth of the lease duration.
+	Interval time.Duration
+	// Timeout bounds a check. Defaults to 5s, at most a fifth of the lease duration.
+	Timeout time.Duration
+}
+
+// Status is the state of the local instance, as served on /role.
+type Status struct {
+	// Role is the role label of the pod, empty while the replica is neither primary nor secondary
+	Role string `json:"role,omitempty"`
+	// ReplicaRole is the role reported by SQL Server, i.e. RESOLVING
+	ReplicaRole string `json:"replicaRole,omitempty"`
+	// Healthy tells whether the last check could query the instance
+	Healthy bool `json:"healthy"`
+	// Fenced tells whether the last check demoted the local replica, as it is not the holder of the primary lease
+	Fenced bool `json:"fenced,omitempty"`
+	// Error of the last check
+	Error string `json:"error,omitempty"`
+	// LastCheck is the time of the last check
+	LastCheck time.Time `json:"lastCheck"`
+}
+
+// Coordinator keeps the role label of its pod up to date.
+type Coordinator struct {
+	kc   client.Client
+	sql  sqlclient.Client
+	opts Options
+	log  logr.Logger
+
+	mu     sync.RWMutex
+	status Status
+
+	// leaseDuration is the duration of the primary lease, as last read. Only used by Sync, like lastRenew.
+	leaseDuration time.Duration
+	// lastRenew is when the last successful renewal of the primary lease started
+	lastRenew time.Time
+	// writableUntil is how long the local primary replica may take writes without a renewal of the primary lease,
+	// zero while it isn't the primary. It is guarded by mu, as the liveness endpoint reads it.
+	writableUntil time.Time
+}
+
+// New returns a Coordinator labeling its pod through kc after the role of the instance sql connects to.
+func New(kc client.Client, sql sqlclient.Client, opts Options, log logr.Logger) *Coordinator {
+	if opts.Interval == 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &Coordinator{kc: kc, sql: sql, opts: opts, log: log}
+}
+
+// Run checks the local instance every interval until ctx is done.
+func (c *Coordinator) Run(ctx context.Context) {
+	for {
+		if err := c.Sync(ctx); err != nil {
+			c.log.Error(err, "Failed to sync the role of the pod")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.boundedByLease(c.opts.Interval)):
+		}
+	}
+}
+
+// Sync queries the role of the local replica & updates the role label of the pod. The label is left alone when the
+// instance can't be queried, the readiness probe takes the pod out of the services instead. With a lease, the
+// pod is only labeled primary while it holds the lease, see syncLease.
+func (c *Coordinator) Sync(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.boundedByLease(c.opts.Timeout))
+	defer cancel()
+
+	status := Status{LastCheck: time.Now()}
+	rows, err := c.sql.Query(ctx, sqlclient.LocalReplicaRoleQuery, c.opts.AvailabilityGroup)
+	if err != nil {
+		status.Error = err.Error()
+		c.setStatus(status)
+		return err
+	}
+	status.Healthy = true
+	if len(rows) > 0 {
+		status.ReplicaRole = fmt.Sprint(rows[0]["role"])
+	}
+	if c.opts.Lease != "" {
+		renewed := c.lastRenew
+		err = c.syncLease(ctx, &status)
+		c.setWritableUntil(status.ReplicaRole, c.lastRenew != renewed, err != nil)
+		if err != nil {
+			status.Error = err.Error()
+			c.setStatus(status)
+			return err
+		}
+	}
+	switch status.ReplicaRole {
+	case sqlclient.ReplicaRolePrimary:
+		status.Role = dbapi.DatabasePodPrimary
+	case sqlclient.ReplicaRoleSecondary:
+		status.Role = msapi.DatabasePodSecondary
+	}
+	if err = c.setRoleLabel(ctx, status.Role); err != nil {
+		status.Error = err.Error()
+	}
+	c.setStatus(status)
+	return err
+}
+
+// boundedByLease bounds d by a fifth of the lease duration, for the coordinator to fence in time.
+func (c *Coordinator) boundedByLease(d time.Duration) time.Duration {
+	if c.leaseDuration > 0 && d > c.leaseDuration/5 {
+		return c.leaseDuration / 5
+	}
+	return d
+}
+
+func (c *Coordinator) setRoleLabel(ctx context.Context, role string) error {
+	var pod core.Pod
+	if err := c.kc.Get(ctx, types.NamespacedName{Namespace: c.opts.Namespace, Name: c.opts.PodName}, &pod); err != nil {
+		return err
+	}
+	if pod.Labels[dbapi.LabelRole] == role {
+		return nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if role == "" {
+		delete(pod.Labels, dbapi.LabelRole)
+	} else {
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels[dbapi.LabelRole] = role
+	}
+	if err := c.kc.Patch(ctx, &pod, patch); err != nil {
+		return err
+	}
+	c.log.Info("Updated the role of the pod", "role", role)
+	return nil
+}
+
+// setWritableUntil updates how long the local replica may take writes, after a check of the primary lease that
+// renewed it or not. A primary that couldn't be fenced must stop right away.
+func (c *Coordinator) setWritableUntil(replicaRole string, renewed, fenceFailed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case replicaRole != sqlclient.ReplicaRolePrimary:
+		c.writableUntil = time.Time{}
+	case fenceFailed:
+		c.writableUntil = time.Now()
+	case renewed:
+		c.writableUntil = c.lastRenew.Add(c.leaseDuration / 3)
+	}
+}
+
+// Live returns an error once the local replica was last seen as the primary, & the primary lease wasn't renewed
+// for a third of its duration, i.e. when the coordinator should have fenced it.
+func (c *Coordinator) Live(now time.Time) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.writableUntil.IsZero() || now.Before(c.writableUntil) {
+		return nil
+	}
+	return fmt.Errorf("the primary replica is not fenced, though the primary lease was due for renewal at %s",
+		c.writableUntil.Format(time.RFC3339))
+}
+
+func (c *Coordinator) setStatus(status Status) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+// Status returns the result of the last check.
+func (c *Coordinator) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// Handler serves the status of the last check:
+//
+//	/role    : the status as JSON
+//	/readyz  : 200 when the instance answered the last check, 503 otherwise
+//	/healthz : 200 as long as the coordinator runs
+//	/leasez  : 200 unless the local primary replica outlived its primary lease, see Live. It is the liveness
+//	           probe of SQL Server, which fails as well when the coordinator is down.
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/role", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Status())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		status := c.Status()
+		if !status.Healthy {
+			http.Error(w, status.Error, http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/leasez", func(w http.ResponseWriter, _ *http.Request) {
+		if err := c.Live(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSync(t *testing.T) {
+	pod := &core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mssql-0", Namespace: "demo", Labels: map[string]string{"app": "mssql"}}}
+	kc := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(pod).Build()
+	sql := &sqlfake.Client{Results: map[string][]sqlclient.Row{}}
+	c := New(kc, sql, Options{PodName: "mssql-0", Namespace: "demo", AvailabilityGroup: "mssql"}, logr.Discard())
+
+	roleLabel := func() (string, bool) {
+		var got core.Pod
+		if err := kc.Get(context.TODO(), types.NamespacedName{Namespace: "demo", Name: "mssql-0"}, &got); err != nil {
+			t.Fatal(err)
+		}
+		role, ok := got.Labels[dbapi.LabelRole]
+		return role, ok
+	}
+
+	cases := []struct {
+		replicaRole string
+		want        string
+	}{
+		{replicaRole: sqlclient.ReplicaRolePrimary, want: dbapi.DatabasePodPrimary},
+		{replicaRole: sqlclient.ReplicaRoleSecondary, want: msapi.DatabasePodSecondary},
+		{replicaRole: sqlclient.ReplicaRoleResolving, want: ""},
+	}
+	for _, tc := range cases {
+		sql.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": tc.replicaRole}}
+		if err := c.Sync(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		if role, _ := roleLabel(); role != tc.want {
+			t.Errorf("%s: role label = %q, want %q", tc.replicaRole, role, tc.want)
+		}
+		if status := c.Status(); !status.Healthy || status.Role != tc.want || status.ReplicaRole != tc.replicaRole {
+			t.Errorf("%s: unexpected status %+v", tc.replicaRole, status)
+		}
+	}
+	if _, ok := roleLabel(); ok {
+		t.Error("role label is not removed while RESOLVING")
+	}
+
+	// the label is kept when the instance doesn't answer
+	sql.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	sql.QueryErr = errors.New("connection refused")
+	if err := c.Sync(context.TODO()); err == nil {
+		t.Error("expected an error while the instance is down")
+	}
+	if role, _ := roleLabel(); role != dbapi.DatabasePodPrimary {
+		t.Errorf("role label = %q, want it kept as %q", role, dbapi.DatabasePodPrimary)
+	}
+	if status := c.Status(); status.Healthy || status.Error == "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	c := New(nil, nil, Options{}, logr.Discard())
+	c.setStatus(Status{Role: dbapi.DatabasePodPrimary, ReplicaRole: sqlclient.ReplicaRolePrimary, Healthy: true})
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/role")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Role != dbapi.DatabasePodPrimary || !status.Healthy {
+		t.Errorf("/role = %+v", status)
+	}
+
+	for _, tc := range []struct {
+		healthy bool
+		want    int
+	}{{true, http.StatusOK}, {false, http.StatusServiceUnavailable}} {
+		c.setStatus(Status{Healthy: tc.healthy, Error: "down"})
+		resp, err = http.Get(srv.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("healthy %v: /readyz = %d, want %d", tc.healthy, resp.StatusCode, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		writableUntil time.Time
+		want          int
+	}{{time.Time{}, http.StatusOK}, {time.Now().Add(time.Minute), http.StatusOK}, {time.Now().Add(-time.Second), http.StatusServiceUnavailable}} {
+		c.writableUntil = tc.writableUntil
+		resp, err = http.Get(srv.URL + "/leasez")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("writable until %v: /leasez = %d, want %d", tc.writableUntil, resp.StatusCode, tc.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gomodules.xyz/pointer"
+	coordination "k8s.io/api/coordination/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+// syncLease renews the primary lease while the pod holds it. A primary replica is fenced when another pod holds
+// the lease, or when the lease couldn't be renewed for a third of its duration: the operator hands the lease to
+// another pod once it hasn't been renewed for its whole duration. Nothing happens until the operator creates the
+// lease. The lease is renewed whatever the role of the replica, as long as the instance answers, so that the
+// operator can promote it again after a restart.
+func (c *Coordinator) syncLease(ctx context.Context, status *Status) error {
+	start := time.Now()
+	var lease coordination.Lease
+	err := c.kc.Get(ctx, types.NamespacedName{Namespace: c.opts.Namespace, Name: c.opts.Lease}, &lease)
+	if kerr.IsNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		c.leaseDuration = time.Duration(pointer.Int32(lease.Spec.LeaseDurationSeconds)) * time.Second
+		holder := pointer.String(lease.Spec.HolderIdentity)
+		if holder != c.opts.PodName {
+			if status.ReplicaRole == sqlclient.ReplicaRolePrimary {
+				return c.fence(ctx, status, fmt.Sprintf("pod %s holds the primary lease", holder))
+			}
+			return nil
+		}
+		lease.Spec.RenewTime = &metav1.MicroTime{Time: start}
+		if err = c.kc.Update(ctx, &lease); err == nil {
+			c.lastRenew = start
+			return nil
+		}
+	}
+
+	// the lease couldn't be read or renewed
+	status.Error = err.Error()
+	c.log.Error(err, "Failed to renew the primary lease")
+	if status.ReplicaRole == sqlclient.ReplicaRolePrimary && c.mustFence(start) {
+		reason := "the primary lease couldn't be renewed since the coordinator started"
+		if !c.lastRenew.IsZero() {
+			reason = fmt.Sprintf("the primary lease couldn't be renewed since %s", c.lastRenew.Format(time.RFC3339))
+		}
+		return c.fence(ctx, status, reason)
+	}
+	return nil
+}
+
+// mustFence tells whether the lease wasn't renewed for a third of its duration, or ever since the coordinator
+// started, in which case it can't tell how long ago the lease was renewed.
+func (c *Coordinator) mustFence(now time.Time) bool {
+	return c.lastRenew.IsZero() || c.leaseDuration == 0 || now.Sub(c.lastRenew) >= c.leaseDuration/3
+}
+
+// fence demotes the local replica to a secondary, so that its databases stop taking writes.
+func (c *Coordinator) fence(ctx context.Context, status *Status, reason string) error {
+	var batches []string
+	if c.opts.ClusterType == msapi.MSSQLClusterTypeExternal {
+		batches = append(batches, sqlclient.ExternalClusterSessionContext)
+	}
+	batches = append(batches, fmt.Sprintf("ALTER AVAILABILITY GROUP [%s] SET (ROLE = SECONDARY)",
+		strings.ReplaceAll(c.opts.AvailabilityGroup, "]", "]]")))
+	if err := c.sql.ExecScript(ctx, batches); err != nil {
+		// the readiness probe takes the pod out of the primary service
+		status.Healthy = false
+		return fmt.Errorf("failed to fence the primary replica, as %s: %w", reason, err)
+	}
+	c.log.Info("Fenced the primary replica", "reason", reason)
+	status.Fenced = true
+	// the role is read again on the next check
+	status.ReplicaRole = ""
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"gomodules.xyz/pointer"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	dbapi "kubedb.dev/apimachinery/apis/kubedb/v1alpha2"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+	sqlfake "kubedb.dev/mssql/pkg/sqlclient/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// unreachableClient fails to read objects, like a client partitioned from the API server.
+type unreachableClient struct {
+	client.Client
+}
+
+func (unreachableClient) Get(_ context.Context, _ client.ObjectKey, _ client.Object, _ ...client.GetOption) error {
+	return errors.New("connection refused")
+}
+
+func newLeaseTestCoordinator(t *testing.T, holder string) (*Coordinator, client.Client, *sqlfake.Client) {
+	pod := &core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mssql-0", Namespace: "demo"}}
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease := &coordination.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "mssql", Namespace: "demo"},
+		Spec: coordination.LeaseSpec{
+			HolderIdentity:       pointer.StringP(holder),
+			LeaseDurationSeconds: pointer.Int32P(30),
+			RenewTime:            &renewed,
+		},
+	}
+	kc := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(pod, lease).Build()
+	sql := &sqlfake.Client{Results: map[string][]sqlclient.Row{
+		sqlclient.LocalReplicaRoleQuery: {{"role": sqlclient.ReplicaRolePrimary}},
+	}}
+	opts := Options{
+		PodName:           "mssql-0",
+		Namespace:         "demo",
+		AvailabilityGroup: "mssql",
+		ClusterType:       msapi.MSSQLClusterTypeExternal,
+		Lease:             "mssql",
+	}
+	return New(kc, sql, opts, logr.Discard()), kc, sql
+}
+
+func TestSyncRenewsLease(t *testing.T) {
+	c, kc, sql := newLeaseTestCoordinator(t, "mssql-0")
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	var lease coordination.Lease
+	if err := kc.Get(context.TODO(), types.NamespacedName{Namespace: "demo", Name: "mssql"}, &lease); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(lease.Spec.RenewTime.Time) > time.Second {
+		t.Errorf("lease renewed at %v, want now", lease.Spec.RenewTime)
+	}
+	if status := c.Status(); status.Role != dbapi.DatabasePodPrimary || status.Fenced {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(sql.Executed) != 0 {
+		t.Errorf("executed %v", sql.Executed)
+	}
+	// the checks are bounded by the lease
+	if d := c.boundedByLease(time.Minute); d != 6*time.Second {
+		t.Errorf("bounded interval = %v, want 6s", d)
+	}
+
+	// a short partition from the API server doesn't fence the primary
+	c.kc = unreachableClient{kc}
+	if err := c.Sync(context.TODO()); err == nil {
+		t.Error("expected an error while the pod can't be labeled")
+	}
+	if len(sql.Executed) != 0 {
+		t.Errorf("executed %v", sql.Executed)
+	}
+
+	// a longer one does
+	c.lastRenew = time.Now().Add(-15 * time.Second)
+	_ = c.Sync(context.TODO())
+	want := []string{
+		sqlclient.ExternalClusterSessionContext,
+		"ALTER AVAILABILITY GROUP [mssql] SET (ROLE = SECONDARY)",
+	}
+	if !reflect.DeepEqual(sql.Executed, want) {
+		t.Errorf("executed %v, want %v", sql.Executed, want)
+	}
+	if !c.Status().Fenced {
+		t.Error("expected the replica to be fenced")
+	}
+}
+
+func TestSyncFencesPrimaryWithoutLease(t *testing.T) {
+	c, kc, sql := newLeaseTestCoordinator(t, "mssql-1")
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sql.Executed, []string{
+		sqlclient.ExternalClusterSessionContext,
+		"ALTER AVAILABILITY GROUP [mssql] SET (ROLE = SECONDARY)",
+	}) {
+		t.Errorf("executed %v", sql.Executed)
+	}
+	var pod core.Pod
+	if err := kc.Get(context.TODO(), types.NamespacedName{Namespace: "demo", Name: "mssql-0"}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if role, ok := pod.Labels[dbapi.LabelRole]; ok {
+		t.Errorf("role label = %q, want none once fenced", role)
+	}
+
+	// a secondary isn't fenced
+	sql.Executed = nil
+	sql.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sql.Executed) != 0 {
+		t.Errorf("executed %v", sql.Executed)
+	}
+
+	// the replica isn't ready when it can't be fenced
+	sql.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRolePrimary}}
+	sql.ExecErr = errors.New("timeout")
+	if err := c.Sync(context.TODO()); err == nil {
+		t.Error("expected an error when the replica can't be fenced")
+	}
+	if c.Status().Healthy {
+		t.Error("expected the coordinator to be unhealthy")
+	}
+}
+
+func TestLiveFollowsLeaseRenewal(t *testing.T) {
+	c, _, sql := newLeaseTestCoordinator(t, "mssql-0")
+	if err := c.Live(time.Now()); err != nil {
+		t.Errorf("Live() before the first check = %v", err)
+	}
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := c.Live(now); err != nil {
+		t.Errorf("Live() after a renewal = %v", err)
+	}
+	if err := c.Live(now.Add(11 * time.Second)); err == nil {
+		t.Error("expected the primary not to be live a third of the lease after the last renewal")
+	}
+
+	// a check that can't reach the instance, or a hung coordinator, doesn't keep the primary live
+	sql.QueryErr = errors.New("timeout")
+	if err := c.Sync(context.TODO()); err == nil {
+		t.Fatal("expected an error while the instance can't be queried")
+	}
+	if err := c.Live(now.Add(11 * time.Second)); err == nil {
+		t.Error("expected the primary not to be live after a failed check")
+	}
+
+	// a fenced replica is live
+	sql.QueryErr = nil
+	sql.Results[sqlclient.LocalReplicaRoleQuery] = []sqlclient.Row{{"role": sqlclient.ReplicaRoleSecondary}}
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Live(now.Add(time.Hour)); err != nil {
+		t.Errorf("Live() of a secondary = %v", err)
+	}
+}
+
+func TestLiveFenceFailed(t *testing.T) {
+	c, _, sql := newLeaseTestCoordinator(t, "mssql-1")
+	sql.ExecErr = errors.New("timeout")
+	if err := c.Sync(context.TODO()); err == nil {
+		t.Fatal("expected an error when the replica can't be fenced")
+	}
+	if err := c.Live(time.Now()); err == nil {
+		t.Error("expected a primary that can't be fenced not to be live")
+	}
+
+	sql.ExecErr = nil
+	if err := c.Sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Live(time.Now()); err != nil {
+		t.Errorf("Live() once fenced = %v", err)
+	}
+}
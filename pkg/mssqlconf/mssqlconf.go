@@ -0,0 +1,196 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mssqlconf parses, validates, merges & renders the mssql.conf file of SQL Server on Linux.
+package mssqlconf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Config is a parsed mssql.conf, section -> key -> value. Sections & keys are kept in lower case,
+// as mssql-conf does.
+type Config map[string]map[string]string
+
+// Parse reads an ini style mssql.conf. Lines that can't be parsed are skipped & reported, so that the
+// rest of the file can still be used.
+func Parse(data string) (Config, []error) {
+	cfg := Config{}
+	var errs []error
+	section := ""
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) == 2 {
+				errs = append(errs, fmt.Errorf("line %d: invalid section header %q", i+1, line))
+				section = ""
+				continue
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			errs = append(errs, fmt.Errorf("line %d: expected key = value, got %q", i+1, line))
+			continue
+		}
+		if section == "" {
+			errs = append(errs, fmt.Errorf("line %d: key %q is outside of a section", i+1, key))
+			continue
+		}
+		cfg.Set(section, key, strings.TrimSpace(value))
+	}
+	return cfg, errs
+}
+
+// Get returns the value of section.key.
+func (c Config) Get(section, key string) (string, bool) {
+	v, ok := c[strings.ToLower(section)][strings.ToLower(key)]
+	return v, ok
+}
+
+// Set sets section.key to value.
+func (c Config) Set(section, key, value string) {
+	section, key = strings.ToLower(section), strings.ToLower(key)
+	if c[section] == nil {
+		c[section] = map[string]string{}
+	}
+	c[section][key] = value
+}
+
+// Delete removes section.key, & the section if it becomes empty.
+func (c Config) Delete(section, key string) {
+	section, key = strings.ToLower(section), strings.ToLower(key)
+	delete(c[section], key)
+	if len(c[section]) == 0 {
+		delete(c, section)
+	}
+}
+
+// Merge returns a new Config with the values of the given configs, later ones taking precedence.
+func Merge(configs ...Config) Config {
+	out := Config{}
+	for _, cfg := range configs {
+		for section, kv := range cfg {
+			for key, value := range kv {
+				out.Set(section, key, value)
+			}
+		}
+	}
+	return out
+}
+
+// String renders the Config with the sections & keys in lexical order, so that the output is stable.
+func (c Config) String() string {
+	var sb strings.Builder
+	for i, section := range sortedKeys(c) {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "[%s]\n", section)
+		for _, key := range sortedKeys(c[section]) {
+			fmt.Fprintf(&sb, "%s = %s\n", key, c[section][key])
+		}
+	}
+	return sb.String()
+}
+
+// anyKey marks the sections whose keys are defined by the user, i.e. [uncmapping]
+const anyKey = "*"
+
+// knownSettings lists the settings documented for mssql-conf.
+var knownSettings = map[string][]string{
+	"eula":                   {"accepteula"},
+	"coredump":               {"captureminiandfull", "coredumptype"},
+	"control":                {"alternatewritethrough", "hestacksize", "stoponguestprocessfault", "writethrough"},
+	"distributedtransaction": {"allowonlysecurerpccalls", "fallbacktounsecurerpcifnecessary", "maxlogsize", "memorybuffersize", "servertcpport", "trace_cm", "trace_contact", "trace_gateway", "trace_log", "trace_misc", "trace_proxy", "trace_svc", "trace_trace", "trace_util", "trace_xa", "tracefilepath", "turnoffrpcsecurity"},
+	"errorlog":               {"numerrorlogs"},
+	"extensibility":          {"datadirectories", "outboundnetworkaccess"},
+	"filelocation":           {"defaultbackupdir", "defaultdatadir", "defaultdumpdir", "defaultlogdir", "errorlogfile", "masterdatafile", "masterlogfile"},
+	"hadr":                   {"hadrenabled"},
+	"language":               {"lcid"},
+	"memory":                 {"enablecontainersharedmemory", "memorylimitmb"},
+	"network":                {"disablesssd", "enablekdcfromkrb5conf", "forceencryption", "forcesecureldap", "ipaddress", "kerberoskeytabfile", "privilegedadaccount", "tcpport", "tlscert", "tlsciphers", "tlskey", "tlsprotocols", "trustedcertificate"},
+	"sqlagent":               {"databasemailprofile", "enabled", "errorlogfile", "errorlogginglevel"},
+	"telemetry":              {"customerfeedback", "userrequestedlocalauditdirectory"},
+	"traceflag":              {},
+	"uncmapping":             {anyKey},
+}
+
+var traceFlagKey = regexp.MustCompile(`^traceflag[0-9]+$`)
+
+// Validate reports the unknown sections & keys of the Config.
+func (c Config) Validate() []error {
+	var errs []error
+	for _, section := range sortedKeys(c) {
+		keys, ok := knownSettings[section]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown section [%s]", section))
+			continue
+		}
+		for _, key := range sortedKeys(c[section]) {
+			if !isKnownKey(section, key, keys) {
+				errs = append(errs, fmt.Errorf("unknown key %q in section [%s]", key, section))
+			}
+		}
+	}
+	return errs
+}
+
+// Valid returns a copy of the Config without the unknown sections & keys.
+func (c Config) Valid() Config {
+	out := Config{}
+	for section, kv := range c {
+		keys, ok := knownSettings[section]
+		if !ok {
+			continue
+		}
+		for key, value := range kv {
+			if isKnownKey(section, key, keys) {
+				out.Set(section, key, value)
+			}
+		}
+	}
+	return out
+}
+
+func isKnownKey(section, key string, keys []string) bool {
+	if section == "traceflag" {
+		return traceFlagKey.MatchString(key)
+	}
+	for _, k := range keys {
+		if k == anyKey || k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mssqlconf
+
+import (
+	"testing"
+)
+
+const userConf = `
+# user settings
+[memory]
+memorylimitmb = 3072
+
+[SQLAgent]
+Enabled = true
+
+[traceflag]
+traceflag0 = 1222
+
+[network]
+unknownkey = 1
+this line is broken
+
+[nosuchsection]
+a = b
+`
+
+func TestParse(t *testing.T) {
+	cfg, errs := Parse(userConf)
+	if len(errs) != 1 {
+		t.Errorf("expected 1 parse error, got %v", errs)
+	}
+	if v, _ := cfg.Get("sqlagent", "enabled"); v != "true" {
+		t.Errorf("sqlagent.enabled = %q, sections & keys must be case insensitive", v)
+	}
+	if v, _ := cfg.Get("memory", "memorylimitmb"); v != "3072" {
+		t.Errorf("memory.memorylimitmb = %q", v)
+	}
+
+	if _, errs = Parse("key = value\n[]\n"); len(errs) != 2 {
+		t.Errorf("expected 2 parse errors, got %v", errs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, _ := Parse(userConf)
+	if errs := cfg.Validate(); len(errs) != 2 {
+		t.Errorf("expected the unknown section & key to be reported, got %v", errs)
+	}
+
+	valid := cfg.Valid()
+	if _, ok := valid.Get("network", "unknownkey"); ok {
+		t.Error("unknown key was kept")
+	}
+	if _, ok := valid["nosuchsection"]; ok {
+		t.Error("unknown section was kept")
+	}
+	if _, ok := valid.Get("traceflag", "traceflag0"); !ok {
+		t.Error("trace flag was dropped")
+	}
+}
+
+func TestMergeAndString(t *testing.T) {
+	defaults := Config{}
+	defaults.Set("network", "tcpport", "1433")
+	defaults.Set("sqlagent", "enabled", "false")
+	user := Config{}
+	user.Set("sqlagent", "enabled", "true")
+	user.Set("memory", "memorylimitmb", "3072")
+
+	want := `[memory]
+memorylimitmb = 3072
+
+[network]
+tcpport = 1433
+
+[sqlagent]
+enabled = true
+`
+	if got := Merge(defaults, user).String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if v, _ := defaults.Get("sqlagent", "enabled"); v != "false" {
+		t.Error("Merge must not modify its inputs")
+	}
+
+	merged := Merge(defaults, user)
+	merged.Delete("memory", "memorylimitmb")
+	if _, ok := merged["memory"]; ok {
+		t.Error("empty section was kept")
+	}
+}
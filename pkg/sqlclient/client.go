@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sqlclient builds the TDS connections the operator uses to talk to the SQL Server instances of a MSSQL.
+package sqlclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+)
+
+// LocalReplicaRoleQuery returns the role of the local replica in the availability group named by the argument.
+// It returns no rows when the instance hasn't joined the availability group.
+const LocalReplicaRoleQuery = "SELECT rs.role_desc AS role FROM sys.availability_groups ag " +
+	"JOIN sys.dm_hadr_availability_replica_states rs ON rs.group_id = ag.group_id AND rs.is_local = 1 WHERE ag.name = @p1"
+
+// ExternalClusterSessionContext lets the session change the role of the local replica of an availability group of
+// the External cluster type, as a cluster manager does.
+const ExternalClusterSessionContext = "EXEC sp_set_session_context @key = N'external_cluster', @value = N'yes'"
+
+// The roles of sys.dm_hadr_availability_replica_states
+const (
+	ReplicaRolePrimary   = "PRIMARY"
+	ReplicaRoleSecondary = "SECONDARY"
+	ReplicaRoleResolving = "RESOLVING"
+)
+
+// Row is a single row of a query result, keyed by the column names.
+// []byte values are converted to string.
+type Row map[string]interface{}
+
+// Client runs statements against a single SQL Server instance.
+type Client interface {
+	// Ping logs into the instance & runs a probe query. It is retried on transient errors.
+	Ping(ctx context.Context) error
+	// Exec runs a statement that doesn't return rows. It may have side effects, so it is only retried when the
+	// server rolled it back, i.e. as a deadlock victim, but not after a network error. The caller, i.e. the next
+	// reconcile, checks the state again before running it once more.
+	Exec(ctx context.Context, query string, args ...interface{}) error
+	// Query runs a read-only statement & returns all of its rows. It is retried on transient errors.
+	Query(ctx context.Context, query string, args ...interface{}) ([]Row, error)
+	// ExecScript runs the batches of a script in order on a single connection, so that the session state,
+	// i.e. USE, carries over from one batch to the next. It stops at the first failing batch & is not retried.
+	ExecScript(ctx context.Context, batches []string) error
+}
+
+// Factory hands out the clients of the instances of MSSQL objects.
+type Factory interface {
+	// Instance returns the client of the pod with the given ordinal, addressed through the governing service.
+	Instance(ctx context.Context, db *msapi.MSSQL, ordinal int32) (Client, error)
+	// Primary returns the client of the instance behind the primary service.
+	Primary(ctx context.Context, db *msapi.MSSQL) (Client, error)
+	// Close releases the cached connections of db.
+	Close(db *msapi.MSSQL)
+}
+
+// InstanceHost returns the DNS name of the pod with the given ordinal.
+func InstanceHost(db *msapi.MSSQL, ordinal int32) string {
+	return fmt.Sprintf("%s-%d.%s.%s.svc", db.OffshootName(), ordinal, db.GoverningServiceName(), db.Namespace)
+}
+
+// PrimaryHost returns the DNS name of the primary service.
+func PrimaryHost(db *msapi.MSSQL) string {
+	return fmt.Sprintf("%s.%s.svc", db.PrimaryServiceName(), db.Namespace)
+}
+
+// batchSeparator matches the GO lines of sqlcmd scripts. GO is not T-SQL, so the batches are sent separately.
+var batchSeparator = regexp.MustCompile(`(?im)^[ \t]*GO[ \t]*;?[ \t]*$`)
+
+// SplitBatches splits a sqlcmd style script into its batches. Empty batches are dropped.
+func SplitBatches(script string) []string {
+	var batches []string
+	for _, batch := range batchSeparator.Split(script, -1) {
+		if strings.TrimSpace(batch) != "" {
+			batches = append(batches, batch)
+		}
+	}
+	return batches
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	mssqldb "github.com/microsoft/go-mssqldb"
+	"github.com/microsoft/go-mssqldb/msdsn"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const appName = "kubedb-mssql-operator"
+
+// Options tune the connections handed out by the Factory. Zero values are replaced by the defaults.
+type Options struct {
+	// DialTimeout bounds establishing a connection. Defaults to 10s.
+	DialTimeout time.Duration
+	// Retries is the number of times a statement failing with a retryable error is retried. Defaults to 3.
+	Retries int
+	// RetryInterval is the wait between two attempts. Defaults to 1s.
+	RetryInterval time.Duration
+	// MaxIdleTime closes the connections idle for longer. Defaults to 5m.
+	MaxIdleTime time.Duration
+}
+
+func (o *Options) setDefaults() {
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 10 * time.Second
+	}
+	if o.Retries == 0 {
+		o.Retries = 3
+	}
+	if o.RetryInterval == 0 {
+		o.RetryInterval = time.Second
+	}
+	if o.MaxIdleTime == 0 {
+		o.MaxIdleTime = 5 * time.Minute
+	}
+}
+
+// factory caches a connection pool per host. A pool is reopened when the connection string or the CA changes,
+// i.e. the password of the auth secret was rotated, spec.sslMode was changed or the CA was renewed.
+type factory struct {
+	kc   client.Reader
+	opts Options
+
+	mu    sync.Mutex
+	pools map[string]*pool
+}
+
+type pool struct {
+	db    *sql.DB
+	dsn   string
+	ca    []byte
+	owner types.NamespacedName
+}
+
+var _ Factory = &factory{}
+
+// NewFactory returns a Factory reading the credentials from the auth secret of the MSSQL objects through kc.
+func NewFactory(kc client.Reader, opts Options) Factory {
+	opts.setDefaults()
+	return &factory{
+		kc:    kc,
+		opts:  opts,
+		pools: map[string]*pool{},
+	}
+}
+
+// NewClient returns the client of a single host, outside of a Factory, i.e. of the local instance of a pod.
+// The server certificate is verified against ca for the name hostInCertificate.
+func NewClient(host, hostInCertificate string, port int32, user, password string, sslMode msapi.MSSQLSSLMode, ca []byte, opts Options) (Client, error) {
+	opts.setDefaults()
+	connector, err := newConnector(connectionURL(host, hostInCertificate, port, user, password, sslMode, opts.DialTimeout), ca)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB := sql.OpenDB(connector)
+	sqlDB.SetConnMaxIdleTime(opts.MaxIdleTime)
+	return &sqlClient{db: sqlDB, opts: opts}, nil
+}
+
+func (f *factory) Instance(ctx context.Context, db *msapi.MSSQL, ordinal int32) (Client, error) {
+	// the governing service is headless, so the pods are reached on the port SQL Server listens on
+	return f.client(ctx, db, InstanceHost(db, ordinal), db.ServerPort())
+}
+
+func (f *factory) Primary(ctx context.Context, db *msapi.MSSQL) (Client, error) {
+	return f.client(ctx, db, PrimaryHost(db), db.ServicePort())
+}
+
+func (f *factory) Close(db *msapi.MSSQL) {
+	owner := types.NamespacedName{Namespace: db.Namespace, Name: db.Name}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for host, p := range f.pools {
+		if p.owner == owner {
+			_ = p.db.Close()
+			delete(f.pools, host)
+		}
+	}
+}
+
+func (f *factory) client(ctx context.Context, db *msapi.MSSQL, host string, port int32) (Client, error) {
+	user, password, err := f.credentials(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := f.ca(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	dsn := connectionURL(host, host, port, user, password, db.Spec.SSLMode, f.opts.DialTimeout)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.pools[host]; ok {
+		if p.dsn == dsn && bytes.Equal(p.ca, ca) {
+			return &sqlClient{db: p.db, opts: f.opts}, nil
+		}
+		_ = p.db.Close()
+		delete(f.pools, host)
+	}
+
+	connector, err := newConnector(dsn, ca)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB := sql.OpenDB(connector)
+	sqlDB.SetConnMaxIdleTime(f.opts.MaxIdleTime)
+	f.pools[host] = &pool{
+		db:    sqlDB,
+		dsn:   dsn,
+		ca:    ca,
+		owner: types.NamespacedName{Namespace: db.Namespace, Name: db.Name},
+	}
+	return &sqlClient{db: sqlDB, opts: f.opts}, nil
+}
+
+func (f *factory) credentials(ctx context.Context, db *msapi.MSSQL) (string, string, error) {
+	var secret core.Secret
+	err := f.kc.Get(ctx, types.NamespacedName{
+		Name:      db.GetAuthSecretName(),
+		Namespace: db.Namespace,
+	}, &secret)
+	if err != nil {
+		return "", "", err
+	}
+	for _, key := range []string{core.BasicAuthUsernameKey, core.BasicAuthPasswordKey} {
+		if len(secret.Data[key]) == 0 {
+			return "", "", fmt.Errorf("auth secret %s/%s is missing the key %q", secret.Namespace, secret.Name, key)
+		}
+	}
+	return string(secret.Data[core.BasicAuthUsernameKey]), string(secret.Data[core.BasicAuthPasswordKey]), nil
+}
+
+// ca returns the CA the server certificate of db is verified against, from the CA secret. It is nil without
+// spec.tls, or while the CA secret doesn't exist, e.g. for issuers that don't provide their CA: the system roots
+// are used then.
+func (f *factory) ca(ctx context.Context, db *msapi.MSSQL) ([]byte, error) {
+	if db.Spec.TLS == nil || db.Spec.SSLMode == msapi.MSSQLSSLModeDisabled {
+		return nil, nil
+	}
+	var secret core.Secret
+	err := f.kc.Get(ctx, types.NamespacedName{
+		Name:      db.CASecretName(),
+		Namespace: db.Namespace,
+	}, &secret)
+	if kerr.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data[msapi.MSSQLTLSCAKey], nil
+}
+
+// connectionURL returns the go-mssqldb connection string for the master database of the given host. The server
+// certificate is verified for the name hostInCertificate whenever the login is encrypted.
+//
+//	disabled   : nothing is encrypted
+//	allowSSL   : only the login packet is encrypted
+//	requireSSL : the whole connection is encrypted
+func connectionURL(host, hostInCertificate string, port int32, user, password string, sslMode msapi.MSSQLSSLMode, dialTimeout time.Duration) string {
+	query := url.Values{}
+	query.Set("database", "master")
+	query.Set("app name", appName)
+	query.Set("dial timeout", strconv.Itoa(int(dialTimeout.Seconds())))
+	switch sslMode {
+	case msapi.MSSQLSSLModeRequireSSL:
+		query.Set("encrypt", "true")
+		query.Set("TrustServerCertificate", "false")
+		query.Set("hostNameInCertificate", hostInCertificate)
+	case msapi.MSSQLSSLModeAllowSSL:
+		query.Set("encrypt", "false")
+		query.Set("hostNameInCertificate", hostInCertificate)
+	default:
+		query.Set("encrypt", "disable")
+	}
+	u := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(user, password),
+		Host:     host + ":" + strconv.Itoa(int(port)),
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// newConnector returns the connector of the connection string, verifying the server certificate against ca.
+func newConnector(dsn string, ca []byte) (*mssqldb.Connector, error) {
+	cfg, _, err := msdsn.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if len(ca) > 0 && cfg.TLSConfig != nil {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, errors.New("the CA of the server certificate holds no valid PEM certificate")
+		}
+		cfg.TLSConfig.RootCAs = roots
+	}
+	return mssqldb.NewConnectorConfig(cfg), nil
+}
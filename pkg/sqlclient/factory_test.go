@@ -0,0 +1,204 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	mssqldb "github.com/microsoft/go-mssqldb"
+	"github.com/microsoft/go-mssqldb/msdsn"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestConnectionURL(t *testing.T) {
+	cases := []struct {
+		sslMode           msapi.MSSQLSSLMode
+		encrypt           string
+		verified          bool
+		hostInCertificate string
+	}{
+		{msapi.MSSQLSSLModeDisabled, "disable", false, ""},
+		{msapi.MSSQLSSLModeAllowSSL, "false", true, "mssql.demo.svc"},
+		{msapi.MSSQLSSLModeRequireSSL, "true", true, "mssql.demo.svc"},
+	}
+	for _, c := range cases {
+		t.Run(string(c.sslMode), func(t *testing.T) {
+			dsn := connectionURL("mssql-0.mssql-pods.demo.svc", "mssql.demo.svc", 1433, "sa", "p@ss:w/rd", c.sslMode, 5*time.Second)
+			u, err := url.Parse(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Host != "mssql-0.mssql-pods.demo.svc:1433" {
+				t.Errorf("host = %s", u.Host)
+			}
+			if password, _ := u.User.Password(); password != "p@ss:w/rd" {
+				t.Errorf("password = %s", password)
+			}
+			if got := u.Query().Get("encrypt"); got != c.encrypt {
+				t.Errorf("encrypt = %s, want %s", got, c.encrypt)
+			}
+			if got := u.Query().Get("dial timeout"); got != "5" {
+				t.Errorf("dial timeout = %s", got)
+			}
+
+			cfg, _, err := msdsn.Parse(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified := cfg.TLSConfig != nil && !cfg.TLSConfig.InsecureSkipVerify; verified != c.verified {
+				t.Errorf("server certificate verified = %v, want %v", verified, c.verified)
+			}
+			if c.verified && cfg.TLSConfig.ServerName != c.hostInCertificate {
+				t.Errorf("server name = %s, want %s", cfg.TLSConfig.ServerName, c.hostInCertificate)
+			}
+		})
+	}
+}
+
+func TestNewConnector(t *testing.T) {
+	dsn := connectionURL("mssql.demo.svc", "mssql.demo.svc", 1433, "sa", "password", msapi.MSSQLSSLModeRequireSSL, time.Second)
+	if _, err := newConnector(dsn, testCA(t)); err != nil {
+		t.Errorf("valid CA: %v", err)
+	}
+	if _, err := newConnector(dsn, nil); err != nil {
+		t.Errorf("system roots: %v", err)
+	}
+	if _, err := newConnector(dsn, []byte("not a certificate")); err == nil {
+		t.Error("expected an error for an invalid CA")
+	}
+}
+
+func TestFactoryCA(t *testing.T) {
+	db := &msapi.MSSQL{ObjectMeta: metav1.ObjectMeta{Name: "mssql", Namespace: "demo"}}
+	db.Spec.SSLMode = msapi.MSSQLSSLModeRequireSSL
+	ca := testCA(t)
+	kc := fake.NewClientBuilder().WithObjects(&core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: db.CASecretName(), Namespace: db.Namespace},
+		Data:       map[string][]byte{msapi.MSSQLTLSCAKey: ca},
+	}).Build()
+	f := NewFactory(kc, Options{}).(*factory)
+
+	if got, err := f.ca(context.TODO(), db); err != nil || got != nil {
+		t.Errorf("without tls: ca = %q, %v", got, err)
+	}
+	db.Spec.TLS = &kmapi.TLSConfig{}
+	if got, err := f.ca(context.TODO(), db); err != nil || !bytes.Equal(got, ca) {
+		t.Errorf("with tls: ca = %q, %v", got, err)
+	}
+	db.Name = "other"
+	if got, err := f.ca(context.TODO(), db); err != nil || got != nil {
+		t.Errorf("without the CA secret: ca = %q, %v", got, err)
+	}
+}
+
+// testCA returns a self-signed certificate in PEM.
+func testCA(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mssql-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestRetry(t *testing.T) {
+	c := &sqlClient{opts: Options{Retries: 2, RetryInterval: time.Millisecond}}
+
+	attempts := 0
+	err := c.retry(context.TODO(), isTransient, func() error {
+		attempts++
+		return errors.New("connection reset by peer")
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("transient error: attempts = %d, err = %v", attempts, err)
+	}
+
+	attempts = 0
+	err = c.retry(context.TODO(), isTransient, func() error {
+		attempts++
+		return mssqldb.Error{Number: 208, Message: "Invalid object name"}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("server error: attempts = %d, err = %v", attempts, err)
+	}
+
+	attempts = 0
+	err = c.retry(context.TODO(), isTransient, func() error {
+		attempts++
+		if attempts == 1 {
+			return mssqldb.Error{Number: deadlockVictim}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("deadlock: attempts = %d, err = %v", attempts, err)
+	}
+
+	// a statement with side effects is not retried after a network error
+	attempts = 0
+	err = c.retry(context.TODO(), isRolledBack, func() error {
+		attempts++
+		return errors.New("connection reset by peer")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("network error of a statement: attempts = %d, err = %v", attempts, err)
+	}
+
+	attempts = 0
+	err = c.retry(context.TODO(), isRolledBack, func() error {
+		attempts++
+		if attempts == 1 {
+			return mssqldb.Error{Number: deadlockVictim}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("deadlock of a statement: attempts = %d, err = %v", attempts, err)
+	}
+
+	if isTransient(sql.ErrNoRows) {
+		t.Error("sql.ErrNoRows must not be retried")
+	}
+}
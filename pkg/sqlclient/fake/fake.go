@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides an in-memory sqlclient.Factory, so that the controllers can be unit-tested without
+// a SQL Server.
+package fake
+
+import (
+	"context"
+	"sync"
+
+	msapi "kubedb.dev/mssql/api/v1alpha1"
+	"kubedb.dev/mssql/pkg/sqlclient"
+)
+
+// Client is an in-memory sqlclient.Client. It records the statements it runs & answers the queries
+// from Results.
+type Client struct {
+	mu sync.Mutex
+
+	// PingErr is returned by Ping
+	PingErr error
+	// ExecErr is returned by Exec
+	ExecErr error
+	// QueryErr is returned by Query
+	QueryErr error
+	// Results are the rows returned by Query, keyed by the query
+	Results map[string][]sqlclient.Row
+	// Executed lists the statements run through Exec & the batches run through ExecScript, in order
+	Executed []string
+}
+
+var _ sqlclient.Client = &Client{}
+
+func (c *Client) Ping(_ context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PingErr
+}
+
+func (c *Client) Exec(_ context.Context, query string, _ ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ExecErr != nil {
+		return c.ExecErr
+	}
+	c.Executed = append(c.Executed, query)
+	return nil
+}
+
+func (c *Client) ExecScript(_ context.Context, batches []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ExecErr != nil {
+		return c.ExecErr
+	}
+	c.Executed = append(c.Executed, batches...)
+	return nil
+}
+
+func (c *Client) Query(_ context.Context, query string, _ ...interface{}) ([]sqlclient.Row, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.QueryErr != nil {
+		return nil, c.QueryErr
+	}
+	return c.Results[query], nil
+}
+
+// Factory is an in-memory sqlclient.Factory. The clients are keyed by the host they would connect to,
+// see sqlclient.InstanceHost & sqlclient.PrimaryHost, and are created on first use.
+type Factory struct {
+	mu sync.Mutex
+
+	// Err is returned instead of a client, i.e. to mimic a missing auth secret
+	Err     error
+	Clients map[string]*Client
+	// Closed lists the MSSQL objects whose connections were released, as namespace/name
+	Closed []string
+}
+
+var _ sqlclient.Factory = &Factory{}
+
+// NewFactory returns an empty Factory.
+func NewFactory() *Factory {
+	return &Factory{Clients: map[string]*Client{}}
+}
+
+// Client returns the client of the given host, creating it if needed. Use it to set up the results & errors.
+func (f *Factory) Client(host string) *Client {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.Clients[host]
+	if !ok {
+		c = &Client{Results: map[string][]sqlclient.Row{}}
+		f.Clients[host] = c
+	}
+	return c
+}
+
+func (f *Factory) Instance(_ context.Context, db *msapi.MSSQL, ordinal int32) (sqlclient.Client, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.Client(sqlclient.InstanceHost(db, ordinal)), nil
+}
+
+func (f *Factory) Primary(_ context.Context, db *msapi.MSSQL) (sqlclient.Client, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.Client(sqlclient.PrimaryHost(db)), nil
+}
+
+func (f *Factory) Close(db *msapi.MSSQL) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Closed = append(f.Closed, db.Namespace+"/"+db.Name)
+}
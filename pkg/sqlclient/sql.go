@@ -0,0 +1,151 @@
+/*
+Copyright 2022 Appscode Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlclient
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	mssqldb "github.com/microsoft/go-mssqldb"
+)
+
+// deadlockVictim is the error number SQL Server returns to the transaction chosen as a deadlock victim.
+const deadlockVictim = 1205
+
+// sqlClient is a Client on top of a cached connection pool.
+type sqlClient struct {
+	db   *sql.DB
+	opts Options
+}
+
+var _ Client = &sqlClient{}
+
+func (c *sqlClient) Ping(ctx context.Context) error {
+	return c.retry(ctx, isTransient, func() error {
+		var one int
+		return c.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	})
+}
+
+func (c *sqlClient) Exec(ctx context.Context, query string, args ...interface{}) error {
+	return c.retry(ctx, isRolledBack, func() error {
+		_, err := c.db.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+func (c *sqlClient) Query(ctx context.Context, query string, args ...interface{}) ([]Row, error) {
+	var result []Row
+	err := c.retry(ctx, isTransient, func() error {
+		rows, err := c.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		result, err = scanRows(rows)
+		return err
+	})
+	return result, err
+}
+
+func (c *sqlClient) ExecScript(ctx context.Context, batches []string) error {
+	var conn *sql.Conn
+	err := c.retry(ctx, isTransient, func() error {
+		var err error
+		conn, err = c.db.Conn(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i, batch := range batches {
+		if _, err = conn.ExecContext(ctx, batch); err != nil {
+			return fmt.Errorf("batch %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func scanRows(rows *sql.Rows) ([]Row, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result []Row
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(Row, len(columns))
+		for i, col := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// retry runs fn until it succeeds, fails with an error that is not retryable or the retries are exhausted.
+func (c *sqlClient) retry(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= c.opts.Retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(c.opts.RetryInterval):
+		}
+	}
+}
+
+// isTransient reports whether err is worth a retry. Errors reported by the server are permanent, except
+// for deadlocks. Everything else, i.e. network errors, is transient unless the context is done.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	var sqlErr mssqldb.Error
+	if errors.As(err, &sqlErr) {
+		return sqlErr.Number == deadlockVictim
+	}
+	return true
+}
+
+// isRolledBack reports whether a statement failed without leaving any effect, so that running it again is safe even
+// if it's not idempotent. That's the case of a deadlock victim. After a network error, the statement may or may not
+// have run.
+func isRolledBack(err error) bool {
+	var sqlErr mssqldb.Error
+	return errors.As(err, &sqlErr) && sqlErr.Number == deadlockVictim
+}